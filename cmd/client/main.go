@@ -3,15 +3,24 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	igrpc "github.com/go-related/fileservice/internal/adapters/grpc"
 	"github.com/go-related/fileservice/internal/adapters/parser"
 	"github.com/go-related/fileservice/internal/core/ports"
 	"github.com/sirupsen/logrus"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
+const (
+	jsonFormat   = "json"
+	ndjsonFormat = "ndjson"
+	csvFormat    = "csv"
+)
+
 var (
 	streamJsonParser ports.StreamJsonParser
 )
@@ -24,7 +33,8 @@ func main() {
 }
 
 func runClient() {
-	server := igrpc.NewPortClient(config.host, config.port, streamJsonParser)
+	options := igrpc.ImportOptions{DryRun: config.dryRun, IncludeDiffs: config.includeDiffs, ResumeFrom: config.resumeFrom}
+	server := igrpc.NewPortClient(config.host, config.port, streamJsonParser, options)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -46,6 +56,10 @@ func runClient() {
 
 	fmt.Println("started to read from file")
 	err := server.ReadJsonFile(ctx, config.filePath)
+	var importErr *igrpc.ImportError
+	if errors.As(err, &importErr) {
+		fmt.Printf("the import failed, run it again with -resume-from %d\n", importErr.ResumeFrom)
+	}
 	if err != nil {
 		logrus.WithError(err).Error("error reading json file")
 	}
@@ -61,7 +75,53 @@ func initialize() {
 		port:              "50051",
 		host:              "localhost",
 	}
-	streamJsonParser = parser.NewStreamJsonParser(config.addDelayAfterItem)
+	flag.BoolVar(&config.dryRun, "dry-run", false, "run the import without saving anything and report what would change")
+	flag.BoolVar(&config.includeDiffs, "diffs", false, "report the changed fields of every created or updated port")
+	flag.IntVar(&config.resumeFrom, "resume-from", 0, "skip the ports of the file before this index, a failed import tells where to resume from")
+	flag.IntVar(&config.parseWorkers, "parse-workers", 1, "how many goroutines parse the file, with more than one the ports are sent out of order")
+	flag.StringVar(&config.filePath, "file", config.filePath, "the file to import, it can be compressed with gzip, zstd or bzip2")
+	flag.StringVar(&config.format, "format", "", "the format of the file, json, ndjson or csv. By default it's ndjson for the .ndjson and .jsonl files, csv for the .csv files and json for the others")
+	flag.StringVar(&config.csvColumns, "csv-columns", "", "the csv columns that differ from the UN/LOCODE code list, like unloc=0,name=1,country=-1")
+	flag.Parse()
+	var err error
+	streamJsonParser, err = newStreamParser(config)
+	if err != nil {
+		logrus.WithError(err).Fatal("invalid input format")
+	}
+}
+
+// newStreamParser the parser of the format of the file, json is a single object keyed by port id,
+// ndjson has a port object on every line and csv is a UN/LOCODE code list
+func newStreamParser(config clientConfig) (ports.StreamJsonParser, error) {
+	format := config.format
+	if format == "" {
+		// the compressed files are detected by the parsers, the format is the extension before the compression one
+		name := strings.ToLower(config.filePath)
+		for _, compression := range []string{".gz", ".zst", ".zstd", ".bz2"} {
+			name = strings.TrimSuffix(name, compression)
+		}
+		switch filepath.Ext(name) {
+		case ".ndjson", ".jsonl":
+			format = ndjsonFormat
+		case ".csv":
+			format = csvFormat
+		default:
+			format = jsonFormat
+		}
+	}
+	switch format {
+	case jsonFormat:
+		return parser.NewParallelStreamJsonParser(config.addDelayAfterItem, config.parseWorkers), nil
+	case ndjsonFormat:
+		return parser.NewNdjsonParser(config.addDelayAfterItem), nil
+	case csvFormat:
+		columns, err := parser.ParseCsvColumns(config.csvColumns)
+		if err != nil {
+			return nil, err
+		}
+		return parser.NewCsvParser(config.addDelayAfterItem, columns), nil
+	}
+	return nil, fmt.Errorf("unknown format %q, use %s, %s or %s", format, jsonFormat, ndjsonFormat, csvFormat)
 }
 
 type clientConfig struct {
@@ -69,4 +129,13 @@ type clientConfig struct {
 	filePath          string
 	host              string
 	port              string
+	dryRun            bool
+	includeDiffs      bool
+	// resumeFrom the index of the first port of the file to send
+	resumeFrom   int
+	parseWorkers int
+	// format of the file, empty to pick it from the extension
+	format string
+	// csvColumns the changes to the UN/LOCODE layout, see parser.ParseCsvColumns
+	csvColumns string
 }
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	igrpc "github.com/go-related/fileservice/internal/adapters/grpc"
 	"github.com/go-related/fileservice/internal/adapters/repository"
+	"github.com/go-related/fileservice/internal/core/domain"
 	"github.com/go-related/fileservice/internal/core/ports"
 	"github.com/go-related/fileservice/internal/core/service"
 	"github.com/go-related/fileservice/proto/pb"
@@ -12,25 +15,90 @@ import (
 	"google.golang.org/grpc/reflection"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	memoryStorage   = "memory"
+	boltStorage     = "bolt"
+	postgresStorage = "postgres"
+	// shutdownTimeout how long we wait for the running calls before stopping the server, the watchers never end by themselves
+	shutdownTimeout = 10 * time.Second
 )
 
 var (
 	portService    ports.PortService
 	portRepository ports.Repository
+	// closeRepository releases the storage once the server stopped
+	closeRepository = func() error { return nil }
 )
 
+var config serverConfig
+
 func main() {
-	port := "50051" //TODO take this from configuration
+	initialize()
 	initializeDependencies()
-	runServer(port)
+	go compactHistory(config.historyRetention, config.historyCompactionInterval)
+	runServer(config.port)
+	if err := closeRepository(); err != nil {
+		logrus.WithError(err).Error("couldn't close repository")
+	}
+}
+
+func initialize() {
+	config = serverConfig{
+		port: "50051", //TODO take this from configuration
+	}
+	flag.StringVar(&config.storage, "storage", memoryStorage, "where the ports are stored: memory, bolt or postgres, postgres can't watch the changes")
+	flag.StringVar(&config.dbPath, "db-path", "ports.db", "file of the bolt storage")
+	flag.StringVar(&config.postgresDsn, "postgres-dsn", os.Getenv("POSTGRES_DSN"), "connection string of the postgres storage, defaults to $POSTGRES_DSN")
+	flag.IntVar(&config.postgresReadConns, "postgres-read-conns", 0, "connections of the postgres reads, on top of the pool_max_conns of the dsn taken by the imports, 0 as many as those. Every streaming read holds one till it ends")
+	flag.StringVar(&config.snapshot.Dir, "snapshot-dir", "", "directory of the memory storage snapshots, empty disables them")
+	flag.DurationVar(&config.snapshot.Interval, "snapshot-interval", 5*time.Minute, "how often the memory storage is saved, 0 saves it only on shutdown")
+	flag.IntVar(&config.snapshot.Retention, "snapshot-retention", 3, "how many snapshots are kept")
+	flag.StringVar(&config.walDir, "wal-dir", "", "directory of the memory storage write-ahead log, empty disables it")
+	flag.DurationVar(&config.historyRetention.MaxAge, "history-max-age", 0, "how long the replaced versions of the ports are kept, 0 keeps them forever")
+	flag.IntVar(&config.historyRetention.MaxRevisions, "history-max-revisions", 0, "how many replaced versions are kept for every port, 0 keeps all of them")
+	flag.DurationVar(&config.historyCompactionInterval, "history-compaction-interval", time.Hour, "how often the retention is applied to the port history, 0 disables it. The history is only pruned once a history-max-age or history-max-revisions is set")
+	flag.Parse()
 }
 
 func initializeDependencies() {
-	repo, err := repository.NewPortRepository()
-	if err != nil {
-		logrus.WithError(err).Fatalf("couldn't initialize repository")
+	switch config.storage {
+	case memoryStorage:
+		var options []repository.Option
+		if len(config.snapshot.Dir) > 0 {
+			options = append(options, repository.WithSnapshots(config.snapshot))
+		}
+		if len(config.walDir) > 0 {
+			options = append(options, repository.WithWriteAheadLog(config.walDir))
+		}
+		repo, err := repository.NewPortRepository(options...)
+		if err != nil {
+			logrus.WithError(err).Fatalf("couldn't initialize repository")
+		}
+		portRepository = repo
+		closeRepository = repo.Close
+	case boltStorage:
+		repo, err := repository.NewPortBoltRepository(config.dbPath)
+		if err != nil {
+			logrus.WithError(err).Fatalf("couldn't initialize repository")
+		}
+		portRepository = repo
+		closeRepository = repo.Close
+	case postgresStorage:
+		repo, err := repository.NewPortPostgresRepository(context.Background(), config.postgresDsn, config.postgresReadConns)
+		if err != nil {
+			logrus.WithError(err).Fatalf("couldn't initialize repository")
+		}
+		portRepository = repo
+		closeRepository = repo.Close
+	default:
+		logrus.Fatalf("unknown storage %q, use %s, %s or %s", config.storage, memoryStorage, boltStorage, postgresStorage)
 	}
-	portRepository = repo
 	portService = service.NewPortService(portRepository)
 }
 
@@ -43,8 +111,54 @@ func runServer(port string) {
 	portServer := igrpc.NewPortServer(portService)
 	pb.RegisterPortServiceServer(server, portServer)
 	reflection.Register(server)
+	go stopOnSignal(server)
 	logrus.Infof("server listening at %v", listener.Addr())
 	if err := server.Serve(listener); err != nil {
 		log.Fatalf("failed to serve: %v", err)
 	}
 }
+
+// compactHistory applies the retention to the port history till the process ends
+func compactHistory(retention domain.HistoryRetention, interval time.Duration) {
+	if interval <= 0 || retention.IsEmpty() {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		// the error is already logged, we try again on the next tick
+		_, _ = portService.CompactHistory(context.Background(), retention)
+	}
+}
+
+// stopOnSignal lets the running calls finish, an import that is still running is aborted
+func stopOnSignal(server *grpc.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	logrus.Info("shutting down the server")
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(shutdownTimeout):
+		server.Stop()
+	}
+}
+
+type serverConfig struct {
+	port        string
+	storage     string
+	dbPath      string
+	postgresDsn string
+	// postgresReadConns the size of the pool of the postgres reads
+	postgresReadConns int
+	snapshot          repository.SnapshotConfig
+	walDir            string
+	// historyRetention applied every historyCompactionInterval
+	historyRetention          domain.HistoryRetention
+	historyCompactionInterval time.Duration
+}
@@ -0,0 +1,85 @@
+package grpc
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ImportError an import that failed, the ports of the file before ResumeFrom are saved on the server
+// and ImportOptions.ResumeFrom continues from there
+type ImportError struct {
+	ResumeFrom int
+	Err        error
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("import failed, resume from port %d: %v", e.ResumeFrom, e.Err)
+}
+
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
+
+// importCheckpoint follows which ports of the file the server saved. The server acks the ports by id and commits
+// the acked ones in batches, the file index of the first port not saved yet is where a failed import resumes
+type importCheckpoint struct {
+	mx sync.Mutex
+	// sent the file indexes of the ports sent and not acked yet, by id. An id can be in the file more than once
+	sent map[string][]int
+	// acked the file indexes of the ports acked since the last commit
+	acked []int
+	// saved the file indexes committed after resumeFrom, the parallel parser sends the ports out of order
+	saved      map[int]struct{}
+	resumeFrom int
+}
+
+func newImportCheckpoint(resumeFrom int) *importCheckpoint {
+	return &importCheckpoint{sent: make(map[string][]int), saved: make(map[int]struct{}), resumeFrom: resumeFrom}
+}
+
+// send called before the port is sent, its ack can come back anytime after
+func (c *importCheckpoint) send(id string, index int) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.sent[id] = append(c.sent[id], index)
+}
+
+// ack the server processed the port, the acks of an id come back in the order it was sent
+func (c *importCheckpoint) ack(id string) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	indexes := c.sent[id]
+	if len(indexes) == 0 {
+		return
+	}
+	c.acked = append(c.acked, indexes[0])
+	if len(indexes) == 1 {
+		delete(c.sent, id)
+	} else {
+		c.sent[id] = indexes[1:]
+	}
+}
+
+// commit the server saved every port acked so far
+func (c *importCheckpoint) commit() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	for _, index := range c.acked {
+		c.saved[index] = struct{}{}
+	}
+	c.acked = nil
+	for {
+		if _, ok := c.saved[c.resumeFrom]; !ok {
+			return
+		}
+		delete(c.saved, c.resumeFrom)
+		c.resumeFrom++
+	}
+}
+
+// next the file index of the first port not saved yet
+func (c *importCheckpoint) next() int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.resumeFrom
+}
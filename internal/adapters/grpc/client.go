@@ -11,12 +11,22 @@ import (
 	"io"
 )
 
+// ImportOptions DryRun runs the whole import on the server without saving anything,
+// IncludeDiffs makes the server report the changed fields of every port,
+// ResumeFrom skips the ports of the file before that index, they were saved by an import that failed
+type ImportOptions struct {
+	DryRun       bool
+	IncludeDiffs bool
+	ResumeFrom   int
+}
+
 type PortsClient struct {
 	client           pb.PortServiceClient
 	streamJsonParser ports.StreamJsonParser
+	options          ImportOptions
 }
 
-func NewPortClient(host, port string, parser ports.StreamJsonParser) *PortsClient {
+func NewPortClient(host, port string, parser ports.StreamJsonParser, options ImportOptions) *PortsClient {
 	conn, err := grpc.Dial(fmt.Sprintf("%s:%s", host, port), grpc.WithInsecure())
 	if err != nil {
 		logrus.Fatalf("can not connect with server %v", err)
@@ -27,10 +37,25 @@ func NewPortClient(host, port string, parser ports.StreamJsonParser) *PortsClien
 	return &PortsClient{
 		client:           client,
 		streamJsonParser: parser,
+		options:          options,
 	}
 }
 
+// ReadJsonFile streams the ports of the file to the server, which acks every port as soon as it's processed.
+// The server commits the acked ports in batches and says so with a committed progress. If anything goes wrong
+// the stream is cancelled so the server aborts the batch being written, the error is an *ImportError telling
+// where the import resumes from
 func (cl *PortsClient) ReadJsonFile(ctx context.Context, filepath string) error {
+	checkpoint := newImportCheckpoint(cl.options.ResumeFrom)
+	err := cl.readJsonFile(ctx, filepath, checkpoint)
+	if err != nil && !cl.options.DryRun {
+		logrus.WithError(err).WithField("resumeFrom", checkpoint.next()).Error("import failed, the ports before resumeFrom are saved")
+		return &ImportError{ResumeFrom: checkpoint.next(), Err: err}
+	}
+	return err
+}
+
+func (cl *PortsClient) readJsonFile(ctx context.Context, filepath string, checkpoint *importCheckpoint) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer func() {
 		cancel()
@@ -38,75 +63,122 @@ func (cl *PortsClient) ReadJsonFile(ctx context.Context, filepath string) error
 
 	}()
 
-	cn := make(chan domain.Port)
-	stream, err := cl.client.CreateOrUpdatePorts(ctx)
+	stream, err := cl.client.UpsertPorts(ctx)
 	if err != nil {
 		return err
 	}
 
-	// set up channel reader and stream sender
+	// setting up stream receiver, it runs till the server closes the stream
+	received := make(chan error, 1)
+	go func() {
+		received <- receiveAcks(stream, checkpoint)
+	}()
+
+	// set up channel reader and stream sender, the first send error stops the parser.
+	// The parser has its own context so stopping it doesn't cancel the stream before we know why it failed
+	parseCtx, stopParsing := context.WithCancel(ctx)
+	defer stopParsing()
+	cn := make(chan domain.IndexedPort)
+	sent := make(chan error, 1)
 	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				logrus.Info("Worker: Received cancellation signal. Exiting.")
-				return
-			case m := <-cn:
-				logrus.WithField("id", m.Id).Info("New data read")
-				req := &pb.PortRequest{
-					PortDetails: map[string]*pb.PortDetails{
-						m.Id: {
-							Name:        m.Name,
-							City:        m.City,
-							Country:     m.Country,
-							Alias:       m.Alias,
-							Regions:     m.Regions,
-							Coordinates: m.Coordinates,
-							Province:    m.Province,
-							Timezone:    m.Timezone,
-							Unlocs:      m.UNLOCs,
-							Code:        m.Code,
-						},
-					},
-				}
-				streamError := stream.Send(req)
-				if streamError != nil {
-					logrus.WithError(streamError).WithField("req", m).Error("error sending item to the stream")
-				}
+		var sendErr error
+		for parsed := range cn {
+			m := parsed.Port
+			if sendErr != nil || parsed.Index < cl.options.ResumeFrom {
+				continue // keep draining the channel so the parser is not blocked till it stops
+			}
+			logrus.WithField("id", m.Id).Info("New data read")
+			request := convertDomainToPortRequest(m)
+			request.DryRun = cl.options.DryRun
+			request.IncludeDiffs = cl.options.IncludeDiffs
+			checkpoint.send(m.Id, parsed.Index)
+			sendErr = stream.Send(request)
+			if sendErr != nil {
+				logrus.WithError(sendErr).WithField("req", m).Error("error sending item to the stream")
+				stopParsing()
 			}
 		}
+		sent <- sendErr
 	}()
 
 	// start reading from file and send to the channel
-	err = cl.streamJsonParser.ReadJsonFile(ctx, filepath, cn)
+	err = cl.streamJsonParser.ReadJsonFile(parseCtx, filepath, cn)
+	close(cn)
+	sendErr := <-sent
+	// io.EOF means the server closed the stream, the reason comes from the receiver
+	if sendErr == io.EOF {
+		if receiveErr := <-received; receiveErr != nil {
+			return receiveErr
+		}
+		return sendErr
+	}
+	if sendErr != nil {
+		cancel() // the server aborts the transaction
+		return sendErr
+	}
+	if err != nil {
+		cancel()
+		return err
+	}
+	if closeError := stream.CloseSend(); closeError != nil {
+		logrus.WithError(closeError).Error("failed to close send")
+		return closeError
+	}
+	return <-received
+}
 
-	// setting up stream receiver
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				closeErr := stream.CloseSend()
-				if closeErr != nil {
-					logrus.WithError(closeErr).Error("error closing the stream")
-				}
-			default:
+// receiveAcks logs the acks and the progress, the committed progress moves the checkpoint past the acked ports
+func receiveAcks(stream pb.PortService_UpsertPortsClient, checkpoint *importCheckpoint) error {
+	for {
+		response, err := stream.Recv()
+		if err == io.EOF {
+			logrus.Info("connection closed from the server")
+			return nil
+		}
+		if err != nil {
+			logrus.WithError(err).Error("error received from the server, the ports acked after the last commit were not saved")
+			return err
+		}
+		switch payload := response.Payload.(type) {
+		case *pb.UpsertPortsResponse_Ack:
+			checkpoint.ack(payload.Ack.GetId())
+			entry := logrus.WithField("id", payload.Ack.GetId()).WithField("status", payload.Ack.GetStatus())
+			if payload.Ack.GetStatus() == pb.UpsertStatus_UPSERT_STATUS_REJECTED {
+				entry.WithField("reason", payload.Ack.GetReason()).Warn("port rejected by the server")
+			} else {
+				entry.Info("port acked by the server, saved with the next commit")
 			}
-			var response pb.PortResponse
-			err := stream.RecvMsg(response)
-			if err == io.EOF {
-				logrus.Info("connection closed from the server")
+			for _, diff := range payload.Ack.GetDiffs() {
+				entry.WithField("field", diff.GetField()).WithField("old", diff.GetOldValue()).WithField("new", diff.GetNewValue()).Info("port field changed")
 			}
-			if err != nil {
-				logrus.WithError(err).WithField("response", response).Error("error received from the server")
+		case *pb.UpsertPortsResponse_Progress:
+			logrus.WithField("progress", payload.Progress).Info("progress received from the server")
+			if payload.Progress.GetCommitted() {
+				checkpoint.commit()
+			}
+			if payload.Progress.GetDryRun() {
+				logrus.Info("dry run completed, nothing was saved")
 			}
-			logrus.WithField("response", response).Info("response received from the server")
 		}
+	}
+}
 
-	}()
-	closeError := stream.CloseSend()
-	if err != nil {
-		logrus.WithError(closeError).Error("failed to close send")
-		return closeError
+func convertDomainToPortRequest(m domain.Port) *pb.PortRequest {
+	return &pb.PortRequest{
+		PortDetails: map[string]*pb.PortDetails{
+			m.Id: {
+				Name:        m.Name,
+				City:        m.City,
+				Country:     m.Country,
+				Alias:       m.Alias,
+				Regions:     m.Regions,
+				Coordinates: m.Coordinates,
+				Province:    m.Province,
+				Timezone:    m.Timezone,
+				Unlocs:      m.UNLOCs,
+				Code:        m.Code,
+				Version:     m.Version,
+			},
+		},
 	}
-	return err
 }
@@ -0,0 +1,196 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"github.com/go-related/fileservice/internal/core/domain"
+	"github.com/go-related/fileservice/proto/pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"testing"
+)
+
+// upsertClient a server answering UpsertPorts with the stream
+type upsertClient struct {
+	pb.PortServiceClient
+	stream pb.PortService_UpsertPortsClient
+}
+
+func (c *upsertClient) UpsertPorts(ctx context.Context, opts ...grpc.CallOption) (pb.PortService_UpsertPortsClient, error) {
+	return c.stream, nil
+}
+
+// closedUpsertStream a server that closed the stream with an error after the first port
+type closedUpsertStream struct {
+	grpc.ClientStream
+	sent int
+}
+
+func (s *closedUpsertStream) Send(request *pb.PortRequest) error {
+	s.sent++
+	if s.sent > 1 {
+		return io.EOF
+	}
+	return nil
+}
+
+func (s *closedUpsertStream) Recv() (*pb.UpsertPortsResponse, error) {
+	return nil, status.Error(codes.Aborted, "conflict")
+}
+
+func (s *closedUpsertStream) CloseSend() error {
+	return nil
+}
+
+// endlessParser publishes ports till its context is done
+type endlessParser struct {
+	published int
+}
+
+func (p *endlessParser) ReadJsonFile(ctx context.Context, filePath string, channel chan domain.IndexedPort) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case channel <- domain.IndexedPort{Port: domain.Port{Id: "AEAJM", Name: "Ajman"}, Index: p.published}:
+			p.published++
+		}
+	}
+}
+
+func TestReadJsonFile_SendErrorStopsTheParser(t *testing.T) {
+	stream := &closedUpsertStream{}
+	parser := &endlessParser{}
+	client := &PortsClient{client: &upsertClient{stream: stream}, streamJsonParser: parser}
+
+	err := client.ReadJsonFile(context.TODO(), "ports.json")
+
+	// the error is the reason the server closed the stream, not the cancelled parser
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	assert.Equal(t, 2, stream.sent)
+	assert.Less(t, parser.published, 10)
+}
+
+// committingUpsertStream a server that acks every port it receives and commits after the acks counted in commits.
+// After failAfter acks it fails, with none it ends once the client closes its side
+type committingUpsertStream struct {
+	grpc.ClientStream
+	requests  chan *pb.PortRequest
+	sent      []string
+	pending   []*pb.UpsertPortsResponse
+	acked     int
+	commits   map[int]bool
+	failAfter int
+	finished  bool
+}
+
+func newCommittingUpsertStream(failAfter int, commits ...int) *committingUpsertStream {
+	stream := &committingUpsertStream{requests: make(chan *pb.PortRequest, 100), commits: make(map[int]bool), failAfter: failAfter}
+	for _, commit := range commits {
+		stream.commits[commit] = true
+	}
+	return stream
+}
+
+func (c *committingUpsertStream) Send(request *pb.PortRequest) error {
+	for id := range request.PortDetails {
+		c.sent = append(c.sent, id)
+	}
+	c.requests <- request
+	return nil
+}
+
+func (c *committingUpsertStream) Recv() (*pb.UpsertPortsResponse, error) {
+	for len(c.pending) == 0 {
+		if c.failAfter > 0 && c.acked == c.failAfter {
+			return nil, status.Error(codes.Unavailable, "server stopped")
+		}
+		request, ok := <-c.requests
+		if !ok {
+			if c.finished {
+				return nil, io.EOF
+			}
+			c.finished = true
+			return &pb.UpsertPortsResponse{Payload: &pb.UpsertPortsResponse_Progress{Progress: &pb.UpsertProgress{Committed: true}}}, nil
+		}
+		for id := range request.PortDetails {
+			c.pending = append(c.pending, &pb.UpsertPortsResponse{Payload: &pb.UpsertPortsResponse_Ack{Ack: &pb.PortAck{Id: id}}})
+		}
+		c.acked++
+		if c.commits[c.acked] {
+			c.pending = append(c.pending, &pb.UpsertPortsResponse{Payload: &pb.UpsertPortsResponse_Progress{Progress: &pb.UpsertProgress{Committed: true}}})
+		}
+	}
+	response := c.pending[0]
+	c.pending = c.pending[1:]
+	return response, nil
+}
+
+func (c *committingUpsertStream) CloseSend() error {
+	close(c.requests)
+	return nil
+}
+
+// listParser publishes the ports in the order given
+type listParser struct {
+	ports []domain.IndexedPort
+}
+
+func (p *listParser) ReadJsonFile(ctx context.Context, filePath string, channel chan domain.IndexedPort) error {
+	for _, port := range p.ports {
+		channel <- port
+	}
+	return nil
+}
+
+func TestReadJsonFile_FailureTellsWhereToResume(t *testing.T) {
+	// parsed out of order, the ports 0 to 2 and 4 are committed but 3 is not
+	parser := &listParser{ports: []domain.IndexedPort{
+		{Port: domain.Port{Id: "AEAJM"}, Index: 1},
+		{Port: domain.Port{Id: "AEAUH"}, Index: 2},
+		{Port: domain.Port{Id: "AEDXB"}, Index: 0},
+		{Port: domain.Port{Id: "AEFJR"}, Index: 4},
+		{Port: domain.Port{Id: "AEKLF"}, Index: 3},
+	}}
+	stream := newCommittingUpsertStream(5, 2, 4)
+	client := &PortsClient{client: &upsertClient{stream: stream}, streamJsonParser: parser}
+
+	err := client.ReadJsonFile(context.TODO(), "ports.json")
+
+	var importErr *ImportError
+	require.True(t, errors.As(err, &importErr))
+	assert.Equal(t, 3, importErr.ResumeFrom)
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestReadJsonFile_ResumesFromTheIndex(t *testing.T) {
+	parser := &listParser{ports: []domain.IndexedPort{
+		{Port: domain.Port{Id: "AEAJM"}, Index: 0},
+		{Port: domain.Port{Id: "AEAUH"}, Index: 1},
+		{Port: domain.Port{Id: "AEDXB"}, Index: 2},
+	}}
+	stream := newCommittingUpsertStream(0)
+	client := &PortsClient{client: &upsertClient{stream: stream}, streamJsonParser: parser, options: ImportOptions{ResumeFrom: 1}}
+
+	err := client.ReadJsonFile(context.TODO(), "ports.json")
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"AEAUH", "AEDXB"}, stream.sent)
+}
+
+func TestImportCheckpoint_SameIdTwice(t *testing.T) {
+	checkpoint := newImportCheckpoint(0)
+	checkpoint.send("AEAJM", 0)
+	checkpoint.send("AEAJM", 1)
+	checkpoint.ack("AEAJM")
+	checkpoint.commit()
+	assert.Equal(t, 1, checkpoint.next())
+	checkpoint.ack("AEAJM")
+	assert.Equal(t, 1, checkpoint.next())
+	checkpoint.commit()
+	assert.Equal(t, 2, checkpoint.next())
+}
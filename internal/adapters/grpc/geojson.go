@@ -0,0 +1,43 @@
+package grpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-related/fileservice/internal/core/domain"
+)
+
+// geoJsonObject the parts of a GeoJSON geometry or feature we care about
+type geoJsonObject struct {
+	Type        string         `json:"type"`
+	Coordinates [][][]float64  `json:"coordinates"`
+	Geometry    *geoJsonObject `json:"geometry"`
+}
+
+// parseGeoJsonPolygon accepts a Polygon geometry or a Feature with a Polygon geometry, positions are [lon, lat]
+func parseGeoJsonPolygon(data string) (domain.Polygon, error) {
+	var object geoJsonObject
+	if err := json.Unmarshal([]byte(data), &object); err != nil {
+		return nil, fmt.Errorf("invalid geojson: %w", err)
+	}
+	if object.Type == "Feature" {
+		if object.Geometry == nil {
+			return nil, fmt.Errorf("invalid geojson: feature without geometry")
+		}
+		object = *object.Geometry
+	}
+	if object.Type != "Polygon" {
+		return nil, fmt.Errorf("invalid geojson: expected a Polygon but got %q", object.Type)
+	}
+	polygon := make(domain.Polygon, 0, len(object.Coordinates))
+	for _, ring := range object.Coordinates {
+		points := make([]domain.GeoPoint, 0, len(ring))
+		for _, position := range ring {
+			if len(position) < 2 {
+				return nil, fmt.Errorf("invalid geojson: positions need a longitude and a latitude")
+			}
+			points = append(points, domain.GeoPoint{Lat: position[1], Lon: position[0]})
+		}
+		polygon = append(polygon, points)
+	}
+	return polygon, nil
+}
@@ -0,0 +1,41 @@
+package grpc
+
+import (
+	"github.com/go-related/fileservice/internal/core/domain"
+	"github.com/go-related/fileservice/proto/pb"
+	"sync"
+)
+
+// upsertProgress summary of an upsert stream, shared between the receiver and the heartbeat
+type upsertProgress struct {
+	mx      sync.Mutex
+	summary domain.ImportSummary
+}
+
+func (p *upsertProgress) add(result domain.UpsertResult) {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	p.summary.Add(result)
+}
+
+func (p *upsertProgress) snapshot() *pb.UpsertProgress {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return &pb.UpsertProgress{
+		Received:  p.summary.Total(),
+		Created:   p.summary.Created,
+		Updated:   p.summary.Updated,
+		Unchanged: p.summary.Unchanged,
+		Rejected:  p.summary.Failed,
+	}
+}
+
+// importOptions how an ingestion stream runs, they are taken from the first request of the stream
+type importOptions struct {
+	dryRun       bool
+	includeDiffs bool
+}
+
+func newImportOptions(request *pb.PortRequest) *importOptions {
+	return &importOptions{dryRun: request.GetDryRun(), includeDiffs: request.GetIncludeDiffs()}
+}
@@ -2,46 +2,58 @@ package grpc
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/go-related/fileservice/internal/core/domain"
+	cerror "github.com/go-related/fileservice/internal/core/errors"
 	"github.com/go-related/fileservice/internal/core/ports"
 	"github.com/go-related/fileservice/proto/pb"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"io"
+	"sync"
+	"time"
 )
 
+// defaultHeartbeatInterval how often UpsertPorts sends the progress to the client
+const defaultHeartbeatInterval = 5 * time.Second
+
+// defaultCommitEvery how many ports UpsertPorts receives before it commits them
+const defaultCommitEvery = 1000
+
 type PortsServer struct {
 	pb.UnimplementedPortServiceServer
-	portService ports.PortService
+	portService       ports.PortService
+	heartbeatInterval time.Duration
+	commitEvery       int64
 }
 
 func NewPortServer(portService ports.PortService) *PortsServer {
 	return &PortsServer{
-		portService: portService,
+		portService:       portService,
+		heartbeatInterval: defaultHeartbeatInterval,
+		commitEvery:       defaultCommitEvery,
 	}
 }
 
 func (s *PortsServer) CreateOrUpdatePorts(stream pb.PortService_CreateOrUpdatePortsServer) error {
 	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
 
-	defer func() {
-		err := s.portService.AbortTransaction()
-		if err != nil {
-			logrus.WithError(err).Warn("aborting transaction.")
-		}
-		cancel()
-	}()
-
-	err := s.portService.StartTransaction(ctx)
+	trn, err := s.portService.StartTransaction(ctx)
 	if err != nil {
 		return err
 	}
-	var failedCount int64
+	// the transaction belongs to this stream, nothing another stream does can abort it
+	defer s.portService.AbortTransaction(trn)
+	var summary domain.ImportSummary
+	var options *importOptions
 	for {
 		// check if we have any cancellation before continuing
 		select {
 		case <-ctx.Done():
-			err = s.portService.AbortTransaction()
 			return ctx.Err()
 		default:
 		}
@@ -49,48 +61,333 @@ func (s *PortsServer) CreateOrUpdatePorts(stream pb.PortService_CreateOrUpdatePo
 		port, err := stream.Recv()
 		// handle the error
 		if err == io.EOF {
-			err := s.portService.CommitTransaction(ctx)
-			if err != nil {
-				return err
+			dryRun := options != nil && options.dryRun
+			if !dryRun {
+				err := s.portService.CommitTransaction(ctx, trn)
+				if err != nil {
+					return toStatusError(err)
+				}
 			}
 			msg := ""
-			if failedCount > 0 {
-				msg = fmt.Sprintf("operation didn't complete successfully")
+			if summary.Failed > 0 {
+				msg = fmt.Sprintf("operation didn't complete successfully, %d of %d ports failed", summary.Failed, summary.Total())
 			} else {
 				msg = "operation completed successfully"
 			}
-			logrus.WithField("Failed Number", failedCount).Info("operation completed.")
-			return stream.SendAndClose(&pb.PortResponse{
-				FailedItemsNumber: &failedCount,
-				Message:           msg,
-			})
+			if dryRun {
+				msg = "dry run, nothing was saved: " + msg
+			}
+			logrus.WithField("Failed Number", summary.Failed).WithField("dry_run", dryRun).Info("operation completed.")
+			response := convertSummaryToResponse(summary, msg)
+			response.DryRun = dryRun
+			return stream.SendAndClose(response)
 		}
 		if err != nil {
 			return err
 		}
+		if options == nil {
+			options = newImportOptions(port)
+		}
 
 		reqItems := convertPortRequestToDomain(port)
 		if len(reqItems) > 0 {
-			insertedItems, err := s.portService.AddOrUpdatePorts(ctx, reqItems)
+			// invalid ports are rejected one by one, a storage error instead aborts everything: the counts of the
+			// summary so far would report ports that were never saved, so the stream fails without one
+			results, err := s.portService.UpsertPorts(ctx, trn, reqItems, options.includeDiffs)
 			if err != nil {
-				return s.CloseStreamWithError(stream, failedCount, "failed to store port data")
+				logrus.WithError(err).WithField("summary", summary).Error("failed to store port data, nothing was saved")
+				return toStatusError(err)
 			}
-			if len(insertedItems) != len(reqItems) {
-				failedCount += int64(len(reqItems) - len(insertedItems))
+			for _, result := range results {
+				summary.Add(result)
 			}
 		}
 	}
 }
 
-func (s *PortsServer) CloseStreamWithError(stream pb.PortService_CreateOrUpdatePortsServer, failedCount int64, msg string) error {
-	err := s.portService.AbortTransaction()
+// DeletePorts runs inside a transaction like the ingestion, so it can be aborted when it would remove too many ports
+func (s *PortsServer) DeletePorts(ctx context.Context, request *pb.DeletePortsRequest) (*pb.DeletePortsResponse, error) {
+	trn, err := s.portService.StartTransaction(ctx)
 	if err != nil {
-		return err
+		return nil, toStatusError(err)
+	}
+	defer s.portService.AbortTransaction(trn)
+
+	deleted, err := s.portService.DeletePorts(ctx, trn, request.GetIds(), convertPortFilterToDomain(request.GetFilter()))
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	response := &pb.DeletePortsResponse{DeletedCount: int64(deleted)}
+	if request.GetMaxDeletes() > 0 && response.DeletedCount > request.GetMaxDeletes() {
+		logrus.WithField("deleted", deleted).WithField("max_deletes", request.GetMaxDeletes()).Warn("aborting delete.")
+		return nil, status.Errorf(codes.FailedPrecondition, "delete would remove %d ports, more than the max of %d", deleted, request.GetMaxDeletes())
+	}
+	if request.GetDryRun() {
+		return response, nil
+	}
+	if err = s.portService.CommitTransaction(ctx, trn); err != nil {
+		return nil, toStatusError(err)
+	}
+	response.Committed = true
+	return response, nil
+}
+
+func (s *PortsServer) GetPort(ctx context.Context, request *pb.GetPortRequest) (*pb.GetPortResponse, error) {
+	var asOf time.Time
+	if request.GetAsOf() != nil {
+		asOf = request.GetAsOf().AsTime()
+	}
+	port, err := s.portService.GetPortAsOf(ctx, request.GetId(), asOf)
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	return &pb.GetPortResponse{
+		Id:   port.Id,
+		Port: convertDomainToPortDetails(*port),
+	}, nil
+}
+
+func (s *PortsServer) GetPortHistory(ctx context.Context, request *pb.GetPortHistoryRequest) (*pb.GetPortHistoryResponse, error) {
+	revisions, err := s.portService.GetPortHistory(ctx, request.GetId())
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	response := &pb.GetPortHistoryResponse{Id: request.GetId()}
+	for _, revision := range revisions {
+		response.Revisions = append(response.Revisions, &pb.PortRevision{
+			Port:          convertDomainToPortDetails(revision.Port),
+			TransactionId: revision.TransactionId,
+			ReplacedAt:    timestamppb.New(revision.ReplacedAt),
+			Deleted:       revision.Deleted,
+		})
+	}
+	return response, nil
+}
+
+func (s *PortsServer) ListPorts(request *pb.ListPortsRequest, stream pb.PortService_ListPortsServer) error {
+	filter := convertPortFilterToDomain(request.GetFilter())
+	err := s.portService.ListPorts(stream.Context(), filter, int(request.GetPageSize()), request.GetCursor(), func(port domain.Port, cursor string) error {
+		return stream.Send(&pb.ListPortsResponse{
+			Id:     port.Id,
+			Port:   convertDomainToPortDetails(port),
+			Cursor: cursor,
+		})
+	})
+	if err != nil {
+		return toStatusError(err)
+	}
+	return nil
+}
+
+func (s *PortsServer) SearchPorts(ctx context.Context, request *pb.SearchPortsRequest) (*pb.SearchPortsResponse, error) {
+	maxEdits := -1 // let the service decide
+	if request.MaxEdits != nil {
+		maxEdits = int(request.GetMaxEdits())
+	}
+	results, err := s.portService.SearchPorts(ctx, request.GetQuery(), maxEdits, int(request.GetLimit()))
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	response := &pb.SearchPortsResponse{}
+	for _, result := range results {
+		response.Results = append(response.Results, &pb.SearchResult{
+			Id:           result.Port.Id,
+			Port:         convertDomainToPortDetails(result.Port),
+			Score:        result.Score,
+			MatchType:    pb.MatchType(result.MatchType),
+			MatchedField: result.MatchedField,
+		})
+	}
+	return response, nil
+}
+
+func (s *PortsServer) NearestPorts(ctx context.Context, request *pb.NearestPortsRequest) (*pb.GeoPortsResponse, error) {
+	center := domain.GeoPoint{Lat: request.GetLatitude(), Lon: request.GetLongitude()}
+	results, err := s.portService.NearestPorts(ctx, center, int(request.GetK()))
+	if err != nil {
+		return nil, toStatusError(err)
+	}
+	return convertPortDistancesToResponse(results), nil
+}
+
+func (s *PortsServer) PortsWithinRadius(ctx context.Context, request *pb.PortsWithinRadiusRequest) (*pb.GeoPortsResponse, error) {
+	center := domain.GeoPoint{Lat: request.GetLatitude(), Lon: request.GetLongitude()}
+	results, err := s.portService.PortsWithinRadius(ctx, center, request.GetRadiusKm(), int(request.GetLimit()))
+	if err != nil {
+		return nil, toStatusError(err)
 	}
-	return stream.SendAndClose(&pb.PortResponse{
-		FailedItemsNumber: &failedCount,
-		Message:           msg,
+	return convertPortDistancesToResponse(results), nil
+}
+
+func (s *PortsServer) PortsInArea(request *pb.PortsInAreaRequest, stream pb.PortService_PortsInAreaServer) error {
+	filter := convertPortFilterToDomain(request.GetFilter())
+	limit := int(request.GetLimit())
+	send := func(port domain.Port) error {
+		return stream.Send(&pb.PortsInAreaResponse{
+			Id:   port.Id,
+			Port: convertDomainToPortDetails(port),
+		})
+	}
+	var err error
+	switch area := request.GetArea().(type) {
+	case *pb.PortsInAreaRequest_BoundingBox:
+		box := domain.BoundingBox{
+			MinLat: area.BoundingBox.GetMinLatitude(),
+			MinLon: area.BoundingBox.GetMinLongitude(),
+			MaxLat: area.BoundingBox.GetMaxLatitude(),
+			MaxLon: area.BoundingBox.GetMaxLongitude(),
+		}
+		err = s.portService.PortsInBoundingBox(stream.Context(), box, filter, limit, send)
+	case *pb.PortsInAreaRequest_GeojsonPolygon:
+		polygon, parseErr := parseGeoJsonPolygon(area.GeojsonPolygon)
+		if parseErr != nil {
+			return status.Error(codes.InvalidArgument, parseErr.Error())
+		}
+		err = s.portService.PortsInPolygon(stream.Context(), polygon, filter, limit, send)
+	default:
+		return status.Error(codes.InvalidArgument, "a bounding box or a polygon is required")
+	}
+	if err != nil {
+		return toStatusError(err)
+	}
+	return nil
+}
+
+func (s *PortsServer) WatchPorts(request *pb.WatchPortsRequest, stream pb.PortService_WatchPortsServer) error {
+	filter := domain.WatchFilter{
+		Country:  request.GetCountry(),
+		IdPrefix: request.GetIdPrefix(),
+	}
+	err := s.portService.WatchPorts(stream.Context(), filter, request.FromSequence, func(change domain.PortChange) error {
+		return stream.Send(&pb.PortChangeEvent{
+			Sequence:    change.Sequence,
+			Type:        pb.ChangeType(change.Type),
+			Id:          change.Port.Id,
+			Port:        convertDomainToPortDetails(change.Port),
+			CommittedAt: timestamppb.New(change.CommittedAt),
+		})
 	})
+	if err != nil {
+		return toStatusError(err)
+	}
+	return nil
+}
+
+// UpsertPorts commits the ports in batches of commitEvery, a progress with committed set follows every commit and
+// tells the client that the ports acked before it are saved. A failure loses only the batch being written
+func (s *PortsServer) UpsertPorts(stream pb.PortService_UpsertPortsServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	trn, err := s.portService.StartTransaction(ctx)
+	if err != nil {
+		return toStatusError(err)
+	}
+	// the transaction of the batch being written when the stream ends
+	defer func() { s.portService.AbortTransaction(trn) }()
+
+	// the acks and the heartbeats are sent from different goroutines, grpc doesn't allow concurrent sends
+	var sendMx sync.Mutex
+	send := func(response *pb.UpsertPortsResponse) error {
+		sendMx.Lock()
+		defer sendMx.Unlock()
+		return stream.Send(response)
+	}
+	progress := &upsertProgress{}
+	// the heartbeats are stopped and waited for before the final progress and on every return,
+	// the stream can't be used once the handler is done
+	heartbeatCtx, stopHeartbeats := context.WithCancel(ctx)
+	heartbeatsDone := make(chan struct{})
+	stopHeartbeat := func() {
+		stopHeartbeats()
+		<-heartbeatsDone
+	}
+	defer stopHeartbeat()
+	go func() {
+		defer close(heartbeatsDone)
+		ticker := time.NewTicker(s.heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-heartbeatCtx.Done():
+				return
+			case <-ticker.C:
+				err := send(&pb.UpsertPortsResponse{Payload: &pb.UpsertPortsResponse_Progress{Progress: progress.snapshot()}})
+				if err != nil {
+					logrus.WithError(err).Warn("error sending the progress")
+				}
+			}
+		}
+	}()
+
+	var options *importOptions
+	var uncommitted int64
+	for {
+		request, err := stream.Recv()
+		if err == io.EOF {
+			final := progress.snapshot()
+			if options != nil && options.dryRun {
+				// the deferred abort throws away everything that was written
+				final.DryRun = true
+			} else {
+				if err = s.portService.CommitTransaction(ctx, trn); err != nil {
+					return toStatusError(err)
+				}
+				final.Committed = true
+			}
+			stopHeartbeat()
+			logrus.WithField("progress", final).Info("upsert completed.")
+			return send(&pb.UpsertPortsResponse{Payload: &pb.UpsertPortsResponse_Progress{Progress: final}})
+		}
+		if err != nil {
+			return err
+		}
+		if options == nil {
+			options = newImportOptions(request)
+		}
+		reqItems := convertPortRequestToDomain(request)
+		if len(reqItems) == 0 {
+			continue
+		}
+		results, err := s.portService.UpsertPorts(ctx, trn, reqItems, options.includeDiffs)
+		if err != nil {
+			return toStatusError(err)
+		}
+		for _, result := range results {
+			progress.add(result)
+			ack := &pb.PortAck{
+				Id:     result.Id,
+				Status: pb.UpsertStatus(result.Status),
+				Diffs:  convertDiffsToResponse(result.Diffs),
+			}
+			if result.Err != nil {
+				ack.Reason = result.Err.Error()
+				ack.Code = toErrorCode(result.Err)
+			}
+			if err = send(&pb.UpsertPortsResponse{Payload: &pb.UpsertPortsResponse_Ack{Ack: ack}}); err != nil {
+				return err
+			}
+		}
+		// a dry run writes everything in one transaction, it's thrown away at the end
+		uncommitted += int64(len(results))
+		if options.dryRun || uncommitted < s.commitEvery {
+			continue
+		}
+		if err = s.portService.CommitTransaction(ctx, trn); err != nil {
+			return toStatusError(err)
+		}
+		uncommitted = 0
+		checkpoint := progress.snapshot()
+		checkpoint.Committed = true
+		if err = send(&pb.UpsertPortsResponse{Payload: &pb.UpsertPortsResponse_Progress{Progress: checkpoint}}); err != nil {
+			return err
+		}
+		next, err := s.portService.StartTransaction(ctx)
+		if err != nil {
+			return toStatusError(err)
+		}
+		trn = next
+	}
 }
 
 func convertPortRequestToDomain(request *pb.PortRequest) []domain.Port {
@@ -111,8 +408,139 @@ func convertPortRequestToDomain(request *pb.PortRequest) []domain.Port {
 			Timezone:    item.Timezone,
 			UNLOCs:      item.Unlocs,
 			Code:        item.Code,
+			Version:     item.Version,
 		}
 		result = append(result, outputPort)
 	}
 	return result
 }
+
+func convertSummaryToResponse(summary domain.ImportSummary, msg string) *pb.PortResponse {
+	response := &pb.PortResponse{
+		FailedItemsNumber:     &summary.Failed,
+		Message:               msg,
+		CreatedCount:          summary.Created,
+		UpdatedCount:          summary.Updated,
+		UnchangedCount:        summary.Unchanged,
+		FailedCount:           summary.Failed,
+		FailedItemsTruncated:  summary.FailedItemsTruncated,
+		ChangedItemsTruncated: summary.ChangedItemsTruncated,
+	}
+	for _, item := range summary.FailedItems {
+		failedItem := &pb.FailedItem{Id: item.Id, Code: toErrorCode(item.Err)}
+		if item.Err != nil {
+			failedItem.Message = item.Err.Error()
+		}
+		response.FailedItems = append(response.FailedItems, failedItem)
+	}
+	for _, item := range summary.ChangedItems {
+		response.ChangedItems = append(response.ChangedItems, &pb.PortDiff{
+			Id:     item.Id,
+			Status: pb.UpsertStatus(item.Status),
+			Diffs:  convertDiffsToResponse(item.Diffs),
+		})
+	}
+	return response
+}
+
+func convertDiffsToResponse(diffs []domain.FieldDiff) []*pb.FieldDiff {
+	var result []*pb.FieldDiff
+	for _, diff := range diffs {
+		result = append(result, &pb.FieldDiff{Field: diff.Field, OldValue: diff.Old, NewValue: diff.New})
+	}
+	return result
+}
+
+// toErrorCode the structured code of the reason a port was rejected
+func toErrorCode(err error) pb.ErrorCode {
+	switch {
+	case err == nil:
+		return pb.ErrorCode_ERROR_CODE_UNSPECIFIED
+	case errors.Is(err, cerror.InvalidPortId):
+		return pb.ErrorCode_ERROR_CODE_MISSING_ID
+	case errors.Is(err, cerror.MissingPortName):
+		return pb.ErrorCode_ERROR_CODE_MISSING_NAME
+	case errors.Is(err, cerror.InvalidPortCoords):
+		return pb.ErrorCode_ERROR_CODE_INVALID_COORDINATES
+	case errors.Is(err, cerror.VersionMismatch):
+		return pb.ErrorCode_ERROR_CODE_VERSION_MISMATCH
+	default:
+		return pb.ErrorCode_ERROR_CODE_INTERNAL
+	}
+}
+
+func convertDomainToPortDetails(port domain.Port) *pb.PortDetails {
+	details := &pb.PortDetails{
+		Name:        port.Name,
+		City:        port.City,
+		Country:     port.Country,
+		Alias:       port.Alias,
+		Regions:     port.Regions,
+		Coordinates: port.Coordinates,
+		Province:    port.Province,
+		Timezone:    port.Timezone,
+		Unlocs:      port.UNLOCs,
+		Code:        port.Code,
+		Version:     port.Version,
+	}
+	if !port.UpdatedAt.IsZero() {
+		details.UpdatedAt = timestamppb.New(port.UpdatedAt)
+	}
+	return details
+}
+
+func convertPortDistancesToResponse(results []domain.PortDistance) *pb.GeoPortsResponse {
+	response := &pb.GeoPortsResponse{}
+	for _, result := range results {
+		response.Ports = append(response.Ports, &pb.PortDistance{
+			Id:         result.Port.Id,
+			Port:       convertDomainToPortDetails(result.Port),
+			DistanceKm: result.DistanceKm,
+		})
+	}
+	return response
+}
+
+func convertPortFilterToDomain(filter *pb.PortFilter) domain.PortFilter {
+	if filter == nil {
+		return domain.PortFilter{}
+	}
+	return domain.PortFilter{
+		Country:  filter.Country,
+		City:     filter.City,
+		Province: filter.Province,
+		Timezone: filter.Timezone,
+		Code:     filter.Code,
+		Unloc:    filter.Unloc,
+		Alias:    filter.Alias,
+		Region:   filter.Region,
+	}
+}
+
+// toStatusError maps the core errors to grpc status codes, anything unknown is reported as internal
+func toStatusError(err error) error {
+	switch {
+	case errors.Is(err, cerror.PortNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, cerror.InvalidPortId), errors.Is(err, cerror.InvalidPortsInputs),
+		errors.Is(err, cerror.InvalidCursor), errors.Is(err, cerror.InvalidPageSize),
+		errors.Is(err, cerror.InvalidSearchQuery), errors.Is(err, cerror.InvalidCoordinates),
+		errors.Is(err, cerror.InvalidRadius), errors.Is(err, cerror.InvalidLimit),
+		errors.Is(err, cerror.InvalidBoundingBox), errors.Is(err, cerror.InvalidPolygon),
+		errors.Is(err, cerror.InvalidDeleteInput):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, cerror.ChangeFeedGap):
+		return status.Error(codes.OutOfRange, err.Error())
+	case errors.Is(err, cerror.TransactionConflict):
+		// the client can retry the whole stream
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, cerror.VersionMismatch):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
@@ -0,0 +1,302 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"github.com/go-related/fileservice/internal/core/domain"
+	cerror "github.com/go-related/fileservice/internal/core/errors"
+	"github.com/go-related/fileservice/internal/core/ports"
+	"github.com/go-related/fileservice/proto/pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// MockPortService only the methods of the ingestion, the others panic
+type MockPortService struct {
+	ports.PortService
+	mock.Mock
+}
+
+func (m *MockPortService) StartTransaction(ctx context.Context) (ports.Transaction, error) {
+	args := m.Called(ctx)
+	trn, _ := args.Get(0).(ports.Transaction)
+	return trn, args.Error(1)
+}
+
+func (m *MockPortService) UpsertPorts(ctx context.Context, trn ports.Transaction, items []domain.Port, includeDiffs bool) ([]domain.UpsertResult, error) {
+	args := m.Called(ctx, trn, items, includeDiffs)
+	results, _ := args.Get(0).([]domain.UpsertResult)
+	return results, args.Error(1)
+}
+
+func (m *MockPortService) CommitTransaction(ctx context.Context, trn ports.Transaction) error {
+	return m.Called(ctx, trn).Error(0)
+}
+
+func (m *MockPortService) AbortTransaction(trn ports.Transaction) {
+	m.Called(trn)
+}
+
+// createOrUpdateStream replays the requests and keeps the response
+type createOrUpdateStream struct {
+	grpc.ServerStream
+	requests []*pb.PortRequest
+	response *pb.PortResponse
+}
+
+func (s *createOrUpdateStream) Context() context.Context {
+	return context.TODO()
+}
+
+func (s *createOrUpdateStream) Recv() (*pb.PortRequest, error) {
+	if len(s.requests) == 0 {
+		return nil, io.EOF
+	}
+	request := s.requests[0]
+	s.requests = s.requests[1:]
+	return request, nil
+}
+
+func (s *createOrUpdateStream) SendAndClose(response *pb.PortResponse) error {
+	s.response = response
+	return nil
+}
+
+func TestCreateOrUpdatePorts_StorageError(t *testing.T) {
+	service := new(MockPortService)
+	service.On("StartTransaction", mock.Anything).Return(nil, nil)
+	// the first batch is stored, the second fails and the whole transaction is aborted
+	service.On("UpsertPorts", mock.Anything, mock.Anything, mock.MatchedBy(func(items []domain.Port) bool {
+		return items[0].Id == "AEAJM"
+	}), false).Return([]domain.UpsertResult{{Id: "AEAJM", Status: domain.UpsertCreated}}, nil)
+	service.On("UpsertPorts", mock.Anything, mock.Anything, mock.MatchedBy(func(items []domain.Port) bool {
+		return items[0].Id == "AEAUH"
+	}), false).Return(nil, errors.New("disk full"))
+	service.On("AbortTransaction", mock.Anything).Return()
+	stream := &createOrUpdateStream{requests: []*pb.PortRequest{
+		{PortDetails: map[string]*pb.PortDetails{"AEAJM": {Name: "Ajman"}}},
+		{PortDetails: map[string]*pb.PortDetails{"AEAUH": {Name: "Abu Dhabi"}}},
+	}}
+
+	err := NewPortServer(service).CreateOrUpdatePorts(stream)
+
+	require.Error(t, err)
+	assert.Equal(t, codes.Internal, status.Code(err))
+	// no summary counting the ports of the first batch that were never saved
+	assert.Nil(t, stream.response)
+	service.AssertCalled(t, "AbortTransaction", mock.Anything)
+	service.AssertNotCalled(t, "CommitTransaction", mock.Anything, mock.Anything)
+}
+
+// upsertStream replays the requests and keeps the responses. With heartbeat set the stream ends only
+// once a heartbeat reported the ports that were received
+type upsertStream struct {
+	grpc.ServerStream
+	mx        sync.Mutex
+	requests  []*pb.PortRequest
+	responses []*pb.UpsertPortsResponse
+	heartbeat chan struct{}
+	once      sync.Once
+}
+
+func (s *upsertStream) Context() context.Context {
+	return context.TODO()
+}
+
+func (s *upsertStream) Recv() (*pb.PortRequest, error) {
+	if len(s.requests) == 0 {
+		if s.heartbeat != nil {
+			<-s.heartbeat
+		}
+		return nil, io.EOF
+	}
+	request := s.requests[0]
+	s.requests = s.requests[1:]
+	return request, nil
+}
+
+func (s *upsertStream) Send(response *pb.UpsertPortsResponse) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.responses = append(s.responses, response)
+	if s.heartbeat != nil && response.GetProgress().GetReceived() > 0 {
+		s.once.Do(func() { close(s.heartbeat) })
+	}
+	return nil
+}
+
+func (s *upsertStream) acks() []*pb.PortAck {
+	var acks []*pb.PortAck
+	for _, response := range s.responses {
+		if response.GetAck() != nil {
+			acks = append(acks, response.GetAck())
+		}
+	}
+	return acks
+}
+
+func (s *upsertStream) lastProgress() *pb.UpsertProgress {
+	if len(s.responses) == 0 {
+		return nil
+	}
+	return s.responses[len(s.responses)-1].GetProgress()
+}
+
+func TestUpsertPorts_AcksEveryPort(t *testing.T) {
+	service := new(MockPortService)
+	service.On("StartTransaction", mock.Anything).Return(nil, nil)
+	service.On("UpsertPorts", mock.Anything, mock.Anything, mock.Anything, true).Return([]domain.UpsertResult{
+		{Id: "AEAJM", Status: domain.UpsertCreated, Diffs: []domain.FieldDiff{{Field: "name", New: "Ajman"}}},
+		{Id: "AEXXX", Status: domain.UpsertRejected, Err: cerror.MissingPortName},
+	}, nil).Once()
+	service.On("UpsertPorts", mock.Anything, mock.Anything, mock.Anything, true).Return([]domain.UpsertResult{
+		{Id: "AEAUH", Status: domain.UpsertUpdated},
+	}, nil).Once()
+	service.On("CommitTransaction", mock.Anything, mock.Anything).Return(nil)
+	service.On("AbortTransaction", mock.Anything).Return()
+	stream := &upsertStream{requests: []*pb.PortRequest{
+		{PortDetails: map[string]*pb.PortDetails{"AEAJM": {Name: "Ajman"}, "AEXXX": {}}, IncludeDiffs: true},
+		{PortDetails: map[string]*pb.PortDetails{"AEAUH": {Name: "Abu Dhabi"}}},
+	}}
+
+	err := NewPortServer(service).UpsertPorts(stream)
+
+	require.NoError(t, err)
+	acks := stream.acks()
+	require.Len(t, acks, 3)
+	assert.Equal(t, "AEAJM", acks[0].Id)
+	assert.Equal(t, pb.UpsertStatus_UPSERT_STATUS_CREATED, acks[0].Status)
+	assert.Equal(t, []*pb.FieldDiff{{Field: "name", NewValue: "Ajman"}}, acks[0].Diffs)
+	assert.Equal(t, "AEXXX", acks[1].Id)
+	assert.Equal(t, pb.UpsertStatus_UPSERT_STATUS_REJECTED, acks[1].Status)
+	assert.Equal(t, pb.ErrorCode_ERROR_CODE_MISSING_NAME, acks[1].Code)
+	assert.Equal(t, cerror.MissingPortName.Error(), acks[1].Reason)
+	assert.Equal(t, pb.UpsertStatus_UPSERT_STATUS_UPDATED, acks[2].Status)
+	final := stream.lastProgress()
+	require.NotNil(t, final)
+	assert.True(t, final.Committed)
+	assert.False(t, final.DryRun)
+	assert.Equal(t, int64(3), final.Received)
+	assert.Equal(t, int64(1), final.Created)
+	assert.Equal(t, int64(1), final.Updated)
+	assert.Equal(t, int64(1), final.Rejected)
+	service.AssertCalled(t, "CommitTransaction", mock.Anything, mock.Anything)
+}
+
+func TestUpsertPorts_CommitsInBatches(t *testing.T) {
+	service := new(MockPortService)
+	service.On("StartTransaction", mock.Anything).Return(nil, nil)
+	service.On("UpsertPorts", mock.Anything, mock.Anything, mock.Anything, false).
+		Return([]domain.UpsertResult{{Id: "AEAJM", Status: domain.UpsertCreated}}, nil).Twice()
+	service.On("UpsertPorts", mock.Anything, mock.Anything, mock.Anything, false).
+		Return(nil, errors.New("disk full"))
+	service.On("CommitTransaction", mock.Anything, mock.Anything).Return(nil)
+	service.On("AbortTransaction", mock.Anything).Return()
+	stream := &upsertStream{requests: []*pb.PortRequest{
+		{PortDetails: map[string]*pb.PortDetails{"AEAJM": {Name: "Ajman"}}},
+		{PortDetails: map[string]*pb.PortDetails{"AEAJM": {Name: "Ajman"}}},
+		{PortDetails: map[string]*pb.PortDetails{"AEAUH": {Name: "Abu Dhabi"}}},
+	}}
+	server := NewPortServer(service)
+	server.commitEvery = 2
+
+	err := server.UpsertPorts(stream)
+
+	require.Error(t, err)
+	assert.Equal(t, codes.Internal, status.Code(err))
+	// the first batch was committed and the client was told so right after its acks
+	require.Len(t, stream.responses, 3)
+	assert.NotNil(t, stream.responses[0].GetAck())
+	assert.NotNil(t, stream.responses[1].GetAck())
+	checkpoint := stream.responses[2].GetProgress()
+	require.NotNil(t, checkpoint)
+	assert.True(t, checkpoint.Committed)
+	assert.Equal(t, int64(2), checkpoint.Received)
+	service.AssertNumberOfCalls(t, "CommitTransaction", 1)
+	service.AssertNumberOfCalls(t, "StartTransaction", 2)
+	service.AssertCalled(t, "AbortTransaction", mock.Anything)
+}
+
+func TestUpsertPorts_DryRun(t *testing.T) {
+	service := new(MockPortService)
+	service.On("StartTransaction", mock.Anything).Return(nil, nil)
+	service.On("UpsertPorts", mock.Anything, mock.Anything, mock.Anything, false).
+		Return([]domain.UpsertResult{{Id: "AEAJM", Status: domain.UpsertCreated}}, nil)
+	service.On("AbortTransaction", mock.Anything).Return()
+	stream := &upsertStream{requests: []*pb.PortRequest{
+		{PortDetails: map[string]*pb.PortDetails{"AEAJM": {Name: "Ajman"}}, DryRun: true},
+	}}
+
+	server := NewPortServer(service)
+	server.commitEvery = 1
+
+	err := server.UpsertPorts(stream)
+
+	require.NoError(t, err)
+	final := stream.lastProgress()
+	require.NotNil(t, final)
+	assert.True(t, final.DryRun)
+	assert.False(t, final.Committed)
+	assert.Equal(t, int64(1), final.Created)
+	service.AssertCalled(t, "AbortTransaction", mock.Anything)
+	service.AssertNotCalled(t, "CommitTransaction", mock.Anything, mock.Anything)
+}
+
+func TestUpsertPorts_CommitFails(t *testing.T) {
+	service := new(MockPortService)
+	service.On("StartTransaction", mock.Anything).Return(nil, nil)
+	service.On("UpsertPorts", mock.Anything, mock.Anything, mock.Anything, false).
+		Return([]domain.UpsertResult{{Id: "AEAJM", Status: domain.UpsertCreated}}, nil)
+	service.On("CommitTransaction", mock.Anything, mock.Anything).Return(cerror.TransactionConflict)
+	service.On("AbortTransaction", mock.Anything).Return()
+	stream := &upsertStream{requests: []*pb.PortRequest{
+		{PortDetails: map[string]*pb.PortDetails{"AEAJM": {Name: "Ajman"}}},
+	}}
+
+	err := NewPortServer(service).UpsertPorts(stream)
+
+	require.Error(t, err)
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	// the port was acked but there is no final progress saying it was committed
+	assert.Len(t, stream.acks(), 1)
+	assert.Nil(t, stream.lastProgress())
+	service.AssertCalled(t, "AbortTransaction", mock.Anything)
+}
+
+func TestUpsertPorts_Heartbeats(t *testing.T) {
+	service := new(MockPortService)
+	service.On("StartTransaction", mock.Anything).Return(nil, nil)
+	service.On("UpsertPorts", mock.Anything, mock.Anything, mock.Anything, false).
+		Return([]domain.UpsertResult{{Id: "AEAJM", Status: domain.UpsertCreated}}, nil)
+	service.On("CommitTransaction", mock.Anything, mock.Anything).Return(nil)
+	service.On("AbortTransaction", mock.Anything).Return()
+	stream := &upsertStream{
+		requests:  []*pb.PortRequest{{PortDetails: map[string]*pb.PortDetails{"AEAJM": {Name: "Ajman"}}}},
+		heartbeat: make(chan struct{}),
+	}
+	server := NewPortServer(service)
+	server.heartbeatInterval = time.Millisecond
+
+	err := server.UpsertPorts(stream)
+
+	require.NoError(t, err)
+	var heartbeats []*pb.UpsertProgress
+	for _, response := range stream.responses[:len(stream.responses)-1] {
+		if response.GetProgress() != nil {
+			heartbeats = append(heartbeats, response.GetProgress())
+		}
+	}
+	require.NotEmpty(t, heartbeats)
+	last := heartbeats[len(heartbeats)-1]
+	assert.Equal(t, int64(1), last.Created)
+	assert.False(t, last.Committed)
+	assert.True(t, stream.lastProgress().Committed)
+}
@@ -0,0 +1,251 @@
+package parser
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/go-related/fileservice/internal/core/domain"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CsvColumns the position of the fields in the rows starting from 0, -1 when the file doesn't have the field
+type CsvColumns struct {
+	// Change the change indicator, the rows marked X are removed entries and the rows marked = reference
+	// another name of a location listed on its own. Both are skipped
+	Change int
+	// Unloc the whole UN/LOCODE in one column, when it's missing the code is Country followed by Location
+	Unloc    int
+	Country  int
+	Location int
+	Name     int
+	// NameWithoutDiacritics becomes an alias of the port when it's different from the name
+	NameWithoutDiacritics int
+	Subdivision           int
+	// Coordinates in the degrees and minutes of UN/LOCODE like "2523N 05531E"
+	Coordinates int
+}
+
+// UnlocodeColumns the layout of the code list published by UN/LOCODE: change indicator, country, location, name,
+// name without diacritics, subdivision, function, status, date, IATA, coordinates and remarks
+var UnlocodeColumns = CsvColumns{
+	Change:                0,
+	Unloc:                 -1,
+	Country:               1,
+	Location:              2,
+	Name:                  3,
+	NameWithoutDiacritics: 4,
+	Subdivision:           5,
+	Coordinates:           10,
+}
+
+// ParseCsvColumns changes the columns of UnlocodeColumns listed in spec, like "unloc=0,name=1,country=-1"
+func ParseCsvColumns(spec string) (CsvColumns, error) {
+	columns := UnlocodeColumns
+	fields := map[string]*int{
+		"change":                &columns.Change,
+		"unloc":                 &columns.Unloc,
+		"country":               &columns.Country,
+		"location":              &columns.Location,
+		"name":                  &columns.Name,
+		"namewithoutdiacritics": &columns.NameWithoutDiacritics,
+		"subdivision":           &columns.Subdivision,
+		"coordinates":           &columns.Coordinates,
+	}
+	for _, assignment := range strings.Split(spec, ",") {
+		if strings.TrimSpace(assignment) == "" {
+			continue
+		}
+		name, value, found := strings.Cut(assignment, "=")
+		field, ok := fields[strings.ToLower(strings.TrimSpace(name))]
+		if !found || !ok {
+			return CsvColumns{}, fmt.Errorf("invalid column %q", assignment)
+		}
+		position, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || position < -1 {
+			return CsvColumns{}, fmt.Errorf("invalid position of column %q", assignment)
+		}
+		*field = position
+	}
+	if columns.Unloc < 0 && (columns.Country < 0 || columns.Location < 0) {
+		return CsvColumns{}, errors.New("the ports need either the unloc column or both the country and the location ones")
+	}
+	return columns, nil
+}
+
+// CsvParser reads the UN/LOCODE code lists. The rows without a location are the countries, their name
+// starting with a dot becomes the country of the ports that follow
+type CsvParser struct {
+	addDelayAfterItemRead bool
+	columns               CsvColumns
+}
+
+func NewCsvParser(addDelayAfterItemRead bool, columns CsvColumns) *CsvParser {
+	return &CsvParser{addDelayAfterItemRead: addDelayAfterItemRead, columns: columns}
+}
+
+func (parser *CsvParser) ReadJsonFile(ctx context.Context, filePath string, publishChannel chan domain.IndexedPort) error {
+	f, err := openInput(filePath)
+	if err != nil {
+		logrus.WithError(err).Error("error reading csv file")
+		return err
+	}
+	defer func(f *inputFile) {
+		err := f.Close()
+		if err != nil {
+			logrus.WithError(err).Error("error closing reader to the file")
+		}
+	}(f)
+	return parser.readFromReader(ctx, f, publishChannel)
+}
+
+// readFromReader converts the rows one at a time, the errors tell the line of the row
+func (parser *CsvParser) readFromReader(ctx context.Context, reader io.Reader, publishChannel chan domain.IndexedPort) error {
+	rows := csv.NewReader(reader)
+	rows.FieldsPerRecord = -1 // the country rows are often shorter
+	rows.ReuseRecord = true
+	// the names of the countries by code, from their rows
+	countries := make(map[string]string)
+	title := cases.Title(language.English)
+	index := 0
+	for {
+		//if we are cancelled or sm like that
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		row, err := rows.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err // the csv errors tell the line already
+		}
+		line, _ := rows.FieldPos(0)
+		if change := field(row, parser.columns.Change); change == "X" || change == "=" {
+			continue
+		}
+		if parser.isCountry(row) {
+			countries[field(row, parser.columns.Country)] = title.String(strings.TrimPrefix(field(row, parser.columns.Name), "."))
+			continue
+		}
+		port, err := parser.convertRow(row, countries)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		publishChannel <- domain.IndexedPort{Port: port, Index: index}
+		index++
+		if parser.addDelayAfterItemRead {
+			time.Sleep(5 * time.Second)
+		}
+	}
+}
+
+func (parser *CsvParser) isCountry(row []string) bool {
+	return parser.columns.Unloc < 0 && field(row, parser.columns.Location) == "" && strings.HasPrefix(field(row, parser.columns.Name), ".")
+}
+
+// convertRow the port of the row, the country is the name from the country rows when there was one
+func (parser *CsvParser) convertRow(row []string, countries map[string]string) (domain.Port, error) {
+	columns := parser.columns
+	var country string
+	port := domain.Port{
+		Name:     field(row, columns.Name),
+		Province: field(row, columns.Subdivision),
+	}
+	if columns.Unloc >= 0 {
+		port.Id = strings.ToUpper(strings.ReplaceAll(field(row, columns.Unloc), " ", ""))
+		if len(port.Id) > 2 {
+			country = port.Id[:2]
+		}
+	} else {
+		country = strings.ToUpper(field(row, columns.Country))
+		port.Id = country + strings.ToUpper(field(row, columns.Location))
+	}
+	if len(port.Id) != 5 {
+		return domain.Port{}, fmt.Errorf("invalid UN/LOCODE %q", port.Id)
+	}
+	if len(port.Name) == 0 {
+		return domain.Port{}, errors.New("couldn't parse data to the correct interface")
+	}
+	port.City = port.Name
+	port.UNLOCs = []string{port.Id}
+	port.Country = country
+	if name, ok := countries[country]; ok {
+		port.Country = name
+	}
+	if alias := field(row, columns.NameWithoutDiacritics); alias != "" && alias != port.Name {
+		port.Alias = []string{alias}
+	}
+	if coordinates := field(row, columns.Coordinates); coordinates != "" {
+		var err error
+		port.Coordinates, err = ParseUnlocodeCoordinates(coordinates)
+		if err != nil {
+			return domain.Port{}, err
+		}
+	}
+	return port, nil
+}
+
+// ParseUnlocodeCoordinates converts the degrees and minutes of UN/LOCODE, like "2523N 05531E", to the decimal
+// longitude and latitude of the ports
+func ParseUnlocodeCoordinates(value string) ([]float64, error) {
+	parts := strings.Fields(value)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid coordinates %q", value)
+	}
+	latitude, err := parseDegreesMinutes(parts[0], 2, 90, 'N', 'S')
+	if err != nil {
+		return nil, fmt.Errorf("invalid latitude in %q: %w", value, err)
+	}
+	longitude, err := parseDegreesMinutes(parts[1], 3, 180, 'E', 'W')
+	if err != nil {
+		return nil, fmt.Errorf("invalid longitude in %q: %w", value, err)
+	}
+	return []float64{longitude, latitude}, nil
+}
+
+// parseDegreesMinutes a value like "05531E" with the degrees in the first digits and two digits of minutes
+func parseDegreesMinutes(value string, degreeDigits int, limit float64, positive, negative byte) (float64, error) {
+	if len(value) != degreeDigits+3 {
+		return 0, fmt.Errorf("%q is not %d digits of degrees, 2 of minutes and the hemisphere", value, degreeDigits)
+	}
+	for i := 0; i < degreeDigits+2; i++ {
+		if value[i] < '0' || value[i] > '9' {
+			return 0, fmt.Errorf("%q is not %d digits of degrees, 2 of minutes and the hemisphere", value, degreeDigits)
+		}
+	}
+	degrees, _ := strconv.Atoi(value[:degreeDigits])
+	minutes, _ := strconv.Atoi(value[degreeDigits : degreeDigits+2])
+	if minutes >= 60 {
+		return 0, fmt.Errorf("%d minutes", minutes)
+	}
+	result := float64(degrees) + float64(minutes)/60
+	switch value[degreeDigits+2] {
+	case positive:
+	case negative:
+		result = -result
+	default:
+		return 0, fmt.Errorf("unknown hemisphere %q", value[degreeDigits+2])
+	}
+	if result > limit || result < -limit {
+		return 0, fmt.Errorf("%v degrees out of range", result)
+	}
+	return result, nil
+}
+
+// field the trimmed value of the column, empty when the column is not mapped or the row is shorter
+func field(row []string, column int) string {
+	if column < 0 || column >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[column])
+}
@@ -0,0 +1,115 @@
+package parser
+
+import (
+	"context"
+	"github.com/go-related/fileservice/internal/core/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+// unlocodeTestData rows in the layout of the UN/LOCODE code list
+const unlocodeTestData = `,"AE",,".UNITED ARAB EMIRATES",,,,,,,,
+,"AE","AJM","Ajman","Ajman","AJ","1-------","AI","9307",,"2524N 05526E",
+"X","AE","OLD","Old Ajman","Old Ajman","AJ","1-------","AI","9307",,,
+"=","AE","ABU","Abu Dhabi = Abu Zaby","Abu Dhabi = Abu Zaby",,,,,,,
+,"AE","AUH","Abu Dhabi","Abu Dhabi","AZ","1--45---","AI","0201",,"2428N 05422E",
+,"SE",,".SWEDEN",,,,,,,,
+,"SE","GOT","Göteborg","Goteborg","O","1234----","AI","0101","GOT","5742N 01157E",
+,"AR","USH","Ushuaia","Ushuaia","V","1--4----","AI","0501",,"5448S 06818W",
+`
+
+// readAllCsv parses the data and collects the ports it publishes
+func readAllCsv(ctx context.Context, columns CsvColumns, data string) ([]domain.IndexedPort, error) {
+	channel := make(chan domain.IndexedPort, 100)
+	err := NewCsvParser(false, columns).readFromReader(ctx, strings.NewReader(data), channel)
+	close(channel)
+	var ports []domain.IndexedPort
+	for port := range channel {
+		ports = append(ports, port)
+	}
+	return ports, err
+}
+
+func TestCsvParser(t *testing.T) {
+	ports, err := readAllCsv(context.TODO(), UnlocodeColumns, unlocodeTestData)
+	require.NoError(t, err)
+	require.Len(t, ports, 4)
+	assert.Equal(t, domain.Port{
+		Id:          "AEAJM",
+		Name:        "Ajman",
+		City:        "Ajman",
+		Country:     "United Arab Emirates",
+		Province:    "AJ",
+		UNLOCs:      []string{"AEAJM"},
+		Coordinates: []float64{55 + 26.0/60, 25 + 24.0/60},
+	}, ports[0].Port)
+	assert.Equal(t, "AEAUH", ports[1].Port.Id)
+	assert.Equal(t, 1, ports[1].Index)
+	assert.Equal(t, "Sweden", ports[2].Port.Country)
+	assert.Equal(t, []string{"Goteborg"}, ports[2].Port.Alias)
+	// without a country row the country is the code
+	assert.Equal(t, "AR", ports[3].Port.Country)
+	assert.InDeltaSlice(t, []float64{-68.3, -54.8}, ports[3].Port.Coordinates, 1e-9)
+}
+
+func TestCsvParser_ConfiguredColumns(t *testing.T) {
+	columns, err := ParseCsvColumns("unloc=0, name=1, coordinates=2, change=-1, country=-1, location=-1, namewithoutdiacritics=-1, subdivision=-1")
+	require.NoError(t, err)
+	ports, err := readAllCsv(context.TODO(), columns, "AE AJM,Ajman,2524N 05526E\nSEGOT,Göteborg,\n")
+	require.NoError(t, err)
+	require.Len(t, ports, 2)
+	assert.Equal(t, domain.Port{
+		Id:          "AEAJM",
+		Name:        "Ajman",
+		City:        "Ajman",
+		Country:     "AE",
+		UNLOCs:      []string{"AEAJM"},
+		Coordinates: []float64{55 + 26.0/60, 25 + 24.0/60},
+	}, ports[0].Port)
+	assert.Equal(t, "SEGOT", ports[1].Port.Id)
+	assert.Nil(t, ports[1].Port.Coordinates)
+}
+
+func TestParseCsvColumns_Errors(t *testing.T) {
+	for _, spec := range []string{"city=1", "name", "name=first", "name=-2", "unloc=-1,country=-1"} {
+		_, err := ParseCsvColumns(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestCsvParser_ErrorsTellTheLine(t *testing.T) {
+	data := `,"AE","AJM","Ajman","Ajman","AJ","1-------","AI","9307",,"2524N 05526E",
+,"AE","AUH","Abu Dhabi","Abu Dhabi","AZ","1--45---","AI","0201",,"2428X 05422E",
+`
+	ports, err := readAllCsv(context.TODO(), UnlocodeColumns, data)
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "line 2:"), err.Error())
+	assert.Len(t, ports, 1)
+}
+
+func TestParseUnlocodeCoordinates(t *testing.T) {
+	valid := map[string][]float64{
+		"2523N 05531E": {55 + 31.0/60, 25 + 23.0/60},
+		"5448S 06818W": {-(68 + 18.0/60), -(54 + 48.0/60)},
+		"0000N 18000E": {180, 0},
+	}
+	for value, expected := range valid {
+		coordinates, err := ParseUnlocodeCoordinates(value)
+		require.NoError(t, err, value)
+		assert.InDeltaSlice(t, expected, coordinates, 1e-9, value)
+	}
+	for _, value := range []string{"2523N", "2523N05531E", "2523E 05531N", "2560N 05531E", "9100N 05531E", "2523N 18100E", "2523N 5531E", "+523N 05531E"} {
+		_, err := ParseUnlocodeCoordinates(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestCsvParser_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	ports, err := readAllCsv(ctx, UnlocodeColumns, unlocodeTestData)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, ports)
+}
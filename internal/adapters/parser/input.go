@@ -0,0 +1,115 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"time"
+)
+
+// progressLogInterval how often the progress of the read is logged
+const progressLogInterval = 10 * time.Second
+
+// the first bytes of the compressed files
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	bzip2Magic = []byte("BZh")
+)
+
+// inputFile the content of a file, decompressed on the fly when the file starts with the magic bytes of
+// gzip, zstd or bzip2. The compressed files are never expanded on disk
+type inputFile struct {
+	io.Reader
+	file     *os.File
+	progress *progressReader
+	// decoder closes the decompression, nil for the plain files
+	decoder io.Closer
+}
+
+// openInput opens the file and picks the decompression from its first bytes, whatever its extension
+func openInput(filePath string) (*inputFile, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	progress := &progressReader{reader: f, lastLog: time.Now(), path: filePath}
+	if info, err := f.Stat(); err == nil {
+		progress.size = info.Size()
+	}
+	input := &inputFile{file: f, progress: progress}
+	buffered := bufio.NewReader(progress)
+	magic, err := buffered.Peek(len(zstdMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		_ = f.Close()
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		decoder, err := gzip.NewReader(buffered)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		input.Reader, input.decoder, progress.compression = decoder, decoder, "gzip"
+	case bytes.HasPrefix(magic, zstdMagic):
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			_ = f.Close()
+			return nil, err
+		}
+		input.Reader, input.decoder, progress.compression = decoder, decoder.IOReadCloser(), "zstd"
+	case bytes.HasPrefix(magic, bzip2Magic):
+		input.Reader, progress.compression = bzip2.NewReader(buffered), "bzip2"
+	default:
+		input.Reader = buffered
+	}
+	return input, nil
+}
+
+// Close closes the decompression and the file
+func (i *inputFile) Close() error {
+	if i.decoder != nil {
+		_ = i.decoder.Close()
+	}
+	i.progress.log()
+	return i.file.Close()
+}
+
+// progressReader counts the bytes read from the file, for the compressed files these are compressed bytes
+// so they can be compared with the size of the file
+type progressReader struct {
+	reader      io.Reader
+	path        string
+	compression string
+	size        int64
+	read        int64
+	lastLog     time.Time
+}
+
+func (p *progressReader) Read(data []byte) (int, error) {
+	n, err := p.reader.Read(data)
+	p.read += int64(n)
+	if time.Since(p.lastLog) >= progressLogInterval {
+		p.log()
+	}
+	return n, err
+}
+
+func (p *progressReader) log() {
+	p.lastLog = time.Now()
+	entry := logrus.WithField("file", p.path).WithField("read_bytes", p.read).WithField("size", p.size)
+	if p.compression != "" {
+		entry = entry.WithField("compression", p.compression)
+	}
+	if p.size > 0 {
+		entry = entry.WithField("percent", float64(p.read)*100/float64(p.size))
+	}
+	entry.Info("reading the file")
+}
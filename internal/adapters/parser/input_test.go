@@ -0,0 +1,101 @@
+package parser
+
+import (
+	"compress/gzip"
+	"context"
+	"github.com/go-related/fileservice/internal/core/domain"
+	"github.com/go-related/fileservice/internal/core/ports"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testPortsFile = "../../../config/ports.json"
+
+// compressFile writes the file compressed by newWriter to a temporary path, with an extension saying nothing
+func compressFile(t *testing.T, path string, newWriter func(w io.Writer) (io.WriteCloser, error)) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	compressed := filepath.Join(t.TempDir(), "ports.data")
+	f, err := os.Create(compressed)
+	require.NoError(t, err)
+	defer f.Close()
+	writer, err := newWriter(f)
+	require.NoError(t, err)
+	_, err = writer.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	return compressed
+}
+
+func readFile(t *testing.T, parser ports.StreamJsonParser, path string) []domain.IndexedPort {
+	t.Helper()
+	channel := make(chan domain.IndexedPort, 100)
+	require.NoError(t, parser.ReadJsonFile(context.TODO(), path, channel))
+	close(channel)
+	var ports []domain.IndexedPort
+	for port := range channel {
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+func TestCompressedInput(t *testing.T) {
+	expected := readFile(t, NewStreamJsonParser(false), testPortsFile)
+	files := map[string]string{
+		"gzip": compressFile(t, testPortsFile, func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		}),
+		"zstd": compressFile(t, testPortsFile, func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		}),
+		"bzip2": "testdata/ports.json.bz2",
+	}
+	for compression, path := range files {
+		path := path
+		t.Run(compression, func(t *testing.T) {
+			assert.Equal(t, expected, readFile(t, NewStreamJsonParser(false), path))
+			// the parallel parser splits the decompressed data
+			assert.ElementsMatch(t, expected, readFile(t, newTestParallelParser(2, 256), path))
+
+			input, err := openInput(path)
+			require.NoError(t, err)
+			decompressed, err := io.ReadAll(input)
+			require.NoError(t, err)
+			info, err := os.Stat(path)
+			require.NoError(t, err)
+			// the progress counts the bytes of the file
+			assert.Equal(t, info.Size(), input.progress.read)
+			assert.Equal(t, compression, input.progress.compression)
+			assert.Greater(t, int64(len(decompressed)), info.Size())
+			require.NoError(t, input.Close())
+		})
+	}
+}
+
+func TestCompressedInput_Ndjson(t *testing.T) {
+	plain := filepath.Join(t.TempDir(), "ports.ndjson")
+	require.NoError(t, os.WriteFile(plain, []byte(`{"id": "AEAJM", "name": "Ajman"}`+"\n"), 0o644))
+	compressed := compressFile(t, plain, func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	})
+	assert.Equal(t, []domain.IndexedPort{{Port: domain.Port{Id: "AEAJM", Name: "Ajman"}}}, readFile(t, NewNdjsonParser(false), compressed))
+}
+
+func TestPlainInput_ShortFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ports.json")
+	require.NoError(t, os.WriteFile(path, []byte("{}"), 0o644))
+	assert.Empty(t, readFile(t, NewStreamJsonParser(false), path))
+}
+
+func TestCompressedInput_Corrupted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ports.json.gz")
+	require.NoError(t, os.WriteFile(path, append([]byte{0x1f, 0x8b}, []byte("not really gzip")...), 0o644))
+	channel := make(chan domain.IndexedPort, 100)
+	assert.Error(t, NewStreamJsonParser(false).ReadJsonFile(context.TODO(), path, channel))
+}
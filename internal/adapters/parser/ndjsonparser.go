@@ -0,0 +1,100 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-related/fileservice/internal/core/domain"
+	"github.com/sirupsen/logrus"
+	"io"
+	"time"
+)
+
+// NdjsonParser reads the files with a port object on every line, the port is identified by its "id" field
+// or when missing by its "unloc" one. Blank lines are skipped
+type NdjsonParser struct {
+	addDelayAfterItemRead bool
+}
+
+func NewNdjsonParser(addDelayAfterItemRead bool) *NdjsonParser {
+	return &NdjsonParser{addDelayAfterItemRead: addDelayAfterItemRead}
+}
+
+// ndjsonPort a line of the file, the fields of the port with the alternative id
+type ndjsonPort struct {
+	filePort
+	Unloc string `json:"unloc"`
+}
+
+func (parser *NdjsonParser) ReadJsonFile(ctx context.Context, filePath string, publishChannel chan domain.IndexedPort) error {
+	f, err := openInput(filePath)
+	if err != nil {
+		logrus.WithError(err).Error("error reading ndjson file")
+		return err
+	}
+	defer func(f *inputFile) {
+		err := f.Close()
+		if err != nil {
+			logrus.WithError(err).Error("error closing reader to the file")
+		}
+	}(f)
+	return parser.readFromReader(ctx, f, publishChannel)
+}
+
+// readFromReader decodes the file line by line, the errors tell the line they come from
+func (parser *NdjsonParser) readFromReader(ctx context.Context, reader io.Reader, publishChannel chan domain.IndexedPort) error {
+	lines := bufio.NewReader(reader)
+	index := 0
+	for number := 1; ; number++ {
+		//if we are cancelled or sm like that
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		line, err := lines.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("line %d: %w", number, err)
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			port, decodeErr := decodeNdjsonLine(line)
+			if decodeErr != nil {
+				return fmt.Errorf("line %d: %w", number, decodeErr)
+			}
+			publishChannel <- domain.IndexedPort{Port: port, Index: index}
+			index++
+			if parser.addDelayAfterItemRead {
+				time.Sleep(5 * time.Second)
+			}
+		}
+		if err != nil {
+			return nil // io.EOF, the last line might not end with a newline
+		}
+	}
+}
+
+// decodeNdjsonLine the port of the line, a port identified by its UN/LOCODE lists it among its UNLOCs
+func decodeNdjsonLine(line []byte) (domain.Port, error) {
+	var data ndjsonPort
+	if err := json.Unmarshal(line, &data); err != nil {
+		return domain.Port{}, err
+	}
+	port := data.toDomain()
+	if port.Id == "" {
+		port.Id = data.Unloc
+		if port.Id != "" && len(port.UNLOCs) == 0 {
+			port.UNLOCs = []string{data.Unloc}
+		}
+	}
+	if port.Id == "" {
+		return domain.Port{}, errors.New("the port has neither an id nor an unloc")
+	}
+	if len(port.Name) == 0 {
+		return domain.Port{}, errors.New("couldn't parse data to the correct interface")
+	}
+	return port, nil
+}
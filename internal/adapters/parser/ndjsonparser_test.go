@@ -0,0 +1,82 @@
+package parser
+
+import (
+	"context"
+	"github.com/go-related/fileservice/internal/core/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readAllNdjson parses the data and collects the ports it publishes
+func readAllNdjson(ctx context.Context, data string) ([]domain.IndexedPort, error) {
+	channel := make(chan domain.IndexedPort, 100)
+	err := NewNdjsonParser(false).readFromReader(ctx, strings.NewReader(data), channel)
+	close(channel)
+	var ports []domain.IndexedPort
+	for port := range channel {
+		ports = append(ports, port)
+	}
+	return ports, err
+}
+
+func TestNdjsonParser(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ports.ndjson")
+	data := `{"id": "AEAJM", "name": "Ajman", "city": "Ajman", "unlocs": ["AEAJM"], "coordinates": [55.51, 25.40]}
+
+{"unloc": "AEAUH", "name": "Abu Dhabi", "code": "52001"}
+{"id": "AEDXB", "unloc": "AEJEA", "name": "Dubai"}`
+	require.NoError(t, os.WriteFile(path, []byte(data), 0o644))
+	channel := make(chan domain.IndexedPort, 10)
+	require.NoError(t, NewNdjsonParser(false).ReadJsonFile(context.TODO(), path, channel))
+	close(channel)
+	var ports []domain.IndexedPort
+	for port := range channel {
+		ports = append(ports, port)
+	}
+
+	assert.Equal(t, []domain.IndexedPort{
+		{Port: domain.Port{Id: "AEAJM", Name: "Ajman", City: "Ajman", UNLOCs: []string{"AEAJM"}, Coordinates: []float64{55.51, 25.40}}},
+		// identified by the unloc, that becomes one of its UNLOCs
+		{Port: domain.Port{Id: "AEAUH", Name: "Abu Dhabi", Code: "52001", UNLOCs: []string{"AEAUH"}}, Index: 1},
+		// the id wins over the unloc
+		{Port: domain.Port{Id: "AEDXB", Name: "Dubai"}, Index: 2},
+	}, ports)
+}
+
+func TestNdjsonParser_ErrorsTellTheLine(t *testing.T) {
+	tests := map[string]struct {
+		data string
+		line string
+	}{
+		"InvalidJson":    {data: "{\"id\": \"AEAJM\", \"name\": \"Ajman\"}\n{\"id\": \"AEAUH\",\n", line: "line 2:"},
+		"MissingId":      {data: "{\"id\": \"AEAJM\", \"name\": \"Ajman\"}\n\n{\"name\": \"Abu Dhabi\"}\n", line: "line 3:"},
+		"MissingName":    {data: "{\"unloc\": \"AEAJM\"}", line: "line 1:"},
+		"WrongFieldType": {data: "{\"id\": \"AEAJM\", \"name\": \"Ajman\", \"code\": 52000}", line: "line 1:"},
+	}
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			_, err := readAllNdjson(context.TODO(), test.data)
+			require.Error(t, err)
+			assert.True(t, strings.HasPrefix(err.Error(), test.line), err.Error())
+		})
+	}
+}
+
+func TestNdjsonParser_IgnoresVersion(t *testing.T) {
+	ports, err := readAllNdjson(context.TODO(), `{"id": "AEAJM", "name": "Ajman", "version": 7, "updatedAt": "2020-01-01T00:00:00Z"}`)
+	require.NoError(t, err)
+	assert.Equal(t, []domain.IndexedPort{{Port: domain.Port{Id: "AEAJM", Name: "Ajman"}}}, ports)
+}
+
+func TestNdjsonParser_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	ports, err := readAllNdjson(ctx, `{"id": "AEAJM", "name": "Ajman"}`)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, ports)
+}
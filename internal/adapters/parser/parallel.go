@@ -0,0 +1,179 @@
+package parser
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-related/fileservice/internal/core/domain"
+	"io"
+	"strings"
+	"sync"
+)
+
+const (
+	// parallelChunkSize about how many bytes of entries a worker decodes at a time
+	parallelChunkSize = 4 << 20
+	// parallelReadSize how much of the file the splitter reads at a time
+	parallelReadSize = 1 << 20
+)
+
+// jsonChunk consecutive entries of the top level object, wrapped in braces they are an object on their own
+type jsonChunk struct {
+	// offset of the first byte of data in the file
+	offset int64
+	// first the index of the first port of the chunk
+	first int
+	data  []byte
+}
+
+// readParallel splits the top level object in chunks at the commas between its entries and decodes the chunks
+// on the workers, the ports are published as soon as they are decoded. The splitter only follows the strings
+// and the nesting so it's much faster than the decoding, and about a chunk for every worker is kept in memory.
+// The first error stops everything
+func (parser *StreamJsonParser) readParallel(ctx context.Context, reader io.Reader, publishChannel chan domain.IndexedPort) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	chunks := make(chan jsonChunk, parser.workers)
+	var wg sync.WaitGroup
+	for i := 0; i < parser.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// once failed the chunks left are dropped right away, decodeObject checks ctx first
+			for chunk := range chunks {
+				object := io.MultiReader(strings.NewReader("{"), bytes.NewReader(chunk.data), strings.NewReader("}"))
+				if err := parser.decodeObject(ctx, object, chunk.first, publishChannel); err != nil {
+					fail(fmt.Errorf("chunk at offset %d: %w", chunk.offset, err))
+				}
+			}
+		}()
+	}
+	if err := splitObject(ctx, reader, parser.chunkSize, chunks); err != nil {
+		fail(err)
+	}
+	close(chunks)
+	wg.Wait()
+	return firstErr
+}
+
+// splitObject sends the entries of the top level object in chunks of about size bytes, cut at the commas between
+// two entries. The braces of the object are left out. Only the structure around the entries is checked here,
+// the entries themselves are checked by the decoder
+func splitObject(ctx context.Context, reader io.Reader, size int, chunks chan<- jsonChunk) error {
+	var (
+		depth            int
+		inString, escape bool
+		started, done    bool
+		// entries the top level commas so far, that's the index of the entry after the last one
+		entries int
+		// offset of the start of the block in the file
+		offset int64
+		chunk  jsonChunk
+	)
+	send := func() error {
+		select {
+		case chunks <- chunk:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	block := make([]byte, parallelReadSize)
+	for {
+		n, err := reader.Read(block)
+		// start of the bytes of the block that are not in the chunk yet
+		start := 0
+		for i := 0; i < n; i++ {
+			c := block[i]
+			if inString {
+				switch {
+				case escape:
+					escape = false
+				case c == '\\':
+					escape = true
+				case c == '"':
+					inString = false
+				}
+				continue
+			}
+			if depth == 0 {
+				if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+					continue
+				}
+				if c != '{' || started {
+					return fmt.Errorf("unexpected %q at offset %d outside the top level object", c, offset+int64(i))
+				}
+				started = true
+				depth = 1
+				start = i + 1
+				chunk.offset = offset + int64(start)
+				continue
+			}
+			switch c {
+			case '"':
+				inString = true
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth > 0 {
+					continue
+				}
+				if c != '}' {
+					return fmt.Errorf("unexpected %q at offset %d closing the top level object", c, offset+int64(i))
+				}
+				chunk.data = append(chunk.data, block[start:i]...)
+				start = i + 1
+				if len(bytes.TrimSpace(chunk.data)) == 0 {
+					if chunk.first > 0 {
+						return fmt.Errorf("trailing comma before offset %d", offset+int64(i))
+					}
+					done = true // an empty object
+					continue
+				}
+				if err := send(); err != nil {
+					return err
+				}
+				done = true
+			case ',':
+				if depth > 1 {
+					continue
+				}
+				entries++
+				if len(chunk.data)+i-start < size {
+					continue
+				}
+				chunk.data = append(chunk.data, block[start:i]...)
+				if err := send(); err != nil {
+					return err
+				}
+				start = i + 1
+				chunk = jsonChunk{offset: offset + int64(start), first: entries}
+			}
+		}
+		if depth > 0 {
+			chunk.data = append(chunk.data, block[start:n]...)
+		}
+		offset += int64(n)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !done {
+		return fmt.Errorf("the top level object is not closed: %w", io.ErrUnexpectedEOF)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package parser
+
+import (
+	"context"
+	"github.com/go-related/fileservice/internal/core/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"runtime"
+	"sort"
+	"testing"
+)
+
+// parallelTestData the strings are full of the characters the splitter looks for
+const parallelTestData = `{
+  "AEAJM": {"name": "Ajman", "alias": ["a,b", "{[", "]}"], "coordinates": [55.51, 25.40]},
+  "AE,UH": {"name": "Abu \"Dhabi\", {}", "regions": [], "unlocs": ["AEAUH"]},
+  "AEDXB\\\\": {"name": "Dubai,", "province": "}"},
+  "AEFJR": {"name": "Fujairah", "code": "52051"}
+}`
+
+func newTestParallelParser(workers, chunkSize int) *StreamJsonParser {
+	parser := NewParallelStreamJsonParser(false, workers)
+	parser.chunkSize = chunkSize
+	return parser
+}
+
+func TestReadParallel_SameAsSequential(t *testing.T) {
+	expected, err := readAll(context.TODO(), NewStreamJsonParser(false), parallelTestData)
+	require.NoError(t, err)
+	require.Len(t, expected, 4)
+	for _, chunkSize := range []int{1, 64, parallelChunkSize} {
+		ports, err := readAll(context.TODO(), newTestParallelParser(3, chunkSize), parallelTestData)
+		require.NoError(t, err)
+		// the index restores the order of the file
+		sort.Slice(ports, func(i, j int) bool { return ports[i].Index < ports[j].Index })
+		assert.Equal(t, expected, ports, "chunks of %d bytes", chunkSize)
+	}
+	for i, port := range expected {
+		assert.Equal(t, i, port.Index)
+	}
+}
+
+func TestReadParallel_EmptyObject(t *testing.T) {
+	ports, err := readAll(context.TODO(), newTestParallelParser(2, 1), " { \n } ")
+	assert.NoError(t, err)
+	assert.Empty(t, ports)
+}
+
+func TestReadParallel_Errors(t *testing.T) {
+	tests := map[string]string{
+		"NotAnObject":    `[{"name": "Ajman"}]`,
+		"TwoObjects":     `{"AEAJM": {"name": "Ajman"}} {}`,
+		"NotClosed":      `{"AEAJM": {"name": "Ajman"}, "AEAUH": {"name": "Abu Dhabi"}`,
+		"ClosedByArray":  `{"AEAJM": {"name": "Ajman"}]`,
+		"TrailingComma":  `{"AEAJM": {"name": "Ajman"}, }`,
+		"MissingName":    `{"AEAJM": {"name": "Ajman"}, "AEAUH": {"city": "Abu Dhabi"}}`,
+		"WrongFieldType": `{"AEAJM": {"name": "Ajman"}, "AEAUH": {"name": "Abu Dhabi", "code": 52001}}`,
+	}
+	for name, data := range tests {
+		data := data
+		t.Run(name, func(t *testing.T) {
+			_, err := readAll(context.TODO(), newTestParallelParser(2, 1), data)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestReadParallel_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	_, err := readAll(ctx, newTestParallelParser(2, 1), parallelTestData)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestReadParallel_File(t *testing.T) {
+	channel := make(chan domain.IndexedPort, 100)
+	err := newTestParallelParser(4, 256).ReadJsonFile(context.TODO(), "../../../config/ports.json", channel)
+	require.NoError(t, err)
+	close(channel)
+	seen := make(map[int]string)
+	for port := range channel {
+		seen[port.Index] = port.Port.Id
+	}
+	assert.Equal(t, "AEAJM", seen[0])
+	assert.Equal(t, "AEAUH", seen[1])
+	for i := range seen {
+		assert.Less(t, i, len(seen))
+	}
+}
+
+// BenchmarkReadJsonFile_Parallel a worker for every cpu, with -cpu 1 it's the same as the sequential parser
+func BenchmarkReadJsonFile_Parallel(b *testing.B) {
+	benchmarkParser(b, NewParallelStreamJsonParser(false, runtime.GOMAXPROCS(0)))
+}
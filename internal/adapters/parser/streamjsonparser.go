@@ -4,29 +4,70 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"github.com/bcicen/jstream"
+	"fmt"
 	"github.com/go-related/fileservice/internal/core/domain"
 	"github.com/sirupsen/logrus"
 	"io"
-	"os"
 	"time"
 )
 
 type StreamJsonParser struct {
 	addDelayAfterItemRead bool
+	// workers how many goroutines decode the file, with more than one see readParallel
+	workers int
+	// chunkSize about how many bytes every worker decodes at a time
+	chunkSize int
+}
+
+// filePort the fields of a port in the input files. Version and UpdatedAt of domain.Port are left out on purpose:
+// they are set by the server, a "version" key of a vendor file would turn into the version the upsert expects
+type filePort struct {
+	Id          string
+	Name        string
+	City        string
+	Country     string
+	Alias       []string
+	Regions     []string
+	Coordinates []float64
+	Province    string
+	Timezone    string
+	UNLOCs      []string
+	Code        string
+}
+
+func (p filePort) toDomain() domain.Port {
+	return domain.Port{
+		Id:          p.Id,
+		Name:        p.Name,
+		City:        p.City,
+		Country:     p.Country,
+		Alias:       p.Alias,
+		Regions:     p.Regions,
+		Coordinates: p.Coordinates,
+		Province:    p.Province,
+		Timezone:    p.Timezone,
+		UNLOCs:      p.UNLOCs,
+		Code:        p.Code,
+	}
 }
 
 func NewStreamJsonParser(addDelayAfterItemRead bool) *StreamJsonParser {
 	return &StreamJsonParser{addDelayAfterItemRead: addDelayAfterItemRead}
 }
 
-func (parser *StreamJsonParser) ReadJsonFile(ctx context.Context, filePath string, publishChannel chan domain.Port) error {
-	f, err := os.Open(filePath)
+// NewParallelStreamJsonParser a parser decoding the file on workers goroutines, the ports are published
+// out of order with their Index
+func NewParallelStreamJsonParser(addDelayAfterItemRead bool, workers int) *StreamJsonParser {
+	return &StreamJsonParser{addDelayAfterItemRead: addDelayAfterItemRead, workers: workers, chunkSize: parallelChunkSize}
+}
+
+func (parser *StreamJsonParser) ReadJsonFile(ctx context.Context, filePath string, publishChannel chan domain.IndexedPort) error {
+	f, err := openInput(filePath)
 	if err != nil {
 		logrus.WithError(err).Error("error reading json file")
 		return err
 	}
-	defer func(f *os.File) {
+	defer func(f *inputFile) {
 		err := f.Close()
 		if err != nil {
 			logrus.WithError(err).Error("error closing reader to the file")
@@ -35,12 +76,21 @@ func (parser *StreamJsonParser) ReadJsonFile(ctx context.Context, filePath strin
 	return parser.readJsonFileFromReader(ctx, f, publishChannel)
 }
 
-func (parser *StreamJsonParser) readJsonFileFromReader(ctx context.Context, reader io.Reader, publishChannel chan domain.Port) error {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+func (parser *StreamJsonParser) readJsonFileFromReader(ctx context.Context, reader io.Reader, publishChannel chan domain.IndexedPort) error {
+	if parser.workers > 1 {
+		return parser.readParallel(ctx, reader, publishChannel)
+	}
+	return parser.decodeObject(ctx, reader, 0, publishChannel)
+}
 
-	decoder := jstream.NewDecoder(reader, 1).EmitKV() // extract JSON values at a depth level of 1
-	for mv := range decoder.Stream() {
+// decodeObject walks the top level object with the tokens of the decoder and decodes every value
+// straight into a port, so only one port at a time is kept in memory. The ports are indexed from first
+func (parser *StreamJsonParser) decodeObject(ctx context.Context, reader io.Reader, first int, publishChannel chan domain.IndexedPort) error {
+	decoder := json.NewDecoder(reader)
+	if err := expectDelim(decoder, '{'); err != nil {
+		return err
+	}
+	for index := first; decoder.More(); index++ {
 		//if we are cancelled or sm like that
 		select {
 		case <-ctx.Done():
@@ -48,17 +98,21 @@ func (parser *StreamJsonParser) readJsonFileFromReader(ctx context.Context, read
 		default:
 		}
 
-		keyValueData := mv.Value.(jstream.KV) // safe to do since we dit the EmitKV
-		port := domain.Port{}
-		mapData := keyValueData.Value.(map[string]interface{})
-		err := convertToPort(mapData, &port)
+		token, err := decoder.Token()
 		if err != nil {
 			return err
 		}
+		key := token.(string) // the decoder only returns strings for the keys of an object
+		// a new port every time, decoding into the previous one would reuse the slices already sent
+		data := filePort{}
+		if err = decoder.Decode(&data); err != nil {
+			return fmt.Errorf("port %s: %w", key, err)
+		}
+		port := data.toDomain()
 		// validate the extracted data and publish
 		if len(port.Name) > 0 {
-			port.Id = keyValueData.Key
-			publishChannel <- port
+			port.Id = key
+			publishChannel <- domain.IndexedPort{Port: port, Index: index}
 		} else {
 			return errors.New("couldn't parse data to the correct interface")
 		}
@@ -66,18 +120,17 @@ func (parser *StreamJsonParser) readJsonFileFromReader(ctx context.Context, read
 			time.Sleep(5 * time.Second)
 		}
 	}
-	return nil
+	return expectDelim(decoder, '}')
 }
 
-func convertToPort(data map[string]interface{}, target *domain.Port) error {
-	// Convert the map to JSON
-	jsonData, err := json.Marshal(data)
+// expectDelim reads the next token, that has to be the delimiter
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
 	if err != nil {
 		return err
 	}
-	// Unmarshal the JSON into the struct
-	if err := json.Unmarshal(jsonData, target); err != nil {
-		return err
+	if token != delim {
+		return fmt.Errorf("expected %v at offset %d, found %v", delim, decoder.InputOffset(), token)
 	}
 	return nil
 }
@@ -0,0 +1,198 @@
+package parser
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-related/fileservice/internal/core/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const (
+	// benchmarkFileEnv an existing file to parse in the benchmarks instead of the generated one, like the nightly file
+	benchmarkFileEnv = "PARSER_BENCH_FILE"
+	// benchmarkSizeEnv the size in bytes of the generated file
+	benchmarkSizeEnv = "PARSER_BENCH_SIZE"
+)
+
+// readAll parses the reader and collects the ports it publishes
+func readAll(ctx context.Context, parser *StreamJsonParser, data string) ([]domain.IndexedPort, error) {
+	channel := make(chan domain.IndexedPort)
+	result := make(chan []domain.IndexedPort)
+	go func() {
+		var ports []domain.IndexedPort
+		for port := range channel {
+			ports = append(ports, port)
+		}
+		result <- ports
+	}()
+	err := parser.readJsonFileFromReader(ctx, strings.NewReader(data), channel)
+	close(channel)
+	return <-result, err
+}
+
+func TestReadJsonFile(t *testing.T) {
+	channel := make(chan domain.IndexedPort, 100)
+	err := NewStreamJsonParser(false).ReadJsonFile(context.TODO(), "../../../config/ports.json", channel)
+	require.NoError(t, err)
+	close(channel)
+	var ports []domain.IndexedPort
+	for port := range channel {
+		ports = append(ports, port)
+	}
+	require.NotEmpty(t, ports)
+	assert.Equal(t, domain.Port{
+		Id:          "AEAJM",
+		Name:        "Ajman",
+		City:        "Ajman",
+		Country:     "United Arab Emirates",
+		Alias:       []string{},
+		Regions:     []string{},
+		Coordinates: []float64{55.5136433, 25.4052165},
+		Province:    "Ajman",
+		Timezone:    "Asia/Dubai",
+		UNLOCs:      []string{"AEAJM"},
+		Code:        "52000",
+	}, ports[0].Port)
+	// the file order is kept
+	assert.Equal(t, "AEAUH", ports[1].Port.Id)
+}
+
+func TestReadJsonFile_Errors(t *testing.T) {
+	tests := map[string]string{
+		"NotAnObject":    `[{"name": "Ajman"}]`,
+		"MissingName":    `{"AEAJM": {"city": "Ajman"}}`,
+		"WrongFieldType": `{"AEAJM": {"name": "Ajman", "coordinates": "55.51,25.40"}}`,
+		"Truncated":      `{"AEAJM": {"name": "Ajman"}, "AEAUH": {"name": "Abu`,
+	}
+	for name, data := range tests {
+		data := data
+		t.Run(name, func(t *testing.T) {
+			_, err := readAll(context.TODO(), NewStreamJsonParser(false), data)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestReadJsonFile_PortsDontShareSlices(t *testing.T) {
+	ports, err := readAll(context.TODO(), NewStreamJsonParser(false),
+		`{"AEAJM": {"name": "Ajman", "unlocs": ["AEAJM"]}, "AEAUH": {"name": "Abu Dhabi", "unlocs": ["AEAUH"]}}`)
+	require.NoError(t, err)
+	require.Len(t, ports, 2)
+	assert.Equal(t, []string{"AEAJM"}, ports[0].Port.UNLOCs)
+	assert.Equal(t, []string{"AEAUH"}, ports[1].Port.UNLOCs)
+}
+
+func TestReadJsonFile_IgnoresVersion(t *testing.T) {
+	// the version is set by the server, one in the file would make the upsert conditional
+	ports, err := readAll(context.TODO(), NewStreamJsonParser(false),
+		`{"AEAJM": {"name": "Ajman", "version": 7, "updatedAt": "2020-01-01T00:00:00Z"}}`)
+	require.NoError(t, err)
+	require.Len(t, ports, 1)
+	assert.Equal(t, domain.Port{Id: "AEAJM", Name: "Ajman"}, ports[0].Port)
+}
+
+func TestReadJsonFile_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	ports, err := readAll(ctx, NewStreamJsonParser(false), `{"AEAJM": {"name": "Ajman"}}`)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, ports)
+}
+
+// benchmarkPort the shape of the entries of ports.json
+type benchmarkPort struct {
+	Name        string    `json:"name"`
+	City        string    `json:"city"`
+	Country     string    `json:"country"`
+	Alias       []string  `json:"alias"`
+	Regions     []string  `json:"regions"`
+	Coordinates []float64 `json:"coordinates"`
+	Province    string    `json:"province"`
+	Timezone    string    `json:"timezone"`
+	UNLOCs      []string  `json:"unlocs"`
+	Code        string    `json:"code"`
+}
+
+// benchmarkFile the file of $PARSER_BENCH_FILE, otherwise a file of generated ports of $PARSER_BENCH_SIZE bytes, 1 GB by default
+func benchmarkFile(b *testing.B) string {
+	b.Helper()
+	if path := os.Getenv(benchmarkFileEnv); path != "" {
+		return path
+	}
+	size := int64(1 << 30)
+	if value := os.Getenv(benchmarkSizeEnv); value != "" {
+		var err error
+		size, err = strconv.ParseInt(value, 10, 64)
+		require.NoError(b, err)
+	}
+	path := filepath.Join(b.TempDir(), "ports.json")
+	f, err := os.Create(path)
+	require.NoError(b, err)
+	defer f.Close()
+	writer := bufio.NewWriter(f)
+	written := int64(0)
+	for i := 0; written < size; i++ {
+		id := fmt.Sprintf("P%08d", i)
+		data, err := json.MarshalIndent(benchmarkPort{
+			Name:        "Port " + id,
+			City:        "City " + strconv.Itoa(i%5000),
+			Country:     "Country " + strconv.Itoa(i%200),
+			Alias:       []string{},
+			Regions:     []string{},
+			Coordinates: []float64{float64(i%360) - 180.123456, float64(i%180) - 90.654321},
+			Province:    "Province " + strconv.Itoa(i%1000),
+			Timezone:    "Asia/Dubai",
+			UNLOCs:      []string{id},
+			Code:        strconv.Itoa(50000 + i%10000),
+		}, "  ", "  ")
+		require.NoError(b, err)
+		separator := ",\n"
+		if i == 0 {
+			separator = "{\n"
+		}
+		n, err := fmt.Fprintf(writer, "%s  %q: %s", separator, id, data)
+		require.NoError(b, err)
+		written += int64(n)
+	}
+	_, err = writer.WriteString("\n}\n")
+	require.NoError(b, err)
+	require.NoError(b, writer.Flush())
+	return path
+}
+
+func BenchmarkReadJsonFile(b *testing.B) {
+	benchmarkParser(b, NewStreamJsonParser(false))
+}
+
+// benchmarkParser parses the file of benchmarkFile b.N times
+func benchmarkParser(b *testing.B, parser *StreamJsonParser) {
+	path := benchmarkFile(b)
+	info, err := os.Stat(path)
+	require.NoError(b, err)
+	b.SetBytes(info.Size())
+	b.ReportAllocs()
+	b.ResetTimer()
+	count := 0
+	for i := 0; i < b.N; i++ {
+		channel := make(chan domain.IndexedPort, 1024)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for range channel {
+				count++
+			}
+		}()
+		require.NoError(b, parser.ReadJsonFile(context.TODO(), path, channel))
+		close(channel)
+		<-done
+	}
+	b.ReportMetric(float64(count)/b.Elapsed().Seconds(), "ports/s")
+}
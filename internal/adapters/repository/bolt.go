@@ -0,0 +1,837 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/go-related/fileservice/internal/core/domain"
+	"github.com/go-related/fileservice/internal/core/ports"
+	"github.com/hashicorp/go-memdb"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	boltMetaBucket  = "meta"
+	boltIndexPrefix = "index_"
+	// boltIndexesKey the indexes and their indexers the file was built with, when they don't match the schema they are rebuilt
+	boltIndexesKey = "indexes"
+	// boltSequenceKey the sequence of the last change in the file, written with the commit of the change
+	boltSequenceKey = "sequence"
+	// boltInitialMmapSize with a big enough mapping the writers almost never need to remap the file,
+	// remapping has to wait for all the open read transactions
+	boltInitialMmapSize = 1 << 30
+	// boltOpenTimeout how long we wait for the file lock, another process might have the file open
+	boltOpenTimeout = time.Second
+)
+
+// PortBoltRepository keeps the ports in a bbolt file so they survive restarts. It has the same indexes as the memdb
+// adapter: every secondary index is a bucket whose keys are the index value followed by the port id.
+// The changes of the feed stay in memory but the last sequence is kept in the file, so after a restart the numbering
+// goes on and the watchers resuming from before get a gap instead of missing the new changes
+type PortBoltRepository struct {
+	db      *bolt.DB
+	indexes map[string]*memdb.IndexSchema
+	feed    *changeFeed
+	// commitMx keeps the changes in the feed in the same order of the commits
+	commitMx sync.Mutex
+	// snapshots keeps what the commits replace for the listings still paging through the file
+	snapshots boltSnapshots
+}
+
+// GetById the committed port, nil when it doesn't exist
+func (rp *PortBoltRepository) GetById(ctx context.Context, Id string) (*domain.Port, error) {
+	var port *domain.Port
+	err := rp.view(func(trn *boltTxn) error {
+		var err error
+		port, err = getPort(ctx, trn, Id)
+		return err
+	})
+	return port, err
+}
+
+// ListPorts walks the committed ports sorted by id, starting after afterId, and calls fn for each port matching the filter.
+// The ports are read a page at a time, so a slow caller doesn't keep a read transaction open, and the whole list
+// is the last commit before the call
+func (rp *PortBoltRepository) ListPorts(ctx context.Context, filter domain.PortFilter, afterId string, limit int, fn func(port domain.Port) error) error {
+	return rp.pages(func(reads *boltPagedReads) error {
+		return listPorts(ctx, reads, filter, afterId, limit, fn)
+	})
+}
+
+// FindByUnloc the committed ports listing the UN/LOCODE, through the unlocs index
+func (rp *PortBoltRepository) FindByUnloc(ctx context.Context, unloc string) ([]domain.Port, error) {
+	var found []domain.Port
+	err := rp.view(func(trn *boltTxn) error {
+		var err error
+		found, err = findPorts(ctx, trn, domain.PortFilter{Unloc: unloc})
+		return err
+	})
+	return found, err
+}
+
+// FindByCode the committed ports with the code, through the code index
+func (rp *PortBoltRepository) FindByCode(ctx context.Context, code string) ([]domain.Port, error) {
+	var found []domain.Port
+	err := rp.view(func(trn *boltTxn) error {
+		var err error
+		found, err = findPorts(ctx, trn, domain.PortFilter{Code: code})
+		return err
+	})
+	return found, err
+}
+
+// SearchPorts matches the query against name, alias and city of the committed ports and returns the best results first
+func (rp *PortBoltRepository) SearchPorts(ctx context.Context, query string, maxEdits int, limit int) ([]domain.SearchResult, error) {
+	var results []domain.SearchResult
+	err := rp.view(func(trn *boltTxn) error {
+		var err error
+		results, err = searchPorts(ctx, trn, query, maxEdits, limit)
+		return err
+	})
+	return results, err
+}
+
+// NearestPorts the k committed ports closest to the point
+func (rp *PortBoltRepository) NearestPorts(ctx context.Context, center domain.GeoPoint, k int) ([]domain.PortDistance, error) {
+	var results []domain.PortDistance
+	err := rp.view(func(trn *boltTxn) error {
+		var err error
+		results, err = nearestPorts(ctx, trn, center, k)
+		return err
+	})
+	return results, err
+}
+
+// PortsWithinRadius the committed ports within radiusKm from the point sorted by distance, limit <= 0 means no limit
+func (rp *PortBoltRepository) PortsWithinRadius(ctx context.Context, center domain.GeoPoint, radiusKm float64, limit int) ([]domain.PortDistance, error) {
+	var results []domain.PortDistance
+	err := rp.view(func(trn *boltTxn) error {
+		var err error
+		results, err = portsWithinRadius(ctx, trn, center, radiusKm, limit)
+		return err
+	})
+	if err != nil {
+		logrus.WithError(err).Error("error loading ports within radius from db")
+		return nil, err
+	}
+	return results, nil
+}
+
+// PortsInBoundingBox calls fn for every committed port inside the box matching the filter, limit <= 0 means no limit
+func (rp *PortBoltRepository) PortsInBoundingBox(ctx context.Context, box domain.BoundingBox, filter domain.PortFilter, limit int, fn func(port domain.Port) error) error {
+	return rp.pages(func(reads *boltPagedReads) error {
+		return portsInArea(ctx, reads, boxesForBoundingBox(box), func(domain.GeoPoint) bool { return true }, filter, limit, fn)
+	})
+}
+
+// PortsInPolygon calls fn for every committed port inside the polygon matching the filter, limit <= 0 means no limit
+func (rp *PortBoltRepository) PortsInPolygon(ctx context.Context, polygon domain.Polygon, filter domain.PortFilter, limit int, fn func(port domain.Port) error) error {
+	return rp.pages(func(reads *boltPagedReads) error {
+		return portsInArea(ctx, reads, boxesForBoundingBox(polygon.BoundingBox()), polygon.Contains, filter, limit, fn)
+	})
+}
+
+// WatchChanges calls fn for every committed change after the sequence, then keeps waiting for new ones till ctx is done
+func (rp *PortBoltRepository) WatchChanges(ctx context.Context, afterSequence uint64, fn func(change domain.PortChange) error) error {
+	return rp.feed.watch(ctx, afterSequence, fn)
+}
+
+// LastChangeSequence the sequence of the last committed change, it survives the restarts
+func (rp *PortBoltRepository) LastChangeSequence() uint64 {
+	return rp.feed.lastSequence()
+}
+
+// StartTransaction bolt has a single writer, so the transaction keeps its writes aside and they are
+// applied in one bolt transaction on commit. The streams don't wait for each other till then
+func (rp *PortBoltRepository) StartTransaction(ctx context.Context) (ports.Transaction, error) {
+	// check if we have any cancellation before continuing
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	view := func(fn func(trn portIndexes) error) error {
+		return rp.view(func(trn *boltTxn) error {
+			return fn(trn)
+		})
+	}
+	return newPendingTransaction(view, rp.commit), nil
+}
+
+// commit writes the transaction if none of its ports changed since it read them. The changes are on disk
+// once bolt returns from the update, only then the watchers hear about them. Like the memdb commit the
+// ports are stamped with the time of the commit taken under commitMx
+func (rp *PortBoltRepository) commit(ctx context.Context, pending *pendingTransaction) error {
+	rp.commitMx.Lock()
+	defer rp.commitMx.Unlock()
+	now := time.Now()
+	var changes []domain.PortChange
+	defer rp.snapshots.writeDone()
+	err := rp.db.Update(func(tx *bolt.Tx) error {
+		trn := newBoltTxn(tx, rp.indexes)
+		if err := pending.checkConflicts(ctx, trn); err != nil {
+			return err
+		}
+		for _, id := range pending.order {
+			current, err := getPort(ctx, trn, id)
+			if err != nil {
+				return err
+			}
+			if port := pending.writes[id]; port != nil {
+				var last uint64
+				if current == nil {
+					revisions, err := trn.revisions(ctx, id)
+					if err != nil {
+						return err
+					}
+					last = lastVersion(revisions)
+				}
+				err = trn.insert(nextVersion(*port, current, last, now), current)
+			} else if current != nil {
+				err = trn.delete(*current)
+			}
+			if err != nil {
+				logrus.WithField("id", id).WithError(err).Error("error writing port into bucket")
+				return err
+			}
+		}
+		if err := trn.flush(); err != nil {
+			logrus.WithError(err).Error("error writing ports into bucket")
+			return err
+		}
+		if err := trn.insertRevisions(convertRevisions(trn.changes, pending.id, now)); err != nil {
+			return err
+		}
+		// the paged listings get the ports as they were before bolt makes the commit visible
+		rp.snapshots.writeStarted(tx.ID(), trn.changes)
+		changes = convertChanges(trn.changes, now)
+		if len(changes) == 0 {
+			return nil
+		}
+		// commitMx keeps anybody else from publishing, the feed numbers the changes from here
+		return putSequence(tx, rp.feed.lastSequence()+uint64(len(changes)))
+	})
+	if err != nil {
+		logrus.WithError(err).Error("error committing bolt transaction")
+		return err
+	}
+	rp.feed.publish(changes)
+	return nil
+}
+
+// GetPortHistory the revisions of the port from the history bucket, the oldest first
+func (rp *PortBoltRepository) GetPortHistory(ctx context.Context, id string) ([]domain.PortRevision, error) {
+	var revisions []domain.PortRevision
+	err := rp.view(func(trn *boltTxn) error {
+		var err error
+		revisions, err = trn.revisions(ctx, id)
+		return err
+	})
+	return revisions, err
+}
+
+// GetByIdAsOf reads the port and its history in the same read transaction
+func (rp *PortBoltRepository) GetByIdAsOf(ctx context.Context, id string, at time.Time) (*domain.Port, error) {
+	var port *domain.Port
+	err := rp.view(func(trn *boltTxn) error {
+		current, err := getPort(ctx, trn, id)
+		if err != nil {
+			return err
+		}
+		revisions, err := trn.revisions(ctx, id)
+		if err != nil {
+			return err
+		}
+		port = domain.PortAsOf(current, revisions, at)
+		return nil
+	})
+	return port, err
+}
+
+// CompactHistory walks the history bucket port by port and removes the expired revisions in one update
+func (rp *PortBoltRepository) CompactHistory(ctx context.Context, retention domain.HistoryRetention) (int, error) {
+	rp.commitMx.Lock()
+	defer rp.commitMx.Unlock()
+	removed := 0
+	now := time.Now()
+	err := rp.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(historyTable))
+		// bolt cursors can't be used while the bucket changes, the expired keys are collected first
+		var expired, keys [][]byte
+		var revisions []domain.PortRevision
+		cursor := bucket.Cursor()
+		for key, value := cursor.First(); ; key, value = cursor.Next() {
+			if key == nil || (len(revisions) > 0 && !bytes.HasPrefix(key, revisionPrefix(revisions[0].Port.Id))) {
+				expired = append(expired, keys[:retention.Expired(revisions, now)]...)
+				keys, revisions = keys[:0], revisions[:0]
+			}
+			if key == nil {
+				break
+			}
+			// check if we have any cancellation before continuing
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			var revision domain.PortRevision
+			if err := json.Unmarshal(value, &revision); err != nil {
+				return err
+			}
+			keys = append(keys, append([]byte(nil), key...))
+			revisions = append(revisions, revision)
+		}
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		removed = len(expired)
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).Error("error removing port history")
+		return 0, err
+	}
+	return removed, nil
+}
+
+// Close closes the file, it waits for the running reads to finish
+func (rp *PortBoltRepository) Close() error {
+	return rp.db.Close()
+}
+
+// view runs fn inside a read only transaction
+func (rp *PortBoltRepository) view(fn func(trn *boltTxn) error) error {
+	return rp.db.View(func(tx *bolt.Tx) error {
+		return fn(newBoltTxn(tx, rp.indexes))
+	})
+}
+
+// pages runs fn with the lookups reading a page at a time, all of them see the last commit before the call
+func (rp *PortBoltRepository) pages(fn func(reads *boltPagedReads) error) error {
+	snapshot, err := rp.snapshots.start(rp.db)
+	if err != nil {
+		return err
+	}
+	defer rp.snapshots.stop(snapshot)
+	return fn(&boltPagedReads{repo: rp, snapshot: snapshot})
+}
+
+// NewPortBoltRepository opens or creates the bolt file at path, the indexes are rebuilt if the file has different ones
+func NewPortBoltRepository(path string) (*PortBoltRepository, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltOpenTimeout, InitialMmapSize: boltInitialMmapSize})
+	if err != nil {
+		logrus.WithError(err).WithField("path", path).Error("error opening bolt file")
+		return nil, err
+	}
+	repo := PortBoltRepository{
+		db:      db,
+		indexes: secondaryIndexes(),
+		feed:    newChangeFeed(defaultChangeFeedCapacity),
+	}
+	if err = db.Update(repo.prepareBuckets); err != nil {
+		logrus.WithError(err).WithField("path", path).Error("error preparing bolt buckets")
+		_ = db.Close()
+		return nil, err
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		sequence, err := getSequence(tx)
+		repo.feed.skipTo(sequence)
+		return err
+	})
+	if err != nil {
+		logrus.WithError(err).WithField("path", path).Error("error reading the change sequence")
+		_ = db.Close()
+		return nil, err
+	}
+	return &repo, nil
+}
+
+// getSequence the sequence of the last change written in the file, 0 for a new file
+func getSequence(tx *bolt.Tx) (uint64, error) {
+	value := tx.Bucket([]byte(boltMetaBucket)).Get([]byte(boltSequenceKey))
+	if value == nil {
+		return 0, nil
+	}
+	if len(value) != 8 {
+		return 0, fmt.Errorf("malformed change sequence of %d bytes", len(value))
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
+
+func putSequence(tx *bolt.Tx, sequence uint64) error {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, sequence)
+	return tx.Bucket([]byte(boltMetaBucket)).Put([]byte(boltSequenceKey), value)
+}
+
+// prepareBuckets creates the missing buckets and rebuilds all the indexes when the file was built with different ones
+func (rp *PortBoltRepository) prepareBuckets(tx *bolt.Tx) error {
+	ports, err := tx.CreateBucketIfNotExists([]byte(tableName))
+	if err != nil {
+		return err
+	}
+	meta, err := tx.CreateBucketIfNotExists([]byte(boltMetaBucket))
+	if err != nil {
+		return err
+	}
+	if _, err = tx.CreateBucketIfNotExists([]byte(historyTable)); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(rp.indexes))
+	built := make([]string, 0, len(rp.indexes))
+	for name := range rp.indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// the indexer tells how the keys are made, a file with the keys of another one is rebuilt too
+		built = append(built, fmt.Sprintf("%s:%T", name, rp.indexes[name].Indexer))
+	}
+	indexes := strings.Join(built, ",")
+	if string(meta.Get([]byte(boltIndexesKey))) == indexes {
+		return nil
+	}
+
+	logrus.WithField("indexes", indexes).Info("rebuilding the bolt indexes")
+	var stale [][]byte
+	err = tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if bytes.HasPrefix(name, []byte(boltIndexPrefix)) {
+			stale = append(stale, append([]byte(nil), name...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range stale {
+		if err = tx.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		if _, err = tx.CreateBucket(indexBucket(name)); err != nil {
+			return err
+		}
+	}
+	trn := newBoltTxn(tx, rp.indexes)
+	err = ports.ForEach(func(_, value []byte) error {
+		port, err := decodePort(value)
+		if err != nil {
+			return err
+		}
+		return trn.updateIndexes(port, func(bucket *bolt.Bucket, key []byte) error {
+			trn.put(bucket, key, []byte(port.Id))
+			return nil
+		})
+	})
+	if err == nil {
+		err = trn.flush()
+	}
+	if err != nil {
+		return err
+	}
+	return meta.Put([]byte(boltIndexesKey), []byte(indexes))
+}
+
+// secondaryIndexes the indexes of the memdb schema apart from the id, which is the key of the ports bucket
+func secondaryIndexes() map[string]*memdb.IndexSchema {
+	indexes := make(map[string]*memdb.IndexSchema)
+	for name, index := range creatDbSchema().Tables[tableName].Indexes {
+		if name != "id" {
+			indexes[name] = index
+		}
+	}
+	return indexes
+}
+
+func stringArg(args ...interface{}) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("must provide only a single argument")
+	}
+	arg, ok := args[0].(string)
+	if !ok {
+		return "", fmt.Errorf("argument must be a string: %#v", args[0])
+	}
+	return arg, nil
+}
+
+func indexBucket(name string) []byte {
+	return []byte(boltIndexPrefix + name)
+}
+
+func decodePort(data []byte) (domain.Port, error) {
+	var port domain.Port
+	err := json.Unmarshal(data, &port)
+	return port, err
+}
+
+// boltTxn a bolt transaction with the same lookups of a memdb transaction. The writes keep the index buckets
+// up to date and collect the changes for the feed the same way memdb does with TrackChanges
+type boltTxn struct {
+	tx      *bolt.Tx
+	indexes map[string]*memdb.IndexSchema
+	changes memdb.Changes
+	// changed the position in changes of every changed id, so many writes of the same port become a single change
+	changed map[string]int
+	// puts the writes waiting for flush by bucket, a port is written at most once by a commit so nothing
+	// reads them before
+	puts map[*bolt.Bucket][]boltPut
+}
+
+type boltPut struct {
+	key, value []byte
+}
+
+func newBoltTxn(tx *bolt.Tx, indexes map[string]*memdb.IndexSchema) *boltTxn {
+	return &boltTxn{tx: tx, indexes: indexes, changed: make(map[string]int), puts: make(map[*bolt.Bucket][]boltPut)}
+}
+
+func (t *boltTxn) First(table, index string, args ...interface{}) (interface{}, error) {
+	iterator, err := t.Get(table, index, args...)
+	if err != nil {
+		return nil, err
+	}
+	return iterator.Next(), nil
+}
+
+// Get supports the exact and the "_prefix" lookups of memdb, without arguments the id index returns all the ports
+func (t *boltTxn) Get(table, index string, args ...interface{}) (memdb.ResultIterator, error) {
+	scan, err := getScan(t.indexes, table, index, args...)
+	if err != nil {
+		return nil, err
+	}
+	return t.iterator(scan), nil
+}
+
+// LowerBound all the entries of the index starting from the value
+func (t *boltTxn) LowerBound(table, index string, args ...interface{}) (memdb.ResultIterator, error) {
+	scan, err := lowerBoundScan(t.indexes, table, index, args...)
+	if err != nil {
+		return nil, err
+	}
+	return t.iterator(scan), nil
+}
+
+// iterator walks the keys of the scan. The index buckets have the id as value so the port is loaded from the ports bucket
+func (t *boltTxn) iterator(scan boltScan) *boltIterator {
+	iterator := &boltIterator{
+		cursor:   t.tx.Bucket(scan.bucket).Cursor(),
+		ports:    t.tx.Bucket([]byte(tableName)),
+		prefix:   scan.prefix,
+		indirect: scan.index != nil,
+		match:    scan.match,
+	}
+	iterator.key, iterator.value = scan.first(iterator.cursor)
+	return iterator
+}
+
+// boltScan the keys of a lookup: the keys of bucket from start on, with the prefix and narrowed down by match.
+// index is the schema of the index bucket, nil for the ports bucket
+type boltScan struct {
+	bucket []byte
+	index  *memdb.IndexSchema
+	prefix []byte
+	start  []byte
+	match  func(key []byte) bool
+}
+
+// getScan the keys of the exact and "_prefix" lookups
+func getScan(indexes map[string]*memdb.IndexSchema, table, index string, args ...interface{}) (boltScan, error) {
+	if table != tableName {
+		return boltScan{}, fmt.Errorf("invalid table '%s'", table)
+	}
+	name, prefix := strings.CutSuffix(index, "_prefix")
+	if name == "id" {
+		if len(args) == 0 {
+			return boltScan{bucket: []byte(tableName)}, nil
+		}
+		id, err := stringArg(args...)
+		if err != nil {
+			return boltScan{}, err
+		}
+		if prefix {
+			return boltScan{bucket: []byte(tableName), prefix: []byte(id)}, nil
+		}
+		key := []byte(id)
+		return boltScan{bucket: []byte(tableName), prefix: key, match: func(k []byte) bool { return bytes.Equal(k, key) }}, nil
+	}
+	schema, ok := indexes[name]
+	if !ok {
+		return boltScan{}, fmt.Errorf("invalid index '%s'", index)
+	}
+	var value []byte
+	var err error
+	if prefix {
+		indexer, ok := schema.Indexer.(memdb.PrefixIndexer)
+		if !ok {
+			return boltScan{}, fmt.Errorf("index '%s' does not support prefix lookups", name)
+		}
+		value, err = indexer.PrefixFromArgs(args...)
+	} else {
+		value, err = schema.Indexer.FromArgs(args...)
+	}
+	if err != nil {
+		return boltScan{}, err
+	}
+	return boltScan{bucket: indexBucket(name), index: schema, prefix: value}, nil
+}
+
+// lowerBoundScan the keys of the LowerBound lookups, like memdb they go on till the end of the bucket
+func lowerBoundScan(indexes map[string]*memdb.IndexSchema, table, index string, args ...interface{}) (boltScan, error) {
+	if table != tableName {
+		return boltScan{}, fmt.Errorf("invalid table '%s'", table)
+	}
+	if index == "id" {
+		id, err := stringArg(args...)
+		if err != nil {
+			return boltScan{}, err
+		}
+		return boltScan{bucket: []byte(tableName), start: []byte(id)}, nil
+	}
+	name, prefix := strings.CutSuffix(index, "_prefix")
+	schema, ok := indexes[name]
+	if !ok {
+		return boltScan{}, fmt.Errorf("invalid index '%s'", index)
+	}
+	var value []byte
+	var err error
+	if prefix {
+		indexer, ok := schema.Indexer.(memdb.PrefixIndexer)
+		if !ok {
+			return boltScan{}, fmt.Errorf("index '%s' does not support prefix lookups", name)
+		}
+		value, err = indexer.PrefixFromArgs(args...)
+	} else {
+		value, err = schema.Indexer.FromArgs(args...)
+	}
+	if err != nil {
+		return boltScan{}, err
+	}
+	return boltScan{bucket: indexBucket(name), index: schema, start: value}, nil
+}
+
+// first positions the cursor on the first key of the scan
+func (s boltScan) first(cursor *bolt.Cursor) ([]byte, []byte) {
+	switch {
+	case s.start != nil:
+		return cursor.Seek(s.start)
+	case len(s.prefix) > 0:
+		return cursor.Seek(s.prefix)
+	default:
+		return cursor.First()
+	}
+}
+
+// contains whether the key is one of the scan, keys before start included
+func (s boltScan) contains(key []byte) bool {
+	return bytes.HasPrefix(key, s.prefix) && (s.match == nil || s.match(key))
+}
+
+// keys the keys the port has in the bucket of the scan
+func (s boltScan) keys(port domain.Port) ([][]byte, error) {
+	if s.index == nil {
+		return [][]byte{[]byte(port.Id)}, nil
+	}
+	return indexKeys(s.index, port)
+}
+
+// insert stores the port in place of current, that is nil for new ports
+func (t *boltTxn) insert(port domain.Port, current *domain.Port) error {
+	data, err := json.Marshal(port)
+	if err != nil {
+		return err
+	}
+	var before interface{}
+	if current != nil {
+		before = *current
+		if err = t.updateIndexes(*current, (*bolt.Bucket).Delete); err != nil {
+			return err
+		}
+	}
+	t.put(t.tx.Bucket([]byte(tableName)), []byte(port.Id), data)
+	err = t.updateIndexes(port, func(bucket *bolt.Bucket, key []byte) error {
+		t.put(bucket, key, []byte(port.Id))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	t.trackChange(port.Id, before, port)
+	return nil
+}
+
+// put buffers the write till flush
+func (t *boltTxn) put(bucket *bolt.Bucket, key, value []byte) {
+	t.puts[bucket] = append(t.puts[bucket], boltPut{key: key, value: value})
+}
+
+// flush writes the buffered puts sorted by key. The nodes of a bolt write transaction keep their keys in a slice
+// till the commit and every key put in the middle moves the rest of it, big unsorted writes get quadratic
+func (t *boltTxn) flush() error {
+	for bucket, puts := range t.puts {
+		sort.Slice(puts, func(i, j int) bool { return bytes.Compare(puts[i].key, puts[j].key) < 0 })
+		for _, put := range puts {
+			if err := bucket.Put(put.key, put.value); err != nil {
+				return err
+			}
+		}
+		delete(t.puts, bucket)
+	}
+	return nil
+}
+
+func (t *boltTxn) delete(port domain.Port) error {
+	if err := t.updateIndexes(port, (*bolt.Bucket).Delete); err != nil {
+		return err
+	}
+	if err := t.tx.Bucket([]byte(tableName)).Delete([]byte(port.Id)); err != nil {
+		return err
+	}
+	t.trackChange(port.Id, port, nil)
+	return nil
+}
+
+// insertRevisions adds the replaced ports to the history bucket
+func (t *boltTxn) insertRevisions(revisions []domain.PortRevision) error {
+	bucket := t.tx.Bucket([]byte(historyTable))
+	for _, revision := range revisions {
+		data, err := json.Marshal(revision)
+		if err != nil {
+			return err
+		}
+		if err = bucket.Put(revisionKey(revision), data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revisions the history of the port, the keys of its revisions share the prefix and sort from the oldest
+func (t *boltTxn) revisions(ctx context.Context, id string) ([]domain.PortRevision, error) {
+	var revisions []domain.PortRevision
+	prefix := revisionPrefix(id)
+	cursor := t.tx.Bucket([]byte(historyTable)).Cursor()
+	for key, value := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+		// check if we have any cancellation before continuing
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		var revision domain.PortRevision
+		if err := json.Unmarshal(value, &revision); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision)
+	}
+	return revisions, nil
+}
+
+// updateIndexes calls update with the key of every index entry of the port
+func (t *boltTxn) updateIndexes(port domain.Port, update func(bucket *bolt.Bucket, key []byte) error) error {
+	for name, schema := range t.indexes {
+		keys, err := indexKeys(schema, port)
+		if err != nil {
+			return err
+		}
+		bucket := t.tx.Bucket(indexBucket(name))
+		for _, key := range keys {
+			if err = update(bucket, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexKeys the keys of the port in the bucket of the index. Like memdb the values of a non-unique index are
+// followed by the id, the unique ones have it already
+func indexKeys(schema *memdb.IndexSchema, port domain.Port) ([][]byte, error) {
+	values, err := indexValues(schema, port)
+	if err != nil || schema.Unique {
+		return values, err
+	}
+	for i := range values {
+		values[i] = append(values[i], port.Id...)
+	}
+	return values, nil
+}
+
+// trackChange keeps the state before the first write and after the last one, like the memdb changes
+func (t *boltTxn) trackChange(id string, before, after interface{}) {
+	if i, ok := t.changed[id]; ok {
+		t.changes[i].After = after
+		return
+	}
+	t.changed[id] = len(t.changes)
+	t.changes = append(t.changes, memdb.Change{Table: tableName, Before: before, After: after})
+}
+
+// indexValues the values the memdb indexer produces for the port, ports missing the field have none
+func indexValues(schema *memdb.IndexSchema, port domain.Port) ([][]byte, error) {
+	switch indexer := schema.Indexer.(type) {
+	case memdb.SingleIndexer:
+		ok, value, err := indexer.FromObject(port)
+		if err != nil || !ok {
+			return nil, err
+		}
+		return [][]byte{value}, nil
+	case memdb.MultiIndexer:
+		ok, values, err := indexer.FromObject(port)
+		if err != nil || !ok {
+			return nil, err
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unsupported indexer %T for index '%s'", schema.Indexer, schema.Name)
+	}
+}
+
+// boltIterator implements memdb.ResultIterator over a bolt cursor
+type boltIterator struct {
+	cursor     *bolt.Cursor
+	ports      *bolt.Bucket
+	key, value []byte
+	prefix     []byte
+	indirect   bool
+	match      func(key []byte) bool
+	err        error
+}
+
+// WatchCh bolt has no watches, the change feed is the way to follow the changes
+func (it *boltIterator) WatchCh() <-chan struct{} {
+	return nil
+}
+
+func (it *boltIterator) Next() interface{} {
+	if it.err != nil || it.key == nil || !bytes.HasPrefix(it.key, it.prefix) || (it.match != nil && !it.match(it.key)) {
+		return nil
+	}
+	data := it.value
+	if it.indirect {
+		data = it.ports.Get(it.value)
+	}
+	key := it.key
+	it.key, it.value = it.cursor.Next()
+	port, err := decodePort(data)
+	if err != nil {
+		logrus.WithError(err).WithField("key", string(key)).Error("error decoding port from bolt")
+		it.err = err
+		return nil
+	}
+	return port
+}
+
+// Err the decoding error that stopped the iteration
+func (it *boltIterator) Err() error {
+	return it.err
+}
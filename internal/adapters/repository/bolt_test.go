@@ -0,0 +1,142 @@
+package repository
+
+import (
+	"context"
+	"github.com/go-related/fileservice/internal/core/domain"
+	cerror "github.com/go-related/fileservice/internal/core/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+	"path/filepath"
+	"testing"
+)
+
+func TestBoltRepository_SurvivesRestart(t *testing.T) {
+	ctx := context.TODO()
+	path := filepath.Join(t.TempDir(), "ports.db")
+	repo, err := NewPortBoltRepository(path)
+	require.NoError(t, err)
+	trn := startTransaction(t, repo)
+	_, err = trn.AddOrUpdatePort(ctx, domain.Port{Id: "AEAUH", Name: "Abu Dhabi", Country: "United Arab Emirates"})
+	require.NoError(t, err)
+	require.NoError(t, trn.Commit(ctx))
+	// the open transaction is lost on close
+	trn = startTransaction(t, repo)
+	_, err = trn.AddOrUpdatePort(ctx, domain.Port{Id: "AEAJM", Name: "Ajman", Country: "United Arab Emirates"})
+	require.NoError(t, err)
+	require.NoError(t, repo.Close())
+
+	repo, err = NewPortBoltRepository(path)
+	require.NoError(t, err)
+	defer repo.Close()
+	assert.Equal(t, []string{"AEAUH"}, listIds(t, repo, domain.PortFilter{Country: "united arab emirates"}, "", 0))
+}
+
+func TestBoltRepository_RebuildsIndexes(t *testing.T) {
+	ctx := context.TODO()
+	path := filepath.Join(t.TempDir(), "ports.db")
+	repo, err := NewPortBoltRepository(path)
+	require.NoError(t, err)
+	trn := startTransaction(t, repo)
+	_, err = trn.AddOrUpdatePort(ctx, domain.Port{Id: "AEAUH", Name: "Abu Dhabi", City: "Abu Dhabi"})
+	require.NoError(t, err)
+	require.NoError(t, trn.Commit(ctx))
+	// a file written with other indexes, the city index is gone
+	err = repo.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(indexBucket("city")); err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(boltMetaBucket)).Put([]byte(boltIndexesKey), []byte("country"))
+	})
+	require.NoError(t, err)
+	require.NoError(t, repo.Close())
+
+	repo, err = NewPortBoltRepository(path)
+	require.NoError(t, err)
+	defer repo.Close()
+	assert.Equal(t, []string{"AEAUH"}, listIds(t, repo, domain.PortFilter{City: "abu dhabi"}, "", 0))
+}
+
+func TestBoltRepository_ReadsDuringCommit(t *testing.T) {
+	ctx := context.TODO()
+	repo, err := NewPortBoltRepository(filepath.Join(t.TempDir(), "ports.db"))
+	require.NoError(t, err)
+	defer repo.Close()
+	trn := startTransaction(t, repo)
+	_, err = trn.AddOrUpdatePort(ctx, domain.Port{Id: "AEAUH", Name: "Abu Dhabi"})
+	require.NoError(t, err)
+	require.NoError(t, trn.Commit(ctx))
+
+	// a commit in the middle of writing a big import holds both
+	repo.commitMx.Lock()
+	defer repo.commitMx.Unlock()
+	writing, err := repo.db.Begin(true)
+	require.NoError(t, err)
+	defer func() { _ = writing.Rollback() }()
+	require.NoError(t, writing.Bucket([]byte(tableName)).Put([]byte("AEDXB"), []byte(`{"Id":"AEDXB","Name":"Dubai"}`)))
+
+	readWithoutWaiting(t, func() {
+		ids, err := collectIds(repo, domain.PortFilter{}, "", 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"AEAUH"}, ids)
+		port, err := repo.GetById(ctx, "AEDXB")
+		assert.NoError(t, err)
+		assert.Nil(t, port)
+	})
+}
+
+func TestBoltRepository_KeepsTheSequence(t *testing.T) {
+	ctx := context.TODO()
+	path := filepath.Join(t.TempDir(), "ports.db")
+	repo, err := NewPortBoltRepository(path)
+	require.NoError(t, err)
+	trn := startTransaction(t, repo)
+	_, err = trn.AddOrUpdatePorts(ctx, []domain.Port{{Id: "AEAUH", Name: "Abu Dhabi"}, {Id: "AEAJM", Name: "Ajman"}})
+	require.NoError(t, err)
+	require.NoError(t, trn.Commit(ctx))
+	require.Equal(t, uint64(2), repo.LastChangeSequence())
+	require.NoError(t, repo.Close())
+
+	repo, err = NewPortBoltRepository(path)
+	require.NoError(t, err)
+	defer repo.Close()
+	assert.Equal(t, uint64(2), repo.LastChangeSequence())
+	// the changes before the restart are gone
+	err = repo.WatchChanges(ctx, 1, func(change domain.PortChange) error { return nil })
+	assert.ErrorIs(t, err, cerror.ChangeFeedGap)
+	trn = startTransaction(t, repo)
+	_, err = trn.AddOrUpdatePort(ctx, domain.Port{Id: "AEDXB", Name: "Dubai"})
+	require.NoError(t, err)
+	require.NoError(t, trn.Commit(ctx))
+	watchCtx, cancel := context.WithCancel(ctx)
+	var changes []domain.PortChange
+	err = repo.WatchChanges(watchCtx, 2, func(change domain.PortChange) error {
+		changes = append(changes, change)
+		cancel()
+		return nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	require.Len(t, changes, 1)
+	assert.Equal(t, uint64(3), changes[0].Sequence)
+	assert.Equal(t, "AEDXB", changes[0].Port.Id)
+}
+
+func TestBoltRepository_SlowListKeepsNoReadTransaction(t *testing.T) {
+	ctx := context.TODO()
+	repo, err := NewPortBoltRepository(filepath.Join(t.TempDir(), "ports.db"))
+	require.NoError(t, err)
+	defer repo.Close()
+	trn := startTransaction(t, repo)
+	_, err = trn.AddOrUpdatePorts(ctx, []domain.Port{{Id: "AEAUH", Name: "Abu Dhabi"}, {Id: "AEAJM", Name: "Ajman"}})
+	require.NoError(t, err)
+	require.NoError(t, trn.Commit(ctx))
+
+	var open []int
+	err = repo.ListPorts(ctx, domain.PortFilter{}, "", 0, func(port domain.Port) error {
+		// a client reading slowly, bolt could remap the file now
+		open = append(open, repo.db.Stats().OpenTxN)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 0}, open)
+}
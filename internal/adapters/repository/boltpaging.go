@@ -0,0 +1,257 @@
+package repository
+
+import (
+	"bytes"
+	"github.com/go-related/fileservice/internal/core/domain"
+	"github.com/hashicorp/go-memdb"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"sort"
+	"sync"
+)
+
+// boltPageSize how many keys a paged iterator reads with every read transaction
+const boltPageSize = 500
+
+// boltSnapshot the ports as they were when a paged read started. Bolt keeps a single version of the file, so every
+// commit landing meanwhile adds the ports it replaces the first time they change, with the id of its bolt
+// transaction. The pages read in a later transaction use them in place of what they find for the commits they see
+type boltSnapshot struct {
+	// txId the last commit the read started from
+	txId   int
+	mx     sync.Mutex
+	before map[string]boltBefore
+}
+
+// boltBefore a port as it was when the read started, replaced by the commit of txId. port is nil when it didn't exist
+type boltBefore struct {
+	txId int
+	port *domain.Port
+}
+
+// add keeps the ports before the changes of the commit of txId, if they didn't change since the read started
+func (sn *boltSnapshot) add(txId int, changes memdb.Changes) {
+	sn.mx.Lock()
+	defer sn.mx.Unlock()
+	for _, change := range changes {
+		if change.Table != tableName {
+			continue
+		}
+		var port *domain.Port
+		var id string
+		if change.Before != nil {
+			before := change.Before.(domain.Port)
+			port, id = &before, before.Id
+		} else if change.After != nil {
+			id = change.After.(domain.Port).Id
+		} else {
+			continue
+		}
+		if _, ok := sn.before[id]; !ok {
+			sn.before[id] = boltBefore{txId: txId, port: port}
+		}
+	}
+}
+
+// seenBy the ports replaced by the commits a read transaction with the id sees
+func (sn *boltSnapshot) seenBy(txId int) map[string]*domain.Port {
+	sn.mx.Lock()
+	defer sn.mx.Unlock()
+	seen := make(map[string]*domain.Port)
+	for id, before := range sn.before {
+		if before.txId <= txId {
+			seen[id] = before.port
+		}
+	}
+	return seen
+}
+
+// boltSnapshots the snapshots of the paged reads running and the changes of the commit being written. The commit
+// hands over its changes before bolt makes them visible and keeps them till it's done, so a read starting in the
+// middle doesn't miss them
+type boltSnapshots struct {
+	mx          sync.Mutex
+	open        map[*boltSnapshot]struct{}
+	writing     memdb.Changes
+	writingTxId int
+}
+
+// start a snapshot of the last commit, the read transaction only tells which one it is
+func (s *boltSnapshots) start(db *bolt.DB) (*boltSnapshot, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	tx, err := db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &boltSnapshot{txId: tx.ID(), before: make(map[string]boltBefore)}
+	_ = tx.Rollback()
+	if s.writing != nil && s.writingTxId > snapshot.txId {
+		snapshot.add(s.writingTxId, s.writing)
+	}
+	if s.open == nil {
+		s.open = make(map[*boltSnapshot]struct{})
+	}
+	s.open[snapshot] = struct{}{}
+	return snapshot, nil
+}
+
+func (s *boltSnapshots) stop(snapshot *boltSnapshot) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	delete(s.open, snapshot)
+}
+
+// writeStarted called by the commit of txId before bolt makes the changes visible. A failed commit leaves its
+// ports in the snapshots, they are the ones still stored so the reads see the same
+func (s *boltSnapshots) writeStarted(txId int, changes memdb.Changes) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.writing, s.writingTxId = changes, txId
+	for snapshot := range s.open {
+		if snapshot.txId < txId {
+			snapshot.add(txId, changes)
+		}
+	}
+}
+
+func (s *boltSnapshots) writeDone() {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.writing = nil
+}
+
+// boltPagedReads the lookups of the reads calling back the caller for every port, their iterators read a page at a time
+type boltPagedReads struct {
+	repo     *PortBoltRepository
+	snapshot *boltSnapshot
+}
+
+func (r *boltPagedReads) First(table, index string, args ...interface{}) (interface{}, error) {
+	iterator, err := r.Get(table, index, args...)
+	if err != nil {
+		return nil, err
+	}
+	return iterator.Next(), nil
+}
+
+func (r *boltPagedReads) Get(table, index string, args ...interface{}) (memdb.ResultIterator, error) {
+	scan, err := getScan(r.repo.indexes, table, index, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &boltPagedIterator{db: r.repo.db, snapshot: r.snapshot, scan: scan}, nil
+}
+
+func (r *boltPagedReads) LowerBound(table, index string, args ...interface{}) (memdb.ResultIterator, error) {
+	scan, err := lowerBoundScan(r.repo.indexes, table, index, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &boltPagedIterator{db: r.repo.db, snapshot: r.snapshot, scan: scan}, nil
+}
+
+// boltPagedIterator walks the scan a page at a time, every page in a short read transaction of its own keyed on the
+// last key read. A slow caller never keeps a transaction open, bolt can't grow the file while one is
+type boltPagedIterator struct {
+	db       *bolt.DB
+	snapshot *boltSnapshot
+	scan     boltScan
+	// last the last key read, the next page starts after it
+	last     []byte
+	page     []boltEntry
+	position int
+	done     bool
+	err      error
+}
+
+type boltEntry struct {
+	key  []byte
+	port domain.Port
+}
+
+// WatchCh bolt has no watches, the change feed is the way to follow the changes
+func (it *boltPagedIterator) WatchCh() <-chan struct{} {
+	return nil
+}
+
+func (it *boltPagedIterator) Next() interface{} {
+	for it.position == len(it.page) {
+		if it.done || it.err != nil {
+			return nil
+		}
+		if it.err = it.fetch(); it.err != nil {
+			logrus.WithError(it.err).Error("error reading a page of ports from bolt")
+			return nil
+		}
+	}
+	entry := it.page[it.position]
+	it.position++
+	return entry.port
+}
+
+// Err the error that stopped the iteration
+func (it *boltPagedIterator) Err() error {
+	return it.err
+}
+
+// fetch reads the next page. The ports the snapshot has are skipped, their version from the snapshot takes their
+// place if it has a key of the page
+func (it *boltPagedIterator) fetch() error {
+	after := it.last
+	var page []boltEntry
+	var before map[string]*domain.Port
+	err := it.db.View(func(tx *bolt.Tx) error {
+		// the commits seen by the transaction gave their ports to the snapshot before
+		before = it.snapshot.seenBy(tx.ID())
+		cursor := tx.Bucket(it.scan.bucket).Cursor()
+		ports := tx.Bucket([]byte(tableName))
+		key, value := it.scan.first(cursor)
+		if after != nil {
+			key, value = cursor.Seek(after)
+			if bytes.Equal(key, after) {
+				key, value = cursor.Next()
+			}
+		}
+		for read := 0; key != nil && it.scan.contains(key) && read < boltPageSize; key, value = cursor.Next() {
+			read++
+			it.last = append([]byte(nil), key...)
+			id, data := key, value
+			if it.scan.index != nil {
+				id, data = value, ports.Get(value)
+			}
+			if _, changed := before[string(id)]; changed {
+				continue
+			}
+			port, err := decodePort(data)
+			if err != nil {
+				return err
+			}
+			page = append(page, boltEntry{key: it.last, port: port})
+		}
+		it.done = key == nil || !it.scan.contains(key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, port := range before {
+		if port == nil {
+			continue
+		}
+		keys, err := it.scan.keys(*port)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			inPage := it.scan.contains(key) && bytes.Compare(key, it.scan.start) >= 0 &&
+				(after == nil || bytes.Compare(key, after) > 0) && (it.done || bytes.Compare(key, it.last) <= 0)
+			if inPage {
+				page = append(page, boltEntry{key: key, port: *port})
+			}
+		}
+	}
+	sort.Slice(page, func(i, j int) bool { return bytes.Compare(page[i].key, page[j].key) < 0 })
+	it.page, it.position = page, 0
+	return nil
+}
@@ -0,0 +1,134 @@
+package repository
+
+import (
+	"context"
+	"github.com/go-related/fileservice/internal/core/domain"
+	cerror "github.com/go-related/fileservice/internal/core/errors"
+	"github.com/hashicorp/go-memdb"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// defaultChangeFeedCapacity how many changes we keep at least in memory for the watchers that resume
+const defaultChangeFeedCapacity = 100000
+
+// changeFeed keeps the last committed changes in memory and wakes up the watchers on every publish,
+// the same way the memdb watch channels work: the channel is closed and replaced by a new one
+type changeFeed struct {
+	mx       sync.Mutex
+	events   []domain.PortChange
+	lastSeq  uint64
+	capacity int
+	notify   chan struct{}
+}
+
+func newChangeFeed(capacity int) *changeFeed {
+	return &changeFeed{
+		capacity: capacity,
+		notify:   make(chan struct{}),
+	}
+}
+
+// publish numbers the changes and wakes up the watchers
+func (f *changeFeed) publish(changes []domain.PortChange) {
+	if len(changes) == 0 {
+		return
+	}
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	for _, change := range changes {
+		f.lastSeq++
+		change.Sequence = f.lastSeq
+		f.events = append(f.events, change)
+	}
+	// we trim only once we have twice the capacity so we don't copy on every commit
+	if len(f.events) > 2*f.capacity {
+		f.events = append([]domain.PortChange(nil), f.events[len(f.events)-f.capacity:]...)
+	}
+	close(f.notify)
+	f.notify = make(chan struct{})
+}
+
+// skipTo moves the numbering forward when the data is restored from disk, the older changes are gone
+func (f *changeFeed) skipTo(sequence uint64) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if sequence > f.lastSeq {
+		f.lastSeq = sequence
+		f.events = nil
+	}
+}
+
+func (f *changeFeed) lastSequence() uint64 {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return f.lastSeq
+}
+
+// since the changes after the sequence and a channel that gets closed on the next publish. A sequence after the
+// last one is a gap too: it comes from before a restart that lost the numbering, waiting would skip the next changes
+func (f *changeFeed) since(sequence uint64) ([]domain.PortChange, <-chan struct{}, error) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if sequence > f.lastSeq {
+		return nil, nil, cerror.ChangeFeedGap
+	}
+	if sequence == f.lastSeq {
+		return nil, f.notify, nil
+	}
+	first := f.lastSeq - uint64(len(f.events)) + 1
+	if sequence+1 < first {
+		return nil, nil, cerror.ChangeFeedGap
+	}
+	events := f.events[sequence+1-first:]
+	return events[:len(events):len(events)], f.notify, nil
+}
+
+// watch calls fn for every change after the sequence and then waits for the next ones till the context is done
+func (f *changeFeed) watch(ctx context.Context, afterSequence uint64, fn func(change domain.PortChange) error) error {
+	for {
+		events, notify, err := f.since(afterSequence)
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			if err = fn(event); err != nil {
+				return err
+			}
+			afterSequence = event.Sequence
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-notify:
+		}
+	}
+}
+
+// convertChanges maps the memdb changes of a transaction, updates that didn't change anything are skipped
+func convertChanges(changes memdb.Changes, committedAt time.Time) []domain.PortChange {
+	var result []domain.PortChange
+	for _, change := range changes {
+		if change.Table != tableName {
+			continue
+		}
+		portChange := domain.PortChange{CommittedAt: committedAt}
+		switch {
+		case change.Created():
+			portChange.Type = domain.ChangeCreated
+			portChange.Port = change.After.(domain.Port)
+		case change.Deleted():
+			portChange.Type = domain.ChangeDeleted
+			portChange.Port = change.Before.(domain.Port)
+		default:
+			if reflect.DeepEqual(change.Before, change.After) {
+				continue
+			}
+			portChange.Type = domain.ChangeUpdated
+			portChange.Port = change.After.(domain.Port)
+		}
+		result = append(result, portChange)
+	}
+	return result
+}
@@ -1,143 +1,565 @@
 package repository
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"github.com/go-related/fileservice/internal/core/domain"
+	"github.com/go-related/fileservice/internal/core/ports"
 	"github.com/hashicorp/go-memdb"
 	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
 )
 
 const (
 	tableName = "ports"
 )
 
-var (
-	// TransactionAlreadyExists this is a simplified version of what i want to achieve
-	TransactionAlreadyExists = errors.New("transaction already exists")
-)
+// filterIndexes the secondary indexes used to resolve a PortFilter, the first one present in the filter is used
+// so they are sorted from the most selective
+var filterIndexes = []struct {
+	name    string
+	value   func(filter domain.PortFilter) string
+	indexer *valueIdIndexer
+}{
+	{"unlocs", func(filter domain.PortFilter) string { return filter.Unloc }, lowercaseSliceIndexer("UNLOCs")},
+	{"code", func(filter domain.PortFilter) string { return filter.Code }, lowercaseFieldIndexer("Code")},
+	{"alias", func(filter domain.PortFilter) string { return filter.Alias }, lowercaseSliceIndexer("Alias")},
+	{"city", func(filter domain.PortFilter) string { return filter.City }, lowercaseFieldIndexer("City")},
+	{"province", func(filter domain.PortFilter) string { return filter.Province }, lowercaseFieldIndexer("Province")},
+	{"country", func(filter domain.PortFilter) string { return filter.Country }, lowercaseFieldIndexer("Country")},
+	{"timezone", func(filter domain.PortFilter) string { return filter.Timezone }, lowercaseFieldIndexer("Timezone")},
+	{"regions", func(filter domain.PortFilter) string { return filter.Region }, lowercaseSliceIndexer("Regions")},
+}
+
+// errLimitReached used internally to stop the iterations once we have enough results
+var errLimitReached = errors.New("limit reached")
 
 type PortInMemoryRepository struct {
-	trn *memdb.Txn
-	db  *memdb.MemDB
+	db   *memdb.MemDB
+	feed *changeFeed
+	// commitMx makes the commit and the publish of its changes atomic for the snapshots
+	commitMx sync.Mutex
+
+	snapshots *SnapshotConfig
+	// snapshotMx serializes the periodic snapshots with the one taken on Close
+	snapshotMx sync.Mutex
+	// snapshotSequence the change sequence of the last snapshot, when nothing changed we don't take a new one
+	snapshotSequence uint64
+	stopSnapshots    chan struct{}
+	snapshotsDone    chan struct{}
+	closeOnce        sync.Once
+
+	// wal nil when the commits are not logged, it's guarded by commitMx
+	wal *writeAheadLog
 }
 
-func (rp *PortInMemoryRepository) AddOrUpdatePort(ctx context.Context, port domain.Port) (*domain.Port, error) {
-	if rp.trn == nil { // Here maybe we can use Guards to check
-		err := fmt.Errorf("please strart a transaction before countinuing") // maybe this needs to be a custom error
-		logrus.Error(err)
-		return nil, err
-	}
+// GetById the committed port, nil when it doesn't exist
+func (rp *PortInMemoryRepository) GetById(ctx context.Context, Id string) (*domain.Port, error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	currentData, err := rp.GetById(ctx, port.Id)
+
+	trn := rp.db.Txn(false)
+	defer trn.Abort()
+	return getPort(ctx, trn, Id)
+}
+
+// ListPorts walks the committed ports sorted by id, starting after afterId, and calls fn for each port matching the filter.
+// It reads from a snapshot so a long running list doesn't see or block an ongoing transaction. limit <= 0 means no limit
+func (rp *PortInMemoryRepository) ListPorts(ctx context.Context, filter domain.PortFilter, afterId string, limit int, fn func(port domain.Port) error) error {
+	trn := rp.db.Txn(false)
+	defer trn.Abort()
+
+	return listPorts(ctx, trn, filter, afterId, limit, fn)
+}
+
+// FindByUnloc the committed ports listing the UN/LOCODE, through the unlocs index
+func (rp *PortInMemoryRepository) FindByUnloc(ctx context.Context, unloc string) ([]domain.Port, error) {
+	trn := rp.db.Txn(false)
+	defer trn.Abort()
+
+	return findPorts(ctx, trn, domain.PortFilter{Unloc: unloc})
+}
+
+// FindByCode the committed ports with the code, through the code index
+func (rp *PortInMemoryRepository) FindByCode(ctx context.Context, code string) ([]domain.Port, error) {
+	trn := rp.db.Txn(false)
+	defer trn.Abort()
+
+	return findPorts(ctx, trn, domain.PortFilter{Code: code})
+}
+
+// SearchPorts matches the query against name, alias and city of the committed ports and returns the best results first.
+// Exact and prefix matches come from the search index, the typo tolerant matches are only looked for when there
+// are none of them, among a bounded set of candidates from the same index
+func (rp *PortInMemoryRepository) SearchPorts(ctx context.Context, query string, maxEdits int, limit int) ([]domain.SearchResult, error) {
+	trn := rp.db.Txn(false)
+	defer trn.Abort()
+
+	return searchPorts(ctx, trn, query, maxEdits, limit)
+}
+
+// NearestPorts the k committed ports closest to the point, it looks in a growing radius till it finds enough ports
+func (rp *PortInMemoryRepository) NearestPorts(ctx context.Context, center domain.GeoPoint, k int) ([]domain.PortDistance, error) {
+	trn := rp.db.Txn(false)
+	defer trn.Abort()
+
+	return nearestPorts(ctx, trn, center, k)
+}
+
+// PortsWithinRadius the committed ports within radiusKm from the point sorted by distance, limit <= 0 means no limit
+func (rp *PortInMemoryRepository) PortsWithinRadius(ctx context.Context, center domain.GeoPoint, radiusKm float64, limit int) ([]domain.PortDistance, error) {
+	trn := rp.db.Txn(false)
+	defer trn.Abort()
+
+	results, err := portsWithinRadius(ctx, trn, center, radiusKm, limit)
 	if err != nil {
-		logrus.WithField("id", port.Id).WithError(err).Error("error loading port from db")
+		logrus.WithError(err).Error("error loading ports within radius from db")
 		return nil, err
 	}
+	return results, nil
+}
+
+// PortsInBoundingBox calls fn for every committed port inside the box matching the filter, limit <= 0 means no limit
+func (rp *PortInMemoryRepository) PortsInBoundingBox(ctx context.Context, box domain.BoundingBox, filter domain.PortFilter, limit int, fn func(port domain.Port) error) error {
+	trn := rp.db.Txn(false)
+	defer trn.Abort()
+
+	return portsInArea(ctx, trn, boxesForBoundingBox(box), func(domain.GeoPoint) bool { return true }, filter, limit, fn)
+}
+
+// PortsInPolygon calls fn for every committed port inside the polygon matching the filter, limit <= 0 means no limit
+func (rp *PortInMemoryRepository) PortsInPolygon(ctx context.Context, polygon domain.Polygon, filter domain.PortFilter, limit int, fn func(port domain.Port) error) error {
+	trn := rp.db.Txn(false)
+	defer trn.Abort()
+
+	return portsInArea(ctx, trn, boxesForBoundingBox(polygon.BoundingBox()), polygon.Contains, filter, limit, fn)
+}
+
+// StartTransaction memdb has a single writer, so the transaction keeps its writes aside and they are
+// applied in one memdb transaction on commit. The streams don't wait for each other till then
+func (rp *PortInMemoryRepository) StartTransaction(ctx context.Context) (ports.Transaction, error) {
 	// check if we have any cancellation before continuing
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	default:
 	}
-	// here is the same code but i left intentionally to distinguish btw insert and update
-	if currentData == nil {
-		err = rp.trn.Insert(tableName, port)
+	view := func(fn func(trn portIndexes) error) error {
+		trn := rp.db.Txn(false)
+		defer trn.Abort()
+		return fn(trn)
+	}
+	return newPendingTransaction(view, rp.commit), nil
+}
+
+// commit writes the transaction if none of its ports changed since it read them. The changes are logged
+// before anybody can see them, and the watchers only hear about them once they are committed. The time of
+// the commit is taken under commitMx, so the versions and the history follow the order of the commits
+func (rp *PortInMemoryRepository) commit(ctx context.Context, pending *pendingTransaction) error {
+	rp.commitMx.Lock()
+	defer rp.commitMx.Unlock()
+	now := time.Now()
+	trn := rp.db.Txn(true)
+	defer trn.Abort()  // does nothing once committed
+	trn.TrackChanges() // needed for the change feed
+	if err := pending.checkConflicts(ctx, trn); err != nil {
+		return err
+	}
+	for _, id := range pending.order {
+		current, err := getPort(ctx, trn, id)
 		if err != nil {
-			logrus.WithError(err).Error("error inserting data into table")
+			return err
+		}
+		if port := pending.writes[id]; port != nil {
+			var last uint64
+			if current == nil {
+				revisions, err := portRevisions(ctx, trn, id)
+				if err != nil {
+					return err
+				}
+				last = lastVersion(revisions)
+			}
+			err = trn.Insert(tableName, nextVersion(*port, current, last, now))
+		} else {
+			_, err = trn.DeleteAll(tableName, "id", id)
 		}
-	} else {
-		err = rp.trn.Insert(tableName, port)
 		if err != nil {
-			logrus.WithError(err).Error("error updating data into table")
+			logrus.WithField("id", id).WithError(err).Error("error writing port into table")
+			return err
+		}
+	}
+	if err := insertRevisions(trn, convertRevisions(trn.Changes(), pending.id, now)); err != nil {
+		logrus.WithError(err).Error("error writing port history")
+		return err
+	}
+	changes := convertChanges(trn.Changes(), now)
+	if rp.wal != nil && len(changes) > 0 {
+		record := walRecord{Sequence: rp.feed.lastSequence() + uint64(len(changes)), Changes: changes, TransactionId: pending.id}
+		if err := rp.wal.append(record); err != nil {
+			logrus.WithError(err).Error("error writing the write-ahead log")
+			return err
 		}
 	}
-	return currentData, err
+	trn.Commit()
+	rp.feed.publish(changes)
+	return nil
 }
 
-func (rp *PortInMemoryRepository) GetById(ctx context.Context, Id string) (*domain.Port, error) {
-	if rp.trn == nil { // use Guard
-		err := fmt.Errorf("please strart a transaction before countinuing") // maybe this needs to be a custom error
-		logrus.Error(err)
+// GetPortHistory the revisions of the port from the history table, the oldest first
+func (rp *PortInMemoryRepository) GetPortHistory(ctx context.Context, id string) ([]domain.PortRevision, error) {
+	trn := rp.db.Txn(false)
+	defer trn.Abort()
+
+	return portRevisions(ctx, trn, id)
+}
+
+// GetByIdAsOf reads the port and its history from the same snapshot
+func (rp *PortInMemoryRepository) GetByIdAsOf(ctx context.Context, id string, at time.Time) (*domain.Port, error) {
+	trn := rp.db.Txn(false)
+	defer trn.Abort()
+
+	current, err := getPort(ctx, trn, id)
+	if err != nil {
 		return nil, err
 	}
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	raw, err := rp.trn.First(tableName, "id", Id)
+	revisions, err := portRevisions(ctx, trn, id)
 	if err != nil {
-		logrus.WithError(err).Error("error loading port from db")
 		return nil, err
 	}
-	// check if we have any cancellation before continuing
-	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	default:
+	return domain.PortAsOf(current, revisions, at), nil
+}
+
+// CompactHistory removes the expired revisions in one write transaction. The compaction is logged like the commits,
+// so a restart doesn't bring back the revisions it removed
+func (rp *PortInMemoryRepository) CompactHistory(ctx context.Context, retention domain.HistoryRetention) (int, error) {
+	rp.commitMx.Lock()
+	defer rp.commitMx.Unlock()
+	trn := rp.db.Txn(true)
+	defer trn.Abort()
+
+	now := time.Now()
+	expired, err := expiredRevisions(ctx, trn, retention, now)
+	if err != nil {
+		return 0, err
+	}
+	if len(expired) == 0 {
+		return 0, nil
 	}
-	//not found
-	if raw == nil {
-		return nil, nil
+	if rp.wal != nil {
+		record := walRecord{Sequence: rp.feed.lastSequence(), Compaction: &walCompaction{Retention: retention, At: now}}
+		if err = rp.wal.append(record); err != nil {
+			logrus.WithError(err).Error("error writing the write-ahead log")
+			return 0, err
+		}
+	}
+	if err = removeRevisions(trn, expired); err != nil {
+		return 0, err
 	}
-	result := raw.(domain.Port)
-	return &result, nil
+	trn.Commit()
+	return len(expired), nil
 }
 
-func (rp *PortInMemoryRepository) StartTransaction(ctx context.Context) error {
-	// check if we have any cancellation before continuing
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	default:
+// expiredRevisions the revisions past the retention at the time
+func expiredRevisions(ctx context.Context, trn *memdb.Txn, retention domain.HistoryRetention, now time.Time) ([]domain.PortRevision, error) {
+	iterator, err := trn.Get(historyTable, "id")
+	if err != nil {
+		return nil, err
+	}
+	// memdb iterators can't be used while the table changes, the expired revisions are collected first
+	var expired, revisions []domain.PortRevision
+	for raw := iterator.Next(); ; raw = iterator.Next() {
+		if raw == nil || (len(revisions) > 0 && raw.(domain.PortRevision).Port.Id != revisions[0].Port.Id) {
+			expired = append(expired, revisions[:retention.Expired(revisions, now)]...)
+			revisions = revisions[:0]
+		}
+		if raw == nil {
+			break
+		}
+		// check if we have any cancellation before continuing
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		revisions = append(revisions, raw.(domain.PortRevision))
 	}
-	if rp.trn == nil { //otherwise we are inside a transaction
-		rp.trn = rp.db.Txn(true)
-	} else {
-		return TransactionAlreadyExists
+	return expired, nil
+}
+
+func removeRevisions(trn *memdb.Txn, revisions []domain.PortRevision) error {
+	for _, revision := range revisions {
+		if err := trn.Delete(historyTable, revision); err != nil {
+			logrus.WithError(err).Error("error removing port history")
+			return err
+		}
 	}
 	return nil
 }
 
-// CommitTransaction i would have prefered to pass a context to the commit so i would be able to cancel or timeout this operation in case it takes a long time
-func (rp *PortInMemoryRepository) CommitTransaction(ctx context.Context) error {
-	if rp.trn == nil {
-		return nil // TODO return proper error
+// insertRevisions adds the replaced ports to the history table of the write transaction
+func insertRevisions(trn *memdb.Txn, revisions []domain.PortRevision) error {
+	for _, revision := range revisions {
+		if err := trn.Insert(historyTable, revision); err != nil {
+			return err
+		}
 	}
-	// check if we have any cancellation before continuing
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	default:
+	return nil
+}
+
+// portRevisions the history of the port, the oldest first
+func portRevisions(ctx context.Context, trn *memdb.Txn, id string) ([]domain.PortRevision, error) {
+	iterator, err := trn.Get(historyTable, "id_prefix", id)
+	if err != nil {
+		logrus.WithField("id", id).WithError(err).Error("error loading port history from db")
+		return nil, err
+	}
+	var revisions []domain.PortRevision
+	for raw := iterator.Next(); raw != nil; raw = iterator.Next() {
+		// check if we have any cancellation before continuing
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+		revisions = append(revisions, raw.(domain.PortRevision))
 	}
-	rp.trn.Commit()
-	rp.trn = nil // we do this so we know we have to start a transaction to update data on db
+	return revisions, nil
+}
+
+// WatchChanges calls fn for every committed change after the sequence, then keeps waiting for new ones till ctx is done
+func (rp *PortInMemoryRepository) WatchChanges(ctx context.Context, afterSequence uint64, fn func(change domain.PortChange) error) error {
+	return rp.feed.watch(ctx, afterSequence, fn)
+}
+
+// LastChangeSequence the sequence of the last committed change, 0 when nothing changed yet
+func (rp *PortInMemoryRepository) LastChangeSequence() uint64 {
+	return rp.feed.lastSequence()
+}
+
+// Snapshot saves the committed ports to a new snapshot file and removes the ones past the retention.
+// It does nothing when the snapshots are not configured or nothing changed since the last one
+func (rp *PortInMemoryRepository) Snapshot() error {
+	if rp.snapshots == nil {
+		return nil
+	}
+	rp.snapshotMx.Lock()
+	defer rp.snapshotMx.Unlock()
+
+	rp.commitMx.Lock()
+	trn := rp.db.Txn(false)
+	sequence := rp.feed.lastSequence()
+	var err error
+	if rp.wal != nil && sequence != rp.snapshotSequence && rp.wal.first != sequence+1 {
+		// the commits after the snapshot go to a new segment, so the current ones can be compacted
+		err = rp.wal.startSegment(sequence + 1)
+	}
+	rp.commitMx.Unlock()
+	defer trn.Abort()
+	if err != nil {
+		logrus.WithError(err).Error("error starting a new write-ahead log segment")
+		return err
+	}
+	if sequence == rp.snapshotSequence {
+		return nil
+	}
+	start := time.Now()
+	path, err := writeSnapshot(rp.snapshots.Dir, trn, sequence)
+	if err != nil {
+		logrus.WithError(err).Error("error writing snapshot")
+		return err
+	}
+	rp.snapshotSequence = sequence
+	logrus.WithField("path", path).WithField("sequence", sequence).WithField("took", time.Since(start)).Info("snapshot saved")
+	if err = rotateSnapshots(rp.snapshots.Dir, rp.snapshots.Retention); err != nil {
+		return err
+	}
+	return rp.compactWriteAheadLog()
+}
+
+// compactWriteAheadLog removes the log segments covered by the oldest snapshot we keep,
+// so falling back to an older snapshot still finds all the following changes in the log
+func (rp *PortInMemoryRepository) compactWriteAheadLog() error {
+	if rp.wal == nil {
+		return nil
+	}
+	sequence, ok, err := oldestSnapshotSequence(rp.snapshots.Dir)
+	if err != nil || !ok {
+		return err
+	}
+	rp.commitMx.Lock()
+	defer rp.commitMx.Unlock()
+	return rp.wal.compact(sequence)
+}
+
+// replayWriteAheadLog applies the logged commits that came after the loaded snapshot and starts a new segment
+func (rp *PortInMemoryRepository) replayWriteAheadLog() error {
+	replayed := 0
+	err := rp.wal.replay(func(record walRecord) error {
+		if record.Compaction != nil {
+			// a snapshot at the same sequence might be from before the compaction, doing it again is harmless
+			if record.Sequence < rp.feed.lastSequence() {
+				return nil
+			}
+			replayed++
+			return rp.replayCompaction(*record.Compaction)
+		}
+		if record.Sequence <= rp.feed.lastSequence() {
+			return nil // already in the snapshot
+		}
+		if first := record.firstSequence(); first != rp.feed.lastSequence()+1 {
+			logrus.WithField("expected", rp.feed.lastSequence()+1).WithField("found", first).Warn("write-ahead log doesn't follow the snapshot, some changes are missing")
+			rp.feed.skipTo(first - 1)
+		}
+		trn := rp.db.Txn(true)
+		trn.TrackChanges() // the history is rebuilt from the replaced ports
+		for _, change := range record.Changes {
+			var err error
+			if change.Type == domain.ChangeDeleted {
+				_, err = trn.DeleteAll(tableName, "id", change.Port.Id)
+			} else {
+				err = trn.Insert(tableName, change.Port)
+			}
+			if err != nil {
+				trn.Abort()
+				return err
+			}
+		}
+		if len(record.Changes) > 0 {
+			revisions := convertRevisions(trn.Changes(), record.TransactionId, record.Changes[0].CommittedAt)
+			if err := insertRevisions(trn, revisions); err != nil {
+				trn.Abort()
+				return err
+			}
+		}
+		trn.Commit()
+		rp.feed.publish(record.Changes)
+		replayed++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logrus.WithField("transactions", replayed).WithField("sequence", rp.feed.lastSequence()).Info("write-ahead log replayed")
+	return rp.wal.startSegment(rp.feed.lastSequence() + 1)
+}
+
+// replayCompaction removes again the revisions a logged CompactHistory removed
+func (rp *PortInMemoryRepository) replayCompaction(compaction walCompaction) error {
+	trn := rp.db.Txn(true)
+	defer trn.Abort()
+	expired, err := expiredRevisions(context.Background(), trn, compaction.Retention, compaction.At)
+	if err != nil {
+		return err
+	}
+	if err = removeRevisions(trn, expired); err != nil {
+		return err
+	}
+	trn.Commit()
 	return nil
 }
 
-func (rp *PortInMemoryRepository) AbortTransaction() {
-	if rp.trn == nil {
-		return // TODO return proper error
+// Close stops the periodic snapshots and takes a last one, so a restart finds all the committed ports
+func (rp *PortInMemoryRepository) Close() error {
+	var err error
+	rp.closeOnce.Do(func() {
+		if rp.stopSnapshots != nil {
+			close(rp.stopSnapshots)
+			<-rp.snapshotsDone
+		}
+		err = rp.Snapshot()
+		if rp.wal != nil {
+			rp.commitMx.Lock()
+			defer rp.commitMx.Unlock()
+			if closeErr := rp.wal.close(); err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
+
+func (rp *PortInMemoryRepository) snapshotLoop(interval time.Duration) {
+	defer close(rp.snapshotsDone)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rp.stopSnapshots:
+			return
+		case <-ticker.C:
+			// the error is already logged, we try again on the next tick
+			_ = rp.Snapshot()
+		}
+	}
+}
+
+// loadLatestSnapshot restores the newest snapshot that is readable, the broken ones are skipped.
+// If there are snapshots but none of them can be read we fail instead of starting empty
+func (rp *PortInMemoryRepository) loadLatestSnapshot() error {
+	paths, err := listSnapshots(rp.snapshots.Dir)
+	if err != nil {
+		return err
 	}
-	rp.trn.Abort()
-	rp.trn = nil // same as in the commit
+	for i := len(paths) - 1; i >= 0; i-- {
+		trn := rp.db.Txn(true)
+		sequence, err := readSnapshot(paths[i], trn)
+		if err != nil {
+			trn.Abort()
+			logrus.WithError(err).WithField("path", paths[i]).Warn("skipping unreadable snapshot")
+			continue
+		}
+		trn.Commit()
+		rp.feed.skipTo(sequence)
+		rp.snapshotSequence = sequence
+		logrus.WithField("path", paths[i]).WithField("sequence", sequence).Info("snapshot loaded")
+		return nil
+	}
+	if len(paths) > 0 {
+		return fmt.Errorf("none of the %d snapshots in %s can be read", len(paths), rp.snapshots.Dir)
+	}
+	return nil
 }
 
-func NewPortRepository() (*PortInMemoryRepository, error) {
+func NewPortRepository(options ...Option) (*PortInMemoryRepository, error) {
 	db, err := memdb.NewMemDB(creatDbSchema())
 	if err != nil {
 		logrus.WithError(err).Error("error setting up memdb")
 		return nil, err
 	}
 	repo := PortInMemoryRepository{
-		db: db,
+		db:   db,
+		feed: newChangeFeed(defaultChangeFeedCapacity),
+	}
+	for _, option := range options {
+		option(&repo)
+	}
+	if repo.snapshots != nil {
+		if err = repo.loadLatestSnapshot(); err != nil {
+			logrus.WithError(err).Error("error loading snapshot")
+			return nil, err
+		}
+	}
+	if repo.wal != nil {
+		if err = repo.replayWriteAheadLog(); err != nil {
+			logrus.WithError(err).Error("error replaying the write-ahead log")
+			return nil, err
+		}
+	}
+	if repo.snapshots != nil {
+		if repo.snapshots.Interval > 0 {
+			repo.stopSnapshots = make(chan struct{})
+			repo.snapshotsDone = make(chan struct{})
+			go repo.snapshotLoop(repo.snapshots.Interval)
+		}
 	}
 	return &repo, nil
 }
 
 func creatDbSchema() *memdb.DBSchema {
-	return &memdb.DBSchema{
+	schema := &memdb.DBSchema{
 		Tables: map[string]*memdb.TableSchema{
 			tableName: {
 				Name: tableName,
@@ -148,8 +570,137 @@ func creatDbSchema() *memdb.DBSchema {
 						Unique:  true,
 						Indexer: &memdb.StringFieldIndex{Field: "Id"},
 					},
+					geoIndex: {
+						Name:         geoIndex,
+						AllowMissing: true,
+						Indexer:      &geohashIndexer{},
+					},
+					searchIndex: {
+						Name:         searchIndex,
+						AllowMissing: true,
+						Indexer:      &searchTermsIndexer{},
+					},
+					trigramIndex: {
+						Name:         trigramIndex,
+						AllowMissing: true,
+						Indexer:      &trigramIndexer{},
+					},
+				},
+			},
+			historyTable: {
+				Name: historyTable,
+				Indexes: map[string]*memdb.IndexSchema{
+					"id": {
+						Name:    "id",
+						Unique:  true,
+						Indexer: &revisionIndexer{},
+					},
 				},
 			},
 		},
 	}
+	for _, index := range filterIndexes {
+		// the id in the key makes every key unique, ports without a value are left out of the index
+		schema.Tables[tableName].Indexes[index.name] = &memdb.IndexSchema{
+			Name:         index.name,
+			Unique:       true,
+			AllowMissing: true,
+			Indexer:      index.indexer,
+		}
+	}
+	return schema
+}
+
+// lowercaseFieldIndexer the filter index of a string field
+func lowercaseFieldIndexer(field string) *valueIdIndexer {
+	return &valueIdIndexer{values: &memdb.StringFieldIndex{Field: field, Lowercase: true}}
+}
+
+// lowercaseSliceIndexer the filter index of a slice field, a port is found by any of the values of the slice
+func lowercaseSliceIndexer(field string) *valueIdIndexer {
+	return &valueIdIndexer{values: &memdb.StringSliceFieldIndex{Field: field, Lowercase: true}}
+}
+
+// valueIdIndexer indexes the ports by the lowercase values of a field followed by their id. The ports of a value
+// are sorted by id, so a listing seeks straight to the first port after its cursor with
+// LowerBound(index+"_prefix", value, afterId) instead of reading all the ports before it
+type valueIdIndexer struct {
+	values memdb.Indexer
+}
+
+func (v *valueIdIndexer) FromObject(obj interface{}) (bool, [][]byte, error) {
+	port, ok := obj.(domain.Port)
+	if !ok {
+		return false, nil, fmt.Errorf("unexpected type %T for a filter index", obj)
+	}
+	var values [][]byte
+	switch indexer := v.values.(type) {
+	case memdb.SingleIndexer:
+		ok, value, err := indexer.FromObject(port)
+		if err != nil || !ok {
+			return false, nil, err
+		}
+		values = [][]byte{value}
+	case memdb.MultiIndexer:
+		ok, found, err := indexer.FromObject(port)
+		if err != nil || !ok {
+			return false, nil, err
+		}
+		values = found
+	default:
+		return false, nil, fmt.Errorf("unsupported indexer %T for a filter index", v.values)
+	}
+	for i := range values {
+		values[i] = append(values[i], port.Id+"\x00"...)
+	}
+	return true, values, nil
+}
+
+// FromArgs the key of the value and the id
+func (v *valueIdIndexer) FromArgs(args ...interface{}) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, fmt.Errorf("must provide the value and the id")
+	}
+	key, err := v.PrefixFromArgs(args...)
+	if err != nil {
+		return nil, err
+	}
+	return append(key, 0), nil
+}
+
+// PrefixFromArgs the keys of the value, and of the ids starting with the second argument when there is one
+func (v *valueIdIndexer) PrefixFromArgs(args ...interface{}) ([]byte, error) {
+	if len(args) == 0 || len(args) > 2 {
+		return nil, fmt.Errorf("must provide the value and optionally the id")
+	}
+	key, err := v.values.FromArgs(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 2 {
+		id, ok := args[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("argument must be a string: %#v", args[1])
+		}
+		key = append(key, id...)
+	}
+	return key, nil
+}
+
+// has whether the port has the value, its key for the value is the one of its id
+func (v *valueIdIndexer) has(port domain.Port, value string) (bool, error) {
+	ok, keys, err := v.FromObject(port)
+	if err != nil || !ok {
+		return false, err
+	}
+	key, err := v.FromArgs(value, port.Id)
+	if err != nil {
+		return false, err
+	}
+	for _, k := range keys {
+		if bytes.Equal(k, key) {
+			return true, nil
+		}
+	}
+	return false, nil
 }
@@ -0,0 +1,1218 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-related/fileservice/internal/core/domain"
+	cerror "github.com/go-related/fileservice/internal/core/errors"
+	"github.com/go-related/fileservice/internal/core/ports"
+	"github.com/go-related/fileservice/internal/core/service"
+	"github.com/hashicorp/go-memdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// repositoryFactory creates an empty repository of one of the adapters
+type repositoryFactory func(t *testing.T) ports.Repository
+
+// repositoryAdapters every adapter has to pass the same behavioral tests in repositoryContract
+var repositoryAdapters = map[string]repositoryFactory{
+	"memdb": func(t *testing.T) ports.Repository {
+		repo, err := NewPortRepository()
+		require.NoError(t, err)
+		return repo
+	},
+	"bolt": func(t *testing.T) ports.Repository {
+		repo, err := NewPortBoltRepository(filepath.Join(t.TempDir(), "ports.db"))
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = repo.Close() })
+		return repo
+	},
+	"postgres": func(t *testing.T) ports.Repository {
+		return newTestPostgresRepository(t)
+	},
+}
+
+var repositoryContract = map[string]func(t *testing.T, newRepository repositoryFactory){
+	"ListPorts":                    testListPorts,
+	"FindPorts":                    testFindPorts,
+	"SearchPorts":                  testSearchPorts,
+	"GeoQueries":                   testGeoQueries,
+	"AreaQueries":                  testAreaQueries,
+	"DeletePorts":                  testDeletePorts,
+	"Transactions":                 testTransactions,
+	"Versions":                     testVersions,
+	"BatchUpserts":                 testBatchUpserts,
+	"History":                      testHistory,
+	"HistoryStampedOnCommit":       testHistoryStampedOnCommit,
+	"ConcurrentTransactions":       testConcurrentTransactions,
+	"ReadsDuringImport":            testReadsDuringImport,
+	"CommitsBetweenPages":          testCommitsBetweenPages,
+	"WatchChanges":                 testWatchChanges,
+	"WatchChanges_WaitsForCommits": testWatchChangesWaitsForCommits,
+}
+
+func TestRepositoryContract(t *testing.T) {
+	for adapter, newRepository := range repositoryAdapters {
+		for name, test := range repositoryContract {
+			newRepository, test := newRepository, test
+			t.Run(adapter+"/"+name, func(t *testing.T) {
+				test(t, newRepository)
+			})
+		}
+	}
+}
+
+func newTestRepository(t *testing.T, newRepository repositoryFactory, initial ...domain.Port) ports.Repository {
+	t.Helper()
+	repo := newRepository(t)
+	var err error
+	ctx := context.TODO()
+	trn := startTransaction(t, repo)
+	for _, port := range initial {
+		_, err = trn.AddOrUpdatePort(ctx, port)
+		require.NoError(t, err)
+	}
+	require.NoError(t, trn.Commit(ctx))
+	return repo
+}
+
+func startTransaction(t *testing.T, repo ports.Repository) ports.Transaction {
+	t.Helper()
+	trn, err := repo.StartTransaction(context.TODO())
+	require.NoError(t, err)
+	t.Cleanup(trn.Abort)
+	return trn
+}
+
+func listIds(t *testing.T, repo ports.Repository, filter domain.PortFilter, afterId string, limit int) []string {
+	t.Helper()
+	ids, err := collectIds(repo, filter, afterId, limit)
+	require.NoError(t, err)
+	return ids
+}
+
+// collectIds the ids listed by the repository, it doesn't stop the test so it can run in another goroutine
+func collectIds(repo ports.Repository, filter domain.PortFilter, afterId string, limit int) ([]string, error) {
+	var ids []string
+	err := repo.ListPorts(context.TODO(), filter, afterId, limit, func(port domain.Port) error {
+		ids = append(ids, port.Id)
+		return nil
+	})
+	return ids, err
+}
+
+func testListPorts(t *testing.T, newRepository repositoryFactory) {
+	repo := newTestRepository(t, newRepository,
+		domain.Port{Id: "AEAUH", Name: "Abu Dhabi", City: "Abu Dhabi", Country: "United Arab Emirates", Code: "52001", Regions: []string{"Gulf", "Middle East"}},
+		domain.Port{Id: "AEAJM", Name: "Ajman", City: "Ajman", Country: "United Arab Emirates", Code: "52000", Regions: []string{"Middle East"}},
+		domain.Port{Id: "ALDRZ", Name: "Durres", City: "Durres", Country: "Albania"},
+		domain.Port{Id: "AEDXB", Name: "Dubai", City: "Dubai", Country: "United Arab Emirates", Timezone: "Asia/Dubai", Regions: []string{"Gulf", "Middle East"}},
+	)
+
+	testCases := map[string]struct {
+		filter   domain.PortFilter
+		afterId  string
+		limit    int
+		expected []string
+	}{
+		"AllSortedById": {
+			expected: []string{"AEAJM", "AEAUH", "AEDXB", "ALDRZ"},
+		},
+		"Page": {
+			afterId:  "AEAJM",
+			limit:    2,
+			expected: []string{"AEAUH", "AEDXB"},
+		},
+		"ByCountryCaseInsensitive": {
+			filter:   domain.PortFilter{Country: "united arab emirates"},
+			expected: []string{"AEAJM", "AEAUH", "AEDXB"},
+		},
+		"ByCountryAfterCursor": {
+			filter:   domain.PortFilter{Country: "United Arab Emirates"},
+			afterId:  "AEAJM",
+			limit:    1,
+			expected: []string{"AEAUH"},
+		},
+		"ByRegionAfterCursor": {
+			filter:   domain.PortFilter{Region: "middle east"},
+			afterId:  "AEAJM",
+			expected: []string{"AEAUH", "AEDXB"},
+		},
+		"CombinedFilters": {
+			filter:   domain.PortFilter{Country: "United Arab Emirates", Timezone: "Asia/Dubai"},
+			expected: []string{"AEDXB"},
+		},
+		"NoMatch": {
+			filter: domain.PortFilter{Code: "99999"},
+		},
+	}
+	for name, test := range testCases {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, listIds(t, repo, test.filter, test.afterId, test.limit))
+		})
+	}
+}
+
+// countingIndexes counts the rows the iterators of the lookups hand over
+type countingIndexes struct {
+	portIndexes
+	scanned int
+}
+
+func (c *countingIndexes) Get(table, index string, args ...interface{}) (memdb.ResultIterator, error) {
+	iterator, err := c.portIndexes.Get(table, index, args...)
+	return &countingIterator{ResultIterator: iterator, scanned: &c.scanned}, err
+}
+
+func (c *countingIndexes) LowerBound(table, index string, args ...interface{}) (memdb.ResultIterator, error) {
+	iterator, err := c.portIndexes.LowerBound(table, index, args...)
+	return &countingIterator{ResultIterator: iterator, scanned: &c.scanned}, err
+}
+
+type countingIterator struct {
+	memdb.ResultIterator
+	scanned *int
+}
+
+func (it *countingIterator) Next() interface{} {
+	raw := it.ResultIterator.Next()
+	if raw != nil {
+		*it.scanned++
+	}
+	return raw
+}
+
+// TestListPorts_SeeksTheCursor every page of a filtered listing reads the ports of the page and the cursor,
+// not the ones of the value before it
+func TestListPorts_SeeksTheCursor(t *testing.T) {
+	ctx := context.TODO()
+	initial := make([]domain.Port, 300)
+	for i := range initial {
+		initial[i] = domain.Port{Id: fmt.Sprintf("P%05d", i), Name: "Port", Country: "Albania", Regions: []string{"Europe", "Mediterranean"}}
+		if i%2 == 1 {
+			initial[i].Country, initial[i].Regions = "Zambia", []string{"Africa"}
+		}
+	}
+	views := map[string]func(t *testing.T) func(fn func(trn portIndexes) error) error{
+		"memdb": func(t *testing.T) func(fn func(trn portIndexes) error) error {
+			repo := newTestRepository(t, repositoryAdapters["memdb"], initial...).(*PortInMemoryRepository)
+			return func(fn func(trn portIndexes) error) error {
+				trn := repo.db.Txn(false)
+				defer trn.Abort()
+				return fn(trn)
+			}
+		},
+		"bolt": func(t *testing.T) func(fn func(trn portIndexes) error) error {
+			repo := newTestRepository(t, repositoryAdapters["bolt"], initial...).(*PortBoltRepository)
+			return func(fn func(trn portIndexes) error) error {
+				return repo.view(func(trn *boltTxn) error { return fn(trn) })
+			}
+		},
+	}
+	filters := map[string]domain.PortFilter{
+		"Country": {Country: "albania"},
+		// the ports of the value are followed by their keys of the other value
+		"Region": {Region: "europe"},
+	}
+	const pageSize = 10
+	for adapter, newView := range views {
+		view := newView(t)
+		for name, filter := range filters {
+			t.Run(adapter+"/"+name, func(t *testing.T) {
+				var listed []string
+				afterId := ""
+				for page := 0; page <= len(initial)/2/pageSize; page++ {
+					var ids []string
+					err := view(func(trn portIndexes) error {
+						counting := &countingIndexes{portIndexes: trn}
+						err := listPorts(ctx, counting, filter, afterId, pageSize, func(port domain.Port) error {
+							ids = append(ids, port.Id)
+							return nil
+						})
+						// the cursor and the ports of the page, the last page reads the first port past the value
+						assert.LessOrEqual(t, counting.scanned, pageSize+1)
+						return err
+					})
+					require.NoError(t, err)
+					if len(ids) == 0 {
+						break
+					}
+					listed = append(listed, ids...)
+					afterId = ids[len(ids)-1]
+				}
+				require.Len(t, listed, len(initial)/2)
+				for i, id := range listed {
+					assert.Equal(t, initial[2*i].Id, id)
+				}
+			})
+		}
+	}
+}
+
+func testFindPorts(t *testing.T, newRepository repositoryFactory) {
+	ctx := context.TODO()
+	repo := newTestRepository(t, newRepository,
+		domain.Port{Id: "AEAUH", Name: "Abu Dhabi", Alias: []string{"Abu Zaby"}, Regions: []string{"Gulf"}, UNLOCs: []string{"AEAUH"}, Code: "52001"},
+		domain.Port{Id: "AEMKH", Name: "Mina Khalid", Regions: []string{"Gulf"}, UNLOCs: []string{"AEMKH", "AESHJ"}, Code: "52001"},
+		domain.Port{Id: "AESHJ", Name: "Sharjah", UNLOCs: []string{"AESHJ"}, Code: "52070"},
+	)
+
+	found, err := repo.FindByUnloc(ctx, "aeshj")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"AEMKH", "AESHJ"}, portIds(found))
+	found, err = repo.FindByCode(ctx, "52001")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"AEAUH", "AEMKH"}, portIds(found))
+	found, err = repo.FindByUnloc(ctx, "ZZZZZ")
+	require.NoError(t, err)
+	assert.Empty(t, found)
+
+	assert.Equal(t, []string{"AEAUH"}, listIds(t, repo, domain.PortFilter{Alias: "abu zaby"}, "", 0))
+	assert.Equal(t, []string{"AEAUH", "AEMKH"}, listIds(t, repo, domain.PortFilter{Region: "GULF"}, "", 0))
+	assert.Equal(t, []string{"AEMKH"}, listIds(t, repo, domain.PortFilter{Region: "Gulf", Unloc: "AESHJ"}, "", 0))
+
+	// the indexes follow the updates
+	trn := startTransaction(t, repo)
+	_, err = trn.AddOrUpdatePort(ctx, domain.Port{Id: "AEMKH", Name: "Mina Khalid", UNLOCs: []string{"AEMKH"}})
+	require.NoError(t, err)
+	require.NoError(t, trn.Commit(ctx))
+	found, err = repo.FindByUnloc(ctx, "AESHJ")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"AESHJ"}, portIds(found))
+	assert.Equal(t, []string{"AEAUH"}, listIds(t, repo, domain.PortFilter{Region: "gulf"}, "", 0))
+}
+
+func testSearchPorts(t *testing.T, newRepository repositoryFactory) {
+	repo := newTestRepository(t, newRepository,
+		domain.Port{Id: "AEAUH", Name: "Abu Dhabi", City: "Abu Dhabi", Province: "Abu Z¸aby [Abu Dhabi]"},
+		domain.Port{Id: "AEAJM", Name: "Ajman", City: "Ajman"},
+		domain.Port{Id: "AEDXB", Name: "Dubai", City: "Dubai", Alias: []string{"Dubayy"}},
+		domain.Port{Id: "BRSSZ", Name: "Santos", City: "São Paulo"},
+		domain.Port{Id: "AEJEA", Name: "Jebel Ali", City: "Dubai"},
+	)
+
+	testCases := map[string]struct {
+		query           string
+		maxEdits        int
+		expected        []string
+		expectedMatches []domain.MatchType
+	}{
+		"Exact": {
+			query:           "ajman",
+			expected:        []string{"AEAJM"},
+			expectedMatches: []domain.MatchType{domain.MatchExact},
+		},
+		"NameRankedBeforeCity": {
+			query:           "Dubai",
+			expected:        []string{"AEDXB", "AEJEA"},
+			expectedMatches: []domain.MatchType{domain.MatchExact, domain.MatchExact},
+		},
+		"Prefix": {
+			query:           "abu d",
+			expected:        []string{"AEAUH"},
+			expectedMatches: []domain.MatchType{domain.MatchPrefix},
+		},
+		"Alias": {
+			query:           "dubayy",
+			expected:        []string{"AEDXB"},
+			expectedMatches: []domain.MatchType{domain.MatchExact},
+		},
+		"Diacritics": {
+			query:           "SAO PAULO",
+			expected:        []string{"BRSSZ"},
+			expectedMatches: []domain.MatchType{domain.MatchExact},
+		},
+		"Typo": {
+			query:           "abu dabi",
+			maxEdits:        2,
+			expected:        []string{"AEAUH"},
+			expectedMatches: []domain.MatchType{domain.MatchFuzzy},
+		},
+		"TypoNotAllowed": {
+			query: "abu dabi",
+		},
+		// the prefix match on the alias and the typo tolerant match on the city of Jebel Ali, ranked together
+		"PrefixAndTypo": {
+			query:           "dubay",
+			maxEdits:        1,
+			expected:        []string{"AEDXB", "AEJEA"},
+			expectedMatches: []domain.MatchType{domain.MatchPrefix, domain.MatchFuzzy},
+		},
+		"TypoInFirstLetters": {
+			query:           "xbu dhabi",
+			maxEdits:        2,
+			expected:        []string{"AEAUH"},
+			expectedMatches: []domain.MatchType{domain.MatchFuzzy},
+		},
+		"TypoInFirstLetterOfOneWord": {
+			query:           "jajman",
+			maxEdits:        1,
+			expected:        []string{"AEAJM"},
+			expectedMatches: []domain.MatchType{domain.MatchFuzzy},
+		},
+	}
+	for name, test := range testCases {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			results, err := repo.SearchPorts(context.TODO(), test.query, test.maxEdits, 10)
+			require.NoError(t, err)
+			var ids []string
+			var matches []domain.MatchType
+			for _, result := range results {
+				ids = append(ids, result.Port.Id)
+				matches = append(matches, result.MatchType)
+			}
+			assert.Equal(t, test.expected, ids)
+			assert.Equal(t, test.expectedMatches, matches)
+		})
+	}
+}
+
+func testGeoQueries(t *testing.T, newRepository repositoryFactory) {
+	repo := newTestRepository(t, newRepository,
+		domain.Port{Id: "AEAUH", Name: "Abu Dhabi", Coordinates: []float64{54.37, 24.47}},
+		domain.Port{Id: "AEAJM", Name: "Ajman", Coordinates: []float64{55.5136433, 25.4052165}},
+		domain.Port{Id: "AEDXB", Name: "Dubai", Coordinates: []float64{55.27, 25.25}},
+		domain.Port{Id: "FJSUV", Name: "Suva", Coordinates: []float64{178.42, -18.13}},
+		domain.Port{Id: "WSAPW", Name: "Apia", Coordinates: []float64{-171.76, -13.83}},
+		domain.Port{Id: "XXNOC", Name: "No coordinates"},
+	)
+	dubai := domain.GeoPoint{Lat: 25.25, Lon: 55.27}
+	ids := func(results []domain.PortDistance) []string {
+		var ids []string
+		for _, result := range results {
+			ids = append(ids, result.Port.Id)
+		}
+		return ids
+	}
+
+	t.Run("Nearest", func(t *testing.T) {
+		results, err := repo.NearestPorts(context.TODO(), dubai, 2)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"AEDXB", "AEAJM"}, ids(results))
+		assert.InDelta(t, 0, results[0].DistanceKm, 0.001)
+		assert.InDelta(t, 30, results[1].DistanceKm, 0.5)
+	})
+	t.Run("NearestGrowsTillTheOtherSideOfTheWorld", func(t *testing.T) {
+		results, err := repo.NearestPorts(context.TODO(), dubai, 10)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"AEDXB", "AEAJM", "AEAUH", "FJSUV", "WSAPW"}, ids(results))
+	})
+	t.Run("WithinRadius", func(t *testing.T) {
+		results, err := repo.PortsWithinRadius(context.TODO(), dubai, 150, 0)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"AEDXB", "AEAJM", "AEAUH"}, ids(results))
+	})
+	t.Run("WithinRadiusAcrossTheAntimeridian", func(t *testing.T) {
+		results, err := repo.PortsWithinRadius(context.TODO(), domain.GeoPoint{Lat: -18.13, Lon: 178.42}, 1500, 0)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"FJSUV", "WSAPW"}, ids(results))
+	})
+}
+
+func testAreaQueries(t *testing.T, newRepository repositoryFactory) {
+	repo := newTestRepository(t, newRepository,
+		domain.Port{Id: "AEAUH", Name: "Abu Dhabi", Country: "United Arab Emirates", Coordinates: []float64{54.37, 24.47}},
+		domain.Port{Id: "AEDXB", Name: "Dubai", Country: "United Arab Emirates", Coordinates: []float64{55.27, 25.25}},
+		domain.Port{Id: "OMKHS", Name: "Khasab", Country: "Oman", Coordinates: []float64{56.24, 26.18}},
+		domain.Port{Id: "IRBND", Name: "Bandar Abbas", Country: "Iran", Coordinates: []float64{56.28, 27.18}},
+		domain.Port{Id: "FJSUV", Name: "Suva", Country: "Fiji", Coordinates: []float64{178.42, -18.13}},
+		domain.Port{Id: "WSAPW", Name: "Apia", Country: "Samoa", Coordinates: []float64{-171.76, -13.83}},
+	)
+	// rough shape of the strait of hormuz with a hole around Khasab
+	hormuz := domain.Polygon{
+		{{Lat: 25.5, Lon: 55.5}, {Lat: 25.5, Lon: 57.5}, {Lat: 27.5, Lon: 57.5}, {Lat: 27.5, Lon: 55.5}, {Lat: 25.5, Lon: 55.5}},
+		{{Lat: 26, Lon: 56}, {Lat: 26, Lon: 56.5}, {Lat: 26.5, Lon: 56.5}, {Lat: 26.5, Lon: 56}, {Lat: 26, Lon: 56}},
+	}
+	collect := func(query func(fn func(port domain.Port) error) error) []string {
+		var ids []string
+		require.NoError(t, query(func(port domain.Port) error {
+			ids = append(ids, port.Id)
+			return nil
+		}))
+		sort.Strings(ids)
+		return ids
+	}
+
+	t.Run("BoundingBox", func(t *testing.T) {
+		box := domain.BoundingBox{MinLat: 24, MinLon: 54, MaxLat: 27, MaxLon: 57}
+		ids := collect(func(fn func(port domain.Port) error) error {
+			return repo.PortsInBoundingBox(context.TODO(), box, domain.PortFilter{}, 0, fn)
+		})
+		assert.Equal(t, []string{"AEAUH", "AEDXB", "OMKHS"}, ids)
+	})
+	t.Run("BoundingBoxWithFilterAndLimit", func(t *testing.T) {
+		box := domain.BoundingBox{MinLat: 24, MinLon: 54, MaxLat: 28, MaxLon: 57}
+		ids := collect(func(fn func(port domain.Port) error) error {
+			return repo.PortsInBoundingBox(context.TODO(), box, domain.PortFilter{Country: "united arab emirates"}, 1, fn)
+		})
+		assert.Len(t, ids, 1)
+		assert.Contains(t, []string{"AEAUH", "AEDXB"}, ids[0])
+	})
+	t.Run("BoundingBoxAcrossTheAntimeridian", func(t *testing.T) {
+		box := domain.BoundingBox{MinLat: -20, MinLon: 170, MaxLat: -10, MaxLon: -170}
+		ids := collect(func(fn func(port domain.Port) error) error {
+			return repo.PortsInBoundingBox(context.TODO(), box, domain.PortFilter{}, 0, fn)
+		})
+		assert.Equal(t, []string{"FJSUV", "WSAPW"}, ids)
+	})
+	t.Run("PolygonWithHole", func(t *testing.T) {
+		ids := collect(func(fn func(port domain.Port) error) error {
+			return repo.PortsInPolygon(context.TODO(), hormuz, domain.PortFilter{}, 0, fn)
+		})
+		assert.Equal(t, []string{"IRBND"}, ids)
+	})
+}
+
+func testDeletePorts(t *testing.T, newRepository repositoryFactory) {
+	ports := []domain.Port{
+		{Id: "AEAUH", Name: "Abu Dhabi", Country: "United Arab Emirates"},
+		{Id: "AEAJM", Name: "Ajman", Country: "United Arab Emirates"},
+		{Id: "ALDRZ", Name: "Durres", Country: "Albania"},
+	}
+	ctx := context.TODO()
+
+	t.Run("ByIdsIgnoresMissing", func(t *testing.T) {
+		repo := newTestRepository(t, newRepository, ports...)
+		trn := startTransaction(t, repo)
+		count, err := trn.DeletePorts(ctx, []string{"AEAUH", "XXXXX"})
+		require.NoError(t, err)
+		require.NoError(t, trn.Commit(ctx))
+		assert.Equal(t, 1, count)
+		assert.Equal(t, []string{"AEAJM", "ALDRZ"}, listIds(t, repo, domain.PortFilter{}, "", 0))
+	})
+	t.Run("ByFilter", func(t *testing.T) {
+		repo := newTestRepository(t, newRepository, ports...)
+		trn := startTransaction(t, repo)
+		count, err := trn.DeletePortsByFilter(ctx, domain.PortFilter{Country: "united arab emirates"})
+		require.NoError(t, err)
+		require.NoError(t, trn.Commit(ctx))
+		assert.Equal(t, 2, count)
+		assert.Equal(t, []string{"ALDRZ"}, listIds(t, repo, domain.PortFilter{}, "", 0))
+	})
+	t.Run("Aborted", func(t *testing.T) {
+		repo := newTestRepository(t, newRepository, ports...)
+		trn := startTransaction(t, repo)
+		count, err := trn.DeletePortsByFilter(ctx, domain.PortFilter{Country: "Albania"})
+		require.NoError(t, err)
+		trn.Abort()
+		assert.Equal(t, 1, count)
+		assert.Equal(t, []string{"AEAJM", "AEAUH", "ALDRZ"}, listIds(t, repo, domain.PortFilter{}, "", 0))
+	})
+	t.Run("IncludesOwnWrites", func(t *testing.T) {
+		repo := newTestRepository(t, newRepository, ports...)
+		trn := startTransaction(t, repo)
+		_, err := trn.AddOrUpdatePort(ctx, domain.Port{Id: "ALSAR", Name: "Sarande", Country: "Albania"})
+		require.NoError(t, err)
+		_, err = trn.AddOrUpdatePort(ctx, domain.Port{Id: "AEAJM", Name: "Ajman", Country: "Albania"})
+		require.NoError(t, err)
+		count, err := trn.DeletePortsByFilter(ctx, domain.PortFilter{Country: "albania"})
+		require.NoError(t, err)
+		require.NoError(t, trn.Commit(ctx))
+		assert.Equal(t, 3, count)
+		assert.Equal(t, []string{"AEAUH"}, listIds(t, repo, domain.PortFilter{}, "", 0))
+	})
+	t.Run("ClosedTransaction", func(t *testing.T) {
+		repo := newTestRepository(t, newRepository, ports...)
+		trn := startTransaction(t, repo)
+		require.NoError(t, trn.Commit(ctx))
+		_, err := trn.DeletePorts(ctx, []string{"AEAUH"})
+		assert.ErrorIs(t, err, cerror.TransactionClosed)
+	})
+}
+
+func testTransactions(t *testing.T, newRepository repositoryFactory) {
+	ctx := context.TODO()
+	repo := newTestRepository(t, newRepository, domain.Port{Id: "AEAUH", Name: "Abu Dhabi", City: "Abu Dhabi", Alias: []string{"Abu Zaby"}})
+
+	trn := startTransaction(t, repo)
+	previous, err := trn.AddOrUpdatePort(ctx, domain.Port{Id: "AEAUH", Name: "Abu Dhabi", City: "Al Mina"})
+	require.NoError(t, err)
+	assert.Equal(t, "Abu Dhabi", previous.City)
+	previous, err = trn.AddOrUpdatePort(ctx, domain.Port{Id: "AEAJM", Name: "Ajman"})
+	require.NoError(t, err)
+	assert.Nil(t, previous)
+	// the transaction sees its own writes, the readers only the committed data
+	port, err := trn.GetById(ctx, "AEAJM")
+	require.NoError(t, err)
+	assert.Equal(t, "Ajman", port.Name)
+	port, err = repo.GetById(ctx, "AEAJM")
+	require.NoError(t, err)
+	assert.Nil(t, port)
+	assert.Equal(t, []string{"AEAUH"}, listIds(t, repo, domain.PortFilter{}, "", 0))
+	trn.Abort()
+
+	port, err = repo.GetById(ctx, "AEAJM")
+	require.NoError(t, err)
+	assert.Nil(t, port)
+
+	trn = startTransaction(t, repo)
+	_, err = trn.AddOrUpdatePort(ctx, domain.Port{Id: "AEAUH", Name: "Abu Dhabi", City: "Al Mina"})
+	require.NoError(t, err)
+	require.NoError(t, trn.Commit(ctx))
+
+	// the updated port moved in the indexes
+	assert.Empty(t, listIds(t, repo, domain.PortFilter{City: "abu dhabi"}, "", 0))
+	assert.Equal(t, []string{"AEAUH"}, listIds(t, repo, domain.PortFilter{City: "al mina"}, "", 0))
+	results, err := repo.SearchPorts(ctx, "zaby", 0, 10)
+	require.NoError(t, err)
+	assert.Empty(t, results)
+	_, err = trn.AddOrUpdatePort(ctx, domain.Port{Id: "AEAJM", Name: "Ajman"})
+	assert.ErrorIs(t, err, cerror.TransactionClosed)
+	assert.ErrorIs(t, trn.Commit(ctx), cerror.TransactionClosed)
+}
+
+func testVersions(t *testing.T, newRepository repositoryFactory) {
+	ctx := context.TODO()
+	repo := newTestRepository(t, newRepository, domain.Port{Id: "AEAUH", Name: "Abu Dhabi"})
+
+	created, err := repo.GetById(ctx, "AEAUH")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), created.Version)
+	assert.False(t, created.UpdatedAt.IsZero())
+
+	// the version sent by the caller is replaced by the next one
+	trn := startTransaction(t, repo)
+	_, err = trn.AddOrUpdatePort(ctx, domain.Port{Id: "AEAUH", Name: "Abu Dhabi", City: "Al Mina", Version: 7})
+	require.NoError(t, err)
+	require.NoError(t, trn.Commit(ctx))
+	updated, err := repo.GetById(ctx, "AEAUH")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), updated.Version)
+	assert.False(t, updated.UpdatedAt.Before(created.UpdatedAt))
+
+	// the lists return the versions too
+	err = repo.ListPorts(ctx, domain.PortFilter{}, "", 0, func(port domain.Port) error {
+		assert.Equal(t, updated.Version, port.Version)
+		assert.True(t, updated.UpdatedAt.Equal(port.UpdatedAt))
+		return nil
+	})
+	require.NoError(t, err)
+
+	t.Run("ChangedAndChangedBackIsAConflict", func(t *testing.T) {
+		reading := startTransaction(t, repo)
+		_, err := reading.GetById(ctx, "AEAUH")
+		require.NoError(t, err)
+		for _, city := range []string{"Abu Dhabi", "Al Mina"} {
+			trn := startTransaction(t, repo)
+			_, err = trn.AddOrUpdatePort(ctx, domain.Port{Id: "AEAUH", Name: "Abu Dhabi", City: city})
+			require.NoError(t, err)
+			require.NoError(t, trn.Commit(ctx))
+		}
+		// postgres already stops the write, the others notice on commit
+		_, err = reading.AddOrUpdatePort(ctx, domain.Port{Id: "AEAUH", Name: "Abu Dhabi", City: "Ruwais"})
+		if err == nil {
+			err = reading.Commit(ctx)
+		}
+		assert.ErrorIs(t, err, cerror.TransactionConflict)
+	})
+
+	t.Run("DeletedAndWrittenAgainGoesOn", func(t *testing.T) {
+		trn := startTransaction(t, repo)
+		_, err := trn.AddOrUpdatePort(ctx, domain.Port{Id: "AEDXB", Name: "Dubai"})
+		require.NoError(t, err)
+		require.NoError(t, trn.Commit(ctx))
+		trn = startTransaction(t, repo)
+		_, err = trn.DeletePorts(ctx, []string{"AEDXB"})
+		require.NoError(t, err)
+		require.NoError(t, trn.Commit(ctx))
+		// the compaction keeps the delete, it holds the last version
+		_, err = repo.CompactHistory(ctx, domain.HistoryRetention{MaxAge: time.Nanosecond})
+		require.NoError(t, err)
+		trn = startTransaction(t, repo)
+		_, err = trn.AddOrUpdatePort(ctx, domain.Port{Id: "AEDXB", Name: "Dubai", City: "Dubai"})
+		require.NoError(t, err)
+		require.NoError(t, trn.Commit(ctx))
+		recreated, err := repo.GetById(ctx, "AEDXB")
+		require.NoError(t, err)
+		assert.Equal(t, uint64(2), recreated.Version)
+
+		// a curation tool still holding the deleted port
+		svr := service.NewPortService(repo)
+		trn = startTransaction(t, repo)
+		results, err := svr.UpsertPorts(ctx, trn, []domain.Port{{Id: "AEDXB", Name: "Dubai", City: "Jebel Ali", Version: 1}}, false)
+		require.NoError(t, err)
+		require.NoError(t, trn.Commit(ctx))
+		require.Len(t, results, 1)
+		assert.Equal(t, domain.UpsertRejected, results[0].Status)
+		assert.ErrorIs(t, results[0].Err, cerror.VersionMismatch)
+		port, err := repo.GetById(ctx, "AEDXB")
+		require.NoError(t, err)
+		assert.Equal(t, "Dubai", port.City)
+	})
+}
+
+func testBatchUpserts(t *testing.T, newRepository repositoryFactory) {
+	ctx := context.TODO()
+	repo := newTestRepository(t, newRepository, domain.Port{Id: "AEAUH", Name: "Abu Dhabi"})
+
+	trn := startTransaction(t, repo)
+	replaced, err := trn.AddOrUpdatePorts(ctx, []domain.Port{
+		{Id: "AEAJM", Name: "Ajman"},
+		{Id: "AEAUH", Name: "Abu Dhabi", City: "Abu Dhabi"},
+		// the second write of the same port replaces the first one
+		{Id: "AEAJM", Name: "Ajman", City: "Ajman"},
+	})
+	require.NoError(t, err)
+	require.Len(t, replaced, 3)
+	assert.Nil(t, replaced[0])
+	require.NotNil(t, replaced[1])
+	assert.Equal(t, uint64(1), replaced[1].Version)
+	require.NotNil(t, replaced[2])
+	assert.Equal(t, "", replaced[2].City)
+
+	// the transaction sees its own writes
+	found, err := trn.GetByIds(ctx, []string{"AEAJM", "AEDXB", "AEAUH"})
+	require.NoError(t, err)
+	require.Len(t, found, 3)
+	require.NotNil(t, found[0])
+	assert.Equal(t, "Ajman", found[0].City)
+	assert.Equal(t, uint64(2), found[0].Version)
+	assert.Nil(t, found[1])
+	require.NotNil(t, found[2])
+	assert.Equal(t, uint64(2), found[2].Version)
+	require.NoError(t, trn.Commit(ctx))
+
+	assert.Equal(t, []string{"AEAJM", "AEAUH"}, listIds(t, repo, domain.PortFilter{}, "", 0))
+	stored, err := repo.GetById(ctx, "AEAJM")
+	require.NoError(t, err)
+	assert.Equal(t, "Ajman", stored.City)
+}
+
+func testHistory(t *testing.T, newRepository repositoryFactory) {
+	ctx := context.TODO()
+	repo := newTestRepository(t, newRepository, domain.Port{Id: "AEAUH", Name: "Abu Dhabi", Coordinates: []float64{54.37, 24.47}})
+	var transactions []string
+	for _, coordinates := range [][]float64{{54.38, 24.48}, {54.39, 24.49}} {
+		trn := startTransaction(t, repo)
+		_, err := trn.AddOrUpdatePort(ctx, domain.Port{Id: "AEAUH", Name: "Abu Dhabi", Coordinates: coordinates})
+		require.NoError(t, err)
+		require.NoError(t, trn.Commit(ctx))
+		transactions = append(transactions, trn.Id())
+	}
+	trn := startTransaction(t, repo)
+	_, err := trn.DeletePorts(ctx, []string{"AEAUH"})
+	require.NoError(t, err)
+	require.NoError(t, trn.Commit(ctx))
+	transactions = append(transactions, trn.Id())
+
+	history, err := repo.GetPortHistory(ctx, "AEAUH")
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	for i, revision := range history {
+		assert.Equal(t, uint64(i+1), revision.Port.Version)
+		assert.Equal(t, transactions[i], revision.TransactionId)
+		assert.True(t, revision.ReplacedAt.After(revision.Port.UpdatedAt))
+	}
+	assert.Equal(t, []float64{54.37, 24.47}, history[0].Port.Coordinates)
+	assert.Equal(t, []bool{false, false, true}, []bool{history[0].Deleted, history[1].Deleted, history[2].Deleted})
+	empty, err := repo.GetPortHistory(ctx, "AEAJM")
+	require.NoError(t, err)
+	assert.Empty(t, empty)
+
+	t.Run("AsOf", func(t *testing.T) {
+		asOf := func(at time.Time) *domain.Port {
+			port, err := repo.GetByIdAsOf(ctx, "AEAUH", at)
+			require.NoError(t, err)
+			return port
+		}
+		assert.Nil(t, asOf(history[0].Port.UpdatedAt.Add(-time.Microsecond)))
+		assert.Equal(t, []float64{54.37, 24.47}, asOf(history[0].Port.UpdatedAt).Coordinates)
+		assert.Equal(t, []float64{54.37, 24.47}, asOf(history[0].ReplacedAt.Add(-time.Microsecond)).Coordinates)
+		assert.Equal(t, []float64{54.38, 24.48}, asOf(history[0].ReplacedAt).Coordinates)
+		assert.Equal(t, uint64(3), asOf(history[2].ReplacedAt.Add(-time.Microsecond)).Version)
+		assert.Nil(t, asOf(history[2].ReplacedAt))
+	})
+	t.Run("Compaction", func(t *testing.T) {
+		removed, err := repo.CompactHistory(ctx, domain.HistoryRetention{MaxRevisions: 2})
+		require.NoError(t, err)
+		assert.Equal(t, 1, removed)
+		compacted, err := repo.GetPortHistory(ctx, "AEAUH")
+		require.NoError(t, err)
+		assert.Equal(t, history[1:], compacted)
+		// what happened before the retention is not known anymore
+		port, err := repo.GetByIdAsOf(ctx, "AEAUH", history[0].Port.UpdatedAt)
+		require.NoError(t, err)
+		assert.Nil(t, port)
+
+		// the delete stays, the port goes on from its version if it's written again
+		removed, err = repo.CompactHistory(ctx, domain.HistoryRetention{MaxAge: time.Nanosecond})
+		require.NoError(t, err)
+		assert.Equal(t, 1, removed)
+		compacted, err = repo.GetPortHistory(ctx, "AEAUH")
+		require.NoError(t, err)
+		assert.Equal(t, history[2:], compacted)
+	})
+}
+
+// testHistoryStampedOnCommit a long import writing before another commit and committing after it
+func testHistoryStampedOnCommit(t *testing.T, newRepository repositoryFactory) {
+	ctx := context.TODO()
+	repo := newTestRepository(t, newRepository,
+		domain.Port{Id: "AEAUH", Name: "Abu Dhabi"},
+		domain.Port{Id: "AEDXB", Name: "Dubai"},
+		domain.Port{Id: "AEJEA", Name: "Jebel Ali"},
+	)
+	long := startTransaction(t, repo)
+	_, err := long.AddOrUpdatePort(ctx, domain.Port{Id: "AEAUH", Name: "Abu Dhabi Port"})
+	require.NoError(t, err)
+	_, err = long.DeletePorts(ctx, []string{"AEJEA"})
+	require.NoError(t, err)
+	time.Sleep(time.Millisecond)
+	short := startTransaction(t, repo)
+	_, err = short.AddOrUpdatePort(ctx, domain.Port{Id: "AEDXB", Name: "Dubai Port"})
+	require.NoError(t, err)
+	require.NoError(t, short.Commit(ctx))
+	time.Sleep(time.Millisecond)
+	require.NoError(t, long.Commit(ctx))
+
+	dubai, err := repo.GetById(ctx, "AEDXB")
+	require.NoError(t, err)
+	abuDhabi, err := repo.GetById(ctx, "AEAUH")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), abuDhabi.Version)
+	// the import became visible after the other commit
+	assert.True(t, abuDhabi.UpdatedAt.After(dubai.UpdatedAt))
+	asOf, err := repo.GetByIdAsOf(ctx, "AEAUH", dubai.UpdatedAt)
+	require.NoError(t, err)
+	assert.Equal(t, "Abu Dhabi", asOf.Name)
+	// the upserts and the deletes of a commit share its time
+	history, err := repo.GetPortHistory(ctx, "AEJEA")
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, abuDhabi.UpdatedAt, history[0].ReplacedAt)
+}
+
+func testConcurrentTransactions(t *testing.T, newRepository repositoryFactory) {
+	ctx := context.TODO()
+
+	t.Run("IndependentImportsInParallel", func(t *testing.T) {
+		repo := newTestRepository(t, newRepository)
+		const streams, portsPerStream = 4, 50
+		var wg sync.WaitGroup
+		errs := make(chan error, streams)
+		for stream := 0; stream < streams; stream++ {
+			wg.Add(1)
+			go func(stream int) {
+				defer wg.Done()
+				trn, err := repo.StartTransaction(ctx)
+				if err != nil {
+					errs <- err
+					return
+				}
+				defer trn.Abort()
+				for i := 0; i < portsPerStream; i++ {
+					if _, err = trn.AddOrUpdatePort(ctx, domain.Port{Id: fmt.Sprintf("S%dP%03d", stream, i), Name: "Port"}); err != nil {
+						errs <- err
+						return
+					}
+				}
+				errs <- trn.Commit(ctx)
+			}(stream)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			require.NoError(t, err)
+		}
+		assert.Len(t, listIds(t, repo, domain.PortFilter{}, "", 0), streams*portsPerStream)
+		assert.Equal(t, uint64(streams*portsPerStream), repo.LastChangeSequence())
+	})
+	t.Run("FirstCommitterWins", func(t *testing.T) {
+		repo := newTestRepository(t, newRepository, domain.Port{Id: "AEAUH", Name: "Abu Dhabi"})
+		first, second := startTransaction(t, repo), startTransaction(t, repo)
+		_, err := first.AddOrUpdatePort(ctx, domain.Port{Id: "AEAUH", Name: "Abu Dhabi", City: "First"})
+		require.NoError(t, err)
+		_, err = second.AddOrUpdatePort(ctx, domain.Port{Id: "AEAUH", Name: "Abu Dhabi", City: "Second"})
+		require.NoError(t, err)
+		_, err = second.AddOrUpdatePort(ctx, domain.Port{Id: "AEAJM", Name: "Ajman"})
+		require.NoError(t, err)
+		require.NoError(t, first.Commit(ctx))
+
+		assert.ErrorIs(t, second.Commit(ctx), cerror.TransactionConflict)
+		// nothing of the losing transaction is saved
+		port, err := repo.GetById(ctx, "AEAUH")
+		require.NoError(t, err)
+		assert.Equal(t, "First", port.City)
+		assert.Equal(t, []string{"AEAUH"}, listIds(t, repo, domain.PortFilter{}, "", 0))
+	})
+	// the imports write the same ports in the opposite order and both reach Commit holding the lock of the first one,
+	// postgres copies the first batch of each right away. One of them wins, they never wait for each other forever
+	t.Run("OverlappingImportsCommit", func(t *testing.T) {
+		repo := newTestRepository(t, newRepository)
+		overlapping := [][]string{{"AEAUH", "AEAJM"}, {"AEAJM", "AEAUH"}}
+		var written sync.WaitGroup
+		written.Add(len(overlapping))
+		errs := make(chan error, len(overlapping))
+		for stream, ids := range overlapping {
+			go func(stream int, ids []string) {
+				name := fmt.Sprintf("Stream %d", stream)
+				trn, err := repo.StartTransaction(ctx)
+				if err == nil {
+					defer trn.Abort()
+					// more than a postgres batch, so the first port is copied before the second one is written
+					first := []domain.Port{{Id: ids[0], Name: name}}
+					for i := 0; i < postgresBatchSize; i++ {
+						first = append(first, domain.Port{Id: fmt.Sprintf("S%dP%05d", stream, i), Name: name})
+					}
+					if _, err = trn.AddOrUpdatePorts(ctx, first); err == nil {
+						_, err = trn.AddOrUpdatePort(ctx, domain.Port{Id: ids[1], Name: name})
+					}
+				}
+				written.Done()
+				if err != nil {
+					errs <- err
+					return
+				}
+				written.Wait()
+				errs <- trn.Commit(ctx)
+			}(stream, ids)
+		}
+		var committed, conflicts int
+		for range overlapping {
+			select {
+			case err := <-errs:
+				switch {
+				case err == nil:
+					committed++
+				case errors.Is(err, cerror.TransactionConflict):
+					conflicts++
+				default:
+					t.Fatalf("unexpected error: %v", err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("the overlapping imports are waiting for each other")
+			}
+		}
+		assert.Equal(t, 1, committed)
+		assert.Equal(t, 1, conflicts)
+		// both ports come from the winner
+		abuDhabi, err := repo.GetById(ctx, "AEAUH")
+		require.NoError(t, err)
+		ajman, err := repo.GetById(ctx, "AEAJM")
+		require.NoError(t, err)
+		assert.Equal(t, abuDhabi.Name, ajman.Name)
+	})
+	// streams importing the same ports in different orders together with their own ones, all in parallel.
+	// All of them read the shared ports before the first commit, so only one can win
+	t.Run("OverlappingImportsInParallel", func(t *testing.T) {
+		repo := newTestRepository(t, newRepository)
+		shared := []string{"AEAUH", "AEAJM", "AEDXB", "AEJEA"}
+		const streams, portsPerStream = 4, 50
+		var written sync.WaitGroup
+		written.Add(streams)
+		errs := make(chan error, streams)
+		for stream := 0; stream < streams; stream++ {
+			go func(stream int) {
+				name := fmt.Sprintf("Stream %d", stream)
+				trn, err := repo.StartTransaction(ctx)
+				if err == nil {
+					defer trn.Abort()
+					for i := 0; i < len(shared) && err == nil; i++ {
+						// every stream starts from a different shared port
+						batch := []domain.Port{{Id: shared[(stream+i)%len(shared)], Name: name}}
+						for j := 0; j < portsPerStream; j++ {
+							batch = append(batch, domain.Port{Id: fmt.Sprintf("S%dB%dP%03d", stream, i, j), Name: name})
+						}
+						_, err = trn.AddOrUpdatePorts(ctx, batch)
+					}
+				}
+				written.Done()
+				if err != nil {
+					errs <- err
+					return
+				}
+				written.Wait()
+				errs <- trn.Commit(ctx)
+			}(stream)
+		}
+		committed := 0
+		for i := 0; i < streams; i++ {
+			select {
+			case err := <-errs:
+				if err == nil {
+					committed++
+				} else if !errors.Is(err, cerror.TransactionConflict) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			case <-time.After(30 * time.Second):
+				t.Fatal("the overlapping imports are waiting for each other")
+			}
+		}
+		assert.Equal(t, 1, committed)
+		// only the ports of the winner are saved
+		assert.Len(t, listIds(t, repo, domain.PortFilter{}, "", 0), len(shared)*(portsPerStream+1))
+		var names []string
+		for _, id := range shared {
+			port, err := repo.GetById(ctx, id)
+			require.NoError(t, err)
+			names = append(names, port.Name)
+		}
+		assert.Equal(t, []string{names[0], names[0], names[0], names[0]}, names)
+	})
+	t.Run("DeleteOfChangedPort", func(t *testing.T) {
+		repo := newTestRepository(t, newRepository, domain.Port{Id: "AEAUH", Name: "Abu Dhabi"})
+		deleting, updating := startTransaction(t, repo), startTransaction(t, repo)
+		port, err := deleting.GetById(ctx, "AEAUH")
+		require.NoError(t, err)
+		require.NotNil(t, port)
+		_, err = updating.AddOrUpdatePort(ctx, domain.Port{Id: "AEAUH", Name: "Abu Dhabi", City: "Abu Dhabi"})
+		require.NoError(t, err)
+		require.NoError(t, updating.Commit(ctx))
+
+		// postgres already stops the delete, the others notice on commit
+		_, err = deleting.DeletePorts(ctx, []string{"AEAUH"})
+		if err == nil {
+			err = deleting.Commit(ctx)
+		}
+		assert.ErrorIs(t, err, cerror.TransactionConflict)
+		port, err = repo.GetById(ctx, "AEAUH")
+		require.NoError(t, err)
+		assert.Equal(t, "Abu Dhabi", port.City)
+	})
+	t.Run("AbortDoesNotTouchOthers", func(t *testing.T) {
+		repo := newTestRepository(t, newRepository)
+		first, second := startTransaction(t, repo), startTransaction(t, repo)
+		_, err := first.AddOrUpdatePort(ctx, domain.Port{Id: "AEAUH", Name: "Abu Dhabi"})
+		require.NoError(t, err)
+		_, err = second.AddOrUpdatePort(ctx, domain.Port{Id: "AEAJM", Name: "Ajman"})
+		require.NoError(t, err)
+		second.Abort()
+		require.NoError(t, first.Commit(ctx))
+		assert.Equal(t, []string{"AEAUH"}, listIds(t, repo, domain.PortFilter{}, "", 0))
+	})
+}
+
+// readWithoutWaiting fails the test when read doesn't return in time, the read was waiting for a writer
+func readWithoutWaiting(t *testing.T, read func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		read()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the read waited for the writer")
+	}
+}
+
+// testReadsDuringImport the reads see the last committed ports while a transaction is writing, and don't wait for it
+func testReadsDuringImport(t *testing.T, newRepository repositoryFactory) {
+	ctx := context.TODO()
+	repo := newTestRepository(t, newRepository,
+		domain.Port{Id: "AEAUH", Name: "Abu Dhabi", Code: "52001"},
+		domain.Port{Id: "AEAJM", Name: "Ajman", Code: "52000"},
+	)
+	trn := startTransaction(t, repo)
+	_, err := trn.AddOrUpdatePorts(ctx, []domain.Port{
+		{Id: "AEAUH", Name: "Abu Dhabi", City: "Abu Dhabi", Code: "52001"},
+		{Id: "AEDXB", Name: "Dubai", Code: "52005"},
+	})
+	require.NoError(t, err)
+	_, err = trn.DeletePorts(ctx, []string{"AEAJM"})
+	require.NoError(t, err)
+
+	readWithoutWaiting(t, func() {
+		port, err := repo.GetById(ctx, "AEAUH")
+		assert.NoError(t, err)
+		if assert.NotNil(t, port) {
+			assert.Equal(t, "", port.City)
+			assert.Equal(t, uint64(1), port.Version)
+		}
+		ids, err := collectIds(repo, domain.PortFilter{}, "", 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"AEAJM", "AEAUH"}, ids)
+		found, err := repo.FindByCode(ctx, "52005")
+		assert.NoError(t, err)
+		assert.Empty(t, found)
+		results, err := repo.SearchPorts(ctx, "dubai", 0, 10)
+		assert.NoError(t, err)
+		assert.Empty(t, results)
+	})
+	require.NoError(t, trn.Commit(ctx))
+
+	assert.Equal(t, []string{"AEAUH", "AEDXB"}, listIds(t, repo, domain.PortFilter{}, "", 0))
+	port, err := repo.GetById(ctx, "AEAUH")
+	require.NoError(t, err)
+	assert.Equal(t, "Abu Dhabi", port.City)
+}
+
+// pagedPorts more ports than the adapters read with every page
+const pagedPorts = postgresPageSize + boltPageSize
+
+// testCommitsBetweenPages the streaming reads see the ports of a single commit even when another one
+// lands while the client is reading the first page
+func testCommitsBetweenPages(t *testing.T, newRepository repositoryFactory) {
+	ctx := context.TODO()
+	initial := make([]domain.Port, pagedPorts)
+	for i := range initial {
+		initial[i] = domain.Port{Id: fmt.Sprintf("P%05d", i), Name: "Port", Country: "Albania", Coordinates: []float64{19.45, 41.31}}
+	}
+	last, deleted := initial[pagedPorts-1].Id, initial[pagedPorts-2].Id
+	box := domain.BoundingBox{MinLat: 41, MinLon: 19, MaxLat: 42, MaxLon: 20}
+	streams := map[string]func(repo ports.Repository, fn func(port domain.Port) error) error{
+		"ListPorts": func(repo ports.Repository, fn func(port domain.Port) error) error {
+			return repo.ListPorts(ctx, domain.PortFilter{}, "", 0, fn)
+		},
+		"ListPortsByCountry": func(repo ports.Repository, fn func(port domain.Port) error) error {
+			return repo.ListPorts(ctx, domain.PortFilter{Country: "albania"}, "", 0, fn)
+		},
+		"PortsInBoundingBox": func(repo ports.Repository, fn func(port domain.Port) error) error {
+			return repo.PortsInBoundingBox(ctx, box, domain.PortFilter{}, 0, fn)
+		},
+	}
+	for name, stream := range streams {
+		stream := stream
+		t.Run(name, func(t *testing.T) {
+			repo := newTestRepository(t, newRepository, initial...)
+			listed := make(map[string]domain.Port)
+			err := stream(repo, func(port domain.Port) error {
+				if len(listed) == 0 {
+					trn := startTransaction(t, repo)
+					_, err := trn.AddOrUpdatePorts(ctx, []domain.Port{
+						{Id: last, Name: "Port", Country: "Albania", City: "Changed", Coordinates: []float64{19.45, 41.31}},
+						{Id: "Q00000", Name: "Port", Country: "Albania", Coordinates: []float64{19.45, 41.31}},
+					})
+					require.NoError(t, err)
+					_, err = trn.DeletePorts(ctx, []string{deleted})
+					require.NoError(t, err)
+					require.NoError(t, trn.Commit(ctx))
+				}
+				listed[port.Id] = port
+				return nil
+			})
+			require.NoError(t, err)
+			assert.Len(t, listed, pagedPorts)
+			assert.Equal(t, "", listed[last].City)
+			assert.Contains(t, listed, deleted)
+			assert.NotContains(t, listed, "Q00000")
+		})
+	}
+}
+
+func testWatchChanges(t *testing.T, newRepository repositoryFactory) {
+	ctx := context.TODO()
+	repo := newTestRepository(t, newRepository, domain.Port{Id: "AEAUH", Name: "Abu Dhabi"})
+	assert.Equal(t, uint64(1), repo.LastChangeSequence())
+
+	trn := startTransaction(t, repo)
+	_, err := trn.AddOrUpdatePort(ctx, domain.Port{Id: "AEAUH", Name: "Abu Dhabi", City: "Abu Dhabi"})
+	require.NoError(t, err)
+	_, err = trn.AddOrUpdatePort(ctx, domain.Port{Id: "AEAJM", Name: "Ajman"})
+	require.NoError(t, err)
+	// nothing is published before the commit
+	assert.Equal(t, uint64(1), repo.LastChangeSequence())
+	require.NoError(t, trn.Commit(ctx))
+
+	trn = startTransaction(t, repo)
+	_, err = trn.DeletePorts(ctx, []string{"AEAUH"})
+	require.NoError(t, err)
+	trn.Abort()
+
+	trn = startTransaction(t, repo)
+	_, err = trn.DeletePorts(ctx, []string{"AEAJM"})
+	require.NoError(t, err)
+	require.NoError(t, trn.Commit(ctx))
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var changes []string
+	err = repo.WatchChanges(watchCtx, 1, func(change domain.PortChange) error {
+		changes = append(changes, fmt.Sprintf("%d %s %s", change.Sequence, change.Type, change.Port.Id))
+		if change.Sequence == repo.LastChangeSequence() {
+			cancel()
+		}
+		return nil
+	})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ElementsMatch(t, []string{"2 updated AEAUH", "3 created AEAJM"}, changes[:2])
+	assert.Equal(t, "4 deleted AEAJM", changes[2])
+}
+
+func testWatchChangesWaitsForCommits(t *testing.T, newRepository repositoryFactory) {
+	ctx, cancel := context.WithTimeout(context.TODO(), 5*time.Second)
+	defer cancel()
+	repo := newTestRepository(t, newRepository)
+
+	received := make(chan domain.PortChange)
+	afterSequence := repo.LastChangeSequence()
+	go func() {
+		_ = repo.WatchChanges(ctx, afterSequence, func(change domain.PortChange) error {
+			received <- change
+			return nil
+		})
+	}()
+	trn := startTransaction(t, repo)
+	_, err := trn.AddOrUpdatePort(ctx, domain.Port{Id: "AEAUH", Name: "Abu Dhabi"})
+	require.NoError(t, err)
+	require.NoError(t, trn.Commit(ctx))
+
+	select {
+	case change := <-received:
+		assert.Equal(t, domain.ChangeCreated, change.Type)
+		assert.Equal(t, "AEAUH", change.Port.Id)
+	case <-ctx.Done():
+		t.Fatal("no change received")
+	}
+}
+
+func TestPortInMemoryRepository_ReadsDuringCommit(t *testing.T) {
+	ctx := context.TODO()
+	repo, err := NewPortRepository()
+	require.NoError(t, err)
+	trn := startTransaction(t, repo)
+	_, err = trn.AddOrUpdatePort(ctx, domain.Port{Id: "AEAUH", Name: "Abu Dhabi"})
+	require.NoError(t, err)
+	require.NoError(t, trn.Commit(ctx))
+
+	// a commit in the middle of writing a big import holds both
+	repo.commitMx.Lock()
+	defer repo.commitMx.Unlock()
+	writing := repo.db.Txn(true)
+	defer writing.Abort()
+	require.NoError(t, writing.Insert(tableName, domain.Port{Id: "AEDXB", Name: "Dubai"}))
+
+	readWithoutWaiting(t, func() {
+		ids, err := collectIds(repo, domain.PortFilter{}, "", 0)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"AEAUH"}, ids)
+		port, err := repo.GetById(ctx, "AEDXB")
+		assert.NoError(t, err)
+		assert.Nil(t, port)
+		_, err = repo.GetPortHistory(ctx, "AEAUH")
+		assert.NoError(t, err)
+	})
+}
+
+func TestChangeFeed_Gap(t *testing.T) {
+	feed := newChangeFeed(1)
+	feed.publish([]domain.PortChange{{Port: domain.Port{Id: "A"}}, {Port: domain.Port{Id: "B"}}, {Port: domain.Port{Id: "C"}}})
+	_, _, err := feed.since(0)
+	assert.ErrorIs(t, err, cerror.ChangeFeedGap)
+	events, _, err := feed.since(2)
+	require.NoError(t, err)
+	assert.Len(t, events, 1)
+}
+
+func TestChangeFeed_FutureSequence(t *testing.T) {
+	// a watcher resuming with a sequence from before a restart that started the numbering again
+	feed := newChangeFeed(10)
+	feed.publish([]domain.PortChange{{Port: domain.Port{Id: "A"}}})
+	_, _, err := feed.since(5)
+	assert.ErrorIs(t, err, cerror.ChangeFeedGap)
+	err = feed.watch(context.TODO(), 5, func(change domain.PortChange) error { return nil })
+	assert.ErrorIs(t, err, cerror.ChangeFeedGap)
+	_, notify, err := feed.since(1)
+	require.NoError(t, err)
+	assert.NotNil(t, notify)
+}
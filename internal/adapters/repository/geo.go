@@ -0,0 +1,250 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-related/fileservice/internal/core/domain"
+	"math"
+	"sort"
+)
+
+const (
+	geoIndex = "geo"
+	// geohashPrecision the precision stored in the index, 9 characters are about 5 meters
+	geohashPrecision = 9
+	// maxCoverCells max number of geohash cells used to cover a box, the less cells the bigger they are
+	maxCoverCells = 32
+	// nearestStartRadiusKm first radius we try for the nearest ports, it grows till we find enough ports
+	nearestStartRadiusKm = 50
+	geohashAlphabet      = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+// geoBox a lat/lon box, it never crosses the antimeridian, such boxes are split in two
+type geoBox struct {
+	MinLat, MinLon, MaxLat, MaxLon float64
+}
+
+func (b geoBox) contains(point domain.GeoPoint) bool {
+	return point.Lat >= b.MinLat && point.Lat <= b.MaxLat && point.Lon >= b.MinLon && point.Lon <= b.MaxLon
+}
+
+// encodeGeohash interleaves the lon and lat bits, starting from lon, and encodes them 5 bits per character
+func encodeGeohash(point domain.GeoPoint, precision int) string {
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+	hash := make([]byte, 0, precision)
+	bits, value, even := 0, 0, true
+	for len(hash) < precision {
+		if even {
+			value = value<<1 | bisect(&lonRange, point.Lon)
+		} else {
+			value = value<<1 | bisect(&latRange, point.Lat)
+		}
+		even = !even
+		if bits++; bits == 5 {
+			hash = append(hash, geohashAlphabet[value])
+			bits, value = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+// bisect halves the range keeping the side of the value, returns 1 for the upper half
+func bisect(valueRange *[2]float64, value float64) int {
+	mid := (valueRange[0] + valueRange[1]) / 2
+	if value >= mid {
+		valueRange[0] = mid
+		return 1
+	}
+	valueRange[1] = mid
+	return 0
+}
+
+// geohashCellSize height and width in degrees of the cells for the given precision
+func geohashCellSize(precision int) (float64, float64) {
+	lonBits := (5*precision + 1) / 2
+	latBits := 5 * precision / 2
+	return 180 / math.Pow(2, float64(latBits)), 360 / math.Pow(2, float64(lonBits))
+}
+
+// coverBox the geohash cells that together cover the whole box, it picks the highest precision
+// that doesn't need more than maxCoverCells cells
+func coverBox(box geoBox) []string {
+	precision := geohashPrecision
+	for ; precision > 1; precision-- {
+		height, width := geohashCellSize(precision)
+		rows := math.Ceil((box.MaxLat-box.MinLat)/height) + 1
+		columns := math.Ceil((box.MaxLon-box.MinLon)/width) + 1
+		if rows*columns <= maxCoverCells {
+			break
+		}
+	}
+	height, width := geohashCellSize(precision)
+	seen := make(map[string]bool)
+	var cells []string
+	// sampling every cell size, plus the max edges, hits every cell that intersects the box
+	for lat := box.MinLat; ; lat += height {
+		lat = math.Min(lat, box.MaxLat)
+		for lon := box.MinLon; ; lon += width {
+			lon = math.Min(lon, box.MaxLon)
+			cell := encodeGeohash(domain.GeoPoint{Lat: lat, Lon: lon}, precision)
+			if !seen[cell] {
+				seen[cell] = true
+				cells = append(cells, cell)
+			}
+			if lon >= box.MaxLon {
+				break
+			}
+		}
+		if lat >= box.MaxLat {
+			break
+		}
+	}
+	return cells
+}
+
+// boxesAroundPoint the boxes containing the circle with the given radius around the point
+func boxesAroundPoint(center domain.GeoPoint, radiusKm float64) []geoBox {
+	angularRadius := radiusKm / domain.EarthRadiusKm
+	deltaLat := angularRadius * 180 / math.Pi
+	minLat, maxLat := center.Lat-deltaLat, center.Lat+deltaLat
+	if minLat <= -90 || maxLat >= 90 {
+		// the circle contains a pole so it touches every meridian
+		return []geoBox{{MinLat: math.Max(minLat, -90), MinLon: -180, MaxLat: math.Min(maxLat, 90), MaxLon: 180}}
+	}
+	ratio := math.Sin(angularRadius) / math.Cos(center.Lat*math.Pi/180)
+	if ratio >= 1 || angularRadius >= math.Pi/2 {
+		return []geoBox{{MinLat: minLat, MinLon: -180, MaxLat: maxLat, MaxLon: 180}}
+	}
+	deltaLon := math.Asin(ratio) * 180 / math.Pi
+	return splitAntimeridian(minLat, center.Lon-deltaLon, maxLat, center.Lon+deltaLon)
+}
+
+// boxesForBoundingBox boxes crossing the antimeridian are split in two
+func boxesForBoundingBox(box domain.BoundingBox) []geoBox {
+	if box.MinLon > box.MaxLon {
+		return splitAntimeridian(box.MinLat, box.MinLon-360, box.MaxLat, box.MaxLon)
+	}
+	return splitAntimeridian(box.MinLat, box.MinLon, box.MaxLat, box.MaxLon)
+}
+
+// splitAntimeridian longitudes outside of [-180, 180] are wrapped around into a second box
+func splitAntimeridian(minLat, minLon, maxLat, maxLon float64) []geoBox {
+	switch {
+	case minLon < -180:
+		return []geoBox{
+			{MinLat: minLat, MinLon: minLon + 360, MaxLat: maxLat, MaxLon: 180},
+			{MinLat: minLat, MinLon: -180, MaxLat: maxLat, MaxLon: maxLon},
+		}
+	case maxLon > 180:
+		return []geoBox{
+			{MinLat: minLat, MinLon: minLon, MaxLat: maxLat, MaxLon: 180},
+			{MinLat: minLat, MinLon: -180, MaxLat: maxLat, MaxLon: maxLon - 360},
+		}
+	default:
+		return []geoBox{{MinLat: minLat, MinLon: minLon, MaxLat: maxLat, MaxLon: maxLon}}
+	}
+}
+
+// visitPortsInBox calls fn for every port with a location inside the box
+func visitPortsInBox(ctx context.Context, trn portIndexes, box geoBox, fn func(port domain.Port, location domain.GeoPoint) error) error {
+	for _, cell := range coverBox(box) {
+		iterator, err := trn.Get(tableName, geoIndex+"_prefix", cell)
+		if err != nil {
+			return err
+		}
+		for raw := iterator.Next(); raw != nil; raw = iterator.Next() {
+			// check if we have any cancellation before continuing
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			port := raw.(domain.Port)
+			location, ok := port.Location()
+			if !ok || !box.contains(location) {
+				continue
+			}
+			if err = fn(port, location); err != nil {
+				return err
+			}
+		}
+		if err = iteratorError(iterator); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// portsWithinRadius the ports within the radius sorted by distance, limit <= 0 means no limit
+func portsWithinRadius(ctx context.Context, trn portIndexes, center domain.GeoPoint, radiusKm float64, limit int) ([]domain.PortDistance, error) {
+	var results []domain.PortDistance
+	for _, box := range boxesAroundPoint(center, radiusKm) {
+		err := visitPortsInBox(ctx, trn, box, func(port domain.Port, location domain.GeoPoint) error {
+			if distance := domain.DistanceKm(center, location); distance <= radiusKm {
+				results = append(results, domain.PortDistance{Port: port, DistanceKm: distance})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sortByDistance(results)
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+func sortByDistance(results []domain.PortDistance) {
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].DistanceKm != results[j].DistanceKm {
+			return results[i].DistanceKm < results[j].DistanceKm
+		}
+		return results[i].Port.Id < results[j].Port.Id
+	})
+}
+
+// geohashIndexer indexes the ports by the geohash of their location, ports without a valid location are left out.
+// Prefix lookups return all the ports inside a geohash cell
+type geohashIndexer struct{}
+
+func (g *geohashIndexer) FromObject(obj interface{}) (bool, []byte, error) {
+	port, ok := obj.(domain.Port)
+	if !ok {
+		return false, nil, fmt.Errorf("unexpected type %T for the geo index", obj)
+	}
+	location, ok := port.Location()
+	if !ok {
+		return false, nil, nil
+	}
+	return true, []byte(encodeGeohash(location, geohashPrecision) + "\x00"), nil
+}
+
+func (g *geohashIndexer) FromArgs(args ...interface{}) ([]byte, error) {
+	hash, err := geohashArg(args...)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(hash + "\x00"), nil
+}
+
+func (g *geohashIndexer) PrefixFromArgs(args ...interface{}) ([]byte, error) {
+	hash, err := geohashArg(args...)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(hash), nil
+}
+
+func geohashArg(args ...interface{}) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("must provide only a single argument")
+	}
+	hash, ok := args[0].(string)
+	if !ok {
+		return "", fmt.Errorf("argument must be a string: %#v", args[0])
+	}
+	return hash, nil
+}
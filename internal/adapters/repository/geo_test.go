@@ -0,0 +1,31 @@
+package repository
+
+import (
+	"github.com/go-related/fileservice/internal/core/domain"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestEncodeGeohash(t *testing.T) {
+	assert.Equal(t, "u4pruydqqvj", encodeGeohash(domain.GeoPoint{Lat: 57.64911, Lon: 10.40744}, 11))
+	assert.Equal(t, "thrr", encodeGeohash(domain.GeoPoint{Lat: 25.25, Lon: 55.27}, 4))
+}
+
+func TestCoverBox_CoversEveryPointInside(t *testing.T) {
+	box := geoBox{MinLat: 24.1, MinLon: 54.2, MaxLat: 25.9, MaxLon: 56.3}
+	cells := coverBox(box)
+	assert.LessOrEqual(t, len(cells), maxCoverCells)
+	for lat := box.MinLat; lat <= box.MaxLat; lat += 0.05 {
+		for lon := box.MinLon; lon <= box.MaxLon; lon += 0.05 {
+			hash := encodeGeohash(domain.GeoPoint{Lat: lat, Lon: lon}, geohashPrecision)
+			covered := false
+			for _, cell := range cells {
+				if hash[:len(cell)] == cell {
+					covered = true
+					break
+				}
+			}
+			assert.True(t, covered, "point %f,%f is not covered", lat, lon)
+		}
+	}
+}
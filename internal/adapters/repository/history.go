@@ -0,0 +1,117 @@
+package repository
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/go-related/fileservice/internal/core/domain"
+	"github.com/hashicorp/go-memdb"
+	"time"
+)
+
+// historyTable the revisions replaced by the commits, in every adapter they are sorted by port id and
+// then by the time they were replaced
+const historyTable = "history"
+
+// newTransactionId a random id, the transactions of the memdb and bolt adapters don't have one of their own
+func newTransactionId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		// crypto/rand doesn't fail on the supported platforms, the time is still unique enough to tag the history
+		return fmt.Sprintf("%032x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+// storedTime the times are kept in microseconds, the precision of postgres, so all the adapters return the same value
+func storedTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Microsecond)
+}
+
+// nextVersion stamps the port written in place of current, that is nil for new ports. A new port goes on from
+// last, the version the id had when it was deleted, so a write expecting a version of the deleted port never
+// matches the new one. The time of a new version is always after the one it replaces, so the history never has
+// two versions at the same time. The transactions stamp their writes when they are buffered so they can read
+// them back, the adapters stamp them again on commit from the committed ports with the time of the commit
+func nextVersion(port domain.Port, current *domain.Port, last uint64, now time.Time) domain.Port {
+	port.Version = last + 1
+	port.UpdatedAt = storedTime(now)
+	if current != nil {
+		port.Version = current.Version + 1
+		if !port.UpdatedAt.After(current.UpdatedAt) {
+			port.UpdatedAt = current.UpdatedAt.Add(time.Microsecond)
+		}
+	}
+	return port
+}
+
+// lastVersion the highest version in the history of a port, 0 when it has none. The compaction keeps the
+// revision of the last delete, so a port written again after a delete always finds it
+func lastVersion(revisions []domain.PortRevision) uint64 {
+	var last uint64
+	for _, revision := range revisions {
+		if revision.Port.Version > last {
+			last = revision.Port.Version
+		}
+	}
+	return last
+}
+
+// convertRevisions the revisions replaced by the committed changes, a deleted port is replaced at the commit time
+func convertRevisions(changes memdb.Changes, transactionId string, committedAt time.Time) []domain.PortRevision {
+	var result []domain.PortRevision
+	for _, change := range changes {
+		if change.Table != tableName || change.Before == nil {
+			continue
+		}
+		revision := domain.PortRevision{Port: change.Before.(domain.Port), TransactionId: transactionId}
+		if change.After != nil {
+			revision.ReplacedAt = change.After.(domain.Port).UpdatedAt
+		} else {
+			revision.Deleted = true
+			revision.ReplacedAt = storedTime(committedAt)
+			if !revision.ReplacedAt.After(revision.Port.UpdatedAt) {
+				revision.ReplacedAt = revision.Port.UpdatedAt.Add(time.Microsecond)
+			}
+		}
+		result = append(result, revision)
+	}
+	return result
+}
+
+// revisionKey sorts the revisions by port id and then by the time they were replaced
+func revisionKey(revision domain.PortRevision) []byte {
+	key := revisionPrefix(revision.Port.Id)
+	key = binary.BigEndian.AppendUint64(key, uint64(revision.ReplacedAt.UnixMicro()))
+	return binary.BigEndian.AppendUint64(key, revision.Port.Version)
+}
+
+// revisionPrefix the common prefix of the keys of all the revisions of a port
+func revisionPrefix(id string) []byte {
+	return []byte(id + "\x00")
+}
+
+// revisionIndexer the memdb index of the history table, the prefix lookups by port id return its revisions
+// from the oldest
+type revisionIndexer struct{}
+
+func (r *revisionIndexer) FromObject(obj interface{}) (bool, []byte, error) {
+	revision, ok := obj.(domain.PortRevision)
+	if !ok {
+		return false, nil, fmt.Errorf("unexpected type %T for the history index", obj)
+	}
+	return true, revisionKey(revision), nil
+}
+
+func (r *revisionIndexer) FromArgs(args ...interface{}) ([]byte, error) {
+	id, err := stringArg(args...)
+	if err != nil {
+		return nil, err
+	}
+	return revisionPrefix(id), nil
+}
+
+func (r *revisionIndexer) PrefixFromArgs(args ...interface{}) ([]byte, error) {
+	return r.FromArgs(args...)
+}
@@ -0,0 +1,1088 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-related/fileservice/internal/core/domain"
+	cerror "github.com/go-related/fileservice/internal/core/errors"
+	"github.com/go-related/fileservice/internal/core/ports"
+	"github.com/hashicorp/go-memdb"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// postgresBatchSize how many upserts are buffered in a transaction before they are copied to the database
+	postgresBatchSize = 1000
+	// postgresPageSize how many rows an iterator reads with every query
+	postgresPageSize = 500
+	// the error codes of the transactions stopped by postgres because of a concurrent one
+	postgresSerializationFailure = "40001"
+	postgresDeadlockDetected     = "40P01"
+	postgresColumns              = "id, name, city, country, alias, regions, coordinates, province, timezone, unlocs, code, version, updated_at"
+	// postgresIndexColumns the columns computed in Go to give the same lookups of the memdb indexes
+	postgresIndexColumns = "geohash, unlocs_key, alias_key, regions_key"
+	// postgresHistoryColumns the columns of port_history after the ones of the replaced port
+	postgresHistoryColumns = "transaction_id, replaced_at, deleted"
+	// postgresChangesChannel the channel notified by the commits writing to port_changes
+	postgresChangesChannel = "port_changes"
+	// postgresChangesLock the advisory lock the commits number their changes under, see insertChanges
+	postgresChangesLock = 7_243_100_015
+	// postgresChangesPollInterval how long a watcher waits for a notification before looking for changes anyway
+	postgresChangesPollInterval = time.Second
+)
+
+// postgresIndexConditions how the memdb indexes are resolved in SQL, $1 is the argument of the lookup
+var postgresIndexConditions = map[string]string{
+	"code":                  "lower(p.code) = $1",
+	"city":                  "lower(p.city) = $1",
+	"province":              "lower(p.province) = $1",
+	"country":               "lower(p.country) = $1",
+	"timezone":              "lower(p.timezone) = $1",
+	"unlocs":                "p.unlocs_key @> ARRAY[$1::text]",
+	"alias":                 "p.alias_key @> ARRAY[$1::text]",
+	"regions":               "p.regions_key @> ARRAY[$1::text]",
+	geoIndex:                "p.geohash = $1",
+	geoIndex + "_prefix":    "p.geohash LIKE $1",
+	searchIndex:             "p.id IN (SELECT port_id FROM port_search_terms WHERE term = $1)",
+	searchIndex + "_prefix": "p.id IN (SELECT port_id FROM port_search_terms WHERE term LIKE $1)",
+	trigramIndex:            "p.id IN (SELECT port_id FROM port_search_trigrams WHERE trigram = $1)",
+}
+
+// PortPostgresRepository keeps the ports in Postgres. The transactions are real database transactions,
+// the upserts are buffered and copied in batches, and the reads outside the transactions run on a
+// repeatable read snapshot, see view. The geo and search indexes are columns and tables filled from Go,
+// so the queries give the same results as the memdb adapter.
+// The change feed is the port_changes table, written by every instance sharing the database with its commits
+type PortPostgresRepository struct {
+	// pool the connections of the transactions, as many as the config of the repository allows
+	pool *pgxpool.Pool
+	// readPool the connections of the reads, on top of the ones of pool. An import holds its connection till
+	// the end of the stream, with a single pool the reads would wait for the imports to finish.
+	// The streaming reads hold theirs till the last port is handed over too
+	readPool *pgxpool.Pool
+	// commitMx keeps the commit times of this process in the same order of the commits
+	commitMx sync.Mutex
+}
+
+// postgresTransaction the transactions run at repeatable read, postgres stops a transaction writing a port that
+// another transaction committed after its snapshot was taken. That's reported as a conflict, so like the other
+// adapters the first committer wins. A transaction writing a port locked by another open transaction waits for
+// it to end first
+type postgresTransaction struct {
+	id     string
+	tx     pgx.Tx
+	trn    *pgTxn
+	repo   *PortPostgresRepository
+	closed bool
+}
+
+func (pt *postgresTransaction) AddOrUpdatePort(ctx context.Context, port domain.Port) (*domain.Port, error) {
+	replaced, err := pt.AddOrUpdatePorts(ctx, []domain.Port{port})
+	if err != nil {
+		return nil, err
+	}
+	return replaced[0], nil
+}
+
+// AddOrUpdatePorts reads the current version of the ports with a single query and buffers the new ones
+func (pt *postgresTransaction) AddOrUpdatePorts(ctx context.Context, ports []domain.Port) ([]*domain.Port, error) {
+	if pt.closed {
+		return nil, cerror.TransactionClosed
+	}
+	pt.trn.ctx = ctx
+	if err := pt.trn.load(portIds(ports)); err != nil {
+		logrus.WithError(err).Error("error loading ports from db")
+		return nil, postgresConflict(err)
+	}
+	now := time.Now()
+	replaced := make([]*domain.Port, 0, len(ports))
+	for _, port := range ports {
+		currentData, err := getPort(ctx, pt.trn, port.Id)
+		if err != nil {
+			logrus.WithField("id", port.Id).WithError(err).Error("error loading port from db")
+			return nil, postgresConflict(err)
+		}
+		// stamped again on commit, a port deleted before gets its version from the history then
+		if err = pt.trn.upsert(nextVersion(port, currentData, 0, now), currentData); err != nil {
+			logrus.WithError(err).Error("error upserting ports into table")
+			return nil, postgresConflict(err)
+		}
+		replaced = append(replaced, currentData)
+	}
+	return replaced, nil
+}
+
+// DeletePorts removes the ports with the given ids, missing ids are ignored. It returns how many ports were removed
+func (pt *postgresTransaction) DeletePorts(ctx context.Context, ids []string) (int, error) {
+	if pt.closed {
+		return 0, cerror.TransactionClosed
+	}
+	pt.trn.ctx = ctx
+	deleted, err := pt.trn.delete(ids)
+	if err != nil {
+		logrus.WithError(err).Error("error deleting ports from db")
+	}
+	return deleted, postgresConflict(err)
+}
+
+// DeletePortsByFilter removes the ports matching the filter and returns how many were removed
+func (pt *postgresTransaction) DeletePortsByFilter(ctx context.Context, filter domain.PortFilter) (int, error) {
+	if pt.closed {
+		return 0, cerror.TransactionClosed
+	}
+	pt.trn.ctx = ctx
+	matches, err := portsMatching(pt.trn, filter)
+	if err != nil {
+		return 0, postgresConflict(err)
+	}
+	ids := make([]string, 0, len(matches))
+	for _, port := range matches {
+		ids = append(ids, port.Id)
+	}
+	deleted, err := pt.trn.delete(ids)
+	if err != nil {
+		logrus.WithError(err).Error("error deleting ports from db")
+	}
+	return deleted, postgresConflict(err)
+}
+
+// GetById reads through the transaction, so it sees its writes
+func (pt *postgresTransaction) GetById(ctx context.Context, id string) (*domain.Port, error) {
+	if pt.closed {
+		return nil, cerror.TransactionClosed
+	}
+	pt.trn.ctx = ctx
+	port, err := getPort(ctx, pt.trn, id)
+	return port, postgresConflict(err)
+}
+
+// GetByIds reads the ports the transaction didn't see yet with a single query
+func (pt *postgresTransaction) GetByIds(ctx context.Context, ids []string) ([]*domain.Port, error) {
+	if pt.closed {
+		return nil, cerror.TransactionClosed
+	}
+	pt.trn.ctx = ctx
+	if err := pt.trn.load(ids); err != nil {
+		return nil, postgresConflict(err)
+	}
+	result := make([]*domain.Port, 0, len(ids))
+	for _, id := range ids {
+		port, err := getPort(ctx, pt.trn, id)
+		if err != nil {
+			return nil, postgresConflict(err)
+		}
+		result = append(result, port)
+	}
+	return result, nil
+}
+
+// Commit copies the buffered upserts, stamps the written ports with the time of the commit and copies the
+// replaced revisions before committing the database transaction. The time is taken under commitMx so it
+// follows the order of the commits. The last upserts are copied before taking commitMx: they can wait for the
+// row locks of another transaction, that might be waiting for commitMx itself. Once they are copied the
+// transaction holds the locks of all its ports, so nothing done under commitMx waits for another transaction
+func (pt *postgresTransaction) Commit(ctx context.Context) error {
+	if pt.closed {
+		return cerror.TransactionClosed
+	}
+	pt.trn.ctx = ctx
+	if err := pt.trn.flush(); err != nil {
+		logrus.WithError(err).Error("error writing the buffered ports")
+		return postgresConflict(err) // still open, the caller aborts it
+	}
+	pt.repo.commitMx.Lock()
+	defer pt.repo.commitMx.Unlock()
+	now := time.Now()
+	if err := pt.trn.stamp(now); err != nil {
+		logrus.WithError(err).Error("error stamping the written ports")
+		return postgresConflict(err)
+	}
+	if err := pt.trn.insertRevisions(convertRevisions(pt.trn.changes, pt.id, now)); err != nil {
+		logrus.WithError(err).Error("error writing port history")
+		return postgresConflict(err)
+	}
+	changes := convertChanges(pt.trn.changes, now)
+	if err := pt.trn.insertChanges(changes); err != nil {
+		logrus.WithError(err).Error("error writing the port changes")
+		return postgresConflict(err)
+	}
+	pt.closed = true // a failed commit is rolled back by postgres, so the transaction is gone in both cases
+	if err := pt.tx.Commit(ctx); err != nil {
+		logrus.WithError(err).Error("error committing postgres transaction")
+		return postgresConflict(err)
+	}
+	if len(changes) > 0 {
+		pt.repo.trimChanges(ctx)
+	}
+	return nil
+}
+
+func (pt *postgresTransaction) Id() string {
+	return pt.id
+}
+
+func (pt *postgresTransaction) Abort() {
+	if pt.closed {
+		return
+	}
+	pt.closed = true
+	// the context of the transaction might be cancelled already, the rollback has to happen anyway
+	if err := pt.tx.Rollback(context.Background()); err != nil {
+		logrus.WithError(err).Warn("error rolling back postgres transaction")
+	}
+}
+
+// postgresConflict reports the serialization failures and the deadlocks between two transactions as conflicts,
+// in both cases postgres rolled back the transaction and it can be retried from the start
+func postgresConflict(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && (pgErr.Code == postgresSerializationFailure || pgErr.Code == postgresDeadlockDetected) {
+		return fmt.Errorf("%w: %v", cerror.TransactionConflict, err)
+	}
+	return err
+}
+
+// GetById the committed port, nil when it doesn't exist
+func (rp *PortPostgresRepository) GetById(ctx context.Context, Id string) (*domain.Port, error) {
+	var port *domain.Port
+	err := rp.view(ctx, func(trn *pgTxn) error {
+		var err error
+		port, err = getPort(ctx, trn, Id)
+		return err
+	})
+	return port, err
+}
+
+// ListPorts walks the committed ports sorted by id, starting after afterId, and calls fn for each port matching the filter
+func (rp *PortPostgresRepository) ListPorts(ctx context.Context, filter domain.PortFilter, afterId string, limit int, fn func(port domain.Port) error) error {
+	return rp.view(ctx, func(trn *pgTxn) error {
+		return listPorts(ctx, trn, filter, afterId, limit, fn)
+	})
+}
+
+// FindByUnloc the committed ports listing the UN/LOCODE, through the unlocs index
+func (rp *PortPostgresRepository) FindByUnloc(ctx context.Context, unloc string) ([]domain.Port, error) {
+	var found []domain.Port
+	err := rp.view(ctx, func(trn *pgTxn) error {
+		var err error
+		found, err = findPorts(ctx, trn, domain.PortFilter{Unloc: unloc})
+		return err
+	})
+	return found, err
+}
+
+// FindByCode the committed ports with the code, through the code index
+func (rp *PortPostgresRepository) FindByCode(ctx context.Context, code string) ([]domain.Port, error) {
+	var found []domain.Port
+	err := rp.view(ctx, func(trn *pgTxn) error {
+		var err error
+		found, err = findPorts(ctx, trn, domain.PortFilter{Code: code})
+		return err
+	})
+	return found, err
+}
+
+// SearchPorts matches the query against name, alias and city of the committed ports and returns the best results first
+func (rp *PortPostgresRepository) SearchPorts(ctx context.Context, query string, maxEdits int, limit int) ([]domain.SearchResult, error) {
+	var results []domain.SearchResult
+	err := rp.view(ctx, func(trn *pgTxn) error {
+		var err error
+		results, err = searchPorts(ctx, trn, query, maxEdits, limit)
+		return err
+	})
+	return results, err
+}
+
+// NearestPorts the k committed ports closest to the point
+func (rp *PortPostgresRepository) NearestPorts(ctx context.Context, center domain.GeoPoint, k int) ([]domain.PortDistance, error) {
+	var results []domain.PortDistance
+	err := rp.view(ctx, func(trn *pgTxn) error {
+		var err error
+		results, err = nearestPorts(ctx, trn, center, k)
+		return err
+	})
+	return results, err
+}
+
+// PortsWithinRadius the committed ports within radiusKm from the point sorted by distance, limit <= 0 means no limit
+func (rp *PortPostgresRepository) PortsWithinRadius(ctx context.Context, center domain.GeoPoint, radiusKm float64, limit int) ([]domain.PortDistance, error) {
+	var results []domain.PortDistance
+	err := rp.view(ctx, func(trn *pgTxn) error {
+		var err error
+		results, err = portsWithinRadius(ctx, trn, center, radiusKm, limit)
+		return err
+	})
+	if err != nil {
+		logrus.WithError(err).Error("error loading ports within radius from db")
+		return nil, err
+	}
+	return results, nil
+}
+
+// PortsInBoundingBox calls fn for every committed port inside the box matching the filter, limit <= 0 means no limit
+func (rp *PortPostgresRepository) PortsInBoundingBox(ctx context.Context, box domain.BoundingBox, filter domain.PortFilter, limit int, fn func(port domain.Port) error) error {
+	return rp.view(ctx, func(trn *pgTxn) error {
+		return portsInArea(ctx, trn, boxesForBoundingBox(box), func(domain.GeoPoint) bool { return true }, filter, limit, fn)
+	})
+}
+
+// PortsInPolygon calls fn for every committed port inside the polygon matching the filter, limit <= 0 means no limit
+func (rp *PortPostgresRepository) PortsInPolygon(ctx context.Context, polygon domain.Polygon, filter domain.PortFilter, limit int, fn func(port domain.Port) error) error {
+	return rp.view(ctx, func(trn *pgTxn) error {
+		return portsInArea(ctx, trn, boxesForBoundingBox(polygon.BoundingBox()), polygon.Contains, filter, limit, fn)
+	})
+}
+
+// WatchChanges tails port_changes from the sequence. Once it's read to the end it waits for the notification
+// of the next commit of any instance, or polls after postgresChangesPollInterval in case one got lost.
+// The watcher holds a connection of the read pool till ctx is done
+func (rp *PortPostgresRepository) WatchChanges(ctx context.Context, afterSequence uint64, fn func(change domain.PortChange) error) error {
+	conn, err := rp.readPool.Acquire(ctx)
+	if err != nil {
+		logrus.WithError(err).Error("error acquiring the connection of a watcher")
+		return err
+	}
+	defer func() {
+		// the connection goes back to the pool, the next user mustn't get the notifications
+		if _, err := conn.Exec(context.Background(), "UNLISTEN *"); err != nil {
+			_ = conn.Conn().Close(context.Background())
+		}
+		conn.Release()
+	}()
+	// listening before the first read, a commit landing in between is read on the next round
+	if _, err = conn.Exec(ctx, "LISTEN "+postgresChangesChannel); err != nil {
+		logrus.WithError(err).Error("error listening for the port changes")
+		return err
+	}
+	for {
+		changes, err := changesAfter(ctx, conn, afterSequence)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			if err = fn(change); err != nil {
+				return err
+			}
+			afterSequence = change.Sequence
+		}
+		if len(changes) == postgresPageSize {
+			continue
+		}
+		waitCtx, cancel := context.WithTimeout(ctx, postgresChangesPollInterval)
+		_, err = conn.Conn().WaitForNotification(waitCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil && !pgconn.Timeout(err) {
+			logrus.WithError(err).Error("error waiting for the port changes")
+			return err
+		}
+	}
+}
+
+// LastChangeSequence the sequence of the last change committed by any instance, 0 when it can't be read
+func (rp *PortPostgresRepository) LastChangeSequence() uint64 {
+	var last uint64
+	err := rp.readPool.QueryRow(context.Background(), "SELECT coalesce(max(sequence), 0) FROM port_changes").Scan(&last)
+	if err != nil {
+		logrus.WithError(err).Error("error reading the last change sequence")
+		return 0
+	}
+	return last
+}
+
+// trimChanges removes the changes older than the last defaultChangeFeedCapacity, like the feed in memory does.
+// It runs after the commit outside its repeatable read, two commits removing the same rows would conflict
+func (rp *PortPostgresRepository) trimChanges(ctx context.Context) {
+	_, err := rp.pool.Exec(ctx, "DELETE FROM port_changes WHERE sequence <= (SELECT max(sequence) FROM port_changes) - $1",
+		defaultChangeFeedCapacity)
+	if err != nil {
+		logrus.WithError(err).Warn("error removing the old port changes")
+	}
+}
+
+// changesAfter a page of the changes after the sequence. Like the feed in memory, a sequence after the last one
+// or before the changes kept is a gap
+func changesAfter(ctx context.Context, conn *pgxpool.Conn, afterSequence uint64) ([]domain.PortChange, error) {
+	var changes []domain.PortChange
+	err := pgx.BeginTxFunc(ctx, conn, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly}, func(tx pgx.Tx) error {
+		var last uint64
+		if err := tx.QueryRow(ctx, "SELECT coalesce(max(sequence), 0) FROM port_changes").Scan(&last); err != nil {
+			return err
+		}
+		if afterSequence > last || afterSequence+defaultChangeFeedCapacity < last {
+			return cerror.ChangeFeedGap
+		}
+		rows, err := tx.Query(ctx, fmt.Sprintf("SELECT sequence, type, %s, committed_at FROM port_changes WHERE sequence > $1 ORDER BY sequence LIMIT %d",
+			postgresColumns, postgresPageSize), int64(afterSequence))
+		if err != nil {
+			return err
+		}
+		changes, err = pgx.CollectRows(rows, scanChange)
+		return err
+	})
+	if err != nil && !errors.Is(err, cerror.ChangeFeedGap) && ctx.Err() == nil {
+		logrus.WithError(err).Error("error reading the port changes")
+	}
+	return changes, err
+}
+
+// StartTransaction a database transaction at repeatable read, see postgresTransaction. The transactions take
+// the connections of their own pool, so the reads never wait for them
+func (rp *PortPostgresRepository) StartTransaction(ctx context.Context) (ports.Transaction, error) {
+	tx, err := rp.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead})
+	if err != nil {
+		logrus.WithError(err).Error("error starting postgres transaction")
+		return nil, err
+	}
+	return &postgresTransaction{id: newTransactionId(), tx: tx, trn: newPgTxn(ctx, tx), repo: rp}, nil
+}
+
+// GetPortHistory the revisions of the port from the port_history table, the oldest first
+func (rp *PortPostgresRepository) GetPortHistory(ctx context.Context, id string) ([]domain.PortRevision, error) {
+	var revisions []domain.PortRevision
+	err := rp.view(ctx, func(trn *pgTxn) error {
+		var err error
+		revisions, err = trn.revisions(id)
+		return err
+	})
+	return revisions, err
+}
+
+// GetByIdAsOf reads the port and its history from the same snapshot
+func (rp *PortPostgresRepository) GetByIdAsOf(ctx context.Context, id string, at time.Time) (*domain.Port, error) {
+	var port *domain.Port
+	err := rp.view(ctx, func(trn *pgTxn) error {
+		current, err := getPort(ctx, trn, id)
+		if err != nil {
+			return err
+		}
+		revisions, err := trn.revisions(id)
+		if err != nil {
+			return err
+		}
+		port = domain.PortAsOf(current, revisions, at)
+		return nil
+	})
+	return port, err
+}
+
+// CompactHistory removes the revisions past the retention with two statements, the same revisions
+// HistoryRetention.Expired picks in the other adapters. The newest revision is never past MaxRevisions,
+// the age keeps it when it's a delete
+func (rp *PortPostgresRepository) CompactHistory(ctx context.Context, retention domain.HistoryRetention) (int, error) {
+	removed := 0
+	err := pgx.BeginFunc(ctx, rp.pool, func(tx pgx.Tx) error {
+		if retention.MaxRevisions > 0 {
+			tag, err := tx.Exec(ctx, `DELETE FROM port_history h USING (
+				SELECT id, replaced_at, version, row_number() OVER (PARTITION BY id ORDER BY replaced_at DESC, version DESC) AS position
+				FROM port_history
+			) r WHERE h.id = r.id AND h.replaced_at = r.replaced_at AND h.version = r.version AND r.position > $1`, retention.MaxRevisions)
+			if err != nil {
+				return err
+			}
+			removed += int(tag.RowsAffected())
+		}
+		if retention.MaxAge > 0 {
+			tag, err := tx.Exec(ctx, `DELETE FROM port_history h WHERE replaced_at < $1 AND NOT (deleted AND NOT EXISTS (
+				SELECT 1 FROM port_history n WHERE n.id = h.id AND (n.replaced_at, n.version) > (h.replaced_at, h.version)
+			))`, time.Now().Add(-retention.MaxAge))
+			if err != nil {
+				return err
+			}
+			removed += int(tag.RowsAffected())
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).Error("error removing port history")
+		return 0, err
+	}
+	return removed, nil
+}
+
+// Close closes the connections of both pools. It blocks till the open transactions and reads give their
+// connection back, so the transactions have to be committed or aborted first
+func (rp *PortPostgresRepository) Close() error {
+	rp.readPool.Close()
+	rp.pool.Close()
+	return nil
+}
+
+// view runs fn inside a read only repeatable read transaction on the read pool, so all the pages of the iterators
+// come from the same snapshot and a listing never shows half of a commit. The reads calling back the caller for
+// every port keep the transaction and its connection till the end, even with a slow client
+func (rp *PortPostgresRepository) view(ctx context.Context, fn func(trn *pgTxn) error) error {
+	tx, err := rp.readPool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		logrus.WithError(err).Error("error starting postgres read transaction")
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback(context.Background())
+	}()
+	return fn(newPgTxn(ctx, tx))
+}
+
+// NewPortPostgresRepository connects to the database and migrates the schema to the latest version. The transactions
+// take up to the pool_max_conns of the dsn, the reads readConns more connections, <= 0 as many as the transactions
+func NewPortPostgresRepository(ctx context.Context, dsn string, readConns int) (*PortPostgresRepository, error) {
+	config, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		logrus.WithError(err).Error("error parsing postgres dsn")
+		return nil, err
+	}
+	return newPortPostgresRepository(ctx, config, readConns)
+}
+
+func newPortPostgresRepository(ctx context.Context, config *pgxpool.Config, readConns int) (*PortPostgresRepository, error) {
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		logrus.WithError(err).Error("error connecting to postgres")
+		return nil, err
+	}
+	if err = migratePostgres(ctx, pool); err != nil {
+		logrus.WithError(err).Error("error migrating postgres schema")
+		pool.Close()
+		return nil, err
+	}
+	readConfig := config.Copy()
+	if readConns > 0 {
+		readConfig.MaxConns = int32(readConns)
+	}
+	if readConfig.MinConns > readConfig.MaxConns {
+		readConfig.MinConns = readConfig.MaxConns
+	}
+	readPool, err := pgxpool.NewWithConfig(ctx, readConfig)
+	if err != nil {
+		logrus.WithError(err).Error("error connecting to postgres")
+		pool.Close()
+		return nil, err
+	}
+	repo := PortPostgresRepository{
+		pool:     pool,
+		readPool: readPool,
+	}
+	return &repo, nil
+}
+
+// pgTxn a postgres transaction with the same lookups of a memdb transaction. The upserts are buffered
+// in pending and the reads of the transaction look there first, every other query flushes them before running
+type pgTxn struct {
+	// ctx the context of the current call, the lookups of the portIndexes interface don't take one
+	ctx     context.Context
+	tx      pgx.Tx
+	pending []domain.Port
+	// lookups the pending ports and the ports read since the last flush by id, nil when the port doesn't exist
+	lookups map[string]*domain.Port
+	staging bool
+	changes memdb.Changes
+	changed map[string]int
+}
+
+func newPgTxn(ctx context.Context, tx pgx.Tx) *pgTxn {
+	return &pgTxn{ctx: ctx, tx: tx, lookups: make(map[string]*domain.Port), changed: make(map[string]int)}
+}
+
+func (t *pgTxn) First(table, index string, args ...interface{}) (interface{}, error) {
+	if table == tableName && index == "id" && len(args) == 1 {
+		if id, ok := args[0].(string); ok {
+			if err := t.load([]string{id}); err != nil {
+				return nil, err
+			}
+			if port := t.lookups[id]; port != nil {
+				return *port, nil
+			}
+			return nil, nil
+		}
+	}
+	return t.first(index, args...)
+}
+
+// load reads the ports missing from lookups with a single query. The pending ports are always in lookups,
+// so the missing ones are up to date in the database and there is no need to flush before reading them
+func (t *pgTxn) load(ids []string) error {
+	var missing []string
+	for _, id := range ids {
+		if _, ok := t.lookups[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	rows, err := t.tx.Query(t.ctx, fmt.Sprintf("SELECT %s FROM ports p WHERE p.id = ANY($1)", prefixColumns("p")), missing)
+	if err != nil {
+		return err
+	}
+	found, err := pgx.CollectRows(rows, scanPort)
+	if err != nil {
+		return err
+	}
+	for _, id := range missing {
+		t.lookups[id] = nil
+	}
+	for i := range found {
+		t.lookups[found[i].Id] = &found[i]
+	}
+	return nil
+}
+
+func (t *pgTxn) first(index string, args ...interface{}) (interface{}, error) {
+	iterator, err := t.Get(tableName, index, args...)
+	if err != nil {
+		return nil, err
+	}
+	raw := iterator.Next()
+	return raw, iteratorError(iterator)
+}
+
+// Get supports the exact and the "_prefix" lookups of memdb, without arguments the id index returns all the ports
+func (t *pgTxn) Get(table, index string, args ...interface{}) (memdb.ResultIterator, error) {
+	if table != tableName {
+		return nil, fmt.Errorf("invalid table '%s'", table)
+	}
+	if index == "id" && len(args) == 0 {
+		return t.iterator("TRUE", nil, false), nil
+	}
+	arg, err := stringArg(args...)
+	if err != nil {
+		return nil, err
+	}
+	name, prefix := strings.CutSuffix(index, "_prefix")
+	switch name {
+	case "id":
+		if prefix {
+			return t.iterator("p.id LIKE $1", []interface{}{likePrefix(arg)}, false), nil
+		}
+		return t.iterator("p.id = $1", []interface{}{arg}, false), nil
+	case searchIndex:
+		arg = normalizeText(arg)
+	default:
+		arg = strings.ToLower(arg)
+	}
+	condition, ok := postgresIndexConditions[index]
+	if !ok {
+		return nil, fmt.Errorf("invalid index '%s'", index)
+	}
+	if prefix {
+		arg = likePrefix(arg)
+	}
+	return t.iterator(condition, []interface{}{arg}, false), nil
+}
+
+// LowerBound the lookups walking the ports from an id: the id index, and the filter indexes with the value
+// and the id. The rows of a filter index stop at the last port of the value, the (lower(column), id) indexes
+// of the single value columns seek straight to the id
+func (t *pgTxn) LowerBound(table, index string, args ...interface{}) (memdb.ResultIterator, error) {
+	if table != tableName {
+		return nil, fmt.Errorf("invalid table '%s'", table)
+	}
+	if index == "id" {
+		id, err := stringArg(args...)
+		if err != nil {
+			return nil, err
+		}
+		iterator := t.iterator("TRUE", nil, true)
+		iterator.last = id
+		return iterator, nil
+	}
+	name, _ := strings.CutSuffix(index, "_prefix")
+	condition, ok := postgresIndexConditions[name]
+	if !ok || name == geoIndex || name == searchIndex || name == trigramIndex || len(args) != 2 {
+		return nil, fmt.Errorf("lower bound not supported on '%s.%s'", table, index)
+	}
+	value, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("argument must be a string: %#v", args[0])
+	}
+	id, ok := args[1].(string)
+	if !ok {
+		return nil, fmt.Errorf("argument must be a string: %#v", args[1])
+	}
+	iterator := t.iterator(condition, []interface{}{strings.ToLower(value)}, true)
+	iterator.last = id
+	return iterator, nil
+}
+
+// iterator pages through the ports matching the condition sorted by id. inclusive makes the first page
+// start from last instead of after it
+func (t *pgTxn) iterator(condition string, args []interface{}, inclusive bool) *pgIterator {
+	return &pgIterator{trn: t, condition: condition, args: args, inclusive: inclusive}
+}
+
+// upsert buffers the port in place of current, that is nil for new ports
+func (t *pgTxn) upsert(port domain.Port, current *domain.Port) error {
+	var before interface{}
+	if current != nil {
+		before = *current
+	}
+	t.pending = append(t.pending, port)
+	t.lookups[port.Id] = &port
+	t.trackChange(port.Id, before, port)
+	if len(t.pending) >= postgresBatchSize {
+		return t.flush()
+	}
+	return nil
+}
+
+func (t *pgTxn) delete(ids []string) (int, error) {
+	if err := t.flush(); err != nil {
+		return 0, err
+	}
+	rows, err := t.tx.Query(t.ctx, "DELETE FROM ports p WHERE p.id = ANY($1) RETURNING "+prefixColumns("p"), ids)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := pgx.CollectRows(rows, scanPort)
+	if err != nil {
+		return 0, err
+	}
+	for _, port := range deleted {
+		t.lookups[port.Id] = nil
+		t.trackChange(port.Id, port, nil)
+	}
+	return len(deleted), nil
+}
+
+// flush copies the pending ports into a staging table and upserts them from there in a single statement,
+// then it replaces their search terms and trigrams
+func (t *pgTxn) flush() error {
+	if len(t.pending) == 0 {
+		return nil
+	}
+	// the same port can be pending twice, only the last version is written
+	latest := make(map[string]domain.Port, len(t.pending))
+	ids := make([]string, 0, len(t.pending))
+	for _, port := range t.pending {
+		if _, ok := latest[port.Id]; !ok {
+			ids = append(ids, port.Id)
+		}
+		latest[port.Id] = port
+	}
+	if !t.staging {
+		_, err := t.tx.Exec(t.ctx, "CREATE TEMPORARY TABLE ports_staging (LIKE ports INCLUDING DEFAULTS) ON COMMIT DROP")
+		if err != nil {
+			return err
+		}
+		t.staging = true
+	}
+	columns := strings.Split(postgresColumns+", "+postgresIndexColumns, ", ")
+	_, err := t.tx.CopyFrom(t.ctx, pgx.Identifier{"ports_staging"}, columns, pgx.CopyFromSlice(len(ids), func(i int) ([]interface{}, error) {
+		port := latest[ids[i]]
+		return append(portValues(port), portIndexValues(port)...), nil
+	}))
+	if err != nil {
+		return err
+	}
+	var updates []string
+	for _, column := range columns[1:] {
+		updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", column, column))
+	}
+	_, err = t.tx.Exec(t.ctx, fmt.Sprintf("INSERT INTO ports (%[1]s) SELECT %[1]s FROM ports_staging ON CONFLICT (id) DO UPDATE SET %[2]s",
+		strings.Join(columns, ", "), strings.Join(updates, ", ")))
+	if err != nil {
+		return err
+	}
+	if _, err = t.tx.Exec(t.ctx, "TRUNCATE ports_staging"); err != nil {
+		return err
+	}
+	if _, err = t.tx.Exec(t.ctx, "DELETE FROM port_search_terms WHERE port_id = ANY($1)", ids); err != nil {
+		return err
+	}
+	var terms [][]interface{}
+	for _, id := range ids {
+		for _, term := range searchTerms(latest[id]) {
+			terms = append(terms, []interface{}{id, term})
+		}
+	}
+	_, err = t.tx.CopyFrom(t.ctx, pgx.Identifier{"port_search_terms"}, []string{"port_id", "term"}, pgx.CopyFromRows(terms))
+	if err != nil {
+		return err
+	}
+	if _, err = t.tx.Exec(t.ctx, "DELETE FROM port_search_trigrams WHERE port_id = ANY($1)", ids); err != nil {
+		return err
+	}
+	var trigrams [][]interface{}
+	for _, id := range ids {
+		for _, trigram := range searchTrigrams(latest[id]) {
+			trigrams = append(trigrams, []interface{}{id, trigram})
+		}
+	}
+	_, err = t.tx.CopyFrom(t.ctx, pgx.Identifier{"port_search_trigrams"}, []string{"port_id", "trigram"}, pgx.CopyFromRows(trigrams))
+	if err != nil {
+		return err
+	}
+	t.pending = nil
+	// what we read so far is in the database now, no need to keep it in memory
+	t.lookups = make(map[string]*domain.Port)
+	return nil
+}
+
+// stamp gives the written ports their version and the time of the commit, from the committed version they
+// replace. The repeatable read makes sure that's still the version the transaction read first
+func (t *pgTxn) stamp(committedAt time.Time) error {
+	last, err := t.lastVersions()
+	if err != nil {
+		return err
+	}
+	var ids []string
+	var versions []int64
+	var times []time.Time
+	for i, change := range t.changes {
+		if change.After == nil {
+			continue
+		}
+		var before *domain.Port
+		if change.Before != nil {
+			port := change.Before.(domain.Port)
+			before = &port
+		}
+		next := nextVersion(change.After.(domain.Port), before, last[change.After.(domain.Port).Id], committedAt)
+		t.changes[i].After = next
+		ids = append(ids, next.Id)
+		versions = append(versions, int64(next.Version))
+		times = append(times, next.UpdatedAt)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err = t.tx.Exec(t.ctx, `UPDATE ports p SET version = s.version, updated_at = s.updated_at
+		FROM unnest($1::text[], $2::bigint[], $3::timestamptz[]) AS s(id, version, updated_at) WHERE p.id = s.id`,
+		ids, versions, times)
+	return err
+}
+
+// lastVersions the highest version in the history of the created ports, the ones deleted before go on from it
+func (t *pgTxn) lastVersions() (map[string]uint64, error) {
+	var created []string
+	for _, change := range t.changes {
+		if change.Before == nil && change.After != nil {
+			created = append(created, change.After.(domain.Port).Id)
+		}
+	}
+	last := make(map[string]uint64)
+	if len(created) == 0 {
+		return last, nil
+	}
+	rows, err := t.tx.Query(t.ctx, "SELECT id, max(version) FROM port_history WHERE id = ANY($1) GROUP BY id", created)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var version int64
+		if err = rows.Scan(&id, &version); err != nil {
+			return nil, err
+		}
+		last[id] = uint64(version)
+	}
+	return last, rows.Err()
+}
+
+// insertRevisions copies the replaced ports into port_history
+func (t *pgTxn) insertRevisions(revisions []domain.PortRevision) error {
+	if len(revisions) == 0 {
+		return nil
+	}
+	columns := strings.Split(postgresColumns+", "+postgresHistoryColumns, ", ")
+	_, err := t.tx.CopyFrom(t.ctx, pgx.Identifier{"port_history"}, columns, pgx.CopyFromSlice(len(revisions), func(i int) ([]interface{}, error) {
+		revision := revisions[i]
+		return append(portValues(revision.Port), revision.TransactionId, revision.ReplacedAt, revision.Deleted), nil
+	}))
+	return err
+}
+
+// insertChanges numbers the changes in port_changes and notifies the watchers, both take effect with the commit.
+// The sequences come from a bigserial, taken when the rows are written and not when they are committed: the
+// advisory lock is held till the commit, so no other commit takes a sequence meanwhile and a watcher never
+// sees one before another that is still being committed
+func (t *pgTxn) insertChanges(changes []domain.PortChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	if _, err := t.tx.Exec(t.ctx, "SELECT pg_advisory_xact_lock($1)", postgresChangesLock); err != nil {
+		return err
+	}
+	columns := append(append([]string{"type"}, strings.Split(postgresColumns, ", ")...), "committed_at")
+	_, err := t.tx.CopyFrom(t.ctx, pgx.Identifier{"port_changes"}, columns, pgx.CopyFromSlice(len(changes), func(i int) ([]interface{}, error) {
+		change := changes[i]
+		return append(append([]interface{}{int16(change.Type)}, portValues(change.Port)...), change.CommittedAt), nil
+	}))
+	if err != nil {
+		return err
+	}
+	_, err = t.tx.Exec(t.ctx, "SELECT pg_notify($1, '')", postgresChangesChannel)
+	return err
+}
+
+// revisions the history of the port, the oldest first
+func (t *pgTxn) revisions(id string) ([]domain.PortRevision, error) {
+	rows, err := t.tx.Query(t.ctx, fmt.Sprintf("SELECT %s, %s FROM port_history WHERE id = $1 ORDER BY replaced_at, version",
+		postgresColumns, postgresHistoryColumns), id)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (domain.PortRevision, error) {
+		var revision domain.PortRevision
+		port := &revision.Port
+		err := row.Scan(&port.Id, &port.Name, &port.City, &port.Country, &port.Alias, &port.Regions, &port.Coordinates,
+			&port.Province, &port.Timezone, &port.UNLOCs, &port.Code, &port.Version, &port.UpdatedAt,
+			&revision.TransactionId, &revision.ReplacedAt, &revision.Deleted)
+		port.UpdatedAt = port.UpdatedAt.UTC()
+		revision.ReplacedAt = revision.ReplacedAt.UTC()
+		return revision, err
+	})
+}
+
+// trackChange keeps the state before the first write and after the last one, like the memdb changes
+func (t *pgTxn) trackChange(id string, before, after interface{}) {
+	if i, ok := t.changed[id]; ok {
+		t.changes[i].After = after
+		return
+	}
+	t.changed[id] = len(t.changes)
+	t.changes = append(t.changes, memdb.Change{Table: tableName, Before: before, After: after})
+}
+
+// pgIterator implements memdb.ResultIterator with keyset pagination, every page is a query for the rows after
+// the last id seen, so a caller that stops early doesn't read the whole result
+type pgIterator struct {
+	trn       *pgTxn
+	condition string
+	args      []interface{}
+	inclusive bool
+	last      string
+	page      []domain.Port
+	position  int
+	done      bool
+	err       error
+}
+
+// WatchCh the database has no watches
+func (it *pgIterator) WatchCh() <-chan struct{} {
+	return nil
+}
+
+func (it *pgIterator) Next() interface{} {
+	if it.position == len(it.page) {
+		if it.done || it.err != nil {
+			return nil
+		}
+		if it.err = it.fetch(); it.err != nil {
+			logrus.WithError(it.err).Error("error reading ports from postgres")
+			return nil
+		}
+		if len(it.page) == 0 {
+			return nil
+		}
+	}
+	port := it.page[it.position]
+	it.position++
+	it.last = port.Id
+	return port
+}
+
+// Err the query error that stopped the iteration
+func (it *pgIterator) Err() error {
+	return it.err
+}
+
+func (it *pgIterator) fetch() error {
+	if err := it.trn.flush(); err != nil {
+		return err
+	}
+	operator := ">"
+	if it.inclusive {
+		operator = ">="
+		it.inclusive = false
+	}
+	position := len(it.args) + 1
+	query := fmt.Sprintf("SELECT %s FROM ports p WHERE %s AND p.id %s $%d ORDER BY p.id LIMIT %d",
+		prefixColumns("p"), it.condition, operator, position, postgresPageSize)
+	rows, err := it.trn.tx.Query(it.trn.ctx, query, append(it.args, it.last)...)
+	if err != nil {
+		return err
+	}
+	it.page, err = pgx.CollectRows(rows, scanPort)
+	if err != nil {
+		return err
+	}
+	it.position = 0
+	it.done = len(it.page) < postgresPageSize
+	return nil
+}
+
+func scanPort(row pgx.CollectableRow) (domain.Port, error) {
+	var port domain.Port
+	err := row.Scan(&port.Id, &port.Name, &port.City, &port.Country, &port.Alias, &port.Regions, &port.Coordinates,
+		&port.Province, &port.Timezone, &port.UNLOCs, &port.Code, &port.Version, &port.UpdatedAt)
+	port.UpdatedAt = port.UpdatedAt.UTC()
+	return port, err
+}
+
+// scanChange a row of port_changes, the sequence and the type come before the port and the commit time after
+func scanChange(row pgx.CollectableRow) (domain.PortChange, error) {
+	var change domain.PortChange
+	var changeType int16
+	port := &change.Port
+	err := row.Scan(&change.Sequence, &changeType, &port.Id, &port.Name, &port.City, &port.Country, &port.Alias, &port.Regions,
+		&port.Coordinates, &port.Province, &port.Timezone, &port.UNLOCs, &port.Code, &port.Version, &port.UpdatedAt,
+		&change.CommittedAt)
+	change.Type = domain.ChangeType(changeType)
+	port.UpdatedAt = port.UpdatedAt.UTC()
+	change.CommittedAt = change.CommittedAt.UTC()
+	return change, err
+}
+
+// portValues the values of the port in the order of postgresColumns
+func portValues(port domain.Port) []interface{} {
+	return []interface{}{port.Id, port.Name, port.City, port.Country, port.Alias, port.Regions, port.Coordinates,
+		port.Province, port.Timezone, port.UNLOCs, port.Code, port.Version, port.UpdatedAt}
+}
+
+// portIndexValues the values of the port in the order of postgresIndexColumns
+func portIndexValues(port domain.Port) []interface{} {
+	return []interface{}{portGeohash(port), lowercaseValues(port.UNLOCs), lowercaseValues(port.Alias), lowercaseValues(port.Regions)}
+}
+
+// lowercaseValues the keys of a multi value index, like memdb they are compared lowercase
+func lowercaseValues(values []string) []string {
+	keys := make([]string, 0, len(values))
+	for _, value := range values {
+		if len(value) > 0 {
+			keys = append(keys, strings.ToLower(value))
+		}
+	}
+	return keys
+}
+
+// portGeohash the value of the geo index, NULL for the ports without a valid location
+func portGeohash(port domain.Port) interface{} {
+	location, ok := port.Location()
+	if !ok {
+		return nil
+	}
+	return encodeGeohash(location, geohashPrecision)
+}
+
+func prefixColumns(alias string) string {
+	return alias + "." + strings.ReplaceAll(postgresColumns, ", ", ", "+alias+".")
+}
+
+// likePrefix the LIKE pattern matching the values starting with prefix
+func likePrefix(prefix string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix) + "%"
+}
@@ -0,0 +1,156 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/sirupsen/logrus"
+)
+
+// postgresMigrationLock the advisory lock taken while migrating, so two instances starting together don't race
+const postgresMigrationLock = 7_243_100_014
+
+// errPostgresSchemaTooNew used when the database was migrated by a newer version of the service
+var errPostgresSchemaTooNew = errors.New("database schema is newer than this version of the service")
+
+// postgresMigrations the schema changes in order, the version of a migration is its position starting from 1.
+// Applied migrations are never edited, a change to the schema is a new entry at the end
+var postgresMigrations = []string{
+	`CREATE TABLE ports (
+		id          text PRIMARY KEY,
+		name        text NOT NULL DEFAULT '',
+		city        text NOT NULL DEFAULT '',
+		country     text NOT NULL DEFAULT '',
+		alias       text[],
+		regions     text[],
+		coordinates double precision[],
+		province    text NOT NULL DEFAULT '',
+		timezone    text NOT NULL DEFAULT '',
+		unlocs      text[],
+		code        text NOT NULL DEFAULT '',
+		geohash     text
+	);
+	CREATE INDEX ports_code_idx ON ports (lower(code), id);
+	CREATE INDEX ports_city_idx ON ports (lower(city), id);
+	CREATE INDEX ports_province_idx ON ports (lower(province), id);
+	CREATE INDEX ports_country_idx ON ports (lower(country), id);
+	CREATE INDEX ports_timezone_idx ON ports (lower(timezone), id);
+	CREATE INDEX ports_geohash_idx ON ports (geohash text_pattern_ops);
+	CREATE TABLE port_search_terms (
+		port_id text NOT NULL REFERENCES ports (id) ON DELETE CASCADE,
+		term    text NOT NULL,
+		PRIMARY KEY (term, port_id)
+	);
+	CREATE INDEX port_search_terms_prefix_idx ON port_search_terms (term text_pattern_ops);
+	CREATE INDEX port_search_terms_port_idx ON port_search_terms (port_id);`,
+	`ALTER TABLE ports
+		ADD COLUMN unlocs_key  text[] NOT NULL DEFAULT '{}',
+		ADD COLUMN alias_key   text[] NOT NULL DEFAULT '{}',
+		ADD COLUMN regions_key text[] NOT NULL DEFAULT '{}';
+	UPDATE ports SET
+		unlocs_key = ARRAY(SELECT lower(v) FROM unnest(unlocs) v WHERE v <> ''),
+		alias_key = ARRAY(SELECT lower(v) FROM unnest(alias) v WHERE v <> ''),
+		regions_key = ARRAY(SELECT lower(v) FROM unnest(regions) v WHERE v <> '');
+	CREATE INDEX ports_unlocs_idx ON ports USING gin (unlocs_key);
+	CREATE INDEX ports_alias_idx ON ports USING gin (alias_key);
+	CREATE INDEX ports_regions_idx ON ports USING gin (regions_key);`,
+	`ALTER TABLE ports
+		ADD COLUMN version    bigint NOT NULL DEFAULT 1,
+		ADD COLUMN updated_at timestamptz NOT NULL DEFAULT now();`,
+	`CREATE TABLE port_history (
+		id             text NOT NULL,
+		name           text NOT NULL DEFAULT '',
+		city           text NOT NULL DEFAULT '',
+		country        text NOT NULL DEFAULT '',
+		alias          text[],
+		regions        text[],
+		coordinates    double precision[],
+		province       text NOT NULL DEFAULT '',
+		timezone       text NOT NULL DEFAULT '',
+		unlocs         text[],
+		code           text NOT NULL DEFAULT '',
+		version        bigint NOT NULL,
+		updated_at     timestamptz NOT NULL,
+		transaction_id text NOT NULL,
+		replaced_at    timestamptz NOT NULL,
+		deleted        boolean NOT NULL DEFAULT false,
+		PRIMARY KEY (id, replaced_at, version)
+	);
+	CREATE INDEX port_history_replaced_at_idx ON port_history (replaced_at);`,
+	// the trigrams of the words already in port_search_terms, padded like wordTrigrams does
+	`CREATE TABLE port_search_trigrams (
+		port_id text NOT NULL REFERENCES ports (id) ON DELETE CASCADE,
+		trigram text NOT NULL,
+		PRIMARY KEY (trigram, port_id)
+	);
+	CREATE INDEX port_search_trigrams_port_idx ON port_search_trigrams (port_id);
+	INSERT INTO port_search_trigrams (port_id, trigram)
+		SELECT DISTINCT t.port_id, substr('  ' || t.term || ' ', i, 3)
+		FROM port_search_terms t, generate_series(1, length(t.term) + 1) i
+		WHERE position(' ' IN t.term) = 0;`,
+	// the change feed, the sequences are numbered by the commits in the order they commit, see insertChanges
+	`CREATE TABLE port_changes (
+		sequence     bigserial PRIMARY KEY,
+		type         smallint NOT NULL,
+		id           text NOT NULL,
+		name         text NOT NULL DEFAULT '',
+		city         text NOT NULL DEFAULT '',
+		country      text NOT NULL DEFAULT '',
+		alias        text[],
+		regions      text[],
+		coordinates  double precision[],
+		province     text NOT NULL DEFAULT '',
+		timezone     text NOT NULL DEFAULT '',
+		unlocs       text[],
+		code         text NOT NULL DEFAULT '',
+		version      bigint NOT NULL,
+		updated_at   timestamptz NOT NULL,
+		committed_at timestamptz NOT NULL
+	);`,
+}
+
+// migratePostgres applies the migrations the database is missing, each one in its own transaction
+func migratePostgres(ctx context.Context, pool *pgxpool.Pool) error {
+	_, err := pool.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    integer PRIMARY KEY,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return err
+	}
+	for i := range postgresMigrations {
+		if err = applyPostgresMigration(ctx, pool, i+1); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// applyPostgresMigration runs the migration unless it's applied already, the lock is released with the transaction
+func applyPostgresMigration(ctx context.Context, pool *pgxpool.Pool, version int) error {
+	return pgx.BeginFunc(ctx, pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", postgresMigrationLock); err != nil {
+			return err
+		}
+		var current int
+		if err := tx.QueryRow(ctx, "SELECT coalesce(max(version), 0) FROM schema_migrations").Scan(&current); err != nil {
+			return err
+		}
+		if current > len(postgresMigrations) {
+			return errPostgresSchemaTooNew
+		}
+		if current >= version {
+			return nil
+		}
+		if _, err := tx.Exec(ctx, postgresMigrations[version-1]); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version) VALUES ($1)", version); err != nil {
+			return err
+		}
+		logrus.WithField("version", version).Info("postgres schema migrated")
+		return nil
+	})
+}
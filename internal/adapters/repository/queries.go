@@ -0,0 +1,279 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"github.com/go-related/fileservice/internal/core/domain"
+	"github.com/hashicorp/go-memdb"
+	"github.com/sirupsen/logrus"
+	"math"
+)
+
+// portIndexes the index lookups the queries are built on. The memdb transactions implement them
+// and the bolt and postgres adapters provide the same lookups on top of their storage, so all of them answer the queries the same way
+type portIndexes interface {
+	First(table, index string, args ...interface{}) (interface{}, error)
+	Get(table, index string, args ...interface{}) (memdb.ResultIterator, error)
+	LowerBound(table, index string, args ...interface{}) (memdb.ResultIterator, error)
+}
+
+// iteratorError the error that ended the iteration early, the memdb iterators never fail but the ones reading
+// from a database can
+func iteratorError(iterator memdb.ResultIterator) error {
+	if failing, ok := iterator.(interface{ Err() error }); ok {
+		return failing.Err()
+	}
+	return nil
+}
+
+func getPort(ctx context.Context, trn portIndexes, id string) (*domain.Port, error) {
+	raw, err := trn.First(tableName, "id", id)
+	if err != nil {
+		logrus.WithError(err).Error("error loading port from db")
+		return nil, err
+	}
+	// check if we have any cancellation before continuing
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+	//not found
+	if raw == nil {
+		return nil, nil
+	}
+	result := raw.(domain.Port)
+	return &result, nil
+}
+
+// listPorts walks the ports sorted by id, starting after afterId, and calls fn for each port matching the filter
+func listPorts(ctx context.Context, trn portIndexes, filter domain.PortFilter, afterId string, limit int, fn func(port domain.Port) error) error {
+	iterator, err := portsIterator(trn, filter, afterId)
+	if err != nil {
+		logrus.WithError(err).Error("error listing ports from db")
+		return err
+	}
+	count := 0
+	for raw := iterator.Next(); raw != nil; raw = iterator.Next() {
+		// check if we have any cancellation before continuing
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		port := raw.(domain.Port)
+		if port.Id <= afterId || !filter.Matches(port) {
+			continue
+		}
+		if err = fn(port); err != nil {
+			return err
+		}
+		count++
+		if limit > 0 && count >= limit {
+			break
+		}
+	}
+	return iteratorError(iterator)
+}
+
+// findPorts collects all the ports matching the filter, the lookup goes through the index of the filter
+func findPorts(ctx context.Context, trn portIndexes, filter domain.PortFilter) ([]domain.Port, error) {
+	var found []domain.Port
+	err := listPorts(ctx, trn, filter, "", 0, func(port domain.Port) error {
+		found = append(found, port)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// portsIterator picks the best index for the filter. The keys of the filter indexes are the value followed by the
+// id, so the lookup seeks straight to the first port of the value after afterId
+func portsIterator(trn portIndexes, filter domain.PortFilter, afterId string) (memdb.ResultIterator, error) {
+	for _, index := range filterIndexes {
+		if value := index.value(filter); len(value) > 0 {
+			iterator, err := trn.LowerBound(tableName, index.name+"_prefix", value, afterId)
+			if err != nil {
+				return nil, err
+			}
+			return &valueIterator{ResultIterator: iterator, indexer: index.indexer, value: value, lastId: afterId}, nil
+		}
+	}
+	return trn.LowerBound(tableName, "id", afterId)
+}
+
+// valueIterator stops the lower bound iterator of a filter index after the last port of the value. The ports come
+// sorted by key, so a port with the value and an id after the last one is at the key of the value. Any other port
+// is past it: the ports of the value after the last one would have come first
+type valueIterator struct {
+	memdb.ResultIterator
+	indexer *valueIdIndexer
+	value   string
+	lastId  string
+	done    bool
+	err     error
+}
+
+func (it *valueIterator) Next() interface{} {
+	for !it.done {
+		raw := it.ResultIterator.Next()
+		if raw == nil {
+			it.done = true
+			break
+		}
+		port := raw.(domain.Port)
+		if port.Id == it.lastId {
+			continue // the cursor itself, or the last port at the key of another value
+		}
+		has, err := it.indexer.has(port, it.value)
+		if err != nil || !has || port.Id < it.lastId {
+			it.done, it.err = true, err
+			break
+		}
+		it.lastId = port.Id
+		return port
+	}
+	return nil
+}
+
+// Err the error of the lookup or of the index keys
+func (it *valueIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return iteratorError(it.ResultIterator)
+}
+
+// portsMatching collects the ports matching the filter, used when the table is going to be modified
+// since we can't do that while iterating it
+func portsMatching(trn portIndexes, filter domain.PortFilter) ([]domain.Port, error) {
+	iterator, err := portsIterator(trn, filter, "")
+	if err != nil {
+		logrus.WithError(err).Error("error loading ports to delete from db")
+		return nil, err
+	}
+	var matches []domain.Port
+	for raw := iterator.Next(); raw != nil; raw = iterator.Next() {
+		if port := raw.(domain.Port); filter.Matches(port) {
+			matches = append(matches, port)
+		}
+	}
+	if err = iteratorError(iterator); err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// searchPorts matches the query against name, alias and city and returns the best results first.
+// Exact and prefix matches come from the search index. When they are less than limit the typo tolerant matches
+// are added, among the ports sharing trigrams with the query. Both passes scan at most searchMaxCandidates rows
+func searchPorts(ctx context.Context, trn portIndexes, query string, maxEdits int, limit int) ([]domain.SearchResult, error) {
+	query = normalizeText(query)
+	if len(query) == 0 {
+		return nil, nil
+	}
+	matches := make(map[string]domain.SearchResult)
+	// checked the ports already scored, a port comes once for every term or trigram matching the lookup
+	checked := make(map[string]bool)
+	// collect scores the ports of the first maxScanned rows of the iterator
+	collect := func(iterator memdb.ResultIterator, edits int, maxScanned int) error {
+		scanned := 0
+		for raw := iterator.Next(); raw != nil && scanned < maxScanned; raw = iterator.Next() {
+			scanned++
+			// check if we have any cancellation before continuing
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			port := raw.(domain.Port)
+			if checked[port.Id] {
+				continue
+			}
+			checked[port.Id] = true
+			if result, ok := scorePort(port, query, edits); ok {
+				matches[port.Id] = result
+			}
+		}
+		return iteratorError(iterator)
+	}
+	iterator, err := trn.Get(tableName, searchIndex+"_prefix", query)
+	if err != nil {
+		logrus.WithError(err).Error("error searching ports in db")
+		return nil, err
+	}
+	if err = collect(iterator, 0, searchMaxCandidates); err != nil {
+		return nil, err
+	}
+	if len(matches) < limit && maxEdits > 0 {
+		// the ports checked by the prefix pass are not checked again, a typo tolerant match scores less anyway.
+		// Every trigram gets its share of the rows, so a common one can't take all of them
+		trigrams := wordTrigrams(query)
+		share := searchMaxCandidates / len(trigrams)
+		if share < 1 {
+			share = 1
+		}
+		for _, trigram := range trigrams {
+			iterator, err = trn.Get(tableName, trigramIndex, trigram)
+			if err != nil {
+				logrus.WithError(err).Error("error searching ports in db")
+				return nil, err
+			}
+			if err = collect(iterator, maxEdits, share); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	results := make([]domain.SearchResult, 0, len(matches))
+	for _, result := range matches {
+		results = append(results, result)
+	}
+	sortSearchResults(results)
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// nearestPorts the k ports closest to the point, it looks in a growing radius till it finds enough ports
+func nearestPorts(ctx context.Context, trn portIndexes, center domain.GeoPoint, k int) ([]domain.PortDistance, error) {
+	for radius := float64(nearestStartRadiusKm); ; radius *= 4 {
+		radius = math.Min(radius, domain.MaxDistanceKm)
+		results, err := portsWithinRadius(ctx, trn, center, radius, k)
+		if err != nil {
+			logrus.WithError(err).Error("error loading nearest ports from db")
+			return nil, err
+		}
+		if len(results) >= k || radius >= domain.MaxDistanceKm {
+			return results, nil
+		}
+	}
+}
+
+// portsInArea looks up the candidates in the boxes through the geo index and checks them against the area and the filter
+func portsInArea(ctx context.Context, trn portIndexes, boxes []geoBox, contains func(location domain.GeoPoint) bool, filter domain.PortFilter, limit int, fn func(port domain.Port) error) error {
+	count := 0
+	for _, box := range boxes {
+		err := visitPortsInBox(ctx, trn, box, func(port domain.Port, location domain.GeoPoint) error {
+			if limit > 0 && count >= limit {
+				return errLimitReached
+			}
+			if !contains(location) || !filter.Matches(port) {
+				return nil
+			}
+			count++
+			return fn(port)
+		})
+		if errors.Is(err, errLimitReached) {
+			return nil
+		}
+		if err != nil {
+			logrus.WithError(err).Error("error loading ports in area from db")
+			return err
+		}
+	}
+	return nil
+}
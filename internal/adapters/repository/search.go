@@ -0,0 +1,290 @@
+package repository
+
+import (
+	"fmt"
+	"github.com/go-related/fileservice/internal/core/domain"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	searchIndex = "search"
+	// trigramIndex the trigrams of the words of the search fields, they pick the candidates of the typo tolerant matches
+	trigramIndex = "trigram"
+)
+
+// scores for the different kind of matches, fuzzy matches lose fuzzyPenalty for every edit
+const (
+	exactScore      = 100
+	exactWordScore  = 90
+	prefixScore     = 80
+	prefixWordScore = 70
+	fuzzyScore      = 50
+	fuzzyPenalty    = 10
+)
+
+// searchMaxCandidates the most ports each pass of a search checks, the prefix pass and the typo tolerant one
+const searchMaxCandidates = 10000
+
+// searchFields the fields we search on with their weight in the final score
+var searchFields = []struct {
+	name   string
+	weight float64
+	values func(port domain.Port) []string
+}{
+	{"name", 1.0, func(port domain.Port) []string { return []string{port.Name} }},
+	{"alias", 0.9, func(port domain.Port) []string { return port.Alias }},
+	{"city", 0.8, func(port domain.Port) []string { return []string{port.City} }},
+}
+
+// normalizeText lower cases, removes the diacritics and replaces the punctuation with single spaces,
+// so "Abu Z¸aby [Abu Dhabi]" becomes "abu zaby abu dhabi"
+func normalizeText(text string) string {
+	folded, _, err := transform.String(transform.Chain(norm.NFKD, runes.Remove(runes.In(unicode.Mn)), norm.NFC), text)
+	if err != nil {
+		folded = text
+	}
+	return strings.Join(strings.FieldsFunc(strings.ToLower(folded), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}), " ")
+}
+
+// searchTerms the normalized values of the search fields and their single words
+func searchTerms(port domain.Port) []string {
+	seen := make(map[string]bool)
+	var terms []string
+	add := func(term string) {
+		if len(term) > 0 && !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	for _, field := range searchFields {
+		for _, value := range field.values(port) {
+			normalized := normalizeText(value)
+			add(normalized)
+			for _, word := range strings.Fields(normalized) {
+				add(word)
+			}
+		}
+	}
+	return terms
+}
+
+// searchTermsIndexer multi value index over the search terms of a port, it supports prefix lookups
+type searchTermsIndexer struct{}
+
+func (s *searchTermsIndexer) FromObject(obj interface{}) (bool, [][]byte, error) {
+	port, ok := obj.(domain.Port)
+	if !ok {
+		return false, nil, fmt.Errorf("unexpected type %T for the search index", obj)
+	}
+	terms := searchTerms(port)
+	if len(terms) == 0 {
+		return false, nil, nil
+	}
+	values := make([][]byte, 0, len(terms))
+	for _, term := range terms {
+		values = append(values, []byte(term+"\x00"))
+	}
+	return true, values, nil
+}
+
+func (s *searchTermsIndexer) FromArgs(args ...interface{}) ([]byte, error) {
+	term, err := searchArg(args...)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(term + "\x00"), nil
+}
+
+func (s *searchTermsIndexer) PrefixFromArgs(args ...interface{}) ([]byte, error) {
+	term, err := searchArg(args...)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(term), nil
+}
+
+// wordTrigrams the trigrams of the words of the normalized text, the words are padded like pg_trgm does with two
+// spaces in front and one after. So a word with a typo still shares most of its trigrams, even with the typo
+// in the first letters, and short words have some trigrams too
+func wordTrigrams(text string) []string {
+	seen := make(map[string]bool)
+	var trigrams []string
+	for _, word := range strings.Fields(text) {
+		padded := []rune("  " + word + " ")
+		for i := 0; i+3 <= len(padded); i++ {
+			trigram := string(padded[i : i+3])
+			if !seen[trigram] {
+				seen[trigram] = true
+				trigrams = append(trigrams, trigram)
+			}
+		}
+	}
+	return trigrams
+}
+
+// searchTrigrams the trigrams of the words of all the search fields
+func searchTrigrams(port domain.Port) []string {
+	var values []string
+	for _, field := range searchFields {
+		for _, value := range field.values(port) {
+			values = append(values, normalizeText(value))
+		}
+	}
+	return wordTrigrams(strings.Join(values, " "))
+}
+
+// trigramIndexer multi value index over the trigrams of a port, the lookups take a trigram as it is
+type trigramIndexer struct{}
+
+func (t *trigramIndexer) FromObject(obj interface{}) (bool, [][]byte, error) {
+	port, ok := obj.(domain.Port)
+	if !ok {
+		return false, nil, fmt.Errorf("unexpected type %T for the trigram index", obj)
+	}
+	trigrams := searchTrigrams(port)
+	if len(trigrams) == 0 {
+		return false, nil, nil
+	}
+	values := make([][]byte, 0, len(trigrams))
+	for _, trigram := range trigrams {
+		values = append(values, []byte(trigram+"\x00"))
+	}
+	return true, values, nil
+}
+
+func (t *trigramIndexer) FromArgs(args ...interface{}) ([]byte, error) {
+	trigram, err := stringArg(args...)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(trigram + "\x00"), nil
+}
+
+func searchArg(args ...interface{}) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("must provide only a single argument")
+	}
+	arg, ok := args[0].(string)
+	if !ok {
+		return "", fmt.Errorf("argument must be a string: %#v", args[0])
+	}
+	return normalizeText(arg), nil
+}
+
+// scorePort finds the best match of the normalized query against the search fields of the port
+func scorePort(port domain.Port, query string, maxEdits int) (domain.SearchResult, bool) {
+	best := domain.SearchResult{Port: port}
+	for _, field := range searchFields {
+		for _, value := range field.values(port) {
+			score, matchType := scoreText(normalizeText(value), query, maxEdits)
+			if score*field.weight > best.Score {
+				best.Score = score * field.weight
+				best.MatchType = matchType
+				best.MatchedField = field.name
+			}
+		}
+	}
+	return best, best.Score > 0
+}
+
+func scoreText(text, query string, maxEdits int) (float64, domain.MatchType) {
+	if len(text) == 0 {
+		return 0, 0
+	}
+	if text == query {
+		return exactScore, domain.MatchExact
+	}
+	words := strings.Fields(text)
+	for _, word := range words {
+		if word == query {
+			return exactWordScore, domain.MatchExact
+		}
+	}
+	if strings.HasPrefix(text, query) {
+		return prefixScore, domain.MatchPrefix
+	}
+	for _, word := range words {
+		if strings.HasPrefix(word, query) {
+			return prefixWordScore, domain.MatchPrefix
+		}
+	}
+	if maxEdits <= 0 {
+		return 0, 0
+	}
+	distance := boundedEditDistance(text, query, maxEdits)
+	for _, word := range words {
+		if d := boundedEditDistance(word, query, maxEdits); d < distance {
+			distance = d
+		}
+	}
+	if distance > maxEdits {
+		return 0, 0
+	}
+	return float64(fuzzyScore - fuzzyPenalty*distance), domain.MatchFuzzy
+}
+
+// boundedEditDistance levenshtein distance between a and b, it stops as soon as the distance is bigger
+// than max and returns max+1 in that case
+func boundedEditDistance(a, b string, max int) int {
+	ra, rb := []rune(a), []rune(b)
+	if diff := len(ra) - len(rb); diff > max || -diff > max {
+		return max + 1
+	}
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		rowMin := current[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+			if current[j] < rowMin {
+				rowMin = current[j]
+			}
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		previous, current = current, previous
+	}
+	if previous[len(rb)] > max {
+		return max + 1
+	}
+	return previous[len(rb)]
+}
+
+func minInt(values ...int) int {
+	result := values[0]
+	for _, value := range values[1:] {
+		if value < result {
+			result = value
+		}
+	}
+	return result
+}
+
+// sortSearchResults by score, ties are sorted by name and id so the order is stable
+func sortSearchResults(results []domain.SearchResult) {
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		if results[i].Port.Name != results[j].Port.Name {
+			return results[i].Port.Name < results[j].Port.Name
+		}
+		return results[i].Port.Id < results[j].Port.Id
+	})
+}
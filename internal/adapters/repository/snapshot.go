@@ -0,0 +1,314 @@
+package repository
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/go-related/fileservice/internal/core/domain"
+	"github.com/hashicorp/go-memdb"
+	"github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A snapshot file is laid out as:
+//
+//	magic "PORTSNAP" | format version uint32 | change sequence uint64 | gzip(gob ports... gob revisions...) |
+//	port count uint64 | revision count uint64 | crc32
+//
+// The numbers are big endian and the crc32 (Castagnoli) covers everything before it.
+// The change sequence is the last change included in the snapshot, so the numbering goes on after a restart.
+// The snapshots of the first format have no history and no revision count, they are still loaded
+const (
+	snapshotMagic                = "PORTSNAP"
+	snapshotFormatVersion        = 2
+	snapshotFormatWithoutHistory = 1
+	snapshotPrefix               = "ports-"
+	snapshotExtension            = ".snap"
+	snapshotHeaderSize           = len(snapshotMagic) + 4 + 8
+	// defaultSnapshotRetention how many snapshots are kept when the config doesn't say
+	defaultSnapshotRetention = 3
+)
+
+var (
+	errSnapshotChecksum = errors.New("snapshot checksum mismatch")
+	errSnapshotFormat   = errors.New("unknown snapshot format")
+	snapshotCrcTable    = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// SnapshotConfig where and how often the memdb repository saves the ports table.
+// Interval <= 0 means a snapshot is taken only on Close, Retention is how many snapshots are kept
+type SnapshotConfig struct {
+	Dir       string
+	Interval  time.Duration
+	Retention int
+}
+
+// Option configures the memdb repository
+type Option func(rp *PortInMemoryRepository)
+
+// WithSnapshots loads the latest snapshot from the directory at startup and keeps saving new ones
+func WithSnapshots(config SnapshotConfig) Option {
+	return func(rp *PortInMemoryRepository) {
+		if config.Retention <= 0 {
+			config.Retention = defaultSnapshotRetention
+		}
+		rp.snapshots = &config
+	}
+}
+
+// writeSnapshot saves all the ports and their history of the transaction into a new file of the directory. The file is written
+// under a temporary name and renamed once it's synced, so a crash never leaves a half written snapshot behind
+func writeSnapshot(dir string, trn *memdb.Txn, sequence uint64) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s%020d%s", snapshotPrefix, time.Now().UnixNano(), snapshotExtension))
+	file, err := os.CreateTemp(dir, snapshotPrefix+"*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		// cleans up after a failure, once renamed the temporary file is gone already
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+	}()
+
+	crc := crc32.New(snapshotCrcTable)
+	buffered := bufio.NewWriter(file)
+	out := io.MultiWriter(buffered, crc)
+	header := make([]byte, 0, snapshotHeaderSize)
+	header = append(header, snapshotMagic...)
+	header = binary.BigEndian.AppendUint32(header, snapshotFormatVersion)
+	header = binary.BigEndian.AppendUint64(header, sequence)
+	if _, err = out.Write(header); err != nil {
+		return "", err
+	}
+
+	compressed := gzip.NewWriter(out)
+	encoder := gob.NewEncoder(compressed)
+	iterator, err := trn.Get(tableName, "id")
+	if err != nil {
+		return "", err
+	}
+	var count uint64
+	for raw := iterator.Next(); raw != nil; raw = iterator.Next() {
+		if err = encoder.Encode(raw.(domain.Port)); err != nil {
+			return "", err
+		}
+		count++
+	}
+	iterator, err = trn.Get(historyTable, "id")
+	if err != nil {
+		return "", err
+	}
+	var revisionCount uint64
+	for raw := iterator.Next(); raw != nil; raw = iterator.Next() {
+		if err = encoder.Encode(raw.(domain.PortRevision)); err != nil {
+			return "", err
+		}
+		revisionCount++
+	}
+	if err = compressed.Close(); err != nil {
+		return "", err
+	}
+	trailer := binary.BigEndian.AppendUint64(nil, count)
+	trailer = binary.BigEndian.AppendUint64(trailer, revisionCount)
+	if _, err = out.Write(trailer); err != nil {
+		return "", err
+	}
+	if _, err = buffered.Write(binary.BigEndian.AppendUint32(nil, crc.Sum32())); err != nil {
+		return "", err
+	}
+	if err = buffered.Flush(); err != nil {
+		return "", err
+	}
+	if err = file.Sync(); err != nil {
+		return "", err
+	}
+	if err = file.Close(); err != nil {
+		return "", err
+	}
+	if err = os.Rename(file.Name(), path); err != nil {
+		return "", err
+	}
+	return path, syncDir(dir)
+}
+
+// readSnapshot checks the format and the checksum of the file before inserting its ports and their history
+// in the transaction, it returns the change sequence of the snapshot
+func readSnapshot(path string, trn *memdb.Txn) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+	if size < int64(snapshotHeaderSize) {
+		return 0, errSnapshotFormat
+	}
+
+	format, sequence, err := readSnapshotHeader(file)
+	if err != nil {
+		return 0, err
+	}
+	trailerSize := int64(snapshotTrailerSize(format))
+	if size < int64(snapshotHeaderSize)+trailerSize {
+		return 0, errSnapshotFormat
+	}
+	trailer := make([]byte, trailerSize)
+	if _, err = file.ReadAt(trailer, size-trailerSize); err != nil {
+		return 0, err
+	}
+	count := binary.BigEndian.Uint64(trailer)
+	var revisionCount uint64
+	if format != snapshotFormatWithoutHistory {
+		revisionCount = binary.BigEndian.Uint64(trailer[8:])
+	}
+
+	// the whole file is checked before loading anything
+	crc := crc32.New(snapshotCrcTable)
+	if _, err = io.Copy(crc, io.NewSectionReader(file, 0, size-4)); err != nil {
+		return 0, err
+	}
+	if crc.Sum32() != binary.BigEndian.Uint32(trailer[trailerSize-4:]) {
+		return 0, errSnapshotChecksum
+	}
+
+	payload := io.NewSectionReader(file, int64(snapshotHeaderSize), size-int64(snapshotHeaderSize)-trailerSize)
+	compressed, err := gzip.NewReader(bufio.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	decoder := gob.NewDecoder(compressed)
+	for loaded := uint64(0); loaded < count; loaded++ {
+		var port domain.Port
+		err = decoder.Decode(&port)
+		if err == io.EOF {
+			return 0, fmt.Errorf("snapshot has %d ports, expected %d: %w", loaded, count, errSnapshotFormat)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if err = trn.Insert(tableName, port); err != nil {
+			return 0, err
+		}
+	}
+	var loaded uint64
+	for {
+		var revision domain.PortRevision
+		err = decoder.Decode(&revision)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if err = trn.Insert(historyTable, revision); err != nil {
+			return 0, err
+		}
+		loaded++
+	}
+	if loaded != revisionCount {
+		return 0, fmt.Errorf("snapshot has %d revisions, expected %d: %w", loaded, revisionCount, errSnapshotFormat)
+	}
+	return sequence, nil
+}
+
+// readSnapshotHeader checks the magic and returns the format version and the change sequence of the snapshot
+func readSnapshotHeader(file io.ReaderAt) (uint32, uint64, error) {
+	header := make([]byte, snapshotHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return 0, 0, err
+	}
+	format := binary.BigEndian.Uint32(header[len(snapshotMagic):])
+	if string(header[:len(snapshotMagic)]) != snapshotMagic ||
+		(format != snapshotFormatVersion && format != snapshotFormatWithoutHistory) {
+		return 0, 0, errSnapshotFormat
+	}
+	return format, binary.BigEndian.Uint64(header[len(snapshotMagic)+4:]), nil
+}
+
+// snapshotTrailerSize the counts and the crc32 at the end of the file
+func snapshotTrailerSize(format uint32) int {
+	if format == snapshotFormatWithoutHistory {
+		return 8 + 4
+	}
+	return 8 + 8 + 4
+}
+
+// oldestSnapshotSequence the change sequence of the oldest snapshot we keep, the write-ahead log is needed
+// only after it. ok is false when there are no readable snapshots
+func oldestSnapshotSequence(dir string) (sequence uint64, ok bool, err error) {
+	paths, err := listSnapshots(dir)
+	if err != nil || len(paths) == 0 {
+		return 0, false, err
+	}
+	file, err := os.Open(paths[0])
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+	_, sequence, err = readSnapshotHeader(file)
+	if err != nil {
+		return 0, false, err
+	}
+	return sequence, true, nil
+}
+
+// listSnapshots the snapshots of the directory from the oldest to the newest, the names sort by creation time
+func listSnapshots(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, entry := range entries {
+		if name := entry.Name(); strings.HasPrefix(name, snapshotPrefix) && strings.HasSuffix(name, snapshotExtension) {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// rotateSnapshots removes the oldest snapshots so that only retention of them are left
+func rotateSnapshots(dir string, retention int) error {
+	paths, err := listSnapshots(dir)
+	if err != nil {
+		return err
+	}
+	for len(paths) > retention {
+		if err = os.Remove(paths[0]); err != nil {
+			return err
+		}
+		logrus.WithField("path", paths[0]).Info("old snapshot removed")
+		paths = paths[1:]
+	}
+	return nil
+}
+
+// syncDir makes the renames and the removals of the directory durable
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
@@ -0,0 +1,135 @@
+package repository
+
+import (
+	"context"
+	"github.com/go-related/fileservice/internal/core/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+	"time"
+)
+
+func commitPorts(t *testing.T, repo *PortInMemoryRepository, ports ...domain.Port) {
+	t.Helper()
+	ctx := context.TODO()
+	trn := startTransaction(t, repo)
+	for _, port := range ports {
+		_, err := trn.AddOrUpdatePort(ctx, port)
+		require.NoError(t, err)
+	}
+	require.NoError(t, trn.Commit(ctx))
+}
+
+func TestSnapshots_RestoreOnStartup(t *testing.T) {
+	config := SnapshotConfig{Dir: t.TempDir()}
+	repo, err := NewPortRepository(WithSnapshots(config))
+	require.NoError(t, err)
+	commitPorts(t, repo,
+		domain.Port{Id: "AEAUH", Name: "Abu Dhabi", Country: "United Arab Emirates", Coordinates: []float64{54.37, 24.47}},
+		domain.Port{Id: "AEAJM", Name: "Ajman", Country: "United Arab Emirates", Alias: []string{"Ajman Port"}},
+	)
+	require.NoError(t, repo.Close())
+
+	repo, err = NewPortRepository(WithSnapshots(config))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"AEAJM", "AEAUH"}, listIds(t, repo, domain.PortFilter{Country: "united arab emirates"}, "", 0))
+	port, err := repo.GetById(context.TODO(), "AEAJM")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Ajman Port"}, port.Alias)
+	// the change numbering goes on from the snapshot
+	assert.Equal(t, uint64(2), repo.LastChangeSequence())
+	commitPorts(t, repo, domain.Port{Id: "AEDXB", Name: "Dubai"})
+	assert.Equal(t, uint64(3), repo.LastChangeSequence())
+}
+
+func TestSnapshots_KeepHistory(t *testing.T) {
+	config := SnapshotConfig{Dir: t.TempDir()}
+	repo, err := NewPortRepository(WithSnapshots(config))
+	require.NoError(t, err)
+	commitPorts(t, repo, domain.Port{Id: "AEAUH", Name: "Abu Dhabi"})
+	commitPorts(t, repo, domain.Port{Id: "AEAUH", Name: "Abu Dhabi", City: "Abu Dhabi"})
+	history, err := repo.GetPortHistory(context.TODO(), "AEAUH")
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.NoError(t, repo.Close())
+
+	repo, err = NewPortRepository(WithSnapshots(config))
+	require.NoError(t, err)
+	restored, err := repo.GetPortHistory(context.TODO(), "AEAUH")
+	require.NoError(t, err)
+	assert.Equal(t, history, restored)
+}
+
+func TestSnapshots_Periodic(t *testing.T) {
+	config := SnapshotConfig{Dir: t.TempDir(), Interval: 10 * time.Millisecond}
+	repo, err := NewPortRepository(WithSnapshots(config))
+	require.NoError(t, err)
+	defer repo.Close()
+	commitPorts(t, repo, domain.Port{Id: "AEAUH", Name: "Abu Dhabi"})
+
+	assert.Eventually(t, func() bool {
+		paths, err := listSnapshots(config.Dir)
+		return err == nil && len(paths) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSnapshots_SkipsWhenNothingChanged(t *testing.T) {
+	config := SnapshotConfig{Dir: t.TempDir()}
+	repo, err := NewPortRepository(WithSnapshots(config))
+	require.NoError(t, err)
+	require.NoError(t, repo.Snapshot())
+	commitPorts(t, repo, domain.Port{Id: "AEAUH", Name: "Abu Dhabi"})
+	require.NoError(t, repo.Snapshot())
+	require.NoError(t, repo.Snapshot())
+
+	paths, err := listSnapshots(config.Dir)
+	require.NoError(t, err)
+	assert.Len(t, paths, 1)
+}
+
+func TestSnapshots_Rotation(t *testing.T) {
+	config := SnapshotConfig{Dir: t.TempDir(), Retention: 2}
+	repo, err := NewPortRepository(WithSnapshots(config))
+	require.NoError(t, err)
+	for _, id := range []string{"AEAUH", "AEAJM", "AEDXB"} {
+		commitPorts(t, repo, domain.Port{Id: id, Name: id})
+		require.NoError(t, repo.Snapshot())
+	}
+
+	paths, err := listSnapshots(config.Dir)
+	require.NoError(t, err)
+	assert.Len(t, paths, 2)
+}
+
+func TestSnapshots_FallsBackOnCorruption(t *testing.T) {
+	config := SnapshotConfig{Dir: t.TempDir()}
+	repo, err := NewPortRepository(WithSnapshots(config))
+	require.NoError(t, err)
+	commitPorts(t, repo, domain.Port{Id: "AEAUH", Name: "Abu Dhabi"})
+	require.NoError(t, repo.Snapshot())
+	commitPorts(t, repo, domain.Port{Id: "AEAJM", Name: "Ajman"})
+	require.NoError(t, repo.Snapshot())
+
+	paths, err := listSnapshots(config.Dir)
+	require.NoError(t, err)
+	require.Len(t, paths, 2)
+	flipByte(t, paths[1])
+
+	repo, err = NewPortRepository(WithSnapshots(config))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"AEAUH"}, listIds(t, repo, domain.PortFilter{}, "", 0))
+
+	flipByte(t, paths[0])
+	_, err = NewPortRepository(WithSnapshots(config))
+	assert.Error(t, err, "snapshots exist but none can be read")
+}
+
+// flipByte corrupts a byte in the middle of the file
+func flipByte(t *testing.T, path string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	data[len(data)/2] ^= 0xff
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+}
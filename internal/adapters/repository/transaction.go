@@ -0,0 +1,270 @@
+package repository
+
+import (
+	"context"
+	"github.com/go-related/fileservice/internal/core/domain"
+	cerror "github.com/go-related/fileservice/internal/core/errors"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// pendingTransaction the transaction of the memdb and bolt adapters, both of them allow a single writer at a time.
+// The writes are kept aside and the reads see the committed ports with the writes of the transaction on top,
+// so any number of streams can import at the same time. On commit the writes are applied in one short write
+// transaction of the adapter, after checking that no other commit changed the written ports since this
+// transaction read them: the first committer wins and the later one fails with a conflict
+type pendingTransaction struct {
+	id string
+	// view runs fn on the committed ports
+	view func(fn func(trn portIndexes) error) error
+	// apply checks the conflicts and writes the transaction in a write transaction of the adapter
+	apply func(ctx context.Context, pending *pendingTransaction) error
+	// writes the new version of the written ports, nil when the port is deleted
+	writes map[string]*domain.Port
+	// order the written ids in the order they were first written, the changes are published in the same order
+	order []string
+	// read the committed version of the ports when the transaction first read them, nil when they didn't exist
+	read   map[string]*domain.Port
+	closed bool
+}
+
+func newPendingTransaction(view func(fn func(trn portIndexes) error) error, apply func(ctx context.Context, pending *pendingTransaction) error) *pendingTransaction {
+	return &pendingTransaction{
+		id:     newTransactionId(),
+		view:   view,
+		apply:  apply,
+		writes: make(map[string]*domain.Port),
+		read:   make(map[string]*domain.Port),
+	}
+}
+
+func (t *pendingTransaction) AddOrUpdatePort(ctx context.Context, port domain.Port) (*domain.Port, error) {
+	replaced, err := t.AddOrUpdatePorts(ctx, []domain.Port{port})
+	if err != nil {
+		return nil, err
+	}
+	return replaced[0], nil
+}
+
+// AddOrUpdatePorts reads the committed version of all the ports in a single view before writing them
+func (t *pendingTransaction) AddOrUpdatePorts(ctx context.Context, ports []domain.Port) ([]*domain.Port, error) {
+	if t.closed {
+		return nil, cerror.TransactionClosed
+	}
+	if err := t.load(ctx, portIds(ports)); err != nil {
+		logrus.WithError(err).Error("error loading ports from db")
+		return nil, err
+	}
+	now := time.Now()
+	replaced := make([]*domain.Port, 0, len(ports))
+	for _, port := range ports {
+		// loaded already, the same id twice sees the first write
+		currentData, err := t.get(ctx, port.Id)
+		if err != nil {
+			return nil, err
+		}
+		// stamped again by apply with the time of the commit, a port deleted before gets its version from the history then
+		next := nextVersion(port, currentData, 0, now)
+		t.write(next.Id, &next)
+		replaced = append(replaced, currentData)
+	}
+	return replaced, nil
+}
+
+// DeletePorts removes the ports with the given ids, missing ids are ignored. It returns how many ports were removed
+func (t *pendingTransaction) DeletePorts(ctx context.Context, ids []string) (int, error) {
+	if t.closed {
+		return 0, cerror.TransactionClosed
+	}
+	deleted := 0
+	for _, id := range ids {
+		port, err := t.get(ctx, id)
+		if err != nil {
+			logrus.WithField("id", id).WithError(err).Error("error loading port from db")
+			return deleted, err
+		}
+		if port == nil {
+			continue
+		}
+		t.write(id, nil)
+		deleted++
+	}
+	return deleted, nil
+}
+
+// DeletePortsByFilter removes the committed ports and the ones written by the transaction matching the filter
+func (t *pendingTransaction) DeletePortsByFilter(ctx context.Context, filter domain.PortFilter) (int, error) {
+	if t.closed {
+		return 0, cerror.TransactionClosed
+	}
+	var matches []domain.Port
+	err := t.view(func(trn portIndexes) error {
+		var err error
+		matches, err = portsMatching(trn, filter)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, port := range matches {
+		// check if we have any cancellation before continuing
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		default:
+		}
+		if _, ok := t.writes[port.Id]; ok {
+			continue // the version written by the transaction is checked below
+		}
+		if _, ok := t.read[port.Id]; !ok {
+			port := port
+			t.read[port.Id] = &port
+		}
+		t.write(port.Id, nil)
+		deleted++
+	}
+	for _, id := range t.order {
+		if port := t.writes[id]; port != nil && filter.Matches(*port) {
+			t.writes[id] = nil
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// GetById the port with the writes of the transaction, nil when it doesn't exist
+func (t *pendingTransaction) GetById(ctx context.Context, id string) (*domain.Port, error) {
+	if t.closed {
+		return nil, cerror.TransactionClosed
+	}
+	return t.get(ctx, id)
+}
+
+// GetByIds the ports with the writes of the transaction in the order of the ids, the committed ones are read in a single view
+func (t *pendingTransaction) GetByIds(ctx context.Context, ids []string) ([]*domain.Port, error) {
+	if t.closed {
+		return nil, cerror.TransactionClosed
+	}
+	if err := t.load(ctx, ids); err != nil {
+		return nil, err
+	}
+	result := make([]*domain.Port, 0, len(ids))
+	for _, id := range ids {
+		port, err := t.get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, port)
+	}
+	return result, nil
+}
+
+// Commit applies the writes, a transaction without writes has nothing to check
+func (t *pendingTransaction) Commit(ctx context.Context) error {
+	if t.closed {
+		return cerror.TransactionClosed
+	}
+	// check if we have any cancellation before continuing
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	t.closed = true
+	if len(t.order) == 0 {
+		return nil
+	}
+	return t.apply(ctx, t)
+}
+
+func (t *pendingTransaction) Id() string {
+	return t.id
+}
+
+func (t *pendingTransaction) Abort() {
+	t.closed = true
+	t.writes, t.read, t.order = nil, nil, nil
+}
+
+// get the port as the transaction sees it, the committed version is read once and then kept for the conflict check
+func (t *pendingTransaction) get(ctx context.Context, id string) (*domain.Port, error) {
+	if port, ok := t.writes[id]; ok {
+		return copyPort(port), nil
+	}
+	if err := t.load(ctx, []string{id}); err != nil {
+		return nil, err
+	}
+	return copyPort(t.read[id]), nil
+}
+
+// load reads in a single view the committed version of the ports the transaction didn't see yet
+func (t *pendingTransaction) load(ctx context.Context, ids []string) error {
+	var missing []string
+	for _, id := range ids {
+		_, written := t.writes[id]
+		if _, read := t.read[id]; !written && !read {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return t.view(func(trn portIndexes) error {
+		for _, id := range missing {
+			committed, err := getPort(ctx, trn, id)
+			if err != nil {
+				return err
+			}
+			t.read[id] = committed
+		}
+		return nil
+	})
+}
+
+func (t *pendingTransaction) write(id string, port *domain.Port) {
+	if _, ok := t.writes[id]; !ok {
+		t.order = append(t.order, id)
+	}
+	t.writes[id] = port
+}
+
+// checkConflicts compares the written ports with their committed version in trn, the write transaction of the adapter
+func (t *pendingTransaction) checkConflicts(ctx context.Context, trn portIndexes) error {
+	for _, id := range t.order {
+		current, err := getPort(ctx, trn, id)
+		if err != nil {
+			return err
+		}
+		if !samePort(current, t.read[id]) {
+			logrus.WithField("id", id).Warn("port changed by another transaction, aborting commit")
+			return cerror.TransactionConflict
+		}
+	}
+	return nil
+}
+
+// samePort the version tells apart a port changed and then changed back
+func samePort(a, b *domain.Port) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Version == b.Version && a.Equal(*b)
+}
+
+func portIds(ports []domain.Port) []string {
+	ids := make([]string, 0, len(ports))
+	for _, port := range ports {
+		ids = append(ids, port.Id)
+	}
+	return ids
+}
+
+// copyPort callers get their own copy, so they can't change the version kept by the transaction
+func copyPort(port *domain.Port) *domain.Port {
+	if port == nil {
+		return nil
+	}
+	result := *port
+	return &result
+}
@@ -0,0 +1,194 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-related/fileservice/internal/adapters/parser"
+	"github.com/go-related/fileservice/internal/core/domain"
+	"github.com/go-related/fileservice/internal/core/ports"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+const (
+	// benchmarkFileEnv a ports file to import in the benchmarks instead of the generated ports, like the nightly file
+	benchmarkFileEnv = "PORTS_BENCH_FILE"
+	// benchmarkPortsEnv how many ports are generated, PORTS_BENCH_COUNT=2000000 is about a full dataset file
+	// and takes a while so the default is smaller
+	benchmarkPortsEnv = "PORTS_BENCH_COUNT"
+)
+
+// benchmarkBatchSize the ports written by a single AddOrUpdatePorts, about what a stream message carries
+const benchmarkBatchSize = 1000
+
+// portsSource publishes the ports to import, like the parser of a real import
+type portsSource func(ctx context.Context, channel chan domain.IndexedPort) error
+
+type importFunc func(ctx context.Context, trn ports.Transaction, items <-chan domain.Port) error
+
+// benchmarkSource the ports of $PORTS_BENCH_FILE parsed on all the cpus, otherwise $PORTS_BENCH_COUNT generated
+// ports, 200k by default. The ports are streamed so millions of them don't have to be kept in memory
+func benchmarkSource(b *testing.B) portsSource {
+	b.Helper()
+	if path := os.Getenv(benchmarkFileEnv); path != "" {
+		fileParser := parser.NewParallelStreamJsonParser(false, runtime.NumCPU())
+		return func(ctx context.Context, channel chan domain.IndexedPort) error {
+			return fileParser.ReadJsonFile(ctx, path, channel)
+		}
+	}
+	count := 200_000
+	if value := os.Getenv(benchmarkPortsEnv); value != "" {
+		var err error
+		count, err = strconv.Atoi(value)
+		require.NoError(b, err)
+	}
+	return func(ctx context.Context, channel chan domain.IndexedPort) error {
+		for i := 0; i < count; i++ {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			default:
+			}
+			id := fmt.Sprintf("P%08d", i)
+			channel <- domain.IndexedPort{Port: domain.Port{
+				Id:          id,
+				Name:        "Port " + id,
+				City:        "City " + strconv.Itoa(i%5000),
+				Country:     "Country " + strconv.Itoa(i%200),
+				Coordinates: []float64{float64(i%360) - 180, float64(i%180) - 90},
+				UNLOCs:      []string{id},
+			}, Index: i}
+		}
+		return nil
+	}
+}
+
+// importStream imports the ports of the source kept by keep and returns how many they were
+func importStream(ctx context.Context, trn ports.Transaction, source portsSource, keep func(port domain.IndexedPort) bool, importPorts importFunc) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	parsed := make(chan domain.IndexedPort, benchmarkBatchSize)
+	kept := make(chan domain.Port, benchmarkBatchSize)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- source(ctx, parsed)
+		close(parsed)
+	}()
+	count := 0
+	go func() {
+		defer close(kept)
+		// parsed is drained till the source is done, even once the import failed
+		for port := range parsed {
+			if !keep(port) {
+				continue
+			}
+			select {
+			case kept <- port.Port:
+				count++
+			case <-ctx.Done():
+			}
+		}
+	}()
+	if err := importPorts(ctx, trn, kept); err != nil {
+		return 0, err
+	}
+	return count, <-errs
+}
+
+// importOneByOne the old import: a read and a write for every port
+func importOneByOne(ctx context.Context, trn ports.Transaction, items <-chan domain.Port) error {
+	for port := range items {
+		if _, err := trn.GetById(ctx, port.Id); err != nil {
+			return err
+		}
+		if _, err := trn.AddOrUpdatePort(ctx, port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func importBatched(ctx context.Context, trn ports.Transaction, items <-chan domain.Port) error {
+	batch := make([]domain.Port, 0, benchmarkBatchSize)
+	write := func() error {
+		if _, err := trn.GetByIds(ctx, portIds(batch)); err != nil {
+			return err
+		}
+		_, err := trn.AddOrUpdatePorts(ctx, batch)
+		batch = batch[:0]
+		return err
+	}
+	for port := range items {
+		batch = append(batch, port)
+		if len(batch) < benchmarkBatchSize {
+			continue
+		}
+		if err := write(); err != nil {
+			return err
+		}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return write()
+}
+
+// BenchmarkImport imports the ports in a single transaction, the postgres variants are skipped without
+// $POSTGRES_TEST_DSN. With a file of millions of ports mind -benchtime=1x
+func BenchmarkImport(b *testing.B) {
+	source := benchmarkSource(b)
+	adapters := map[string]func(b *testing.B) ports.Repository{
+		"memdb": func(b *testing.B) ports.Repository {
+			repo, err := NewPortRepository()
+			require.NoError(b, err)
+			return repo
+		},
+		"bolt": func(b *testing.B) ports.Repository {
+			repo, err := NewPortBoltRepository(filepath.Join(b.TempDir(), "ports.db"))
+			require.NoError(b, err)
+			b.Cleanup(func() { _ = repo.Close() })
+			return repo
+		},
+		"postgres": func(b *testing.B) ports.Repository {
+			return newTestPostgresRepository(b)
+		},
+	}
+	imports := map[string]importFunc{
+		"OneByOne": importOneByOne,
+		"Batched":  importBatched,
+	}
+	everyOther := func(port domain.IndexedPort) bool { return port.Index%2 == 0 }
+	all := func(port domain.IndexedPort) bool { return true }
+	for adapter, newRepository := range adapters {
+		for name, importPorts := range imports {
+			newRepository, importPorts := newRepository, importPorts
+			b.Run(adapter+"/"+name, func(b *testing.B) {
+				ctx := context.TODO()
+				imported := 0
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					repo := newRepository(b)
+					// half of the file is already stored, the other half is new
+					trn, err := repo.StartTransaction(ctx)
+					require.NoError(b, err)
+					_, err = importStream(ctx, trn, source, everyOther, importBatched)
+					require.NoError(b, err)
+					require.NoError(b, trn.Commit(ctx))
+					b.StartTimer()
+
+					trn, err = repo.StartTransaction(ctx)
+					require.NoError(b, err)
+					count, err := importStream(ctx, trn, source, all, importPorts)
+					require.NoError(b, err)
+					require.NoError(b, trn.Commit(ctx))
+					imported += count
+				}
+				b.ReportMetric(float64(imported)/b.Elapsed().Seconds(), "ports/s")
+			})
+		}
+	}
+}
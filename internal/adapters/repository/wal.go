@@ -0,0 +1,266 @@
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/go-related/fileservice/internal/core/domain"
+	"github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The log is split in segments named after the change sequence of their first record, a new segment is started
+// on every snapshot so the older ones can be removed once a snapshot covers them. Every record is
+//
+//	payload length uint32 | crc32 of the payload | gob(walRecord)
+//
+// with the numbers big endian, a record that is cut short or fails the checksum marks the end of the log
+const (
+	walPrefix     = "wal-"
+	walExtension  = ".log"
+	walHeaderSize = 4 + 4
+)
+
+var (
+	errWalRecord = errors.New("invalid write-ahead log record")
+	errWalClosed = errors.New("write-ahead log is closed")
+)
+
+// walRecord the changes of one committed transaction, Sequence is the sequence of the last change.
+// The history is not logged, replaying the changes in order replaces the same revisions again.
+// A compaction of the history has no changes, Sequence is the last one committed before it
+type walRecord struct {
+	Sequence      uint64
+	Changes       []domain.PortChange
+	TransactionId string
+	Compaction    *walCompaction
+}
+
+// walCompaction a CompactHistory, replayed with the same time it removes the same revisions. Doing it again on
+// a history already compacted removes nothing
+type walCompaction struct {
+	Retention domain.HistoryRetention
+	At        time.Time
+}
+
+// firstSequence the sequence of the first change of the record
+func (r walRecord) firstSequence() uint64 {
+	return r.Sequence - uint64(len(r.Changes)) + 1
+}
+
+// WithWriteAheadLog every commit is synced to a log in the directory before it becomes visible and the log is
+// replayed at startup on top of the latest snapshot. Without snapshots the log is never compacted
+func WithWriteAheadLog(dir string) Option {
+	return func(rp *PortInMemoryRepository) {
+		rp.wal = &writeAheadLog{dir: dir}
+	}
+}
+
+type writeAheadLog struct {
+	dir  string
+	file *os.File
+	// first the sequence the current segment starts from
+	first uint64
+	// size the valid bytes of the current segment, a failed append is cut back to it
+	size int64
+}
+
+// replay calls fn with every record of the log in order. The log ends at the first broken record,
+// that segment is cut there and the following ones are removed since they can't be applied after a hole
+func (w *writeAheadLog) replay(fn func(record walRecord) error) error {
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	for i, segment := range segments {
+		valid, err := replaySegment(segment.path, fn)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, errWalRecord) {
+			return err
+		}
+		logrus.WithError(err).WithField("path", segment.path).WithField("valid_bytes", valid).Warn("write-ahead log ends with a broken record, cutting it")
+		if err = os.Truncate(segment.path, valid); err != nil {
+			return err
+		}
+		for _, later := range segments[i+1:] {
+			logrus.WithField("path", later.path).Warn("removing write-ahead log segment after a broken record")
+			if err = os.Remove(later.path); err != nil {
+				return err
+			}
+		}
+		return syncDir(w.dir)
+	}
+	return nil
+}
+
+// replaySegment returns how many bytes of the segment hold valid records
+func replaySegment(path string, fn func(record walRecord) error) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(file)
+	var valid int64
+	header := make([]byte, walHeaderSize)
+	for {
+		if _, err = io.ReadFull(reader, header); err == io.EOF {
+			return valid, nil
+		} else if err != nil {
+			return valid, fmt.Errorf("%w: %v", errWalRecord, err)
+		}
+		length := int64(binary.BigEndian.Uint32(header))
+		if length > info.Size()-valid-walHeaderSize {
+			return valid, fmt.Errorf("%w: record of %d bytes past the end of the file", errWalRecord, length)
+		}
+		payload := make([]byte, length)
+		if _, err = io.ReadFull(reader, payload); err != nil {
+			return valid, fmt.Errorf("%w: %v", errWalRecord, err)
+		}
+		if crc32.Checksum(payload, snapshotCrcTable) != binary.BigEndian.Uint32(header[4:]) {
+			return valid, fmt.Errorf("%w: checksum mismatch", errWalRecord)
+		}
+		var record walRecord
+		if err = gob.NewDecoder(bytes.NewReader(payload)).Decode(&record); err != nil {
+			return valid, fmt.Errorf("%w: %v", errWalRecord, err)
+		}
+		if err = fn(record); err != nil {
+			return valid, err
+		}
+		valid += int64(walHeaderSize + len(payload))
+	}
+}
+
+// append writes the record and syncs it to disk. If anything fails the segment is cut back,
+// so a commit that didn't happen is never replayed
+func (w *writeAheadLog) append(record walRecord) error {
+	if w.file == nil {
+		return errWalClosed
+	}
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(record); err != nil {
+		return err
+	}
+	data := make([]byte, 0, walHeaderSize+payload.Len())
+	data = binary.BigEndian.AppendUint32(data, uint32(payload.Len()))
+	data = binary.BigEndian.AppendUint32(data, crc32.Checksum(payload.Bytes(), snapshotCrcTable))
+	data = append(data, payload.Bytes()...)
+
+	_, err := w.file.Write(data)
+	if err == nil {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		if truncateErr := w.file.Truncate(w.size); truncateErr != nil {
+			logrus.WithError(truncateErr).Error("error cutting back the write-ahead log")
+		}
+		return err
+	}
+	w.size += int64(len(data))
+	return nil
+}
+
+// startSegment closes the current segment and starts writing to the one for the sequence
+func (w *writeAheadLog) startSegment(first uint64) error {
+	if err := os.MkdirAll(w.dir, 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(w.segmentPath(first), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = syncDir(w.dir); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = w.close(); err != nil {
+		logrus.WithError(err).Warn("error closing write-ahead log segment")
+	}
+	w.file, w.first, w.size = file, first, info.Size()
+	return nil
+}
+
+// compact removes the segments whose changes are all at or before the sequence
+func (w *writeAheadLog) compact(sequence uint64) error {
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	removed := false
+	for i := 0; i+1 < len(segments) && segments[i+1].first <= sequence+1; i++ {
+		if err = os.Remove(segments[i].path); err != nil {
+			return err
+		}
+		logrus.WithField("path", segments[i].path).Info("write-ahead log segment compacted")
+		removed = true
+	}
+	if !removed {
+		return nil
+	}
+	return syncDir(w.dir)
+}
+
+func (w *writeAheadLog) close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+type walSegment struct {
+	path  string
+	first uint64
+}
+
+// segments the segments of the directory sorted by their first sequence
+func (w *writeAheadLog) segments() ([]walSegment, error) {
+	entries, err := os.ReadDir(w.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var segments []walSegment
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, walPrefix) || !strings.HasSuffix(name, walExtension) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, walPrefix), walExtension), 10, 64)
+		if err != nil {
+			logrus.WithField("name", name).Warn("skipping file with an invalid write-ahead log name")
+			continue
+		}
+		segments = append(segments, walSegment{path: filepath.Join(w.dir, name), first: first})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].first < segments[j].first })
+	return segments, nil
+}
+
+func (w *writeAheadLog) segmentPath(first uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%s%020d%s", walPrefix, first, walExtension))
+}
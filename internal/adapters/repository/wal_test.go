@@ -0,0 +1,122 @@
+package repository
+
+import (
+	"context"
+	"github.com/go-related/fileservice/internal/core/domain"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+)
+
+func TestWriteAheadLog_ReplaysAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewPortRepository(WithWriteAheadLog(dir))
+	require.NoError(t, err)
+	commitPorts(t, repo, domain.Port{Id: "AEAUH", Name: "Abu Dhabi"}, domain.Port{Id: "AEAJM", Name: "Ajman"})
+	commitPorts(t, repo, domain.Port{Id: "AEAUH", Name: "Abu Dhabi", City: "Abu Dhabi"})
+	ctx := context.TODO()
+	trn := startTransaction(t, repo)
+	_, err = trn.DeletePorts(ctx, []string{"AEAJM"})
+	require.NoError(t, err)
+	require.NoError(t, trn.Commit(ctx))
+	// aborted transactions never reach the log
+	trn = startTransaction(t, repo)
+	_, err = trn.AddOrUpdatePort(ctx, domain.Port{Id: "AEDXB", Name: "Dubai"})
+	require.NoError(t, err)
+	trn.Abort()
+	history, err := repo.GetPortHistory(ctx, "AEAJM")
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+
+	// no Close, like after a crash
+	repo, err = NewPortRepository(WithWriteAheadLog(dir))
+	require.NoError(t, err)
+	defer repo.Close()
+	assert.Equal(t, []string{"AEAUH"}, listIds(t, repo, domain.PortFilter{}, "", 0))
+	port, err := repo.GetById(ctx, "AEAUH")
+	require.NoError(t, err)
+	assert.Equal(t, "Abu Dhabi", port.City)
+	assert.Equal(t, uint64(4), repo.LastChangeSequence())
+	// the history is replaced again by the replayed commits
+	replayed, err := repo.GetPortHistory(ctx, "AEAJM")
+	require.NoError(t, err)
+	assert.Equal(t, history, replayed)
+	replayed, err = repo.GetPortHistory(ctx, "AEAUH")
+	require.NoError(t, err)
+	assert.Len(t, replayed, 1)
+}
+
+func TestWriteAheadLog_OnTopOfSnapshot(t *testing.T) {
+	snapshots := SnapshotConfig{Dir: t.TempDir(), Retention: 1}
+	walDir := t.TempDir()
+	repo, err := NewPortRepository(WithSnapshots(snapshots), WithWriteAheadLog(walDir))
+	require.NoError(t, err)
+	commitPorts(t, repo, domain.Port{Id: "AEAUH", Name: "Abu Dhabi"})
+	require.NoError(t, repo.Snapshot())
+	commitPorts(t, repo, domain.Port{Id: "AEAJM", Name: "Ajman"})
+
+	// the first segment is covered by the snapshot
+	segments, err := repo.wal.segments()
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+	assert.Equal(t, uint64(2), segments[0].first)
+
+	repo, err = NewPortRepository(WithSnapshots(snapshots), WithWriteAheadLog(walDir))
+	require.NoError(t, err)
+	defer repo.Close()
+	assert.Equal(t, []string{"AEAJM", "AEAUH"}, listIds(t, repo, domain.PortFilter{}, "", 0))
+	assert.Equal(t, uint64(2), repo.LastChangeSequence())
+}
+
+func TestWriteAheadLog_ReplaysHistoryCompaction(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewPortRepository(WithWriteAheadLog(dir))
+	require.NoError(t, err)
+	for _, city := range []string{"", "Abu Dhabi", "Abu Zaby"} {
+		commitPorts(t, repo, domain.Port{Id: "AEAUH", Name: "Abu Dhabi", City: city})
+	}
+	ctx := context.TODO()
+	removed, err := repo.CompactHistory(ctx, domain.HistoryRetention{MaxRevisions: 1})
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	compacted, err := repo.GetPortHistory(ctx, "AEAUH")
+	require.NoError(t, err)
+	// a commit after the compaction is replayed on top of it
+	commitPorts(t, repo, domain.Port{Id: "AEAJM", Name: "Ajman"})
+
+	// no Close, like after a crash
+	repo, err = NewPortRepository(WithWriteAheadLog(dir))
+	require.NoError(t, err)
+	defer repo.Close()
+	replayed, err := repo.GetPortHistory(ctx, "AEAUH")
+	require.NoError(t, err)
+	assert.Equal(t, compacted, replayed)
+	assert.Equal(t, []string{"AEAJM", "AEAUH"}, listIds(t, repo, domain.PortFilter{}, "", 0))
+}
+
+func TestWriteAheadLog_CutsBrokenTail(t *testing.T) {
+	dir := t.TempDir()
+	repo, err := NewPortRepository(WithWriteAheadLog(dir))
+	require.NoError(t, err)
+	commitPorts(t, repo, domain.Port{Id: "AEAUH", Name: "Abu Dhabi"})
+	path := repo.wal.file.Name()
+	require.NoError(t, repo.Close())
+	// half a record, like a crash in the middle of a write
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{0, 0, 1, 0, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	repo, err = NewPortRepository(WithWriteAheadLog(dir))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"AEAUH"}, listIds(t, repo, domain.PortFilter{}, "", 0))
+	commitPorts(t, repo, domain.Port{Id: "AEAJM", Name: "Ajman"})
+	require.NoError(t, repo.Close())
+
+	repo, err = NewPortRepository(WithWriteAheadLog(dir))
+	require.NoError(t, err)
+	defer repo.Close()
+	assert.Equal(t, []string{"AEAJM", "AEAUH"}, listIds(t, repo, domain.PortFilter{}, "", 0))
+}
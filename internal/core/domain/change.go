@@ -0,0 +1,46 @@
+package domain
+
+import (
+	"strings"
+	"time"
+)
+
+// ChangeType the values are the same as in the proto enum
+type ChangeType int
+
+const (
+	ChangeCreated ChangeType = iota + 1
+	ChangeUpdated
+	ChangeDeleted
+)
+
+func (c ChangeType) String() string {
+	switch c {
+	case ChangeCreated:
+		return "created"
+	case ChangeUpdated:
+		return "updated"
+	case ChangeDeleted:
+		return "deleted"
+	default:
+		return "unknown"
+	}
+}
+
+// PortChange a committed change of a port, for deletes Port holds the last version before the delete
+type PortChange struct {
+	Sequence    uint64
+	Type        ChangeType
+	Port        Port
+	CommittedAt time.Time
+}
+
+// WatchFilter narrows down the changes sent to a watcher, empty fields are ignored
+type WatchFilter struct {
+	Country  string
+	IdPrefix string
+}
+
+func (f WatchFilter) Matches(change PortChange) bool {
+	return matchesField(f.Country, change.Port.Country) && strings.HasPrefix(change.Port.Id, f.IdPrefix)
+}
@@ -0,0 +1,45 @@
+package domain
+
+import "fmt"
+
+// FieldDiff a field that changed between the stored port and the new one, values are formatted as text
+type FieldDiff struct {
+	Field string
+	Old   string
+	New   string
+}
+
+// DiffPorts the fields that differ between old and new, nil and empty slices are the same
+func DiffPorts(old, new Port) []FieldDiff {
+	var diffs []FieldDiff
+	addText := func(field, oldValue, newValue string) {
+		if oldValue != newValue {
+			diffs = append(diffs, FieldDiff{Field: field, Old: oldValue, New: newValue})
+		}
+	}
+	addStrings := func(field string, oldValue, newValue []string) {
+		if !equalStrings(oldValue, newValue) {
+			diffs = append(diffs, FieldDiff{Field: field, Old: formatSlice(oldValue), New: formatSlice(newValue)})
+		}
+	}
+	addText("name", old.Name, new.Name)
+	addText("city", old.City, new.City)
+	addText("country", old.Country, new.Country)
+	addStrings("alias", old.Alias, new.Alias)
+	addStrings("regions", old.Regions, new.Regions)
+	if !equalFloats(old.Coordinates, new.Coordinates) {
+		diffs = append(diffs, FieldDiff{Field: "coordinates", Old: formatSlice(old.Coordinates), New: formatSlice(new.Coordinates)})
+	}
+	addText("province", old.Province, new.Province)
+	addText("timezone", old.Timezone, new.Timezone)
+	addStrings("unlocs", old.UNLOCs, new.UNLOCs)
+	addText("code", old.Code, new.Code)
+	return diffs
+}
+
+func formatSlice[T any](values []T) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return fmt.Sprint(values)
+}
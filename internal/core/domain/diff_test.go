@@ -0,0 +1,18 @@
+package domain
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestDiffPorts(t *testing.T) {
+	old := Port{Id: "AEAJM", Name: "Ajman", City: "Ajman", Alias: []string{}, Coordinates: []float64{55.5136433, 25.4052165}}
+	updated := Port{Id: "AEAJM", Name: "Ajman Port", City: "Ajman", Coordinates: []float64{55.5, 25.4}, UNLOCs: []string{"AEAJM"}}
+
+	assert.Equal(t, []FieldDiff{
+		{Field: "name", Old: "Ajman", New: "Ajman Port"},
+		{Field: "coordinates", Old: "[55.5136433 25.4052165]", New: "[55.5 25.4]"},
+		{Field: "unlocs", Old: "", New: "[AEAJM]"},
+	}, DiffPorts(old, updated))
+	assert.Empty(t, DiffPorts(old, old))
+}
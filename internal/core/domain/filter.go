@@ -0,0 +1,47 @@
+package domain
+
+import "strings"
+
+// PortFilter narrows down the ports returned by the queries, empty fields are ignored
+// and the values are compared case insensitive. Unloc, Alias and Region match when the port lists the value
+type PortFilter struct {
+	Country  string
+	City     string
+	Province string
+	Timezone string
+	Code     string
+	Unloc    string
+	Alias    string
+	Region   string
+}
+
+func (f PortFilter) IsEmpty() bool {
+	return f == PortFilter{}
+}
+
+func (f PortFilter) Matches(port Port) bool {
+	return matchesField(f.Country, port.Country) &&
+		matchesField(f.City, port.City) &&
+		matchesField(f.Province, port.Province) &&
+		matchesField(f.Timezone, port.Timezone) &&
+		matchesField(f.Code, port.Code) &&
+		matchesAnyField(f.Unloc, port.UNLOCs) &&
+		matchesAnyField(f.Alias, port.Alias) &&
+		matchesAnyField(f.Region, port.Regions)
+}
+
+func matchesField(expected, actual string) bool {
+	return len(expected) == 0 || strings.EqualFold(expected, actual)
+}
+
+func matchesAnyField(expected string, values []string) bool {
+	if len(expected) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if strings.EqualFold(expected, value) {
+			return true
+		}
+	}
+	return false
+}
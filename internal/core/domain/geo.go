@@ -0,0 +1,121 @@
+package domain
+
+import "math"
+
+// EarthRadiusKm mean earth radius used for the great-circle distances
+const EarthRadiusKm = 6371.0088
+
+// MaxDistanceKm half of the earth circumference, no two points are further away than this
+const MaxDistanceKm = math.Pi * EarthRadiusKm
+
+type GeoPoint struct {
+	Lat float64
+	Lon float64
+}
+
+func (p GeoPoint) IsValid() bool {
+	return p.Lat >= -90 && p.Lat <= 90 && p.Lon >= -180 && p.Lon <= 180
+}
+
+// BoundingBox a lat/lon box, when MinLon is bigger than MaxLon the box crosses the antimeridian
+type BoundingBox struct {
+	MinLat float64
+	MinLon float64
+	MaxLat float64
+	MaxLon float64
+}
+
+func (b BoundingBox) IsValid() bool {
+	return GeoPoint{Lat: b.MinLat, Lon: b.MinLon}.IsValid() && GeoPoint{Lat: b.MaxLat, Lon: b.MaxLon}.IsValid() && b.MinLat <= b.MaxLat
+}
+
+// Polygon the first ring is the outer boundary and the others are holes, like in GeoJSON.
+// The edges are straight lines on the lat/lon plane and the polygon can't cross the antimeridian
+type Polygon [][]GeoPoint
+
+// IsValid every ring needs to be closed and have at least 4 points, the first and last being the same
+func (p Polygon) IsValid() bool {
+	if len(p) == 0 {
+		return false
+	}
+	for _, ring := range p {
+		if len(ring) < 4 || ring[0] != ring[len(ring)-1] {
+			return false
+		}
+		for _, point := range ring {
+			if !point.IsValid() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Contains the point needs to be inside the outer ring and outside all the holes
+func (p Polygon) Contains(point GeoPoint) bool {
+	if len(p) == 0 || !ringContains(p[0], point) {
+		return false
+	}
+	for _, hole := range p[1:] {
+		if ringContains(hole, point) {
+			return false
+		}
+	}
+	return true
+}
+
+// BoundingBox the smallest box containing the outer ring
+func (p Polygon) BoundingBox() BoundingBox {
+	box := BoundingBox{MinLat: 90, MinLon: 180, MaxLat: -90, MaxLon: -180}
+	if len(p) == 0 {
+		return box
+	}
+	for _, point := range p[0] {
+		box.MinLat = math.Min(box.MinLat, point.Lat)
+		box.MinLon = math.Min(box.MinLon, point.Lon)
+		box.MaxLat = math.Max(box.MaxLat, point.Lat)
+		box.MaxLon = math.Max(box.MaxLon, point.Lon)
+	}
+	return box
+}
+
+// ringContains ray casting, counts how many edges a ray going east from the point crosses
+func ringContains(ring []GeoPoint, point GeoPoint) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a.Lat > point.Lat) != (b.Lat > point.Lat) &&
+			point.Lon < (b.Lon-a.Lon)*(point.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// PortDistance a port together with its distance from the point of the query
+type PortDistance struct {
+	Port       Port
+	DistanceKm float64
+}
+
+// Location returns the coordinates of the port as a point, keep in mind the file has them as [lon, lat]
+func (p Port) Location() (GeoPoint, bool) {
+	if len(p.Coordinates) != 2 {
+		return GeoPoint{}, false
+	}
+	point := GeoPoint{Lat: p.Coordinates[1], Lon: p.Coordinates[0]}
+	return point, point.IsValid()
+}
+
+// DistanceKm great-circle distance between the two points using the haversine formula
+func DistanceKm(a, b GeoPoint) float64 {
+	lat1, lat2 := toRadians(a.Lat), toRadians(b.Lat)
+	dLat := lat2 - lat1
+	dLon := toRadians(b.Lon - a.Lon)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EarthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+func toRadians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
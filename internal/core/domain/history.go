@@ -0,0 +1,60 @@
+package domain
+
+import "time"
+
+// PortRevision a version of a port that was replaced or deleted by a committed transaction.
+// The revision was the current version from Port.UpdatedAt till ReplacedAt
+type PortRevision struct {
+	Port          Port
+	TransactionId string
+	ReplacedAt    time.Time
+	// Deleted the transaction deleted the port instead of writing a new version
+	Deleted bool
+}
+
+// HistoryRetention how much of the port history is kept, the zero values keep everything
+type HistoryRetention struct {
+	// MaxAge the revisions replaced longer ago than this are removed
+	MaxAge time.Duration
+	// MaxRevisions how many revisions are kept for every port, the newest ones
+	MaxRevisions int
+}
+
+func (r HistoryRetention) IsEmpty() bool {
+	return r.MaxAge <= 0 && r.MaxRevisions <= 0
+}
+
+// Expired how many of the revisions of a port, sorted from the oldest, are past the retention at the time.
+// The revision of the last delete is always kept, a port written again goes on from its version
+func (r HistoryRetention) Expired(revisions []PortRevision, now time.Time) int {
+	expired := 0
+	if r.MaxRevisions > 0 && len(revisions) > r.MaxRevisions {
+		expired = len(revisions) - r.MaxRevisions
+	}
+	if r.MaxAge > 0 {
+		cutoff := now.Add(-r.MaxAge)
+		for expired < len(revisions) && revisions[expired].ReplacedAt.Before(cutoff) {
+			expired++
+		}
+	}
+	if expired == len(revisions) && expired > 0 && revisions[expired-1].Deleted {
+		expired--
+	}
+	return expired
+}
+
+// PortAsOf the version of the port at the time, from the current version and the history sorted from the oldest.
+// It's nil when the port didn't exist at the time or the history of that time was removed by the retention
+func PortAsOf(current *Port, revisions []PortRevision, at time.Time) *Port {
+	if current != nil && !current.UpdatedAt.After(at) {
+		return current
+	}
+	for i := len(revisions) - 1; i >= 0; i-- {
+		revision := revisions[i]
+		if revision.ReplacedAt.After(at) && !revision.Port.UpdatedAt.After(at) {
+			port := revision.Port
+			return &port
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package domain
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestPortAsOf(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(days int) time.Time { return start.AddDate(0, 0, days) }
+	first := Port{Id: "AEAUH", Version: 1, UpdatedAt: at(0), Coordinates: []float64{54.37, 24.47}}
+	second := Port{Id: "AEAUH", Version: 2, UpdatedAt: at(10), Coordinates: []float64{54.38, 24.48}}
+	recreated := Port{Id: "AEAUH", Version: 3, UpdatedAt: at(30)}
+	revisions := []PortRevision{
+		{Port: first, ReplacedAt: at(10)},
+		{Port: second, ReplacedAt: at(20), Deleted: true},
+	}
+
+	assert.Nil(t, PortAsOf(&recreated, revisions, at(-1)))
+	assert.Equal(t, &first, PortAsOf(&recreated, revisions, at(0)))
+	assert.Equal(t, &first, PortAsOf(&recreated, revisions, at(10).Add(-time.Microsecond)))
+	assert.Equal(t, &second, PortAsOf(&recreated, revisions, at(10)))
+	// deleted between day 20 and day 30
+	assert.Nil(t, PortAsOf(&recreated, revisions, at(25)))
+	assert.Equal(t, &recreated, PortAsOf(&recreated, revisions, at(30)))
+	assert.Nil(t, PortAsOf(nil, revisions, at(30)))
+}
+
+func TestHistoryRetention_Expired(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	revisions := []PortRevision{
+		{ReplacedAt: now.AddDate(0, -3, 0)},
+		{ReplacedAt: now.AddDate(0, -2, 0)},
+		{ReplacedAt: now.AddDate(0, 0, -1)},
+	}
+
+	assert.Equal(t, 0, HistoryRetention{}.Expired(revisions, now))
+	assert.Equal(t, 1, HistoryRetention{MaxRevisions: 2}.Expired(revisions, now))
+	assert.Equal(t, 2, HistoryRetention{MaxAge: 30 * 24 * time.Hour}.Expired(revisions, now))
+	assert.Equal(t, 2, HistoryRetention{MaxAge: 30 * 24 * time.Hour, MaxRevisions: 2}.Expired(revisions, now))
+	assert.Equal(t, 3, HistoryRetention{MaxAge: time.Hour}.Expired(revisions, now))
+	// the last delete stays, a port written again goes on from its version
+	revisions[2].Deleted = true
+	assert.Equal(t, 2, HistoryRetention{MaxAge: time.Hour}.Expired(revisions, now))
+}
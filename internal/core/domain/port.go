@@ -1,5 +1,7 @@
 package domain
 
+import "time"
+
 type Port struct {
 	Id          string
 	Name        string
@@ -12,4 +14,54 @@ type Port struct {
 	Timezone    string
 	UNLOCs      []string
 	Code        string
+	// Version and UpdatedAt are set by the repository on every write, the first version of a port is 1.
+	// On the upserts a non zero Version is the version the caller expects to replace
+	Version   uint64
+	UpdatedAt time.Time
+}
+
+// IndexedPort a port published by the parsers with its position in the input file, starting from 0. The parallel
+// parsers publish the ports out of order and the index restores it
+type IndexedPort struct {
+	Port  Port
+	Index int
+}
+
+// Equal compares the data of the ports, Version and UpdatedAt are not part of it. Nil and empty slices are the same
+func (p Port) Equal(other Port) bool {
+	return p.Id == other.Id &&
+		p.Name == other.Name &&
+		p.City == other.City &&
+		p.Country == other.Country &&
+		equalStrings(p.Alias, other.Alias) &&
+		equalStrings(p.Regions, other.Regions) &&
+		equalFloats(p.Coordinates, other.Coordinates) &&
+		p.Province == other.Province &&
+		p.Timezone == other.Timezone &&
+		equalStrings(p.UNLOCs, other.UNLOCs) &&
+		p.Code == other.Code
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalFloats(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
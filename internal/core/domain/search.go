@@ -0,0 +1,31 @@
+package domain
+
+// MatchType the values are the same as in the proto enum
+type MatchType int
+
+const (
+	MatchExact MatchType = iota + 1
+	MatchPrefix
+	MatchFuzzy
+)
+
+func (m MatchType) String() string {
+	switch m {
+	case MatchExact:
+		return "exact"
+	case MatchPrefix:
+		return "prefix"
+	case MatchFuzzy:
+		return "fuzzy"
+	default:
+		return "unknown"
+	}
+}
+
+// SearchResult a port matched by a free text search, results with higher score are more relevant
+type SearchResult struct {
+	Port         Port
+	Score        float64
+	MatchType    MatchType
+	MatchedField string
+}
@@ -0,0 +1,84 @@
+package domain
+
+// UpsertStatus the values are the same as in the proto enum
+type UpsertStatus int
+
+const (
+	UpsertCreated UpsertStatus = iota + 1
+	UpsertUpdated
+	UpsertUnchanged
+	UpsertRejected
+)
+
+func (s UpsertStatus) String() string {
+	switch s {
+	case UpsertCreated:
+		return "created"
+	case UpsertUpdated:
+		return "updated"
+	case UpsertUnchanged:
+		return "unchanged"
+	case UpsertRejected:
+		return "rejected"
+	default:
+		return "unknown"
+	}
+}
+
+// UpsertResult what happened to a single port of an upsert, Err holds the reason of a rejection.
+// Diffs is filled only when asked for, for created ports it holds all the fields that are set
+type UpsertResult struct {
+	Id     string
+	Status UpsertStatus
+	Err    error
+	Diffs  []FieldDiff
+}
+
+const (
+	// MaxFailedItems how many failed ports the import summary keeps, the others are only counted
+	MaxFailedItems = 100
+	// MaxChangedItems how many changed ports with their diffs the import summary keeps
+	MaxChangedItems = 1000
+)
+
+// ImportSummary the outcome of an import, FailedItems holds at most MaxFailedItems failures
+type ImportSummary struct {
+	Created              int64
+	Updated              int64
+	Unchanged            int64
+	Failed               int64
+	FailedItems          []UpsertResult
+	FailedItemsTruncated bool
+	// ChangedItems the created and updated ports that came with diffs
+	ChangedItems          []UpsertResult
+	ChangedItemsTruncated bool
+}
+
+func (s *ImportSummary) Add(result UpsertResult) {
+	if len(result.Diffs) > 0 {
+		if len(s.ChangedItems) < MaxChangedItems {
+			s.ChangedItems = append(s.ChangedItems, result)
+		} else {
+			s.ChangedItemsTruncated = true
+		}
+	}
+	switch result.Status {
+	case UpsertCreated:
+		s.Created++
+	case UpsertUpdated:
+		s.Updated++
+	case UpsertUnchanged:
+		s.Unchanged++
+	case UpsertRejected:
+		s.Failed++
+		if len(s.FailedItems) < MaxFailedItems {
+			s.FailedItems = append(s.FailedItems, result)
+		} else {
+			s.FailedItemsTruncated = true
+		}
+	}
+}
+
+func (s *ImportSummary) Total() int64 {
+	return s.Created + s.Updated + s.Unchanged + s.Failed
+}
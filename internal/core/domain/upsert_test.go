@@ -0,0 +1,27 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestImportSummary_KeepsBoundedFailures(t *testing.T) {
+	var summary ImportSummary
+	summary.Add(UpsertResult{Id: "AEAUH", Status: UpsertCreated})
+	summary.Add(UpsertResult{Id: "AEAJM", Status: UpsertUpdated})
+	summary.Add(UpsertResult{Id: "AEDXB", Status: UpsertUnchanged})
+	for i := 0; i < MaxFailedItems+5; i++ {
+		summary.Add(UpsertResult{Id: fmt.Sprintf("XX%03d", i), Status: UpsertRejected, Err: errors.New("invalid")})
+	}
+
+	assert.Equal(t, int64(1), summary.Created)
+	assert.Equal(t, int64(1), summary.Updated)
+	assert.Equal(t, int64(1), summary.Unchanged)
+	assert.Equal(t, int64(MaxFailedItems+5), summary.Failed)
+	assert.Equal(t, int64(MaxFailedItems+8), summary.Total())
+	assert.Len(t, summary.FailedItems, MaxFailedItems)
+	assert.Equal(t, "XX000", summary.FailedItems[0].Id)
+	assert.True(t, summary.FailedItemsTruncated)
+}
@@ -4,4 +4,23 @@ import "errors"
 
 var (
 	InvalidPortsInputs = errors.New("invalid input, no ports to insert/update")
+	InvalidPortId      = errors.New("invalid input, port id is required")
+	PortNotFound       = errors.New("port not found")
+	InvalidCursor      = errors.New("invalid input, malformed cursor")
+	InvalidPageSize    = errors.New("invalid input, page size out of range")
+	InvalidSearchQuery = errors.New("invalid input, search query is required")
+	InvalidCoordinates = errors.New("invalid input, latitude must be in [-90, 90] and longitude in [-180, 180]")
+	InvalidRadius      = errors.New("invalid input, radius must be positive and not bigger than half of the earth circumference")
+	InvalidLimit       = errors.New("invalid input, limit out of range")
+	InvalidBoundingBox = errors.New("invalid input, bounding box out of range or min latitude bigger than max latitude")
+	InvalidPolygon     = errors.New("invalid input, polygon rings must be closed and have at least 4 valid points")
+	InvalidDeleteInput = errors.New("invalid input, either ids or a filter are required to delete ports")
+	MissingPortName    = errors.New("invalid port, name is required")
+	InvalidPortCoords  = errors.New("invalid port, coordinates must be [longitude, latitude] in range")
+	ChangeFeedGap      = errors.New("the requested sequence is not available, reload the data and watch from now")
+	// TransactionConflict the first transaction to commit wins, the later one can be retried from the start
+	TransactionConflict = errors.New("another transaction changed the same ports first, nothing was saved")
+	TransactionClosed   = errors.New("the transaction is already committed or aborted")
+	// VersionMismatch the port was written since the version the caller expected, it has to read it again
+	VersionMismatch = errors.New("the port was changed since the expected version")
 )
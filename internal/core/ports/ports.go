@@ -3,23 +3,105 @@ package ports
 import (
 	"context"
 	"github.com/go-related/fileservice/internal/core/domain"
+	"time"
 )
 
 type StreamJsonParser interface {
-	ReadJsonFile(ctx context.Context, filePath string, channel chan domain.Port) error
+	ReadJsonFile(ctx context.Context, filePath string, channel chan domain.IndexedPort) error
 }
 
-type Repository interface {
-	// AddOrUpdatePort maybe add a option to add a list together
+// Transaction the writes of one stream, nobody else sees them till Commit. Every stream gets its own transaction
+// and they run in parallel: the first to commit wins, a later Commit fails with errors.TransactionConflict when
+// another transaction committed a change to one of the ports it writes after it read them. Some storages notice
+// the conflict already on the write, in both cases nothing of the transaction is saved.
+// A transaction is used by one goroutine at a time
+type Transaction interface {
+	// AddOrUpdatePort returns the port it replaced, nil when the port is new
 	AddOrUpdatePort(ctx context.Context, port domain.Port) (*domain.Port, error)
-	StartTransaction(ctx context.Context) error
-	CommitTransaction(ctx context.Context) error
-	AbortTransaction()
+	// AddOrUpdatePorts the bulk version of AddOrUpdatePort, the ports are read and written in batches.
+	// It returns the replaced ports in the same order, nil for the new ones
+	AddOrUpdatePorts(ctx context.Context, ports []domain.Port) ([]*domain.Port, error)
+	// DeletePorts removes the ports and returns how many were removed, missing ids are ignored
+	DeletePorts(ctx context.Context, ids []string) (int, error)
+	// DeletePortsByFilter removes the ports matching the filter and returns how many were removed
+	DeletePortsByFilter(ctx context.Context, filter domain.PortFilter) (int, error)
+	// GetById sees the writes of the transaction, it returns nil without error when the port doesn't exist
+	GetById(ctx context.Context, id string) (*domain.Port, error)
+	// GetByIds the bulk version of GetById, the ports are in the order of the ids with nil for the missing ones
+	GetByIds(ctx context.Context, ids []string) ([]*domain.Port, error)
+	Commit(ctx context.Context) error
+	// Id tags the revisions the transaction replaces in the port history
+	Id() string
+	// Abort throws away the writes, after Commit it does nothing so it can always be deferred
+	Abort()
+}
+
+// Repository the reads outside the transactions run on a snapshot of the last committed ports, every call sees a
+// single commit as a whole. They never wait for the transactions, not even for a long import being committed
+type Repository interface {
+	// GetById the committed port, it returns nil without error when the port doesn't exist
+	GetById(ctx context.Context, id string) (*domain.Port, error)
+	// ListPorts calls fn for the committed ports matching the filter sorted by id, starting after afterId. limit <= 0 means no limit
+	ListPorts(ctx context.Context, filter domain.PortFilter, afterId string, limit int, fn func(port domain.Port) error) error
+	// FindByUnloc the committed ports listing the UN/LOCODE, matched case insensitive
+	FindByUnloc(ctx context.Context, unloc string) ([]domain.Port, error)
+	// FindByCode the committed ports with the code, matched case insensitive
+	FindByCode(ctx context.Context, code string) ([]domain.Port, error)
+	// SearchPorts free text search on name, alias and city, the results are sorted by relevance
+	SearchPorts(ctx context.Context, query string, maxEdits int, limit int) ([]domain.SearchResult, error)
+	// NearestPorts the k ports closest to the point sorted by distance, ports without coordinates are ignored
+	NearestPorts(ctx context.Context, center domain.GeoPoint, k int) ([]domain.PortDistance, error)
+	// PortsWithinRadius sorted by distance, limit <= 0 means no limit
+	PortsWithinRadius(ctx context.Context, center domain.GeoPoint, radiusKm float64, limit int) ([]domain.PortDistance, error)
+	// PortsInBoundingBox calls fn for the ports inside the box matching the filter, limit <= 0 means no limit
+	PortsInBoundingBox(ctx context.Context, box domain.BoundingBox, filter domain.PortFilter, limit int, fn func(port domain.Port) error) error
+	// PortsInPolygon calls fn for the ports inside the polygon matching the filter, limit <= 0 means no limit
+	PortsInPolygon(ctx context.Context, polygon domain.Polygon, filter domain.PortFilter, limit int, fn func(port domain.Port) error) error
+	// WatchChanges calls fn for the committed changes after the sequence and keeps waiting for new ones till ctx is done
+	WatchChanges(ctx context.Context, afterSequence uint64, fn func(change domain.PortChange) error) error
+	LastChangeSequence() uint64
+	// GetPortHistory the committed revisions replaced or deleted of the port, sorted from the oldest
+	GetPortHistory(ctx context.Context, id string) ([]domain.PortRevision, error)
+	// GetByIdAsOf the port as it was at the time, nil without error when it didn't exist or that history was removed
+	GetByIdAsOf(ctx context.Context, id string, at time.Time) (*domain.Port, error)
+	// CompactHistory removes the revisions past the retention and returns how many were removed
+	CompactHistory(ctx context.Context, retention domain.HistoryRetention) (int, error)
+	// StartTransaction a new transaction for one stream, see Transaction for how concurrent transactions are committed
+	StartTransaction(ctx context.Context) (Transaction, error)
 }
 
 type PortService interface {
-	AddOrUpdatePorts(ctx context.Context, ports []domain.Port) ([]*domain.Port, error)
-	StartTransaction(ctx context.Context) error
-	CommitTransaction(ctx context.Context) error
-	AbortTransaction() error
+	AddOrUpdatePorts(ctx context.Context, trn Transaction, ports []domain.Port) ([]*domain.Port, error)
+	// UpsertPorts validates and stores the ports one by one in the transaction and reports what happened to each of them.
+	// Invalid ports are rejected without failing the others, only storage errors are returned.
+	// With includeDiffs the results of the created and updated ports carry the changed fields
+	UpsertPorts(ctx context.Context, trn Transaction, ports []domain.Port, includeDiffs bool) ([]domain.UpsertResult, error)
+	// DeletePorts takes either ids or a non empty filter and returns how many ports were removed in the transaction
+	DeletePorts(ctx context.Context, trn Transaction, ids []string, filter domain.PortFilter) (int, error)
+	GetPort(ctx context.Context, id string) (*domain.Port, error)
+	// GetPortAsOf the port as it was at the time, errors.PortNotFound when it didn't exist or that history was removed
+	GetPortAsOf(ctx context.Context, id string, at time.Time) (*domain.Port, error)
+	// GetPortHistory the replaced and deleted revisions of the port sorted from the oldest
+	GetPortHistory(ctx context.Context, id string) ([]domain.PortRevision, error)
+	// CompactHistory applies the retention to the history of all the ports
+	CompactHistory(ctx context.Context, retention domain.HistoryRetention) (int, error)
+	// ListPorts calls fn for every port of the page together with the cursor to resume right after it
+	ListPorts(ctx context.Context, filter domain.PortFilter, pageSize int, cursor string, fn func(port domain.Port, cursor string) error) error
+	// SearchPorts a negative maxEdits lets the service pick the typo tolerance based on the query length
+	SearchPorts(ctx context.Context, query string, maxEdits int, limit int) ([]domain.SearchResult, error)
+	NearestPorts(ctx context.Context, center domain.GeoPoint, k int) ([]domain.PortDistance, error)
+	// PortsWithinRadius limit <= 0 uses the max number of results
+	PortsWithinRadius(ctx context.Context, center domain.GeoPoint, radiusKm float64, limit int) ([]domain.PortDistance, error)
+	// PortsInBoundingBox limit <= 0 streams all the ports in the box
+	PortsInBoundingBox(ctx context.Context, box domain.BoundingBox, filter domain.PortFilter, limit int, fn func(port domain.Port) error) error
+	// PortsInPolygon limit <= 0 streams all the ports in the polygon
+	PortsInPolygon(ctx context.Context, polygon domain.Polygon, filter domain.PortFilter, limit int, fn func(port domain.Port) error) error
+	// WatchPorts streams the committed changes matching the filter, from the sequence after fromSequence
+	// or from now when it's nil, till ctx is done
+	WatchPorts(ctx context.Context, filter domain.WatchFilter, fromSequence *uint64, fn func(change domain.PortChange) error) error
+	// StartTransaction every stream writes through its own transaction, the streams don't wait for each other
+	StartTransaction(ctx context.Context) (Transaction, error)
+	// CommitTransaction fails with errors.TransactionConflict when another transaction changed the same ports first
+	CommitTransaction(ctx context.Context, trn Transaction) error
+	AbortTransaction(trn Transaction)
 }
@@ -0,0 +1,26 @@
+package service
+
+import (
+	"encoding/base64"
+	cerror "github.com/go-related/fileservice/internal/core/errors"
+	"strings"
+)
+
+// cursorPrefix versions the cursor format so we can change it later without breaking the clients
+const cursorPrefix = "v1:"
+
+// encodeCursor the cursor is opaque for the clients, for now it only carries the last id that was sent
+func encodeCursor(lastId string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursorPrefix + lastId))
+}
+
+func decodeCursor(cursor string) (string, error) {
+	if len(cursor) == 0 {
+		return "", nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(data), cursorPrefix) {
+		return "", cerror.InvalidCursor
+	}
+	return strings.TrimPrefix(string(data), cursorPrefix), nil
+}
@@ -2,74 +2,432 @@ package service
 
 import (
 	"context"
+	"errors"
 	"github.com/go-related/fileservice/internal/core/domain"
 	cerror "github.com/go-related/fileservice/internal/core/errors"
 	"github.com/go-related/fileservice/internal/core/ports"
 	"github.com/sirupsen/logrus"
-	"sync"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
+const (
+	// MaxPageSize upper limit for the page size of the list queries, 0 means everything till the end
+	MaxPageSize = 10000
+	// DefaultSearchLimit number of search results returned when the client doesn't ask for a specific number
+	DefaultSearchLimit = 20
+	MaxSearchLimit     = 100
+	// MaxSearchEdits upper limit of the typo tolerance, above it almost everything matches a short query
+	MaxSearchEdits = 3
+	// DefaultNearestPorts number of ports returned by the nearest query when the client doesn't ask for a specific number
+	DefaultNearestPorts = 10
+	// MaxGeoResults upper limit of the ports returned by the geo queries
+	MaxGeoResults = 10000
+)
+
+// PortService has no state of its own, every stream writes through the transaction it started
 type PortService struct {
-	mx   sync.Mutex
 	repo ports.Repository
 }
 
 func NewPortService(repo ports.Repository) *PortService {
-	return &PortService{sync.Mutex{}, repo}
+	return &PortService{repo}
 }
 
-func (svr *PortService) AddOrUpdatePorts(ctx context.Context, ports []domain.Port) ([]*domain.Port, error) {
+func (svr *PortService) AddOrUpdatePorts(ctx context.Context, trn ports.Transaction, ports []domain.Port) ([]*domain.Port, error) {
 	if len(ports) == 0 {
 		err := cerror.InvalidPortsInputs
 		logrus.WithError(err).Error("invalid input")
 		return nil, err
 	}
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-	svr.mx.Lock()
-	defer svr.mx.Unlock()
-	var result []*domain.Port
+	result, err := trn.AddOrUpdatePorts(ctx, ports)
+	if err != nil {
+		logrus.WithError(err).WithField("ports", len(ports)).Error("failed to save ports")
+		return nil, err
+	}
+	return result, nil
+}
+
+func (svr *PortService) UpsertPorts(ctx context.Context, trn ports.Transaction, ports []domain.Port, includeDiffs bool) ([]domain.UpsertResult, error) {
+	if len(ports) == 0 {
+		err := cerror.InvalidPortsInputs
+		logrus.WithError(err).Error("invalid input")
+		return nil, err
+	}
+	// the current ports are read and the changed ones written with one call each, not port by port
+	currentPorts, err := trn.GetByIds(ctx, validPortIds(ports))
+	if err != nil {
+		logrus.WithError(err).WithField("ports", len(ports)).Error("failed to load ports")
+		return nil, err
+	}
+	current := make(map[string]*domain.Port, len(currentPorts))
+	for _, port := range currentPorts {
+		if port != nil {
+			current[port.Id] = port
+		}
+	}
+	results := make([]domain.UpsertResult, 0, len(ports))
+	var changed []domain.Port
 	for _, port := range ports {
 		select {
 		case <-ctx.Done():
 			return nil, ctx.Err() //cancelled
 		default:
 		}
-		insertedPort, err := svr.repo.AddOrUpdatePort(ctx, port)
-		if err != nil {
-			logrus.WithError(err).WithField("port_id", port.Id).Error("failed to save port")
+		result := domain.UpsertResult{Id: port.Id}
+		if err := validatePort(port); err != nil {
+			result.Status = domain.UpsertRejected
+			result.Err = err
+			results = append(results, result)
+			continue
+		}
+		currentPort := current[port.Id]
+		// a conditional write, the port must still be at the version the caller read
+		if port.Version != 0 && (currentPort == nil || currentPort.Version != port.Version) {
+			result.Status = domain.UpsertRejected
+			result.Err = cerror.VersionMismatch
+			results = append(results, result)
+			continue
+		}
+		switch {
+		case currentPort != nil && currentPort.Equal(port):
+			result.Status = domain.UpsertUnchanged
+		case currentPort != nil:
+			result.Status = domain.UpsertUpdated
+		default:
+			result.Status = domain.UpsertCreated
+		}
+		if includeDiffs && result.Status != domain.UpsertUnchanged {
+			previous := domain.Port{Id: port.Id}
+			if currentPort != nil {
+				previous = *currentPort
+			}
+			result.Diffs = domain.DiffPorts(previous, port)
+		}
+		if result.Status != domain.UpsertUnchanged {
+			changed = append(changed, port)
+			// the same id later in the batch sees this version, the expected version is the next one. A port
+			// created here might have existed before and goes on from that version, nobody can expect it yet
+			next := port
+			next.Version = 0
+			if currentPort != nil {
+				next.Version = currentPort.Version + 1
+			}
+			current[port.Id] = &next
+		}
+		results = append(results, result)
+	}
+	if len(changed) > 0 {
+		if _, err = trn.AddOrUpdatePorts(ctx, changed); err != nil {
+			logrus.WithError(err).WithField("ports", len(changed)).Error("failed to save ports")
 			return nil, err
 		}
-		result = append(result, insertedPort)
 	}
-	return result, nil
+	return results, nil
+}
+
+// validPortIds the ids of the ports that can be loaded, the invalid ones are rejected without a lookup
+func validPortIds(ports []domain.Port) []string {
+	ids := make([]string, 0, len(ports))
+	for _, port := range ports {
+		if validatePort(port) == nil {
+			ids = append(ids, port.Id)
+		}
+	}
+	return ids
+}
+
+// validatePort the checks a port needs to pass before we store it
+func validatePort(port domain.Port) error {
+	if len(port.Id) == 0 {
+		return cerror.InvalidPortId
+	}
+	if len(port.Name) == 0 {
+		return cerror.MissingPortName
+	}
+	if _, ok := port.Location(); len(port.Coordinates) > 0 && !ok {
+		return cerror.InvalidPortCoords
+	}
+	return nil
+}
+
+func (svr *PortService) DeletePorts(ctx context.Context, trn ports.Transaction, ids []string, filter domain.PortFilter) (int, error) {
+	// exactly one of the two, an empty filter would match everything
+	hasIds, hasFilter := len(ids) > 0, !filter.IsEmpty()
+	if hasIds == hasFilter {
+		err := cerror.InvalidDeleteInput
+		logrus.WithError(err).Error("invalid input")
+		return 0, err
+	}
+	var deleted int
+	var err error
+	if len(ids) > 0 {
+		deleted, err = trn.DeletePorts(ctx, ids)
+	} else {
+		deleted, err = trn.DeletePortsByFilter(ctx, filter)
+	}
+	if err != nil {
+		logrus.WithError(err).Error("failed to delete ports")
+		return 0, err
+	}
+	logrus.WithField("deleted", deleted).Info("ports deleted")
+	return deleted, nil
 }
 
-func (svr *PortService) StartTransaction(ctx context.Context) error {
-	svr.mx.Lock()
-	defer svr.mx.Unlock()
-	err := svr.repo.StartTransaction(ctx)
+func (svr *PortService) GetPort(ctx context.Context, id string) (*domain.Port, error) {
+	if len(id) == 0 {
+		err := cerror.InvalidPortId
+		logrus.WithError(err).Error("invalid input")
+		return nil, err
+	}
+	port, err := svr.repo.GetById(ctx, id)
 	if err != nil {
-		logrus.WithError(err).Error("error starting transaction")
+		logrus.WithError(err).WithField("port_id", id).Error("failed to load port")
+		return nil, err
+	}
+	if port == nil {
+		return nil, cerror.PortNotFound
+	}
+	return port, nil
+}
+
+// GetPortAsOf a zero time reads the current version, a time in the future too. It's the only read of the past,
+// the lists and the queries always run on the last committed ports
+func (svr *PortService) GetPortAsOf(ctx context.Context, id string, at time.Time) (*domain.Port, error) {
+	if at.IsZero() {
+		return svr.GetPort(ctx, id)
+	}
+	if len(id) == 0 {
+		err := cerror.InvalidPortId
+		logrus.WithError(err).Error("invalid input")
+		return nil, err
+	}
+	port, err := svr.repo.GetByIdAsOf(ctx, id, at)
+	if err != nil {
+		logrus.WithError(err).WithField("port_id", id).WithField("as_of", at).Error("failed to load port")
+		return nil, err
+	}
+	if port == nil {
+		return nil, cerror.PortNotFound
+	}
+	return port, nil
+}
+
+// GetPortHistory a port without history is found as long as it exists
+func (svr *PortService) GetPortHistory(ctx context.Context, id string) ([]domain.PortRevision, error) {
+	if len(id) == 0 {
+		err := cerror.InvalidPortId
+		logrus.WithError(err).Error("invalid input")
+		return nil, err
+	}
+	revisions, err := svr.repo.GetPortHistory(ctx, id)
+	if err != nil {
+		logrus.WithError(err).WithField("port_id", id).Error("failed to load port history")
+		return nil, err
+	}
+	if len(revisions) == 0 {
+		if _, err = svr.GetPort(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	return revisions, nil
+}
+
+// CompactHistory an empty retention keeps the whole history, so there is nothing to do
+func (svr *PortService) CompactHistory(ctx context.Context, retention domain.HistoryRetention) (int, error) {
+	if retention.IsEmpty() {
+		return 0, nil
+	}
+	removed, err := svr.repo.CompactHistory(ctx, retention)
+	if err != nil {
+		logrus.WithError(err).Error("failed to compact port history")
+		return 0, err
+	}
+	logrus.WithField("removed", removed).Info("port history compacted")
+	return removed, nil
+}
+
+// ListPorts the repository lists from a snapshot of the committed data, the open transactions are not visible
+func (svr *PortService) ListPorts(ctx context.Context, filter domain.PortFilter, pageSize int, cursor string, fn func(port domain.Port, cursor string) error) error {
+	if pageSize < 0 || pageSize > MaxPageSize {
+		err := cerror.InvalidPageSize
+		logrus.WithError(err).WithField("page_size", pageSize).Error("invalid input")
+		return err
+	}
+	afterId, err := decodeCursor(cursor)
+	if err != nil {
+		logrus.WithError(err).Error("invalid input")
+		return err
+	}
+	err = svr.repo.ListPorts(ctx, filter, afterId, pageSize, func(port domain.Port) error {
+		return fn(port, encodeCursor(port.Id))
+	})
+	if err != nil {
+		logrus.WithError(err).Error("failed to list ports")
 		return err
 	}
 	return nil
 }
 
-func (svr *PortService) CommitTransaction(ctx context.Context) error {
-	svr.mx.Lock()
-	defer svr.mx.Unlock()
-	err := svr.repo.CommitTransaction(ctx)
+// SearchPorts the repository searches on a snapshot of the committed data
+func (svr *PortService) SearchPorts(ctx context.Context, query string, maxEdits int, limit int) ([]domain.SearchResult, error) {
+	query = strings.TrimSpace(query)
+	if len(query) == 0 {
+		err := cerror.InvalidSearchQuery
+		logrus.WithError(err).Error("invalid input")
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	} else if limit > MaxSearchLimit {
+		limit = MaxSearchLimit
+	}
+	if maxEdits < 0 {
+		maxEdits = defaultMaxEdits(query)
+	} else if maxEdits > MaxSearchEdits {
+		maxEdits = MaxSearchEdits
+	}
+	results, err := svr.repo.SearchPorts(ctx, query, maxEdits, limit)
 	if err != nil {
-		logrus.WithError(err).Error("error committing transaction")
+		logrus.WithError(err).WithField("query", query).Error("failed to search ports")
+		return nil, err
+	}
+	return results, nil
+}
+
+// defaultMaxEdits short queries get less typos, otherwise "rome" would match half of the dataset
+func defaultMaxEdits(query string) int {
+	switch length := utf8.RuneCountInString(query); {
+	case length < 3:
+		return 0
+	case length <= 5:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// NearestPorts the repository reads from a snapshot of the committed data
+func (svr *PortService) NearestPorts(ctx context.Context, center domain.GeoPoint, k int) ([]domain.PortDistance, error) {
+	if !center.IsValid() {
+		err := cerror.InvalidCoordinates
+		logrus.WithError(err).WithField("center", center).Error("invalid input")
+		return nil, err
+	}
+	if k == 0 {
+		k = DefaultNearestPorts
+	}
+	if k < 0 || k > MaxGeoResults {
+		err := cerror.InvalidLimit
+		logrus.WithError(err).WithField("k", k).Error("invalid input")
+		return nil, err
+	}
+	results, err := svr.repo.NearestPorts(ctx, center, k)
+	if err != nil {
+		logrus.WithError(err).Error("failed to load nearest ports")
+		return nil, err
+	}
+	return results, nil
+}
+
+func (svr *PortService) PortsWithinRadius(ctx context.Context, center domain.GeoPoint, radiusKm float64, limit int) ([]domain.PortDistance, error) {
+	if !center.IsValid() {
+		err := cerror.InvalidCoordinates
+		logrus.WithError(err).WithField("center", center).Error("invalid input")
+		return nil, err
+	}
+	if !(radiusKm > 0 && radiusKm <= domain.MaxDistanceKm) {
+		err := cerror.InvalidRadius
+		logrus.WithError(err).WithField("radius_km", radiusKm).Error("invalid input")
+		return nil, err
+	}
+	if limit < 0 || limit > MaxGeoResults {
+		err := cerror.InvalidLimit
+		logrus.WithError(err).WithField("limit", limit).Error("invalid input")
+		return nil, err
+	}
+	if limit == 0 {
+		limit = MaxGeoResults
+	}
+	results, err := svr.repo.PortsWithinRadius(ctx, center, radiusKm, limit)
+	if err != nil {
+		logrus.WithError(err).Error("failed to load ports within radius")
+		return nil, err
+	}
+	return results, nil
+}
+
+// PortsInBoundingBox the repository reads from a snapshot of the committed data
+func (svr *PortService) PortsInBoundingBox(ctx context.Context, box domain.BoundingBox, filter domain.PortFilter, limit int, fn func(port domain.Port) error) error {
+	if !box.IsValid() {
+		err := cerror.InvalidBoundingBox
+		logrus.WithError(err).WithField("box", box).Error("invalid input")
+		return err
+	}
+	err := svr.repo.PortsInBoundingBox(ctx, box, filter, limit, fn)
+	if err != nil {
+		logrus.WithError(err).Error("failed to load ports in bounding box")
+		return err
+	}
+	return nil
+}
+
+func (svr *PortService) PortsInPolygon(ctx context.Context, polygon domain.Polygon, filter domain.PortFilter, limit int, fn func(port domain.Port) error) error {
+	if !polygon.IsValid() {
+		err := cerror.InvalidPolygon
+		logrus.WithError(err).Error("invalid input")
+		return err
+	}
+	err := svr.repo.PortsInPolygon(ctx, polygon, filter, limit, fn)
+	if err != nil {
+		logrus.WithError(err).Error("failed to load ports in polygon")
 		return err
 	}
 	return nil
 }
 
-func (svr *PortService) AbortTransaction() error {
-	svr.mx.Lock()
-	defer svr.mx.Unlock()
-	svr.repo.AbortTransaction()
+// WatchPorts the repository only hands out committed changes
+func (svr *PortService) WatchPorts(ctx context.Context, filter domain.WatchFilter, fromSequence *uint64, fn func(change domain.PortChange) error) error {
+	afterSequence := svr.repo.LastChangeSequence()
+	if fromSequence != nil {
+		afterSequence = *fromSequence
+	}
+	err := svr.repo.WatchChanges(ctx, afterSequence, func(change domain.PortChange) error {
+		if !filter.Matches(change) {
+			return nil
+		}
+		return fn(change)
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		logrus.WithError(err).Error("failed to watch ports")
+	}
+	return err
+}
+
+func (svr *PortService) StartTransaction(ctx context.Context) (ports.Transaction, error) {
+	trn, err := svr.repo.StartTransaction(ctx)
+	if err != nil {
+		logrus.WithError(err).Error("error starting transaction")
+		return nil, err
+	}
+	return trn, nil
+}
+
+func (svr *PortService) CommitTransaction(ctx context.Context, trn ports.Transaction) error {
+	err := trn.Commit(ctx)
+	if errors.Is(err, cerror.TransactionConflict) {
+		logrus.WithError(err).Warn("transaction lost a conflict")
+		return err
+	}
+	if err != nil {
+		logrus.WithError(err).Error("error committing transaction")
+		return err
+	}
 	return nil
 }
+
+// AbortTransaction does nothing after the commit, so it can always be deferred
+func (svr *PortService) AbortTransaction(trn ports.Transaction) {
+	trn.Abort()
+}
@@ -2,9 +2,14 @@ package service
 
 import (
 	"context"
+	"errors"
 	"github.com/go-related/fileservice/internal/core/domain"
+	cerror "github.com/go-related/fileservice/internal/core/errors"
+	"github.com/go-related/fileservice/internal/core/ports"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"testing"
+	"time"
 )
 
 func TestInsertions_HappyPath(t *testing.T) {
@@ -75,35 +80,426 @@ func TestInsertions_HappyPath(t *testing.T) {
 	//}
 }
 
+func TestGetPort(t *testing.T) {
+	storedPort := &domain.Port{Id: "AEAUH", Name: "Abu Dhabi", UNLOCs: []string{"AEAUH"}}
+	storageErr := errors.New("storage failure")
+	testCases := map[string]struct {
+		id            string
+		repoPort      *domain.Port
+		repoErr       error
+		expectedPort  *domain.Port
+		expectedError error
+	}{
+		"Found": {
+			id:           "AEAUH",
+			repoPort:     storedPort,
+			expectedPort: storedPort,
+		},
+		"NotFound": {
+			id:            "XXXXX",
+			expectedError: cerror.PortNotFound,
+		},
+		"EmptyId": {
+			id:            "",
+			expectedError: cerror.InvalidPortId,
+		},
+		"RepositoryError": {
+			id:            "AEAUH",
+			repoErr:       storageErr,
+			expectedError: storageErr,
+		},
+	}
+
+	for name, test := range testCases {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			mockRepository := new(MockRepository)
+			mockRepository.On("GetById", mock.Anything, test.id).Return(test.repoPort, test.repoErr)
+			server := NewPortService(mockRepository)
+
+			actualPort, err := server.GetPort(context.TODO(), test.id)
+			assert.ErrorIs(t, err, test.expectedError)
+			assert.Equal(t, test.expectedPort, actualPort)
+		})
+	}
+}
+
+func TestGetPortHistory(t *testing.T) {
+	replaced := domain.PortRevision{Port: domain.Port{Id: "AEAUH", Name: "Abu Dhabi", Version: 1}, TransactionId: "t1"}
+	mockRepository := new(MockRepository)
+	mockRepository.On("GetPortHistory", mock.Anything, "AEAUH").Return([]domain.PortRevision{replaced}, nil)
+	mockRepository.On("GetPortHistory", mock.Anything, "AEAJM").Return(nil, nil)
+	mockRepository.On("GetById", mock.Anything, "AEAJM").Return(&domain.Port{Id: "AEAJM", Name: "Ajman"}, nil)
+	mockRepository.On("GetPortHistory", mock.Anything, "XXXXX").Return(nil, nil)
+	mockRepository.On("GetById", mock.Anything, "XXXXX").Return(nil, nil)
+	server := NewPortService(mockRepository)
+
+	revisions, err := server.GetPortHistory(context.TODO(), "AEAUH")
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.PortRevision{replaced}, revisions)
+	// a port never replaced has an empty history, one that never existed is not found
+	revisions, err = server.GetPortHistory(context.TODO(), "AEAJM")
+	assert.NoError(t, err)
+	assert.Empty(t, revisions)
+	_, err = server.GetPortHistory(context.TODO(), "XXXXX")
+	assert.ErrorIs(t, err, cerror.PortNotFound)
+}
+
+func TestGetPortAsOf(t *testing.T) {
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	old := &domain.Port{Id: "AEAUH", Name: "Abu Dhabi", Version: 1}
+	mockRepository := new(MockRepository)
+	mockRepository.On("GetByIdAsOf", mock.Anything, "AEAUH", at).Return(old, nil)
+	mockRepository.On("GetByIdAsOf", mock.Anything, "AEAJM", at).Return(nil, nil)
+	server := NewPortService(mockRepository)
+
+	port, err := server.GetPortAsOf(context.TODO(), "AEAUH", at)
+	assert.NoError(t, err)
+	assert.Equal(t, old, port)
+	_, err = server.GetPortAsOf(context.TODO(), "AEAJM", at)
+	assert.ErrorIs(t, err, cerror.PortNotFound)
+}
+
+func TestCompactHistory_EmptyRetentionKeepsEverything(t *testing.T) {
+	mockRepository := new(MockRepository)
+	retention := domain.HistoryRetention{MaxRevisions: 10}
+	mockRepository.On("CompactHistory", mock.Anything, retention).Return(3, nil)
+	server := NewPortService(mockRepository)
+
+	removed, err := server.CompactHistory(context.TODO(), domain.HistoryRetention{})
+	assert.NoError(t, err)
+	assert.Zero(t, removed)
+	mockRepository.AssertNotCalled(t, "CompactHistory", mock.Anything, mock.Anything)
+	removed, err = server.CompactHistory(context.TODO(), retention)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, removed)
+}
+
+func TestListPorts_ResumesFromCursor(t *testing.T) {
+	mockRepository := new(MockRepository)
+	firstPage := []domain.Port{{Id: "AEAJM"}, {Id: "AEAUH"}}
+	secondPage := []domain.Port{{Id: "AEAUI"}}
+	mockRepository.On("ListPorts", mock.Anything, domain.PortFilter{}, "", 2).Return(firstPage, nil)
+	mockRepository.On("ListPorts", mock.Anything, domain.PortFilter{}, "AEAUH", 2).Return(secondPage, nil)
+	server := NewPortService(mockRepository)
+
+	var ids []string
+	var lastCursor string
+	collect := func(port domain.Port, cursor string) error {
+		ids = append(ids, port.Id)
+		lastCursor = cursor
+		return nil
+	}
+	err := server.ListPorts(context.TODO(), domain.PortFilter{}, 2, "", collect)
+	assert.NoError(t, err)
+	err = server.ListPorts(context.TODO(), domain.PortFilter{}, 2, lastCursor, collect)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"AEAJM", "AEAUH", "AEAUI"}, ids)
+
+	err = server.ListPorts(context.TODO(), domain.PortFilter{}, 2, "not a cursor", collect)
+	assert.ErrorIs(t, err, cerror.InvalidCursor)
+	err = server.ListPorts(context.TODO(), domain.PortFilter{}, -1, "", collect)
+	assert.ErrorIs(t, err, cerror.InvalidPageSize)
+}
+
+func TestDeletePorts(t *testing.T) {
+	byCountry := domain.PortFilter{Country: "Albania"}
+	testCases := map[string]struct {
+		ids           []string
+		filter        domain.PortFilter
+		expectedCount int
+		expectedError error
+	}{
+		"ByIds": {
+			ids:           []string{"AEAUH", "AEAJM"},
+			expectedCount: 2,
+		},
+		"ByFilter": {
+			filter:        byCountry,
+			expectedCount: 3,
+		},
+		"NothingToDelete": {
+			expectedError: cerror.InvalidDeleteInput,
+		},
+		"BothIdsAndFilter": {
+			ids:           []string{"AEAUH"},
+			filter:        byCountry,
+			expectedError: cerror.InvalidDeleteInput,
+		},
+	}
+
+	for name, test := range testCases {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			mockTransaction := new(MockTransaction)
+			mockTransaction.On("DeletePorts", mock.Anything, test.ids).Return(len(test.ids), nil)
+			mockTransaction.On("DeletePortsByFilter", mock.Anything, byCountry).Return(3, nil)
+			server := NewPortService(new(MockRepository))
+
+			count, err := server.DeletePorts(context.TODO(), mockTransaction, test.ids, test.filter)
+			assert.ErrorIs(t, err, test.expectedError)
+			assert.Equal(t, test.expectedCount, count)
+		})
+	}
+}
+
+func TestWatchPorts_FiltersChanges(t *testing.T) {
+	mockRepository := new(MockRepository)
+	changes := []domain.PortChange{
+		{Sequence: 8, Type: domain.ChangeCreated, Port: domain.Port{Id: "AEAUH", Country: "United Arab Emirates"}},
+		{Sequence: 9, Type: domain.ChangeUpdated, Port: domain.Port{Id: "ALDRZ", Country: "Albania"}},
+		{Sequence: 10, Type: domain.ChangeDeleted, Port: domain.Port{Id: "AEAJM", Country: "United Arab Emirates"}},
+	}
+	mockRepository.On("LastChangeSequence").Return(uint64(7))
+	mockRepository.On("WatchChanges", mock.Anything, uint64(7)).Return(changes, nil)
+	mockRepository.On("WatchChanges", mock.Anything, uint64(9)).Return(changes[2:], nil)
+	server := NewPortService(mockRepository)
+
+	var sequences []uint64
+	collect := func(change domain.PortChange) error {
+		sequences = append(sequences, change.Sequence)
+		return nil
+	}
+	err := server.WatchPorts(context.TODO(), domain.WatchFilter{Country: "united arab emirates", IdPrefix: "AE"}, nil, collect)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{8, 10}, sequences)
+
+	sequences = nil
+	fromSequence := uint64(9)
+	err = server.WatchPorts(context.TODO(), domain.WatchFilter{}, &fromSequence, collect)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{10}, sequences)
+}
+
+func TestUpsertPorts_ReportsEveryPort(t *testing.T) {
+	stored := domain.Port{Id: "AEAUH", Name: "Abu Dhabi"}
+	updated := domain.Port{Id: "AEAJM", Name: "Ajman", City: "Ajman"}
+	created := domain.Port{Id: "AEDXB", Name: "Dubai"}
+	withoutName := domain.Port{Id: "AEXXX"}
+	badCoordinates := domain.Port{Id: "AEYYY", Name: "Nowhere", Coordinates: []float64{200, 100}}
+
+	mockTransaction := new(MockTransaction)
+	// the invalid ports are not even loaded
+	mockTransaction.On("GetByIds", mock.Anything, []string{"AEAUH", "AEAJM", "AEDXB"}).
+		Return([]*domain.Port{&stored, {Id: "AEAJM", Name: "Ajman"}, nil}, nil)
+	// unchanged ports are not written again
+	mockTransaction.On("AddOrUpdatePorts", mock.Anything, []domain.Port{updated, created}).Return([]*domain.Port{nil, nil}, nil)
+	server := NewPortService(new(MockRepository))
+
+	results, err := server.UpsertPorts(context.TODO(), mockTransaction, []domain.Port{stored, updated, created, withoutName, badCoordinates}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.UpsertResult{
+		{Id: "AEAUH", Status: domain.UpsertUnchanged},
+		{Id: "AEAJM", Status: domain.UpsertUpdated},
+		{Id: "AEDXB", Status: domain.UpsertCreated},
+		{Id: "AEXXX", Status: domain.UpsertRejected, Err: cerror.MissingPortName},
+		{Id: "AEYYY", Status: domain.UpsertRejected, Err: cerror.InvalidPortCoords},
+	}, results)
+	mockTransaction.AssertNumberOfCalls(t, "AddOrUpdatePorts", 1)
+
+	results, err = server.UpsertPorts(context.TODO(), mockTransaction, []domain.Port{stored, updated, created}, true)
+	assert.NoError(t, err)
+	assert.Empty(t, results[0].Diffs)
+	assert.Equal(t, []domain.FieldDiff{{Field: "city", Old: "", New: "Ajman"}}, results[1].Diffs)
+	assert.Equal(t, []domain.FieldDiff{{Field: "name", Old: "", New: "Dubai"}}, results[2].Diffs)
+}
+
+func TestUpsertPorts_ConditionalWrites(t *testing.T) {
+	stored := domain.Port{Id: "AEAUH", Name: "Abu Dhabi", Version: 3}
+	current := domain.Port{Id: "AEAUH", Name: "Abu Dhabi", City: "Al Mina", Version: 3}
+	stale := domain.Port{Id: "AEAUH", Name: "Abu Dhabi", City: "Abu Dhabi", Version: 2}
+	missing := domain.Port{Id: "AEDXB", Name: "Dubai", Version: 1}
+
+	mockTransaction := new(MockTransaction)
+	mockTransaction.On("GetByIds", mock.Anything, []string{"AEAUH", "AEAUH", "AEDXB"}).Return([]*domain.Port{&stored, &stored, nil}, nil)
+	mockTransaction.On("AddOrUpdatePorts", mock.Anything, []domain.Port{current}).Return([]*domain.Port{&stored}, nil)
+	server := NewPortService(new(MockRepository))
+
+	results, err := server.UpsertPorts(context.TODO(), mockTransaction, []domain.Port{current, stale, missing}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []domain.UpsertResult{
+		{Id: "AEAUH", Status: domain.UpsertUpdated},
+		{Id: "AEAUH", Status: domain.UpsertRejected, Err: cerror.VersionMismatch},
+		{Id: "AEDXB", Status: domain.UpsertRejected, Err: cerror.VersionMismatch},
+	}, results)
+	// the second write of the same port in the batch expects the version of the first one
+	mockTransaction.AssertNumberOfCalls(t, "AddOrUpdatePorts", 1)
+}
+
 type MockRepository struct {
 	mock.Mock
 }
 
-// AddOrUpdatePort mocks the AddOrUpdatePort method.
-func (m *MockRepository) AddOrUpdatePort(ctx context.Context, item domain.Port) (domain.Port, error) {
-	args := m.Called(ctx, item)
-	return item, args.Error(1)
+// GetById mocks the GetById method.
+func (m *MockRepository) GetById(ctx context.Context, id string) (*domain.Port, error) {
+	args := m.Called(ctx, id)
+	port, _ := args.Get(0).(*domain.Port)
+	return port, args.Error(1)
 }
 
-// AbortTransaction mocks the AbortTransaction method.
-func (m *MockRepository) AbortTransaction() {
-	m.Called()
+// ListPorts mocks the ListPorts method, it calls fn for every port set as return value.
+func (m *MockRepository) ListPorts(ctx context.Context, filter domain.PortFilter, afterId string, limit int, fn func(port domain.Port) error) error {
+	args := m.Called(ctx, filter, afterId, limit)
+	return callForEach(args, fn)
+}
+
+// FindByUnloc mocks the FindByUnloc method.
+func (m *MockRepository) FindByUnloc(ctx context.Context, unloc string) ([]domain.Port, error) {
+	args := m.Called(ctx, unloc)
+	found, _ := args.Get(0).([]domain.Port)
+	return found, args.Error(1)
+}
+
+// FindByCode mocks the FindByCode method.
+func (m *MockRepository) FindByCode(ctx context.Context, code string) ([]domain.Port, error) {
+	args := m.Called(ctx, code)
+	found, _ := args.Get(0).([]domain.Port)
+	return found, args.Error(1)
+}
+
+// SearchPorts mocks the SearchPorts method.
+func (m *MockRepository) SearchPorts(ctx context.Context, query string, maxEdits int, limit int) ([]domain.SearchResult, error) {
+	args := m.Called(ctx, query, maxEdits, limit)
+	results, _ := args.Get(0).([]domain.SearchResult)
+	return results, args.Error(1)
 }
 
-// DoesTransactionExists mocks the DoesTransactionExists method.
-func (m *MockRepository) DoesTransactionExists() bool {
+// NearestPorts mocks the NearestPorts method.
+func (m *MockRepository) NearestPorts(ctx context.Context, center domain.GeoPoint, k int) ([]domain.PortDistance, error) {
+	args := m.Called(ctx, center, k)
+	results, _ := args.Get(0).([]domain.PortDistance)
+	return results, args.Error(1)
+}
+
+// PortsWithinRadius mocks the PortsWithinRadius method.
+func (m *MockRepository) PortsWithinRadius(ctx context.Context, center domain.GeoPoint, radiusKm float64, limit int) ([]domain.PortDistance, error) {
+	args := m.Called(ctx, center, radiusKm, limit)
+	results, _ := args.Get(0).([]domain.PortDistance)
+	return results, args.Error(1)
+}
+
+// PortsInBoundingBox mocks the PortsInBoundingBox method, it calls fn for every port set as return value.
+func (m *MockRepository) PortsInBoundingBox(ctx context.Context, box domain.BoundingBox, filter domain.PortFilter, limit int, fn func(port domain.Port) error) error {
+	args := m.Called(ctx, box, filter, limit)
+	return callForEach(args, fn)
+}
+
+// PortsInPolygon mocks the PortsInPolygon method, it calls fn for every port set as return value.
+func (m *MockRepository) PortsInPolygon(ctx context.Context, polygon domain.Polygon, filter domain.PortFilter, limit int, fn func(port domain.Port) error) error {
+	args := m.Called(ctx, polygon, filter, limit)
+	return callForEach(args, fn)
+}
+
+func callForEach(args mock.Arguments, fn func(port domain.Port) error) error {
+	ports, _ := args.Get(0).([]domain.Port)
+	for _, port := range ports {
+		if err := fn(port); err != nil {
+			return err
+		}
+	}
+	return args.Error(1)
+}
+
+// WatchChanges mocks the WatchChanges method, it calls fn for every change set as return value.
+func (m *MockRepository) WatchChanges(ctx context.Context, afterSequence uint64, fn func(change domain.PortChange) error) error {
+	args := m.Called(ctx, afterSequence)
+	changes, _ := args.Get(0).([]domain.PortChange)
+	for _, change := range changes {
+		if err := fn(change); err != nil {
+			return err
+		}
+	}
+	return args.Error(1)
+}
+
+// LastChangeSequence mocks the LastChangeSequence method.
+func (m *MockRepository) LastChangeSequence() uint64 {
 	args := m.Called()
-	return args.Get(0).(bool)
+	return args.Get(0).(uint64)
+}
+
+// GetPortHistory mocks the GetPortHistory method.
+func (m *MockRepository) GetPortHistory(ctx context.Context, id string) ([]domain.PortRevision, error) {
+	args := m.Called(ctx, id)
+	revisions, _ := args.Get(0).([]domain.PortRevision)
+	return revisions, args.Error(1)
+}
+
+// GetByIdAsOf mocks the GetByIdAsOf method.
+func (m *MockRepository) GetByIdAsOf(ctx context.Context, id string, at time.Time) (*domain.Port, error) {
+	args := m.Called(ctx, id, at)
+	port, _ := args.Get(0).(*domain.Port)
+	return port, args.Error(1)
+}
+
+// CompactHistory mocks the CompactHistory method.
+func (m *MockRepository) CompactHistory(ctx context.Context, retention domain.HistoryRetention) (int, error) {
+	args := m.Called(ctx, retention)
+	return args.Int(0), args.Error(1)
 }
 
 // StartTransaction mocks the StartTransaction method.
-func (m *MockRepository) StartTransaction(ctx context.Context, readOnly bool) error {
-	args := m.Called(ctx, readOnly)
-	return args.Error(0)
+func (m *MockRepository) StartTransaction(ctx context.Context) (ports.Transaction, error) {
+	args := m.Called(ctx)
+	trn, _ := args.Get(0).(ports.Transaction)
+	return trn, args.Error(1)
 }
 
-// CommitTransaction mocks the CommitTransaction method.
-func (m *MockRepository) CommitTransaction(ctx context.Context) error {
+type MockTransaction struct {
+	mock.Mock
+}
+
+// AddOrUpdatePort mocks the AddOrUpdatePort method.
+func (m *MockTransaction) AddOrUpdatePort(ctx context.Context, item domain.Port) (*domain.Port, error) {
+	args := m.Called(ctx, item)
+	return &item, args.Error(1)
+}
+
+// AddOrUpdatePorts mocks the AddOrUpdatePorts method.
+func (m *MockTransaction) AddOrUpdatePorts(ctx context.Context, items []domain.Port) ([]*domain.Port, error) {
+	args := m.Called(ctx, items)
+	replaced, _ := args.Get(0).([]*domain.Port)
+	return replaced, args.Error(1)
+}
+
+// DeletePorts mocks the DeletePorts method.
+func (m *MockTransaction) DeletePorts(ctx context.Context, ids []string) (int, error) {
+	args := m.Called(ctx, ids)
+	return args.Int(0), args.Error(1)
+}
+
+// DeletePortsByFilter mocks the DeletePortsByFilter method.
+func (m *MockTransaction) DeletePortsByFilter(ctx context.Context, filter domain.PortFilter) (int, error) {
+	args := m.Called(ctx, filter)
+	return args.Int(0), args.Error(1)
+}
+
+// GetById mocks the GetById method.
+func (m *MockTransaction) GetById(ctx context.Context, id string) (*domain.Port, error) {
+	args := m.Called(ctx, id)
+	port, _ := args.Get(0).(*domain.Port)
+	return port, args.Error(1)
+}
+
+// GetByIds mocks the GetByIds method.
+func (m *MockTransaction) GetByIds(ctx context.Context, ids []string) ([]*domain.Port, error) {
+	args := m.Called(ctx, ids)
+	ports, _ := args.Get(0).([]*domain.Port)
+	return ports, args.Error(1)
+}
+
+// Commit mocks the Commit method.
+func (m *MockTransaction) Commit(ctx context.Context) error {
 	args := m.Called(ctx)
 	return args.Error(0)
 }
+
+func (m *MockTransaction) Id() string {
+	args := m.Called()
+	return args.String(0)
+}
+
+// Abort mocks the Abort method.
+func (m *MockTransaction) Abort() {
+	m.Called()
+}
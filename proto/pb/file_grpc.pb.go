@@ -20,6 +20,16 @@ const _ = grpc.SupportPackageIsVersion7
 
 const (
 	PortService_CreateOrUpdatePorts_FullMethodName = "/proto.PortService/CreateOrUpdatePorts"
+	PortService_UpsertPorts_FullMethodName         = "/proto.PortService/UpsertPorts"
+	PortService_GetPort_FullMethodName             = "/proto.PortService/GetPort"
+	PortService_GetPortHistory_FullMethodName      = "/proto.PortService/GetPortHistory"
+	PortService_DeletePorts_FullMethodName         = "/proto.PortService/DeletePorts"
+	PortService_ListPorts_FullMethodName           = "/proto.PortService/ListPorts"
+	PortService_SearchPorts_FullMethodName         = "/proto.PortService/SearchPorts"
+	PortService_NearestPorts_FullMethodName        = "/proto.PortService/NearestPorts"
+	PortService_PortsWithinRadius_FullMethodName   = "/proto.PortService/PortsWithinRadius"
+	PortService_PortsInArea_FullMethodName         = "/proto.PortService/PortsInArea"
+	PortService_WatchPorts_FullMethodName          = "/proto.PortService/WatchPorts"
 )
 
 // PortServiceClient is the client API for PortService service.
@@ -27,6 +37,23 @@ const (
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type PortServiceClient interface {
 	CreateOrUpdatePorts(ctx context.Context, opts ...grpc.CallOption) (PortService_CreateOrUpdatePortsClient, error)
+	// UpsertPorts acks every port as soon as it's processed and sends progress heartbeats. The ports are
+	// committed in batches, a progress marked committed follows every batch and the last one comes when the
+	// client closes its side of the stream. The ports acked before a committed progress are saved, on an error
+	// only the ports acked after the last one are lost and the client resumes from there
+	UpsertPorts(ctx context.Context, opts ...grpc.CallOption) (PortService_UpsertPortsClient, error)
+	GetPort(ctx context.Context, in *GetPortRequest, opts ...grpc.CallOption) (*GetPortResponse, error)
+	// GetPortHistory the versions of the port replaced or deleted by the imports, the oldest first
+	GetPortHistory(ctx context.Context, in *GetPortHistoryRequest, opts ...grpc.CallOption) (*GetPortHistoryResponse, error)
+	DeletePorts(ctx context.Context, in *DeletePortsRequest, opts ...grpc.CallOption) (*DeletePortsResponse, error)
+	ListPorts(ctx context.Context, in *ListPortsRequest, opts ...grpc.CallOption) (PortService_ListPortsClient, error)
+	SearchPorts(ctx context.Context, in *SearchPortsRequest, opts ...grpc.CallOption) (*SearchPortsResponse, error)
+	NearestPorts(ctx context.Context, in *NearestPortsRequest, opts ...grpc.CallOption) (*GeoPortsResponse, error)
+	PortsWithinRadius(ctx context.Context, in *PortsWithinRadiusRequest, opts ...grpc.CallOption) (*GeoPortsResponse, error)
+	PortsInArea(ctx context.Context, in *PortsInAreaRequest, opts ...grpc.CallOption) (PortService_PortsInAreaClient, error)
+	// WatchPorts streams the committed changes. With the postgres storage they are the changes committed by every
+	// instance sharing the database
+	WatchPorts(ctx context.Context, in *WatchPortsRequest, opts ...grpc.CallOption) (PortService_WatchPortsClient, error)
 }
 
 type portServiceClient struct {
@@ -71,11 +98,209 @@ func (x *portServiceCreateOrUpdatePortsClient) CloseAndRecv() (*PortResponse, er
 	return m, nil
 }
 
+func (c *portServiceClient) UpsertPorts(ctx context.Context, opts ...grpc.CallOption) (PortService_UpsertPortsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &PortService_ServiceDesc.Streams[1], PortService_UpsertPorts_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &portServiceUpsertPortsClient{stream}
+	return x, nil
+}
+
+type PortService_UpsertPortsClient interface {
+	Send(*PortRequest) error
+	Recv() (*UpsertPortsResponse, error)
+	grpc.ClientStream
+}
+
+type portServiceUpsertPortsClient struct {
+	grpc.ClientStream
+}
+
+func (x *portServiceUpsertPortsClient) Send(m *PortRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *portServiceUpsertPortsClient) Recv() (*UpsertPortsResponse, error) {
+	m := new(UpsertPortsResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *portServiceClient) GetPort(ctx context.Context, in *GetPortRequest, opts ...grpc.CallOption) (*GetPortResponse, error) {
+	out := new(GetPortResponse)
+	err := c.cc.Invoke(ctx, PortService_GetPort_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *portServiceClient) GetPortHistory(ctx context.Context, in *GetPortHistoryRequest, opts ...grpc.CallOption) (*GetPortHistoryResponse, error) {
+	out := new(GetPortHistoryResponse)
+	err := c.cc.Invoke(ctx, PortService_GetPortHistory_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *portServiceClient) DeletePorts(ctx context.Context, in *DeletePortsRequest, opts ...grpc.CallOption) (*DeletePortsResponse, error) {
+	out := new(DeletePortsResponse)
+	err := c.cc.Invoke(ctx, PortService_DeletePorts_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *portServiceClient) ListPorts(ctx context.Context, in *ListPortsRequest, opts ...grpc.CallOption) (PortService_ListPortsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &PortService_ServiceDesc.Streams[2], PortService_ListPorts_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &portServiceListPortsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type PortService_ListPortsClient interface {
+	Recv() (*ListPortsResponse, error)
+	grpc.ClientStream
+}
+
+type portServiceListPortsClient struct {
+	grpc.ClientStream
+}
+
+func (x *portServiceListPortsClient) Recv() (*ListPortsResponse, error) {
+	m := new(ListPortsResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *portServiceClient) SearchPorts(ctx context.Context, in *SearchPortsRequest, opts ...grpc.CallOption) (*SearchPortsResponse, error) {
+	out := new(SearchPortsResponse)
+	err := c.cc.Invoke(ctx, PortService_SearchPorts_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *portServiceClient) NearestPorts(ctx context.Context, in *NearestPortsRequest, opts ...grpc.CallOption) (*GeoPortsResponse, error) {
+	out := new(GeoPortsResponse)
+	err := c.cc.Invoke(ctx, PortService_NearestPorts_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *portServiceClient) PortsWithinRadius(ctx context.Context, in *PortsWithinRadiusRequest, opts ...grpc.CallOption) (*GeoPortsResponse, error) {
+	out := new(GeoPortsResponse)
+	err := c.cc.Invoke(ctx, PortService_PortsWithinRadius_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *portServiceClient) PortsInArea(ctx context.Context, in *PortsInAreaRequest, opts ...grpc.CallOption) (PortService_PortsInAreaClient, error) {
+	stream, err := c.cc.NewStream(ctx, &PortService_ServiceDesc.Streams[3], PortService_PortsInArea_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &portServicePortsInAreaClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type PortService_PortsInAreaClient interface {
+	Recv() (*PortsInAreaResponse, error)
+	grpc.ClientStream
+}
+
+type portServicePortsInAreaClient struct {
+	grpc.ClientStream
+}
+
+func (x *portServicePortsInAreaClient) Recv() (*PortsInAreaResponse, error) {
+	m := new(PortsInAreaResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *portServiceClient) WatchPorts(ctx context.Context, in *WatchPortsRequest, opts ...grpc.CallOption) (PortService_WatchPortsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &PortService_ServiceDesc.Streams[4], PortService_WatchPorts_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &portServiceWatchPortsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type PortService_WatchPortsClient interface {
+	Recv() (*PortChangeEvent, error)
+	grpc.ClientStream
+}
+
+type portServiceWatchPortsClient struct {
+	grpc.ClientStream
+}
+
+func (x *portServiceWatchPortsClient) Recv() (*PortChangeEvent, error) {
+	m := new(PortChangeEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // PortServiceServer is the server API for PortService service.
 // All implementations must embed UnimplementedPortServiceServer
 // for forward compatibility
 type PortServiceServer interface {
 	CreateOrUpdatePorts(PortService_CreateOrUpdatePortsServer) error
+	// UpsertPorts acks every port as soon as it's processed and sends progress heartbeats. The ports are
+	// committed in batches, a progress marked committed follows every batch and the last one comes when the
+	// client closes its side of the stream. The ports acked before a committed progress are saved, on an error
+	// only the ports acked after the last one are lost and the client resumes from there
+	UpsertPorts(PortService_UpsertPortsServer) error
+	GetPort(context.Context, *GetPortRequest) (*GetPortResponse, error)
+	// GetPortHistory the versions of the port replaced or deleted by the imports, the oldest first
+	GetPortHistory(context.Context, *GetPortHistoryRequest) (*GetPortHistoryResponse, error)
+	DeletePorts(context.Context, *DeletePortsRequest) (*DeletePortsResponse, error)
+	ListPorts(*ListPortsRequest, PortService_ListPortsServer) error
+	SearchPorts(context.Context, *SearchPortsRequest) (*SearchPortsResponse, error)
+	NearestPorts(context.Context, *NearestPortsRequest) (*GeoPortsResponse, error)
+	PortsWithinRadius(context.Context, *PortsWithinRadiusRequest) (*GeoPortsResponse, error)
+	PortsInArea(*PortsInAreaRequest, PortService_PortsInAreaServer) error
+	// WatchPorts streams the committed changes. With the postgres storage they are the changes committed by every
+	// instance sharing the database
+	WatchPorts(*WatchPortsRequest, PortService_WatchPortsServer) error
 	mustEmbedUnimplementedPortServiceServer()
 }
 
@@ -86,6 +311,36 @@ type UnimplementedPortServiceServer struct {
 func (UnimplementedPortServiceServer) CreateOrUpdatePorts(PortService_CreateOrUpdatePortsServer) error {
 	return status.Errorf(codes.Unimplemented, "method CreateOrUpdatePorts not implemented")
 }
+func (UnimplementedPortServiceServer) UpsertPorts(PortService_UpsertPortsServer) error {
+	return status.Errorf(codes.Unimplemented, "method UpsertPorts not implemented")
+}
+func (UnimplementedPortServiceServer) GetPort(context.Context, *GetPortRequest) (*GetPortResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPort not implemented")
+}
+func (UnimplementedPortServiceServer) GetPortHistory(context.Context, *GetPortHistoryRequest) (*GetPortHistoryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPortHistory not implemented")
+}
+func (UnimplementedPortServiceServer) DeletePorts(context.Context, *DeletePortsRequest) (*DeletePortsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeletePorts not implemented")
+}
+func (UnimplementedPortServiceServer) ListPorts(*ListPortsRequest, PortService_ListPortsServer) error {
+	return status.Errorf(codes.Unimplemented, "method ListPorts not implemented")
+}
+func (UnimplementedPortServiceServer) SearchPorts(context.Context, *SearchPortsRequest) (*SearchPortsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SearchPorts not implemented")
+}
+func (UnimplementedPortServiceServer) NearestPorts(context.Context, *NearestPortsRequest) (*GeoPortsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method NearestPorts not implemented")
+}
+func (UnimplementedPortServiceServer) PortsWithinRadius(context.Context, *PortsWithinRadiusRequest) (*GeoPortsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PortsWithinRadius not implemented")
+}
+func (UnimplementedPortServiceServer) PortsInArea(*PortsInAreaRequest, PortService_PortsInAreaServer) error {
+	return status.Errorf(codes.Unimplemented, "method PortsInArea not implemented")
+}
+func (UnimplementedPortServiceServer) WatchPorts(*WatchPortsRequest, PortService_WatchPortsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchPorts not implemented")
+}
 func (UnimplementedPortServiceServer) mustEmbedUnimplementedPortServiceServer() {}
 
 // UnsafePortServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -125,19 +380,262 @@ func (x *portServiceCreateOrUpdatePortsServer) Recv() (*PortRequest, error) {
 	return m, nil
 }
 
+func _PortService_UpsertPorts_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(PortServiceServer).UpsertPorts(&portServiceUpsertPortsServer{stream})
+}
+
+type PortService_UpsertPortsServer interface {
+	Send(*UpsertPortsResponse) error
+	Recv() (*PortRequest, error)
+	grpc.ServerStream
+}
+
+type portServiceUpsertPortsServer struct {
+	grpc.ServerStream
+}
+
+func (x *portServiceUpsertPortsServer) Send(m *UpsertPortsResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *portServiceUpsertPortsServer) Recv() (*PortRequest, error) {
+	m := new(PortRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _PortService_GetPort_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetPortRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PortServiceServer).GetPort(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PortService_GetPort_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PortServiceServer).GetPort(ctx, req.(*GetPortRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PortService_GetPortHistory_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetPortHistoryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PortServiceServer).GetPortHistory(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PortService_GetPortHistory_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PortServiceServer).GetPortHistory(ctx, req.(*GetPortHistoryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PortService_DeletePorts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeletePortsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PortServiceServer).DeletePorts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PortService_DeletePorts_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PortServiceServer).DeletePorts(ctx, req.(*DeletePortsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PortService_ListPorts_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListPortsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PortServiceServer).ListPorts(m, &portServiceListPortsServer{stream})
+}
+
+type PortService_ListPortsServer interface {
+	Send(*ListPortsResponse) error
+	grpc.ServerStream
+}
+
+type portServiceListPortsServer struct {
+	grpc.ServerStream
+}
+
+func (x *portServiceListPortsServer) Send(m *ListPortsResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _PortService_SearchPorts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SearchPortsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PortServiceServer).SearchPorts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PortService_SearchPorts_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PortServiceServer).SearchPorts(ctx, req.(*SearchPortsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PortService_NearestPorts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(NearestPortsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PortServiceServer).NearestPorts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PortService_NearestPorts_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PortServiceServer).NearestPorts(ctx, req.(*NearestPortsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PortService_PortsWithinRadius_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PortsWithinRadiusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PortServiceServer).PortsWithinRadius(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PortService_PortsWithinRadius_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PortServiceServer).PortsWithinRadius(ctx, req.(*PortsWithinRadiusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PortService_PortsInArea_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(PortsInAreaRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PortServiceServer).PortsInArea(m, &portServicePortsInAreaServer{stream})
+}
+
+type PortService_PortsInAreaServer interface {
+	Send(*PortsInAreaResponse) error
+	grpc.ServerStream
+}
+
+type portServicePortsInAreaServer struct {
+	grpc.ServerStream
+}
+
+func (x *portServicePortsInAreaServer) Send(m *PortsInAreaResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _PortService_WatchPorts_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchPortsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PortServiceServer).WatchPorts(m, &portServiceWatchPortsServer{stream})
+}
+
+type PortService_WatchPortsServer interface {
+	Send(*PortChangeEvent) error
+	grpc.ServerStream
+}
+
+type portServiceWatchPortsServer struct {
+	grpc.ServerStream
+}
+
+func (x *portServiceWatchPortsServer) Send(m *PortChangeEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 // PortService_ServiceDesc is the grpc.ServiceDesc for PortService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
 var PortService_ServiceDesc = grpc.ServiceDesc{
 	ServiceName: "proto.PortService",
 	HandlerType: (*PortServiceServer)(nil),
-	Methods:     []grpc.MethodDesc{},
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetPort",
+			Handler:    _PortService_GetPort_Handler,
+		},
+		{
+			MethodName: "GetPortHistory",
+			Handler:    _PortService_GetPortHistory_Handler,
+		},
+		{
+			MethodName: "DeletePorts",
+			Handler:    _PortService_DeletePorts_Handler,
+		},
+		{
+			MethodName: "SearchPorts",
+			Handler:    _PortService_SearchPorts_Handler,
+		},
+		{
+			MethodName: "NearestPorts",
+			Handler:    _PortService_NearestPorts_Handler,
+		},
+		{
+			MethodName: "PortsWithinRadius",
+			Handler:    _PortService_PortsWithinRadius_Handler,
+		},
+	},
 	Streams: []grpc.StreamDesc{
 		{
 			StreamName:    "CreateOrUpdatePorts",
 			Handler:       _PortService_CreateOrUpdatePorts_Handler,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "UpsertPorts",
+			Handler:       _PortService_UpsertPorts_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "ListPorts",
+			Handler:       _PortService_ListPorts_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "PortsInArea",
+			Handler:       _PortService_PortsInArea_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchPorts",
+			Handler:       _PortService_WatchPorts_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "proto/file.proto",
 }